@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package buildinfo describes the build of the plugin binaries, so that the build deployed on a node can be found
+// from the binary itself: "-v" prints it to stderr, after the version on stdout, and the CNI VERSION command adds it
+// to its JSON.
+package buildinfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// GitCommit is the commit that the binaries were built from. It's set at build time with
+// -ldflags "-X github.com/projectcalico/cni-plugin/internal/pkg/buildinfo.GitCommit=<commit>".
+var GitCommit string
+
+const (
+	unknown   = "unknown"
+	cniModule = "github.com/containernetworking/cni"
+)
+
+// Info describes a build of the plugin.
+type Info struct {
+	Version    string `json:"calicoVersion"`
+	GitCommit  string `json:"gitCommit"`
+	CNILibrary string `json:"cniLibraryVersion"`
+	GoVersion  string `json:"goVersion"`
+}
+
+// Get returns the build info for a binary of the given version.
+func Get(calicoVersion string) Info {
+	info := Info{
+		Version:    orUnknown(calicoVersion),
+		GitCommit:  orUnknown(GitCommit),
+		CNILibrary: unknown,
+		GoVersion:  runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if dep.Path != cniModule {
+				continue
+			}
+			info.CNILibrary = dep.Version
+			if dep.Replace != nil {
+				info.CNILibrary = dep.Replace.Version
+			}
+		}
+	}
+	return info
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("Version:     %s\nGit commit:  %s\nCNI library: %s\nGo version:  %s",
+		i.Version, i.GitCommit, i.CNILibrary, i.GoVersion)
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return unknown
+	}
+	return s
+}
+
+// PluginInfo returns the plugin's answer to the CNI VERSION command: the spec versions that it supports, as
+// reported by supported, with the build info added. Runtimes ignore the extra fields.
+func PluginInfo(supported version.PluginInfo, calicoVersion string) version.PluginInfo {
+	return &pluginInfo{PluginInfo: supported, info: Get(calicoVersion)}
+}
+
+type pluginInfo struct {
+	version.PluginInfo
+	info Info
+}
+
+func (p *pluginInfo) Encode(w io.Writer) error {
+	var buf bytes.Buffer
+	if err := p.PluginInfo.Encode(&buf); err != nil {
+		return err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		return err
+	}
+	// Unmarshalling the build info into the same map adds its fields alongside the spec versions.
+	extra, err := json.Marshal(p.info)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(extra, &fields); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(fields)
+}
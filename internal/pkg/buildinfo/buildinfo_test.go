@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buildinfo_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+
+	"github.com/containernetworking/cni/pkg/version"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/buildinfo"
+)
+
+var _ = Describe("Build info", func() {
+	var originalCommit string
+
+	BeforeEach(func() {
+		originalCommit = buildinfo.GitCommit
+		buildinfo.GitCommit = "0123456789ab"
+	})
+
+	AfterEach(func() {
+		buildinfo.GitCommit = originalCommit
+	})
+
+	It("describes the build", func() {
+		info := buildinfo.Get("v3.20.0")
+		Expect(info.Version).To(Equal("v3.20.0"))
+		Expect(info.GitCommit).To(Equal("0123456789ab"))
+		Expect(info.CNILibrary).NotTo(BeEmpty())
+		Expect(info.GoVersion).To(Equal(runtime.Version()))
+		Expect(info.String()).To(ContainSubstring("Git commit:  0123456789ab"))
+	})
+
+	It("says when the version and commit weren't set", func() {
+		buildinfo.GitCommit = ""
+		info := buildinfo.Get("")
+		Expect(info.Version).To(Equal("unknown"))
+		Expect(info.GitCommit).To(Equal("unknown"))
+	})
+
+	It("adds the build info to the VERSION output without upsetting the runtime", func() {
+		pi := buildinfo.PluginInfo(version.PluginSupports("0.3.1", "0.4.0"), "v3.20.0")
+		var out bytes.Buffer
+		Expect(pi.Encode(&out)).To(Succeed())
+
+		decoded, err := (&version.PluginDecoder{}).Decode(out.Bytes())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded.SupportedVersions()).To(Equal([]string{"0.3.1", "0.4.0"}))
+
+		var fields map[string]interface{}
+		Expect(json.Unmarshal(out.Bytes(), &fields)).To(Succeed())
+		Expect(fields).To(HaveKeyWithValue("calicoVersion", "v3.20.0"))
+		Expect(fields).To(HaveKeyWithValue("gitCommit", "0123456789ab"))
+		Expect(fields).To(HaveKey("cniLibraryVersion"))
+		Expect(fields).To(HaveKey("cniVersion"))
+	})
+})
@@ -0,0 +1,220 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics records the duration and outcome of a single CNI operation and pushes them to a Prometheus
+// Pushgateway when the operation completes. The plugin doesn't live long enough to be scraped, so the
+// metrics are pushed synchronously at the end instead, in the Prometheus text format.
+//
+// Each push replaces the metrics that the previous operation of the same kind on the node pushed, so the
+// Pushgateway always holds the most recent ADD and DEL for each node.
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The outcomes that an operation is labelled with.
+const (
+	OutcomeSuccess          = "success"
+	OutcomeIPAMFailure      = "ipam_fail"
+	OutcomeDatastoreFailure = "datastore_fail"
+	OutcomeFailure          = "fail"
+)
+
+const (
+	jobName = "calico-cni"
+
+	// pushTimeout bounds how long Finish waits for the Pushgateway.
+	pushTimeout = 2 * time.Second
+)
+
+// failure marks an error with the outcome that it should be reported as.
+type failure struct {
+	outcome string
+	err     error
+}
+
+func (f *failure) Error() string {
+	return f.err.Error()
+}
+
+func (f *failure) Unwrap() error {
+	return f.err
+}
+
+// IPAMFailure marks err, if it's non-nil, as a failure of the IPAM plugin.
+func IPAMFailure(err error) error {
+	return markFailure(err, OutcomeIPAMFailure)
+}
+
+// DatastoreFailure marks err, if it's non-nil, as a failure to reach or update the datastore.
+func DatastoreFailure(err error) error {
+	return markFailure(err, OutcomeDatastoreFailure)
+}
+
+// markFailure wraps err with the outcome, unless it's already been marked with one. The wrapped error's message
+// is unchanged.
+func markFailure(err error, outcome string) error {
+	if err == nil {
+		return nil
+	}
+	var f *failure
+	if errors.As(err, &f) {
+		return err
+	}
+	return &failure{outcome: outcome, err: err}
+}
+
+// Outcome returns the outcome to report for an operation that returned err.
+func Outcome(err error) string {
+	if err == nil {
+		return OutcomeSuccess
+	}
+	var f *failure
+	if errors.As(err, &f) {
+		return f.outcome
+	}
+	return OutcomeFailure
+}
+
+// Operation records the timing of one CNI operation. The labels may be filled in as they become known. A nil
+// Operation does nothing.
+type Operation struct {
+	// Gateway is the URL of the Pushgateway. If it's empty, nothing is pushed.
+	Gateway string
+
+	Command       string
+	Node          string
+	Orchestrator  string
+	DatastoreType string
+
+	start time.Time
+}
+
+// Start starts timing an operation, such as "add" or "del".
+func Start(command string) *Operation {
+	return &Operation{Command: command, start: time.Now()}
+}
+
+// Finish pushes the operation's duration and outcome, given the error that it returned, to the Pushgateway.
+// Failures are logged rather than returned, since they mustn't affect the outcome of the CNI operation.
+func (op *Operation) Finish(err error, logger *logrus.Entry) {
+	if op == nil || op.Gateway == "" {
+		return
+	}
+	end := time.Now()
+
+	u, perr := op.pushURL()
+	if perr != nil {
+		logger.WithError(perr).Warn("Failed to push metrics")
+		return
+	}
+	labels := map[string]string{
+		"orchestrator":   op.Orchestrator,
+		"datastore_type": op.DatastoreType,
+		"outcome":        Outcome(err),
+	}
+	var body bytes.Buffer
+	writeGauge(&body, "calico_cni_operation_duration_seconds",
+		"How long the most recent CNI operation took.", labels, end.Sub(op.start).Seconds())
+	writeGauge(&body, "calico_cni_operation_completed_timestamp_seconds",
+		"When the most recent CNI operation completed, in seconds since the epoch.", labels,
+		float64(end.UnixNano())/float64(time.Second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+	if perr = push(ctx, u, body.Bytes()); perr != nil {
+		logger.WithError(perr).Warn("Failed to push metrics")
+	}
+}
+
+// pushURL returns the URL of the operation's group on the Pushgateway, which is keyed by the node and the
+// command.
+func (op *Operation) pushURL() (string, error) {
+	u, err := url.Parse(op.Gateway)
+	if err != nil {
+		return "", fmt.Errorf("invalid metrics_push_gateway %q: %v", op.Gateway, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid metrics_push_gateway %q: must be an http or https URL", op.Gateway)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/metrics/job/" + jobName
+	for _, kv := range [][2]string{{"instance", op.Node}, {"command", op.Command}} {
+		u.Path += "/" + groupingLabel(kv[0], kv[1])
+	}
+	return u.String(), nil
+}
+
+// groupingLabel returns the path segments for a label in a group's URL. Values that can't go in the path as they
+// are, because they're empty or contain a slash, are base64 encoded as the Pushgateway allows.
+func groupingLabel(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		encoded := base64.URLEncoding.EncodeToString([]byte(value))
+		if encoded == "" {
+			encoded = "="
+		}
+		return name + "@base64/" + encoded
+	}
+	return name + "/" + value
+}
+
+// push replaces the metrics in a group on the Pushgateway with those in body.
+func push(ctx context.Context, u string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushgateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// writeGauge writes a single gauge sample in the Prometheus text format.
+func writeGauge(b *bytes.Buffer, name, help string, labels map[string]string, value float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s{", name, help, name, name)
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(b, "%s=\"%s\"", k, labelEscaper.Replace(labels[k]))
+	}
+	fmt.Fprintf(b, "} %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
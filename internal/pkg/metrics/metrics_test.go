@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/metrics"
+)
+
+var _ = Describe("Metrics", func() {
+	logger := logrus.WithField("test", "metrics")
+
+	table.DescribeTable("Outcome",
+		func(err error, expected string) {
+			Expect(metrics.Outcome(err)).To(Equal(expected))
+		},
+		table.Entry("no error", nil, metrics.OutcomeSuccess),
+		table.Entry("an unmarked error", errors.New("netlink failed"), metrics.OutcomeFailure),
+		table.Entry("an IPAM failure", metrics.IPAMFailure(errors.New("no addresses")), metrics.OutcomeIPAMFailure),
+		table.Entry("a datastore failure", metrics.DatastoreFailure(errors.New("timed out")), metrics.OutcomeDatastoreFailure),
+		table.Entry("a wrapped failure", fmt.Errorf("ADD failed: %w", metrics.IPAMFailure(errors.New("no addresses"))),
+			metrics.OutcomeIPAMFailure),
+		table.Entry("a failure marked twice", metrics.DatastoreFailure(metrics.IPAMFailure(errors.New("no addresses"))),
+			metrics.OutcomeIPAMFailure),
+	)
+
+	It("doesn't change the message or mark a nil error", func() {
+		Expect(metrics.IPAMFailure(errors.New("no addresses"))).To(MatchError("no addresses"))
+		Expect(metrics.DatastoreFailure(nil)).To(BeNil())
+	})
+
+	Context("with a Pushgateway", func() {
+		var server *httptest.Server
+		var method, path, body string
+		var status int
+
+		BeforeEach(func() {
+			method, path, body = "", "", ""
+			status = http.StatusOK
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				method = r.Method
+				path = r.URL.EscapedPath()
+				data, err := ioutil.ReadAll(r.Body)
+				Expect(err).NotTo(HaveOccurred())
+				body = string(data)
+				w.WriteHeader(status)
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("pushes the duration and outcome of an operation", func() {
+			op := metrics.Start("add")
+			op.Gateway = server.URL
+			op.Node = "node1"
+			op.Orchestrator = "k8s"
+			op.DatastoreType = "kubernetes"
+			op.Finish(metrics.IPAMFailure(errors.New("no addresses")), logger)
+
+			Expect(method).To(Equal(http.MethodPut))
+			Expect(path).To(Equal("/metrics/job/calico-cni/instance/node1/command/add"))
+			labels := `{datastore_type="kubernetes",orchestrator="k8s",outcome="ipam_fail"}`
+			Expect(body).To(ContainSubstring("# TYPE calico_cni_operation_duration_seconds gauge\n"))
+			Expect(body).To(MatchRegexp(`(?m)^calico_cni_operation_duration_seconds%s \S+$`, labels))
+			Expect(body).To(ContainSubstring("# TYPE calico_cni_operation_completed_timestamp_seconds gauge\n"))
+			Expect(body).To(MatchRegexp(`(?m)^calico_cni_operation_completed_timestamp_seconds%s \S+$`, labels))
+		})
+
+		It("keeps a path on the gateway URL and encodes awkward label values", func() {
+			op := metrics.Start("del")
+			op.Gateway = server.URL + "/pushgateway/"
+			op.Node = "rack/1"
+			op.Orchestrator = `odd"name`
+			op.Finish(nil, logger)
+
+			Expect(path).To(Equal("/pushgateway/metrics/job/calico-cni/instance@base64/cmFjay8x/command/del"))
+			Expect(body).To(ContainSubstring(`{datastore_type="",orchestrator="odd\"name",outcome="success"}`))
+		})
+
+		It("doesn't push without a gateway", func() {
+			metrics.Start("add").Finish(nil, logger)
+			var op *metrics.Operation
+			op.Finish(nil, logger)
+			Expect(method).To(BeEmpty())
+		})
+
+		It("carries on when the push fails", func() {
+			status = http.StatusInternalServerError
+			op := metrics.Start("add")
+			op.Gateway = server.URL
+			op.Node = "node1"
+			op.Finish(nil, logger)
+			Expect(method).To(Equal(http.MethodPut))
+
+			op.Gateway = "pushgateway:9091"
+			op.Finish(nil, logger)
+		})
+	})
+})
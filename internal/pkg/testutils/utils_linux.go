@@ -306,22 +306,9 @@ func RunCNIPluginWithId(
 
 // Create veth pair on host
 func CreateHostVeth(containerId, k8sName, k8sNamespace, nodename string) error {
-	hostVethName := "cali" + containerId[:min(11, len(containerId))]
-	if k8sName != "" {
-		ids := names.WorkloadEndpointIdentifiers{
-			Node:         nodename,
-			Orchestrator: "k8s",
-			Endpoint:     "eth0",
-			Pod:          k8sName,
-			ContainerID:  containerId,
-		}
-
-		workloadName, err := ids.CalculateWorkloadEndpointName(false)
-		if err != nil {
-			return err
-		}
-
-		hostVethName = k8sconversion.NewConverter().VethNameForWorkload(k8sNamespace, workloadName)
+	hostVethName, err := hostVethNameFor(containerId, k8sName, k8sNamespace, nodename)
+	if err != nil {
+		return err
 	}
 
 	peerVethName := "calipeer"
@@ -349,6 +336,40 @@ func CreateHostVeth(containerId, k8sName, k8sNamespace, nodename string) error {
 	return nil
 }
 
+// CreateOrphanedHostVeth leaves a link with the container's host veth name that has no peer, as if the
+// container's side had gone. The kernel deletes both ends of a veth together, so it's a dummy link.
+func CreateOrphanedHostVeth(containerId, k8sName, k8sNamespace, nodename string) error {
+	hostVethName, err := hostVethNameFor(containerId, k8sName, k8sNamespace, nodename)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkAdd(&netlink.Dummy{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:  hostVethName,
+			Flags: net.FlagUp,
+		},
+	})
+}
+
+// hostVethNameFor returns the name that the plugin gives the host side of the container's veth.
+func hostVethNameFor(containerId, k8sName, k8sNamespace, nodename string) (string, error) {
+	if k8sName == "" {
+		return "cali" + containerId[:min(11, len(containerId))], nil
+	}
+	ids := names.WorkloadEndpointIdentifiers{
+		Node:         nodename,
+		Orchestrator: "k8s",
+		Endpoint:     "eth0",
+		Pod:          k8sName,
+		ContainerID:  containerId,
+	}
+	workloadName, err := ids.CalculateWorkloadEndpointName(false)
+	if err != nil {
+		return "", err
+	}
+	return k8sconversion.NewConverter().VethNameForWorkload(k8sNamespace, workloadName), nil
+}
+
 // Executes the Calico CNI plugin and return the error code of the command.
 func DeleteContainer(netconf, netnspath, podName, podNamespace string) (exitCode int, err error) {
 	return DeleteContainerWithId(netconf, netnspath, podName, podNamespace, "")
@@ -359,19 +380,50 @@ func DeleteContainerWithId(netconf, netnspath, podName, podNamespace, containerI
 }
 
 func DeleteContainerWithIdAndIfaceName(netconf, netnspath, podName, podNamespace, containerId, ifaceName string) (exitCode int, err error) {
-	netnsname := path.Base(netnspath)
-	container_id := netnsname[:10]
-	if containerId != "" {
-		container_id = containerId
+	return runContainerCommand("DEL", netconf, netnspath, podName, podNamespace, containerId, ifaceName)
+}
+
+// CheckContainerWithId runs a CNI CHECK for the container and returns the plugin's exit code.
+func CheckContainerWithId(netconf, netnspath, podName, podNamespace, containerId string) (exitCode int, err error) {
+	return runContainerCommand("CHECK", netconf, netnspath, podName, podNamespace, containerId, "eth0")
+}
+
+// RunContainerCommand runs the given CNI command for the container and returns what the plugin printed to
+// stdout along with its exit code, for commands whose output isn't a CNI result.
+func RunContainerCommand(command, netconf, netnspath, podName, podNamespace, containerId string) (stdout []byte, exitCode int, err error) {
+	return runContainerCommandOutput(command, netconf, netnspath, podName, podNamespace, containerId, "eth0")
+}
+
+func runContainerCommand(command, netconf, netnspath, podName, podNamespace, containerId, ifaceName string) (exitCode int, err error) {
+	_, exitCode, err = runContainerCommandOutput(command, netconf, netnspath, podName, podNamespace, containerId, ifaceName)
+	return
+}
+
+// DeleteContainerKeepingIPs runs a CNI DEL for the container with CALICO_KEEP_IP=1 in CNI_ARGS, so that its IPs
+// are left reserved.
+func DeleteContainerKeepingIPs(netconf, netnspath, podName, podNamespace, containerId string) (exitCode int, err error) {
+	_, exitCode, err = runContainerCommandOutput("DEL", netconf, netnspath, podName, podNamespace, containerId, "eth0", "CALICO_KEEP_IP=1")
+	return
+}
+
+func runContainerCommandOutput(command, netconf, netnspath, podName, podNamespace, containerId, ifaceName string, extraArgs ...string) (stdout []byte, exitCode int, err error) {
+	container_id := containerId
+	if container_id == "" {
+		container_id = path.Base(netnspath)[:10]
 	}
-	k8sEnv := ""
+	var cniArgs []string
 	if podName != "" {
-		k8sEnv = fmt.Sprintf("CNI_ARGS=K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s;K8S_POD_INFRA_CONTAINER_ID=whatever", podName, podNamespace)
+		cniArgs = append(cniArgs, fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s;K8S_POD_INFRA_CONTAINER_ID=whatever", podName, podNamespace))
+	}
+	cniArgs = append(cniArgs, extraArgs...)
+	k8sEnv := ""
+	if len(cniArgs) > 0 {
+		k8sEnv = "CNI_ARGS=" + strings.Join(cniArgs, ";")
 	}
 
 	// Set up the env for running the CNI plugin
 	env := []string{
-		"CNI_COMMAND=DEL",
+		"CNI_COMMAND=" + command,
 		fmt.Sprintf("CNI_CONTAINERID=%s", container_id),
 		fmt.Sprintf("CNI_NETNS=%s", netnspath),
 		"CNI_IFNAME=" + ifaceName,
@@ -379,7 +431,7 @@ func DeleteContainerWithIdAndIfaceName(netconf, netnspath, podName, podNamespace
 		k8sEnv,
 	}
 
-	log.Debugf("Deleting container with ID %v CNI plugin with the following env vars: %v", containerId, env)
+	log.Debugf("Running %s for container with ID %v CNI plugin with the following env vars: %v", command, containerId, env)
 
 	// Run the CNI plugin passing in the supplied netconf
 	subProcess := exec.Command(fmt.Sprintf("%s/%s", os.Getenv("BIN"), os.Getenv("PLUGIN")), netconf)
@@ -391,16 +443,16 @@ func DeleteContainerWithIdAndIfaceName(netconf, netnspath, podName, podNamespace
 
 	_, err = io.WriteString(stdin, netconf)
 	if err != nil {
-		return 1, err
+		return nil, 1, err
 	}
 	_, err = io.WriteString(stdin, "\n")
 	if err != nil {
-		return 1, err
+		return nil, 1, err
 	}
 
 	err = stdin.Close()
 	if err != nil {
-		return 1, err
+		return nil, 1, err
 	}
 
 	session, err := gexec.Start(subProcess, ginkgo.GinkgoWriter, ginkgo.GinkgoWriter)
@@ -412,6 +464,7 @@ func DeleteContainerWithIdAndIfaceName(netconf, netnspath, podName, podNamespace
 	session.Wait(5)
 
 	exitCode = session.ExitCode()
+	stdout = session.Out.Contents()
 	return
 }
 
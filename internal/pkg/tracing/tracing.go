@@ -0,0 +1,173 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records trace spans for a single CNI operation and exports them, in OpenTelemetry's
+// OTLP format, when the operation completes. The plugin only lives for one operation, so rather than
+// batching in the background like a long-lived process would, spans are held in memory and flushed
+// synchronously at the end.
+//
+// Everything is nil-safe: with no Tracer in the context, Start returns a nil *Span whose methods do nothing,
+// so callers don't need to check whether tracing is enabled.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// exportTimeout bounds how long Flush waits for the exporter.
+const exportTimeout = 2 * time.Second
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+}
+
+// Span is a single timed operation within a trace.
+type Span struct {
+	Name       string
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+
+	tracer *Tracer
+	once   sync.Once
+}
+
+// Tracer collects the spans of one trace.
+type Tracer struct {
+	exporter Exporter
+	traceID  [16]byte
+
+	lock  sync.Mutex
+	spans []*Span
+}
+
+// NewTracer returns a Tracer that exports to the given exporter, or nil if exporter is nil.
+func NewTracer(exporter Exporter) *Tracer {
+	if exporter == nil {
+		return nil
+	}
+	t := &Tracer{exporter: exporter}
+	_, _ = rand.Read(t.traceID[:])
+	return t
+}
+
+type tracerKey struct{}
+type spanKey struct{}
+
+// WithTracer returns a context that carries t, so that Start records spans with it.
+func WithTracer(ctx context.Context, t *Tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// Start starts a span, as a child of the span in ctx, if there is one. It returns a context carrying the new
+// span for starting children of it. If there's no Tracer in ctx, it returns ctx and a nil Span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	t, _ := ctx.Value(tracerKey{}).(*Tracer)
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		Name:       name,
+		TraceID:    t.traceID,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+		tracer:     t,
+	}
+	_, _ = rand.Read(s.SpanID[:])
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		s.ParentID = parent.SpanID
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttribute records a key/value pair on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.Attributes[key] = value
+}
+
+// Finish ends the span, recording err if it's non-nil. Only the first call has any effect, so it's safe to
+// both defer it and call it once the operation is complete.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.tracer.lock.Lock()
+		defer s.tracer.lock.Unlock()
+		s.End = time.Now()
+		if err != nil {
+			s.Error = err.Error()
+		}
+		s.tracer.spans = append(s.tracer.spans, s)
+	})
+}
+
+// Flush exports the finished spans, waiting up to a few seconds. Failures are logged rather than returned,
+// since they mustn't affect the outcome of the CNI operation.
+func (t *Tracer) Flush(logger *logrus.Entry) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.lock.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	if err := t.exporter.Export(ctx, spans); err != nil {
+		logger.WithError(err).Warn("Failed to export trace spans")
+	}
+}
+
+// Recorder is an Exporter that keeps the spans in memory.
+type Recorder struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func (r *Recorder) Export(_ context.Context, spans []*Span) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+// Spans returns the spans exported so far.
+func (r *Recorder) Spans() []*Span {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*Span(nil), r.spans...)
+}
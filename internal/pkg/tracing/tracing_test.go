@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/tracing"
+)
+
+var _ = Describe("Tracing", func() {
+	logger := logrus.WithField("test", "tracing")
+
+	It("records the spans of an ADD", func() {
+		recorder := &tracing.Recorder{}
+		tracer := tracing.NewTracer(recorder)
+		ctx, root := tracing.Start(tracing.WithTracer(context.Background(), tracer), "cni-add")
+		root.SetAttribute("container_id", "abc123")
+
+		for _, name := range []string{"datastore-connect", "ipam-allocate", "veth-setup"} {
+			_, span := tracing.Start(ctx, name)
+			span.Finish(nil)
+		}
+		_, wep := tracing.Start(ctx, "wep-write")
+		wep.Finish(errors.New("datastore unavailable"))
+		root.Finish(nil)
+
+		// Nothing is exported until the flush.
+		Expect(recorder.Spans()).To(BeEmpty())
+		tracer.Flush(logger)
+
+		spans := recorder.Spans()
+		var names []string
+		for _, s := range spans {
+			names = append(names, s.Name)
+			Expect(s.TraceID).To(Equal(root.TraceID))
+			Expect(s.End).NotTo(BeTemporally("<", s.Start))
+			if s != root {
+				Expect(s.ParentID).To(Equal(root.SpanID))
+			}
+		}
+		Expect(names).To(Equal([]string{"datastore-connect", "ipam-allocate", "veth-setup", "wep-write", "cni-add"}))
+		Expect(root.Attributes).To(Equal(map[string]string{"container_id": "abc123"}))
+		Expect(spans[3].Error).To(Equal("datastore unavailable"))
+		Expect(root.Error).To(BeEmpty())
+	})
+
+	It("only records a span once", func() {
+		recorder := &tracing.Recorder{}
+		tracer := tracing.NewTracer(recorder)
+		_, span := tracing.Start(tracing.WithTracer(context.Background(), tracer), "ipam-allocate")
+		span.Finish(errors.New("first"))
+		span.Finish(nil)
+		tracer.Flush(logger)
+
+		Expect(recorder.Spans()).To(HaveLen(1))
+		Expect(recorder.Spans()[0].Error).To(Equal("first"))
+	})
+
+	It("does nothing when tracing isn't enabled", func() {
+		tracer := tracing.NewTracer(nil)
+		Expect(tracer).To(BeNil())
+		ctx, span := tracing.Start(tracing.WithTracer(context.Background(), tracer), "cni-add")
+		Expect(ctx).To(Equal(context.Background()))
+		Expect(span).To(BeNil())
+		span.SetAttribute("key", "value")
+		span.Finish(nil)
+		tracer.Flush(logger)
+	})
+
+	It("exports spans to an OTLP collector", func() {
+		var body map[string]interface{}
+		var path string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			path = r.URL.Path
+			data, err := ioutil.ReadAll(r.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(data, &body)).To(Succeed())
+		}))
+		defer server.Close()
+
+		exporter, err := tracing.NewOTLPExporter(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		tracer := tracing.NewTracer(exporter)
+		_, span := tracing.Start(tracing.WithTracer(context.Background(), tracer), "cni-del")
+		span.SetAttribute("pod", "pod1")
+		span.Finish(nil)
+		tracer.Flush(logger)
+
+		Expect(path).To(Equal("/v1/traces"))
+		rs := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+		spans := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+		Expect(spans).To(HaveLen(1))
+		s := spans[0].(map[string]interface{})
+		Expect(s["name"]).To(Equal("cni-del"))
+		Expect(s["traceId"]).To(HaveLen(32))
+		Expect(s["spanId"]).To(HaveLen(16))
+		Expect(s["attributes"]).To(ConsistOf(map[string]interface{}{
+			"key":   "pod",
+			"value": map[string]interface{}{"stringValue": "pod1"},
+		}))
+	})
+
+	It("rejects an endpoint that isn't an HTTP URL", func() {
+		_, err := tracing.NewOTLPExporter("collector:4318")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The standard Kubernetes annotations for limiting a pod's bandwidth. The values are quantities in bits per
+// second, such as "10M".
+const (
+	IngressBandwidthAnnotation = "kubernetes.io/ingress-bandwidth"
+	EgressBandwidthAnnotation  = "kubernetes.io/egress-bandwidth"
+)
+
+// The range of rates that the bandwidth annotations may ask for, as enforced by the kubelet.
+var (
+	minBandwidth = resource.MustParse("1k")
+	maxBandwidth = resource.MustParse("1P")
+)
+
+// Bandwidth holds the rate limits for a workload's traffic, in bits per second. Ingress is traffic to the
+// workload and egress is traffic from it. Zero means no limit.
+type Bandwidth struct {
+	IngressRate uint64
+	EgressRate  uint64
+}
+
+// ParseBandwidth returns the rate limits from a pod's bandwidth annotations.
+func ParseBandwidth(annotations map[string]string) (Bandwidth, error) {
+	var bw Bandwidth
+	var err error
+	if bw.IngressRate, err = parseBandwidthAnnotation(annotations, IngressBandwidthAnnotation); err != nil {
+		return Bandwidth{}, err
+	}
+	if bw.EgressRate, err = parseBandwidthAnnotation(annotations, EgressBandwidthAnnotation); err != nil {
+		return Bandwidth{}, err
+	}
+	return bw, nil
+}
+
+func parseBandwidthAnnotation(annotations map[string]string, annotation string) (uint64, error) {
+	value := annotations[annotation]
+	if value == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse annotation %q: %s", annotation, err)
+	}
+	if q.Cmp(minBandwidth) < 0 || q.Cmp(maxBandwidth) > 0 {
+		return 0, fmt.Errorf("invalid annotation %q: %s is outside the allowed range of %s to %s bits per second",
+			annotation, value, minBandwidth.String(), maxBandwidth.String())
+	}
+	return uint64(q.Value()), nil
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+)
+
+var _ = Describe("ParseBandwidth", func() {
+	table.DescribeTable("valid annotations",
+		func(annotations map[string]string, expected utils.Bandwidth) {
+			bw, err := utils.ParseBandwidth(annotations)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bw).To(Equal(expected))
+		},
+		table.Entry("none", map[string]string{}, utils.Bandwidth{}),
+		table.Entry("ingress only", map[string]string{utils.IngressBandwidthAnnotation: "10M"},
+			utils.Bandwidth{IngressRate: 10000000}),
+		table.Entry("egress only", map[string]string{utils.EgressBandwidthAnnotation: "1Gi"},
+			utils.Bandwidth{EgressRate: 1 << 30}),
+		table.Entry("both", map[string]string{utils.IngressBandwidthAnnotation: "1k", utils.EgressBandwidthAnnotation: "1P"},
+			utils.Bandwidth{IngressRate: 1000, EgressRate: 1000000000000000}),
+	)
+
+	table.DescribeTable("invalid annotations",
+		func(annotation, value string) {
+			_, err := utils.ParseBandwidth(map[string]string{annotation: value})
+			Expect(err).To(MatchError(ContainSubstring(annotation)))
+		},
+		table.Entry("not a quantity", utils.IngressBandwidthAnnotation, "fast"),
+		table.Entry("too small", utils.EgressBandwidthAnnotation, "999"),
+		table.Entry("too large", utils.IngressBandwidthAnnotation, "2P"),
+		table.Entry("negative", utils.EgressBandwidthAnnotation, "-10M"),
+	)
+})
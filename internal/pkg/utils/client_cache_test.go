@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils_test
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+// Nothing listens on these endpoints; the etcd client only connects when it's first used.
+var (
+	cacheConf1 = types.NetConf{Name: "net1", DatastoreType: "etcdv3", EtcdEndpoints: "http://127.0.0.1:23791"}
+	cacheConf2 = types.NetConf{Name: "net1", DatastoreType: "etcdv3", EtcdEndpoints: "http://127.0.0.1:23792"}
+)
+
+// restoreEnv returns a function that puts back the environment variables that CreateClient sets.
+func restoreEnv() func() {
+	saved := map[string]*string{}
+	for _, k := range []string{"DATASTORE_TYPE", "ETCD_ENDPOINTS"} {
+		if v, ok := os.LookupEnv(k); ok {
+			saved[k] = &v
+		} else {
+			saved[k] = nil
+		}
+	}
+	return func() {
+		for k, v := range saved {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+var _ = Describe("CreateClient caching", func() {
+	var restore func()
+
+	BeforeEach(func() {
+		restore = restoreEnv()
+	})
+
+	AfterEach(func() {
+		restore()
+	})
+
+	It("reuses the client while the config is the same", func() {
+		c1, err := utils.CreateClient(cacheConf1)
+		Expect(err).NotTo(HaveOccurred())
+		c2, err := utils.CreateClient(cacheConf1)
+		Expect(err).NotTo(HaveOccurred())
+		// The clients are struct values, so they can't be compared for identity, but a fresh client would have
+		// its own connection state.
+		Expect(c2).To(Equal(c1))
+	})
+
+	It("creates a new client when the config changes", func() {
+		c1, err := utils.CreateClient(cacheConf1)
+		Expect(err).NotTo(HaveOccurred())
+		c2, err := utils.CreateClient(cacheConf2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c2).NotTo(Equal(c1))
+
+		// Going back to the first config doesn't return the client for the second.
+		c3, err := utils.CreateClient(cacheConf1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c3).NotTo(Equal(c2))
+	})
+})
+
+// BenchmarkCreateClient compares repeated calls with the same config, which share a client, against calls that
+// alternate between two configs and so set up a new client each time.
+func BenchmarkCreateClient(b *testing.B) {
+	defer restoreEnv()()
+
+	b.Run("same config", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := utils.CreateClient(cacheConf1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("changing config", func(b *testing.B) {
+		confs := []types.NetConf{cacheConf1, cacheConf2}
+		for i := 0; i < b.N; i++ {
+			if _, err := utils.CreateClient(confs[i%2]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
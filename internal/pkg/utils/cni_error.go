@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"errors"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/metrics"
+)
+
+// The CNI error codes that the plugin reports for each category of failure, alongside ErrCodePoolExhausted. They're
+// part of the plugin's interface with runtimes, so they mustn't change. An invalid network config is reported with
+// the spec's own ErrInvalidNetworkConfig.
+const (
+	ErrCodeIPAMFailure      uint = 111
+	ErrCodeDatastoreFailure uint = 112
+	ErrCodeNamespaceFailure uint = 113
+)
+
+// codedError marks an error with the CNI error code that it should be reported with.
+type codedError struct {
+	code uint
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// InvalidConfig marks err, if it's non-nil, as caused by the network config.
+func InvalidConfig(err error) error {
+	return markCode(err, cnitypes.ErrInvalidNetworkConfig)
+}
+
+// NamespaceFailure marks err, if it's non-nil, as a failure to set up or clean up the container's interface.
+func NamespaceFailure(err error) error {
+	return markCode(err, ErrCodeNamespaceFailure)
+}
+
+func markCode(err error, code uint) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+// cniErrorMsgs are the messages for each category of failure. The error itself goes in the details.
+var cniErrorMsgs = map[uint]string{
+	cnitypes.ErrInvalidNetworkConfig: "invalid network config",
+	ErrCodeIPAMFailure:               "IPAM failure",
+	ErrCodeDatastoreFailure:          "datastore unreachable or update failed",
+	ErrCodeNamespaceFailure:          "failed to configure container namespace",
+}
+
+// ToCNIError returns err as the CNI error that the runtime is given, with a code for its category of failure so
+// that runtimes can tell failures apart. Errors that already carry a specific CNI code, such as an IPAM plugin's
+// or a request to try again later, keep it; uncategorised errors are ErrInternal, as skel would report them. It
+// returns nil for a nil err.
+func ToCNIError(err error) *cnitypes.Error {
+	if err == nil {
+		return nil
+	}
+	var exhausted *PoolExhaustedError
+	if errors.As(err, &exhausted) {
+		return exhausted.CNIError()
+	}
+	var cniErr *cnitypes.Error
+	if errors.As(err, &cniErr) && cniErr.Code != cnitypes.ErrInternal && cniErr.Code != cnitypes.ErrUnknown {
+		return cniErr
+	}
+
+	code := cnitypes.ErrInternal
+	var coded *codedError
+	if errors.As(err, &coded) {
+		code = coded.code
+	} else {
+		switch metrics.Outcome(err) {
+		case metrics.OutcomeIPAMFailure:
+			code = ErrCodeIPAMFailure
+		case metrics.OutcomeDatastoreFailure:
+			code = ErrCodeDatastoreFailure
+		}
+	}
+	if msg, ok := cniErrorMsgs[code]; ok {
+		return &cnitypes.Error{Code: code, Msg: msg, Details: err.Error()}
+	}
+	return &cnitypes.Error{Code: code, Msg: err.Error()}
+}
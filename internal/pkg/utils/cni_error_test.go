@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/metrics"
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+)
+
+var _ = Describe("ToCNIError", func() {
+	// printed is the JSON that the runtime reads from stdout for err.
+	printed := func(err error) map[string]interface{} {
+		b, jsonErr := json.Marshal(utils.ToCNIError(err))
+		Expect(jsonErr).NotTo(HaveOccurred())
+		var m map[string]interface{}
+		Expect(json.Unmarshal(b, &m)).To(Succeed())
+		return m
+	}
+
+	table.DescribeTable("reports each kind of failure with its code",
+		func(err error, expected map[string]interface{}) {
+			Expect(printed(err)).To(Equal(expected))
+		},
+		table.Entry("invalid config", utils.InvalidConfig(errors.New("failed to load netconf: bad")), map[string]interface{}{
+			"code": float64(cnitypes.ErrInvalidNetworkConfig), "msg": "invalid network config", "details": "failed to load netconf: bad",
+		}),
+		table.Entry("IPAM failure", metrics.IPAMFailure(errors.New("no IPAM")), map[string]interface{}{
+			"code": float64(utils.ErrCodeIPAMFailure), "msg": "IPAM failure", "details": "no IPAM",
+		}),
+		table.Entry("datastore failure", metrics.DatastoreFailure(errors.New("connection refused")), map[string]interface{}{
+			"code": float64(utils.ErrCodeDatastoreFailure), "msg": "datastore unreachable or update failed", "details": "connection refused",
+		}),
+		table.Entry("namespace failure", utils.NamespaceFailure(errors.New("failed to open netns")), map[string]interface{}{
+			"code": float64(utils.ErrCodeNamespaceFailure), "msg": "failed to configure container namespace", "details": "failed to open netns",
+		}),
+		table.Entry("anything else", errors.New("boom"), map[string]interface{}{
+			"code": float64(cnitypes.ErrInternal), "msg": "boom",
+		}),
+	)
+
+	It("should keep a specific CNI code that the error already carries", func() {
+		tryAgain := &cnitypes.Error{Code: cnitypes.ErrTryAgainLater, Msg: "busy"}
+		Expect(utils.ToCNIError(tryAgain)).To(Equal(tryAgain))
+		Expect(utils.ToCNIError(metrics.IPAMFailure(fmt.Errorf("delegate failed: %w", tryAgain)))).To(Equal(tryAgain))
+
+		exhausted := &utils.PoolExhaustedError{Family: 4, Pools: []string{"pool-a"}}
+		Expect(utils.ToCNIError(metrics.IPAMFailure(exhausted))).To(Equal(exhausted.CNIError()))
+	})
+
+	It("should categorise an IPAM plugin's internal error as an IPAM failure", func() {
+		err := metrics.IPAMFailure(&cnitypes.Error{Code: cnitypes.ErrInternal, Msg: "failed to request IP"})
+		Expect(utils.ToCNIError(err).Code).To(Equal(utils.ErrCodeIPAMFailure))
+	})
+
+	It("should return nil for no error", func() {
+		Expect(utils.ToCNIError(nil)).To(BeNil())
+	})
+})
@@ -0,0 +1,91 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/gofrs/flock"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+const (
+	defaultConcurrencyLockDir    = "/var/run/calico/cni"
+	defaultMaxConcurrentTimeout  = 30 * time.Second
+	concurrencySlotRetryInterval = 50 * time.Millisecond
+)
+
+// AcquireConcurrencySlot blocks until one of the node-wide concurrency slots configured by max_concurrent is
+// free, and returns a function that releases it. Each slot is a lock file, so the cap holds across the
+// separate plugin processes that the runtime spawns. If no slot becomes free before the timeout, a
+// "try again later" CNI error is returned so that the runtime retries the operation.
+func AcquireConcurrencySlot(conf types.NetConf, logger *logrus.Entry) (func(), error) {
+	if conf.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+
+	dir := conf.ConcurrencyLockDir
+	if dir == "" {
+		dir = defaultConcurrencyLockDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create concurrency lock directory: %v", err)
+	}
+
+	timeout := defaultMaxConcurrentTimeout
+	if conf.MaxConcurrentTimeout > 0 {
+		timeout = time.Duration(conf.MaxConcurrentTimeout) * time.Second
+	}
+
+	locks := make([]*flock.Flock, conf.MaxConcurrent)
+	for i := range locks {
+		locks[i] = flock.New(filepath.Join(dir, fmt.Sprintf("slot-%d.lock", i)))
+	}
+
+	logger.WithField("maxConcurrent", conf.MaxConcurrent).Debug("Waiting for a concurrency slot")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		for _, l := range locks {
+			locked, err := l.TryLock()
+			if err != nil {
+				return nil, fmt.Errorf("failed to lock %s: %v", l.Path(), err)
+			}
+			if locked {
+				logger.WithField("slot", l.Path()).Debug("Acquired concurrency slot")
+				return func() {
+					if err := l.Unlock(); err != nil {
+						logger.WithError(err).Warn("Failed to release concurrency slot; ignoring because process is about to exit.")
+					}
+				}, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, &cnitypes.Error{
+				Code: cnitypes.ErrTryAgainLater,
+				Msg:  fmt.Sprintf("timed out after %s waiting for one of %d concurrent CNI operation slots", timeout, conf.MaxConcurrent),
+			}
+		case <-time.After(concurrencySlotRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+var _ = Describe("AcquireConcurrencySlot", func() {
+	var dir string
+	logger := logrus.WithField("test", "concurrency")
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "calico-cni-concurrency-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("is a no-op when no cap is configured", func() {
+		release, err := utils.AcquireConcurrencySlot(types.NetConf{ConcurrencyLockDir: dir}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		release()
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+
+	It("never lets more than max_concurrent operations run at once", func() {
+		conf := types.NetConf{ConcurrencyLockDir: dir, MaxConcurrent: 3, MaxConcurrentTimeout: 10}
+
+		var inFlight, maxInFlight int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				release, err := utils.AcquireConcurrencySlot(conf, logger)
+				Expect(err).NotTo(HaveOccurred())
+				n := atomic.AddInt32(&inFlight, 1)
+				for {
+					m := atomic.LoadInt32(&maxInFlight)
+					if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&inFlight, -1)
+				release()
+			}()
+		}
+		wg.Wait()
+
+		Expect(maxInFlight).To(BeNumerically(">", 0))
+		Expect(maxInFlight).To(BeNumerically("<=", 3))
+	})
+
+	It("returns a retryable error when no slot frees up in time", func() {
+		conf := types.NetConf{ConcurrencyLockDir: dir, MaxConcurrent: 1, MaxConcurrentTimeout: 1}
+		release, err := utils.AcquireConcurrencySlot(conf, logger)
+		Expect(err).NotTo(HaveOccurred())
+		defer release()
+
+		_, err = utils.AcquireConcurrencySlot(conf, logger)
+		Expect(err).To(HaveOccurred())
+		cniErr, ok := err.(*cnitypes.Error)
+		Expect(ok).To(BeTrue())
+		Expect(cniErr.Code).To(Equal(cnitypes.ErrTryAgainLater))
+	})
+})
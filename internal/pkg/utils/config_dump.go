@@ -0,0 +1,121 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+const redacted = "<redacted>"
+
+// EffectiveConfig is the config that the plugin would run with, as reported by DumpConfig.
+type EffectiveConfig struct {
+	Nodename      string        `json:"nodename"`
+	DatastoreType string        `json:"datastore_type"`
+	IPAMType      string        `json:"ipam_type"`
+	MTU           int           `json:"mtu"`
+	NetConf       types.NetConf `json:"netconf"`
+}
+
+// DumpConfig loads the CNI config file at path, works out the settings that the plugin would resolve at run
+// time and writes the result to w as JSON, with any secrets redacted. The file may be a single network config
+// or a config list, in which case the calico entry is used. It doesn't touch the datastore.
+func DumpConfig(path string, w io.Writer) error {
+	conf, err := LoadNetConfFile(path)
+	if err != nil {
+		return err
+	}
+
+	eff := EffectiveConfig{
+		Nodename:      DetermineNodename(conf),
+		DatastoreType: conf.DatastoreType,
+		IPAMType:      conf.IPAM.Type,
+		MTU:           conf.MTU,
+	}
+	if eff.DatastoreType == "" {
+		eff.DatastoreType = os.Getenv("DATASTORE_TYPE")
+	}
+	if eff.DatastoreType == "" {
+		eff.DatastoreType = "etcdv3"
+	}
+	if eff.MTU, err = ResolveMTU(conf, ""); err != nil {
+		return err
+	}
+
+	eff.NetConf = redactNetConf(conf)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(eff)
+}
+
+// LoadNetConfFile loads the NetConf from the CNI config file at path, which may be a single network config or a
+// config list, in which case the calico entry is used.
+func LoadNetConfFile(path string) (types.NetConf, error) {
+	conf := types.NetConf{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return conf, err
+	}
+	data, err = calicoPluginConfig(data)
+	if err != nil {
+		return conf, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return conf, fmt.Errorf("failed to load netconf from %s: %v", path, err)
+	}
+	return conf, nil
+}
+
+// calicoPluginConfig returns the config for the calico plugin from data, which may hold a single network
+// config or a config list.
+func calicoPluginConfig(data []byte) ([]byte, error) {
+	var list struct {
+		Plugins []json.RawMessage `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if list.Plugins == nil {
+		return data, nil
+	}
+	for _, p := range list.Plugins {
+		var plugin struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(p, &plugin); err != nil {
+			return nil, err
+		}
+		if plugin.Type == "calico" {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("no calico plugin in config list")
+}
+
+// redactNetConf returns a copy of conf with the private keys and tokens it contains replaced.
+func redactNetConf(conf types.NetConf) types.NetConf {
+	for _, s := range []*string{&conf.EtcdKey, &conf.Policy.K8sAuthToken} {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	return conf
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+const defaultDatastoreTimeout = 30 * time.Second
+
+// DatastoreTimeout returns how long a single datastore operation may take, from datastore_timeout_seconds.
+func DatastoreTimeout(conf types.NetConf) time.Duration {
+	if conf.DatastoreTimeoutSeconds > 0 {
+		return time.Duration(conf.DatastoreTimeoutSeconds) * time.Second
+	}
+	return defaultDatastoreTimeout
+}
+
+// DatastoreProbeTimeout returns how long to wait for the read that checks the datastore can be reached. That's a
+// single small read, so unless datastore_timeout_seconds is set, it gets the same short timeout as the check of
+// the primary etcd endpoints, rather than the usual datastore timeout.
+func DatastoreProbeTimeout(conf types.NetConf) time.Duration {
+	if conf.DatastoreTimeoutSeconds > 0 {
+		return DatastoreTimeout(conf)
+	}
+	return etcdProbeTimeout
+}
+
+// WithDatastoreTimeout runs a datastore operation with a context that expires after the datastore timeout.
+// If the operation fails because that timeout expired, rather than the caller's context, the error says so.
+// Otherwise the operation's error is returned unchanged, so that callers can still check its type.
+func WithDatastoreTimeout(ctx context.Context, conf types.NetConf, op func(ctx context.Context) error) error {
+	timeout := DatastoreTimeout(conf)
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := op(opCtx)
+	if err != nil && opCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return fmt.Errorf("datastore timed out after %s: %v", timeout, err)
+	}
+	return err
+}
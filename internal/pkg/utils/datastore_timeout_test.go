@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// slowWEPs is a WorkloadEndpoint store that never answers, like a partitioned datastore.
+type slowWEPs struct {
+	clientv3.WorkloadEndpointInterface
+}
+
+func (f slowWEPs) Create(ctx context.Context, _ *api.WorkloadEndpoint, _ options.SetOptions) (*api.WorkloadEndpoint, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type slowWEPClient struct {
+	clientv3.Interface
+}
+
+func (c slowWEPClient) WorkloadEndpoints() clientv3.WorkloadEndpointInterface {
+	return slowWEPs{}
+}
+
+var _ = Describe("WithDatastoreTimeout", func() {
+	It("should default to 30 seconds", func() {
+		Expect(utils.DatastoreTimeout(types.NetConf{})).To(Equal(30 * time.Second))
+		Expect(utils.DatastoreTimeout(types.NetConf{DatastoreTimeoutSeconds: 5})).To(Equal(5 * time.Second))
+	})
+
+	It("should give the reachability check a shorter default", func() {
+		Expect(utils.DatastoreProbeTimeout(types.NetConf{})).To(Equal(5 * time.Second))
+		Expect(utils.DatastoreProbeTimeout(types.NetConf{DatastoreTimeoutSeconds: 20})).To(Equal(20 * time.Second))
+	})
+
+	It("should fail an operation on a slow datastore with a timeout error", func() {
+		conf := types.NetConf{DatastoreTimeoutSeconds: 1}
+		start := time.Now()
+		err := utils.WithDatastoreTimeout(context.Background(), conf, func(ctx context.Context) error {
+			_, err := utils.CreateOrUpdate(ctx, slowWEPClient{}, api.NewWorkloadEndpoint())
+			return err
+		})
+		Expect(err).To(MatchError(ContainSubstring("datastore timed out after 1s")))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("should not report a timeout if the caller's context ended first", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := utils.WithDatastoreTimeout(ctx, types.NetConf{}, func(ctx context.Context) error {
+			_, err := utils.CreateOrUpdate(ctx, slowWEPClient{}, api.NewWorkloadEndpoint())
+			return err
+		})
+		Expect(err).To(Equal(context.Canceled))
+	})
+
+	It("should return other errors unchanged", func() {
+		err := utils.WithDatastoreTimeout(context.Background(), types.NetConf{}, func(ctx context.Context) error {
+			return cerrors.ErrorResourceDoesNotExist{}
+		})
+		Expect(err).To(BeAssignableToTypeOf(cerrors.ErrorResourceDoesNotExist{}))
+	})
+})
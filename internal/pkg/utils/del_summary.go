@@ -0,0 +1,71 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+// DelSummary collects what a DEL did so that it can be reported in a single log line at the end.
+type DelSummary struct {
+	Pod         string
+	Namespace   string
+	Node        string
+	ContainerID string
+	HostVeth    string
+
+	// EndpointDeleted is set if the WorkloadEndpoint was found and deleted. ReleasedIPs holds the
+	// IPs it had at the time.
+	EndpointDeleted bool
+	ReleasedIPs     []string
+
+	// InterfaceFound is set if the container interface existed, InterfaceRemoved if we then removed it.
+	InterfaceFound   bool
+	InterfaceRemoved bool
+}
+
+// NewDelSummary returns a DelSummary for the workload identified by epIDs.
+func NewDelSummary(conf types.NetConf, epIDs *WEPIdentifiers) *DelSummary {
+	return &DelSummary{
+		Pod:         epIDs.Pod,
+		Namespace:   epIDs.Namespace,
+		Node:        epIDs.Node,
+		ContainerID: epIDs.ContainerID,
+		HostVeth:    HostVethName(conf, epIDs),
+	}
+}
+
+// Log writes the summary as one info level log line. err is the overall result of the DEL.
+func (s *DelSummary) Log(logger *logrus.Entry, err error) {
+	fields := logrus.Fields{
+		"pod":              s.Pod,
+		"namespace":        s.Namespace,
+		"node":             s.Node,
+		"containerID":      s.ContainerID,
+		"hostVeth":         s.HostVeth,
+		"endpointDeleted":  s.EndpointDeleted,
+		"releasedIPs":      s.ReleasedIPs,
+		"interfaceFound":   s.InterfaceFound,
+		"interfaceRemoved": s.InterfaceRemoved,
+		"nothingToCleanUp": !s.EndpointDeleted && !s.InterfaceFound,
+		"success":          err == nil,
+	}
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+	logger.WithFields(fields).Info("DEL summary")
+}
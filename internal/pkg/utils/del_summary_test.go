@@ -0,0 +1,89 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	"github.com/projectcalico/libcalico-go/lib/names"
+)
+
+var _ = Describe("DEL summary", func() {
+	var logger *logrus.Logger
+	var hook *test.Hook
+	var summary *utils.DelSummary
+
+	BeforeEach(func() {
+		logger, hook = test.NewNullLogger()
+		summary = utils.NewDelSummary(types.NetConf{}, &utils.WEPIdentifiers{
+			Namespace: "default",
+			WorkloadEndpointIdentifiers: names.WorkloadEndpointIdentifiers{
+				Node:        "node1",
+				Pod:         "pod1",
+				ContainerID: "abc123",
+			},
+		})
+	})
+
+	It("should report what was cleaned up", func() {
+		summary.EndpointDeleted = true
+		summary.ReleasedIPs = []string{"10.0.0.1/32"}
+		summary.InterfaceFound = true
+		summary.InterfaceRemoved = true
+		summary.Log(logrus.NewEntry(logger), nil)
+
+		Expect(hook.Entries).To(HaveLen(1))
+		entry := hook.LastEntry()
+		Expect(entry.Level).To(Equal(logrus.InfoLevel))
+		Expect(entry.Message).To(Equal("DEL summary"))
+		Expect(entry.Data).To(Equal(logrus.Fields{
+			"pod":              "pod1",
+			"namespace":        "default",
+			"node":             "node1",
+			"containerID":      "abc123",
+			"hostVeth":         "caliabc123",
+			"endpointDeleted":  true,
+			"releasedIPs":      []string{"10.0.0.1/32"},
+			"interfaceFound":   true,
+			"interfaceRemoved": true,
+			"nothingToCleanUp": false,
+			"success":          true,
+		}))
+	})
+
+	It("should report when there was nothing to clean up", func() {
+		summary.Log(logrus.NewEntry(logger), nil)
+
+		entry := hook.LastEntry()
+		Expect(entry.Data).To(HaveKeyWithValue("nothingToCleanUp", true))
+		Expect(entry.Data).To(HaveKeyWithValue("success", true))
+	})
+
+	It("should include the error on failure", func() {
+		summary.InterfaceFound = true
+		summary.Log(logrus.NewEntry(logger), errors.New("boom"))
+
+		entry := hook.LastEntry()
+		Expect(entry.Data).To(HaveKeyWithValue("success", false))
+		Expect(entry.Data).To(HaveKeyWithValue("interfaceRemoved", false))
+		Expect(entry.Data).To(HaveKey(logrus.ErrorKey))
+	})
+})
@@ -0,0 +1,53 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+// DNSAnnotation lets a pod set the DNS block of its CNI result, in place of the dns section of the NetConf. The
+// value is a JSON object in the same format as that section, for example
+// {"nameservers": ["10.96.0.10"], "search": ["svc.cluster.local"]}.
+const DNSAnnotation = "cni.projectcalico.org/dns"
+
+// ResultDNS returns the DNS settings to report in the CNI result: those in the pod's DNS annotation if it
+// has one, otherwise those in the NetConf. It returns nil if neither sets anything, in which case the result
+// should be left as the IPAM plugin returned it. Every nameserver must be an IP address.
+func ResultDNS(conf types.NetConf, annotations map[string]string) (*cnitypes.DNS, error) {
+	dns := conf.DNS
+	source := "dns config"
+	if value, ok := annotations[DNSAnnotation]; ok {
+		dns = cnitypes.DNS{}
+		source = fmt.Sprintf("annotation %q", DNSAnnotation)
+		if err := json.Unmarshal([]byte(value), &dns); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", source, err)
+		}
+	}
+	for _, ns := range dns.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return nil, fmt.Errorf("invalid nameserver %q in %s: not an IP address", ns, source)
+		}
+	}
+	if len(dns.Nameservers) == 0 && dns.Domain == "" && len(dns.Search) == 0 && len(dns.Options) == 0 {
+		return nil, nil
+	}
+	return &dns, nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+var _ = Describe("ResultDNS", func() {
+	confDNS := cnitypes.DNS{Nameservers: []string{"10.96.0.10"}, Search: []string{"svc.cluster.local"}}
+
+	It("should return nil if nothing is set", func() {
+		dns, err := utils.ResultDNS(types.NetConf{}, map[string]string{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dns).To(BeNil())
+	})
+
+	It("should use the NetConf without an annotation", func() {
+		dns, err := utils.ResultDNS(types.NetConf{DNS: confDNS}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dns).To(Equal(&confDNS))
+	})
+
+	It("should prefer the annotation to the NetConf", func() {
+		dns, err := utils.ResultDNS(types.NetConf{DNS: confDNS}, map[string]string{
+			utils.DNSAnnotation: `{"nameservers": ["fd00::53"], "domain": "example.com", "options": ["ndots:2"]}`,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dns).To(Equal(&cnitypes.DNS{
+			Nameservers: []string{"fd00::53"},
+			Domain:      "example.com",
+			Options:     []string{"ndots:2"},
+		}))
+	})
+
+	table.DescribeTable("invalid DNS settings",
+		func(conf types.NetConf, annotations map[string]string, expectedErr string) {
+			_, err := utils.ResultDNS(conf, annotations)
+			Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+		},
+		table.Entry("nameserver in the NetConf isn't an IP",
+			types.NetConf{DNS: cnitypes.DNS{Nameservers: []string{"dns.example.com"}}}, nil,
+			`invalid nameserver "dns.example.com" in dns config`),
+		table.Entry("nameserver in the annotation isn't an IP",
+			types.NetConf{}, map[string]string{utils.DNSAnnotation: `{"nameservers": ["10.0.0.300"]}`},
+			`invalid nameserver "10.0.0.300" in annotation`),
+		table.Entry("annotation isn't JSON",
+			types.NetConf{}, map[string]string{utils.DNSAnnotation: "10.96.0.10"},
+			"failed to parse annotation"),
+	)
+})
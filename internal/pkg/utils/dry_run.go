@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+// DryRunReport is what an ADD or DEL would have done, as printed in place of a result when dry_run is set.
+type DryRunReport struct {
+	Command          string `json:"command"`
+	Orchestrator     string `json:"orchestrator"`
+	Node             string `json:"node"`
+	Namespace        string `json:"namespace,omitempty"`
+	Pod              string `json:"pod,omitempty"`
+	ContainerID      string `json:"container_id"`
+	WorkloadEndpoint string `json:"workload_endpoint"`
+	EndpointExists   bool   `json:"endpoint_exists"`
+	IPAMType         string `json:"ipam_type"`
+
+	// The pools that IPAM would be asked to allocate from, and where that choice came from. Empty pools mean
+	// that the IPAM plugin would use its own defaults.
+	IPv4Pools      []string `json:"ipv4_pools,omitempty"`
+	IPv4PoolSource string   `json:"ipv4_pool_source,omitempty"`
+	IPv6Pools      []string `json:"ipv6_pools,omitempty"`
+	IPv6PoolSource string   `json:"ipv6_pool_source,omitempty"`
+
+	// For an ADD, the IPs of an existing endpoint that would be kept. For a DEL, the IPs that would be released,
+	// and the IPAM handle they'd be released under.
+	IPs      []string `json:"ips,omitempty"`
+	HandleID string   `json:"handle_id,omitempty"`
+}
+
+// NewDryRunReport returns a report of the given command for the workload.
+func NewDryRunReport(command string, conf types.NetConf, epIDs *WEPIdentifiers) *DryRunReport {
+	return &DryRunReport{
+		Command:          command,
+		Orchestrator:     epIDs.Orchestrator,
+		Node:             epIDs.Node,
+		Namespace:        epIDs.Namespace,
+		Pod:              epIDs.Pod,
+		ContainerID:      epIDs.ContainerID,
+		WorkloadEndpoint: epIDs.WEPName,
+		IPAMType:         conf.IPAM.Type,
+	}
+}
+
+// Write writes the report to w as indented JSON.
+func (r *DryRunReport) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
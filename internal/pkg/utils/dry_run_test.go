@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils_test
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	"github.com/projectcalico/libcalico-go/lib/names"
+)
+
+var _ = Describe("DryRunReport", func() {
+	It("reports the workload's identifiers as JSON", func() {
+		conf := types.NetConf{Name: "net1"}
+		conf.IPAM.Type = "calico-ipam"
+		epIDs := &utils.WEPIdentifiers{
+			WorkloadEndpointIdentifiers: names.WorkloadEndpointIdentifiers{
+				Node:         "node1",
+				Orchestrator: "k8s",
+				Endpoint:     "eth0",
+				Pod:          "pod1",
+				ContainerID:  "abc123",
+			},
+			Namespace: "default",
+			WEPName:   "node1-k8s-pod1-eth0",
+		}
+
+		report := utils.NewDryRunReport("ADD", conf, epIDs)
+		report.IPv4Pools, report.IPv4PoolSource = []string{"10.0.0.0/24"}, "pod annotation"
+		var out bytes.Buffer
+		Expect(report.Write(&out)).To(Succeed())
+		Expect(out.String()).To(MatchJSON(`{
+			"command": "ADD",
+			"orchestrator": "k8s",
+			"node": "node1",
+			"namespace": "default",
+			"pod": "pod1",
+			"container_id": "abc123",
+			"workload_endpoint": "node1-k8s-pod1-eth0",
+			"endpoint_exists": false,
+			"ipam_type": "calico-ipam",
+			"ipv4_pools": ["10.0.0.0/24"],
+			"ipv4_pool_source": "pod annotation"
+		}`))
+	})
+})
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// testCert is a certificate and key, PEM encoded, signed by the CA that's passed to newTestCert.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(cn string, ca *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+var _ = Describe("CreateClient with inline etcd TLS material", func() {
+	var tmpDir, oldTmpDir string
+	var listener net.Listener
+	var clientCNs chan string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "calico-cni-inline-tls-")
+		Expect(err).NotTo(HaveOccurred())
+		oldTmpDir = os.Getenv("TMPDIR")
+		Expect(os.Setenv("TMPDIR", tmpDir)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if listener != nil {
+			listener.Close()
+		}
+		utils.RemoveInlineEtcdTLSFiles()
+		Expect(os.Setenv("TMPDIR", oldTmpDir)).To(Succeed())
+		os.RemoveAll(tmpDir)
+		for _, env := range []string{"ETCD_ENDPOINTS", "ETCD_KEY_FILE", "ETCD_CERT_FILE", "ETCD_CA_CERT_FILE", "DATASTORE_TYPE"} {
+			os.Unsetenv(env)
+		}
+	})
+
+	It("keeps the material available for connections made after it returns", func() {
+		ca := newTestCert("test-ca", nil, true)
+		server := newTestCert("etcd", ca, false)
+		client := newTestCert("calico-cni", ca, false)
+
+		// An etcd stand-in that requires a client certificate and reports the client's name.
+		serverCert, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+		Expect(err).NotTo(HaveOccurred())
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(ca.cert)
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+			NextProtos:   []string{"h2"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		clientCNs = make(chan string, 10)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				tlsConn := conn.(*tls.Conn)
+				if tlsConn.Handshake() == nil {
+					clientCNs <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+				}
+				conn.Close()
+			}
+		}()
+
+		encode := func(b []byte) string {
+			return base64.StdEncoding.EncodeToString(b)
+		}
+		conf := types.NetConf{
+			Name:          "net1",
+			DatastoreType: "etcdv3",
+			EtcdEndpoints: "https://" + listener.Addr().String(),
+			EtcdKey:       encode(client.keyPEM),
+			EtcdCert:      encode(client.certPEM),
+			EtcdCaCert:    encode(ca.certPEM),
+		}
+		calicoClient, err := utils.CreateClient(conf)
+		Expect(err).NotTo(HaveOccurred())
+
+		// The files are kept, readable only by the owner.
+		files, err := filepath.Glob(filepath.Join(tmpDir, "calico-cni-etcd_*"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(3))
+		for _, f := range files {
+			info, err := os.Stat(f)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		}
+
+		// The first real request connects, presenting the inline client certificate. The stand-in isn't a
+		// real etcd so the request itself fails.
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, _ = calicoClient.Nodes().Get(ctx, "node1", options.GetOptions{})
+		Eventually(clientCNs, "2s").Should(Receive(Equal("calico-cni")))
+
+		utils.RemoveInlineEtcdTLSFiles()
+		files, err = filepath.Glob(filepath.Join(tmpDir, "calico-cni-etcd_*"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+})
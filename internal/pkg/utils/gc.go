@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/names"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// GCReport lists the WorkloadEndpoints on a node whose host interface has gone, and what was done about them.
+type GCReport struct {
+	Node      string       `json:"node"`
+	DryRun    bool         `json:"dry_run"`
+	Endpoints []GCEndpoint `json:"endpoints"`
+}
+
+// GCEndpoint is an orphaned WorkloadEndpoint. The IPs are released under the handle, if there is one; other
+// IPAM plugins keep track of their own allocations.
+type GCEndpoint struct {
+	Name          string   `json:"name"`
+	Namespace     string   `json:"namespace"`
+	InterfaceName string   `json:"interface_name"`
+	IPs           []string `json:"ips,omitempty"`
+	HandleID      string   `json:"handle_id,omitempty"`
+	Deleted       bool     `json:"deleted"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// Write writes the report to w as indented JSON.
+func (r *GCReport) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// CollectOrphanedEndpoints finds the node's WorkloadEndpoints whose host veth no longer exists, as left behind
+// by a DEL that never arrived, and unless dryRun is set, deletes them and releases their calico-ipam handles.
+// linkExists reports whether the host has an interface with the given name. Failing to clean up one endpoint
+// is recorded in the report rather than stopping the others.
+func CollectOrphanedEndpoints(
+	ctx context.Context,
+	calicoClient client.Interface,
+	conf types.NetConf,
+	nodename string,
+	dryRun bool,
+	linkExists func(name string) (bool, error),
+	logger *logrus.Entry,
+) (*GCReport, error) {
+	report := &GCReport{Node: nodename, DryRun: dryRun, Endpoints: []GCEndpoint{}}
+
+	var weps *api.WorkloadEndpointList
+	err := WithDatastoreTimeout(ctx, conf, func(ctx context.Context) (err error) {
+		weps, err = calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WorkloadEndpoints: %v", err)
+	}
+
+	for i := range weps.Items {
+		wep := &weps.Items[i]
+		if wep.Spec.Node != nodename || wep.Spec.ContainerID == "" {
+			continue
+		}
+		hostVeth := HostVethName(conf, &WEPIdentifiers{
+			Namespace: wep.Namespace,
+			WEPName:   wep.Name,
+			WorkloadEndpointIdentifiers: names.WorkloadEndpointIdentifiers{
+				Orchestrator: wep.Spec.Orchestrator,
+				Pod:          wep.Spec.Pod,
+				ContainerID:  wep.Spec.ContainerID,
+				Endpoint:     wep.Spec.Endpoint,
+			},
+		})
+		exists, err := linkExists(hostVeth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for interface %s: %v", hostVeth, err)
+		}
+		if exists {
+			continue
+		}
+
+		orphan := GCEndpoint{
+			Name:          wep.Name,
+			Namespace:     wep.Namespace,
+			InterfaceName: hostVeth,
+			IPs:           wep.Spec.IPNetworks,
+		}
+		if conf.IPAM.Type == "calico-ipam" {
+			network := wep.Annotations[NetworkAnnotation]
+			if network == "" {
+				network = conf.Name
+			}
+			orphan.HandleID = GetEndpointHandleID(conf, network, wep.Spec.ContainerID, wep.Spec.Endpoint, wep.Name)
+		}
+		epLogger := logger.WithFields(logrus.Fields{"WorkloadEndpoint": wep.Name, "Namespace": wep.Namespace})
+		if dryRun {
+			epLogger.Info("Dry run, not cleaning up orphaned endpoint")
+		} else if err := deleteOrphanedEndpoint(ctx, calicoClient, conf, wep, orphan.HandleID); err != nil {
+			epLogger.WithError(err).Warn("Failed to clean up orphaned endpoint")
+			orphan.Error = err.Error()
+		} else {
+			epLogger.Info("Cleaned up orphaned endpoint")
+			orphan.Deleted = true
+		}
+		report.Endpoints = append(report.Endpoints, orphan)
+	}
+	return report, nil
+}
+
+// deleteOrphanedEndpoint deletes the endpoint, provided it hasn't changed since it was listed, and then
+// releases the IPs under the handle.
+func deleteOrphanedEndpoint(ctx context.Context, calicoClient client.Interface, conf types.NetConf, wep *api.WorkloadEndpoint, handleID string) error {
+	err := WithDatastoreTimeout(ctx, conf, func(ctx context.Context) error {
+		_, err := calicoClient.WorkloadEndpoints().Delete(ctx, wep.Namespace, wep.Name, options.DeleteOptions{
+			ResourceVersion: wep.ResourceVersion,
+			UID:             &wep.UID,
+		})
+		return err
+	})
+	if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			return fmt.Errorf("failed to delete endpoint: %v", err)
+		}
+	}
+	if handleID == "" {
+		return nil
+	}
+	err = WithDatastoreTimeout(ctx, conf, func(ctx context.Context) error {
+		return calicoClient.IPAM().ReleaseByHandle(ctx, handleID)
+	})
+	if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			return fmt.Errorf("failed to release IPs: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// gcWEPs is a WorkloadEndpoint store that records deletions.
+type gcWEPs struct {
+	clientv3.WorkloadEndpointInterface
+
+	items   []api.WorkloadEndpoint
+	deleted []string
+}
+
+func (f *gcWEPs) List(_ context.Context, _ options.ListOptions) (*api.WorkloadEndpointList, error) {
+	return &api.WorkloadEndpointList{Items: f.items}, nil
+}
+
+func (f *gcWEPs) Delete(_ context.Context, _, name string, _ options.DeleteOptions) (*api.WorkloadEndpoint, error) {
+	f.deleted = append(f.deleted, name)
+	return nil, nil
+}
+
+// gcIPAM is an IPAM client that records released handles.
+type gcIPAM struct {
+	ipam.Interface
+
+	released []string
+}
+
+func (f *gcIPAM) ReleaseByHandle(_ context.Context, handleID string) error {
+	f.released = append(f.released, handleID)
+	return nil
+}
+
+type gcClient struct {
+	clientv3.Interface
+	weps *gcWEPs
+	ipam *gcIPAM
+}
+
+func (c gcClient) WorkloadEndpoints() clientv3.WorkloadEndpointInterface {
+	return c.weps
+}
+
+func (c gcClient) IPAM() ipam.Interface {
+	return c.ipam
+}
+
+var _ = Describe("CollectOrphanedEndpoints", func() {
+	var c gcClient
+	conf := types.NetConf{Name: "net1"}
+	conf.IPAM.Type = "calico-ipam"
+
+	newWEP := func(name, node, containerID string) api.WorkloadEndpoint {
+		wep := api.NewWorkloadEndpoint()
+		wep.Name = name
+		wep.Namespace = "default"
+		wep.Spec.Node = node
+		wep.Spec.Orchestrator = "cni"
+		wep.Spec.ContainerID = containerID
+		wep.Spec.IPNetworks = []string{"10.0.0.1/32"}
+		return *wep
+	}
+	// Only the first container's veth still exists.
+	linkExists := func(name string) (bool, error) {
+		return name == "caliaaaaaaaaaaa", nil
+	}
+
+	BeforeEach(func() {
+		renamed := newWEP("node1-cni-ccc-eth0", "node1", "ccccccccccccccc")
+		renamed.Annotations = map[string]string{utils.NetworkAnnotation: "net0"}
+		c = gcClient{
+			weps: &gcWEPs{items: []api.WorkloadEndpoint{
+				newWEP("node1-cni-aaa-eth0", "node1", "aaaaaaaaaaaaaaa"),
+				newWEP("node1-cni-bbb-eth0", "node1", "bbbbbbbbbbbbbbb"),
+				renamed,
+				newWEP("node2-cni-ddd-eth0", "node2", "ddddddddddddddd"),
+			}},
+			ipam: &gcIPAM{},
+		}
+	})
+
+	It("should delete the node's endpoints whose veth has gone and release their IPs", func() {
+		report, err := utils.CollectOrphanedEndpoints(context.Background(), c, conf, "node1", false, linkExists, logrus.WithField("test", true))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.weps.deleted).To(Equal([]string{"node1-cni-bbb-eth0", "node1-cni-ccc-eth0"}))
+		Expect(c.ipam.released).To(Equal([]string{"net1.bbbbbbbbbbbbbbb", "net0.ccccccccccccccc"}))
+
+		Expect(report.Endpoints).To(HaveLen(2))
+		Expect(report.Endpoints[0]).To(Equal(utils.GCEndpoint{
+			Name:          "node1-cni-bbb-eth0",
+			Namespace:     "default",
+			InterfaceName: "calibbbbbbbbbbb",
+			IPs:           []string{"10.0.0.1/32"},
+			HandleID:      "net1.bbbbbbbbbbbbbbb",
+			Deleted:       true,
+		}))
+	})
+
+	It("should only report with dry run", func() {
+		report, err := utils.CollectOrphanedEndpoints(context.Background(), c, conf, "node1", true, linkExists, logrus.WithField("test", true))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.weps.deleted).To(BeEmpty())
+		Expect(c.ipam.released).To(BeEmpty())
+		Expect(report.DryRun).To(BeTrue())
+		Expect(report.Endpoints).To(HaveLen(2))
+		Expect(report.Endpoints[0].Deleted).To(BeFalse())
+	})
+})
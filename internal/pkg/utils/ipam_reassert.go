@@ -0,0 +1,182 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// ReassertEndpointIPs makes sure that each of the IPs of an existing WorkloadEndpoint is still allocated in
+// Calico IPAM, reserving any that have been lost under the workload's handle. This keeps a workload's IPs
+// stable across a repeated ADD even if IPAM and the endpoint have got out of step. IPs that are allocated
+// are left alone, whichever handle holds them. It does nothing unless calico-ipam is in use.
+func ReassertEndpointIPs(
+	ctx context.Context,
+	calicoClient client.Interface,
+	conf types.NetConf,
+	args *skel.CmdArgs,
+	epIDs WEPIdentifiers,
+	wep *api.WorkloadEndpoint,
+	logger *logrus.Entry,
+) error {
+	if conf.IPAM.Type != "calico-ipam" {
+		return nil
+	}
+
+	handleID := GetEndpointHandleID(conf, conf.Name, args.ContainerID, args.IfName, epIDs.WEPName)
+	for _, ipNet := range wep.Spec.IPNetworks {
+		ip, _, err := cnet.ParseCIDROrIP(ipNet)
+		if err != nil {
+			return err
+		}
+		_, _, err = calicoClient.IPAM().GetAssignmentAttributes(ctx, *ip)
+		if err == nil {
+			continue
+		} else if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			return fmt.Errorf("failed to check IPAM allocation for %s: %v", ip, err)
+		}
+
+		logger.WithFields(logrus.Fields{"IP": ip, "HandleID": handleID}).Warn(
+			"Endpoint IP is missing from IPAM, reserving it again")
+		attrs := map[string]string{
+			ipam.AttributeNode:      epIDs.Node,
+			ipam.AttributeTimestamp: time.Now().UTC().String(),
+		}
+		if epIDs.Pod != "" {
+			attrs[ipam.AttributePod] = epIDs.Pod
+			attrs[ipam.AttributeNamespace] = epIDs.Namespace
+		}
+		err = calicoClient.IPAM().AssignIP(ctx, ipam.AssignIPArgs{
+			IP:       *ip,
+			HandleID: &handleID,
+			Hostname: epIDs.Node,
+			Attrs:    attrs,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to reserve endpoint IP %s: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+// InheritEndpointIPs moves the IPs of an existing WorkloadEndpoint that belongs to a different container onto
+// the IPAM handle of the container being added, so that a replacement sandbox for the same pod keeps the pod's
+// IPs. The IPs are released from the old container's handle and then assigned again under the new one; if any
+// of them can't be reassigned, the ones that were are released and an error is returned.
+func InheritEndpointIPs(
+	ctx context.Context,
+	calicoClient client.Interface,
+	conf types.NetConf,
+	args *skel.CmdArgs,
+	wep *api.WorkloadEndpoint,
+	logger *logrus.Entry,
+) error {
+	oldHandleID := GetEndpointHandleID(conf, conf.Name, wep.Spec.ContainerID, wep.Spec.Endpoint, wep.Name)
+	newHandleID := GetEndpointHandleID(conf, conf.Name, args.ContainerID, args.IfName, wep.Name)
+	logger = logger.WithFields(logrus.Fields{"oldHandleID": oldHandleID, "HandleID": newHandleID})
+
+	ips := make([]cnet.IP, 0, len(wep.Spec.IPNetworks))
+	for _, ipNet := range wep.Spec.IPNetworks {
+		ip, _, err := cnet.ParseCIDROrIP(ipNet)
+		if err != nil {
+			return err
+		}
+		ips = append(ips, *ip)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("endpoint %s has no IPs to inherit", wep.Name)
+	}
+
+	if err := calicoClient.IPAM().ReleaseByHandle(ctx, oldHandleID); err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			return fmt.Errorf("failed to release IPs from handle %s: %v", oldHandleID, err)
+		}
+	}
+
+	attrs := map[string]string{
+		ipam.AttributeNode:      wep.Spec.Node,
+		ipam.AttributeTimestamp: time.Now().UTC().String(),
+	}
+	if wep.Spec.Pod != "" {
+		attrs[ipam.AttributePod] = wep.Spec.Pod
+		attrs[ipam.AttributeNamespace] = wep.Namespace
+	}
+	for _, ip := range ips {
+		logger.WithField("IP", ip).Info("Reassigning endpoint IP to the new container")
+		err := calicoClient.IPAM().AssignIP(ctx, ipam.AssignIPArgs{
+			IP:       ip,
+			HandleID: &newHandleID,
+			Hostname: wep.Spec.Node,
+			Attrs:    attrs,
+		})
+		if err != nil {
+			if relErr := calicoClient.IPAM().ReleaseByHandle(ctx, newHandleID); relErr != nil {
+				logger.WithError(relErr).Warn("Failed to release partially inherited IPs")
+			}
+			return fmt.Errorf("failed to reassign endpoint IP %s: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+// ReleaseRecordedNetworkIPs releases IPs that the workload was given under the network recorded on its
+// WorkloadEndpoint, in case the CNI network has been renamed since the workload was added. The IPAM handle
+// includes the network name, so the handle that DEL works out from the config would no longer find those IPs.
+// The recorded network is only tried if nothing is held under the handle for the configured network. It does
+// nothing unless calico-ipam is in use.
+func ReleaseRecordedNetworkIPs(
+	ctx context.Context,
+	calicoClient client.Interface,
+	conf types.NetConf,
+	args *skel.CmdArgs,
+	wep *api.WorkloadEndpoint,
+	logger *logrus.Entry,
+) error {
+	if conf.IPAM.Type != "calico-ipam" || wep == nil {
+		return nil
+	}
+	network := wep.Annotations[NetworkAnnotation]
+	if network == "" || network == conf.Name {
+		return nil
+	}
+
+	handleID := GetEndpointHandleID(conf, conf.Name, args.ContainerID, args.IfName, wep.Name)
+	if ips, err := calicoClient.IPAM().IPsByHandle(ctx, handleID); err == nil && len(ips) > 0 {
+		return nil
+	}
+
+	recordedHandleID := GetEndpointHandleID(conf, network, args.ContainerID, args.IfName, wep.Name)
+	logger = logger.WithFields(logrus.Fields{"network": network, "HandleID": recordedHandleID})
+	if err := calicoClient.IPAM().ReleaseByHandle(ctx, recordedHandleID); err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to release IPs from handle %s: %v", recordedHandleID, err)
+	}
+	logger.Info("Released IPs allocated under the endpoint's recorded network")
+	return nil
+}
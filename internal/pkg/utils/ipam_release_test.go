@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+var _ = Describe("DeleteIPAM", func() {
+	var dir, origCNIPath string
+	logger := logrus.WithField("test", "ipam-release")
+
+	// writeStub writes a fake IPAM plugin that fails the first failures times it runs with the given CNI error code, then
+	// succeeds. It records each run in the calls file.
+	writeStub := func(failures int, code uint) {
+		script := fmt.Sprintf(`#!/bin/sh
+echo run >> %[1]s/calls
+if [ $(wc -l < %[1]s/calls) -le %[2]d ]; then
+  echo '{"cniVersion": "0.3.1", "code": %[3]d, "msg": "datastore unavailable"}'
+  exit 1
+fi
+exit 0
+`, dir, failures, code)
+		err := ioutil.WriteFile(filepath.Join(dir, "stub-ipam"), []byte(script), 0755)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	calls := func() int {
+		out, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+		Expect(err).NotTo(HaveOccurred())
+		return strings.Count(string(out), "\n")
+	}
+
+	release := func() error {
+		conf := types.NetConf{}
+		conf.IPAM.Type = "stub-ipam"
+		args := &skel.CmdArgs{
+			ContainerID: "abc123",
+			IfName:      "eth0",
+			StdinData:   []byte(`{"cniVersion": "0.3.1", "name": "net1", "type": "calico", "ipam": {"type": "stub-ipam"}}`),
+		}
+		return utils.DeleteIPAM(conf, args, logger)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "calico-cni-ipam-release-")
+		Expect(err).NotTo(HaveOccurred())
+		origCNIPath = os.Getenv("CNI_PATH")
+		Expect(os.Setenv("CNI_PATH", dir)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.Setenv("CNI_PATH", origCNIPath)).To(Succeed())
+		os.RemoveAll(dir)
+	})
+
+	It("retries a transient failure", func() {
+		writeStub(1, 11)
+		Expect(release()).To(Succeed())
+		Expect(calls()).To(Equal(2))
+	})
+
+	It("returns the error once the attempts are used up", func() {
+		writeStub(10, 11)
+		err := release()
+		Expect(err).To(MatchError(ContainSubstring("datastore unavailable")))
+		Expect(calls()).To(Equal(3))
+	})
+
+	It("treats an unknown container as already released", func() {
+		writeStub(10, 3)
+		Expect(release()).To(Succeed())
+		Expect(calls()).To(Equal(1))
+	})
+
+	It("leaves a failed ADD's allocation alone with debug_keep_failed_interface", func() {
+		writeStub(0, 0)
+		conf := types.NetConf{DebugKeepFailedInterface: true}
+		conf.IPAM.Type = "stub-ipam"
+		args := &skel.CmdArgs{
+			ContainerID: "abc123",
+			IfName:      "eth0",
+			StdinData:   []byte(`{"cniVersion": "0.3.1", "name": "net1", "type": "calico", "ipam": {"type": "stub-ipam"}}`),
+		}
+		utils.ReleaseIPAllocation(logger, conf, args)
+		_, err := os.Stat(filepath.Join(dir, "calls"))
+		Expect(os.IsNotExist(err)).To(BeTrue(), "the IPAM plugin shouldn't have run")
+
+		conf.DebugKeepFailedInterface = false
+		utils.ReleaseIPAllocation(logger, conf, args)
+		Expect(calls()).To(Equal(1))
+	})
+})
@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/mcuadros/go-version"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+const ipamVersionTimeout = 5 * time.Second
+
+// CheckIPAMPlugin logs the path of the IPAM plugin binary that will be invoked and, if ipam_min_version is set,
+// makes sure that the plugin reports at least that version. This catches a partially upgraded node, where the
+// IPAM binary lags the main plugin, before we rely on the IPAM plugin to allocate addresses.
+//
+// The version is read by running the plugin with "-v", which is supported by calico-ipam.
+func CheckIPAMPlugin(conf types.NetConf, logger *logrus.Entry) error {
+	path, err := invoke.FindInPath(conf.IPAM.Type, filepath.SplitList(os.Getenv("CNI_PATH")))
+	if err != nil {
+		if conf.IPAMMinVersion != "" {
+			return fmt.Errorf("failed to find IPAM plugin to check its version: %v", err)
+		}
+		// Leave it to the IPAM invocation to report the problem.
+		logger.WithError(err).Warn("Failed to find IPAM plugin")
+		return nil
+	}
+	logger.WithField("path", path).Info("Found IPAM plugin")
+
+	if conf.IPAMMinVersion == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ipamVersionTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, "-v")
+	// Don't pass on the CNI environment, so that a plugin that doesn't understand "-v" can't mistake
+	// this for a real CNI request.
+	cmd.Env = []string{}
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to get version of IPAM plugin %s: %v", path, err)
+	}
+	reported := strings.TrimSpace(string(out))
+	if reported == "" || strings.Contains(reported, "\n") {
+		return fmt.Errorf("IPAM plugin %s did not report a version", path)
+	}
+
+	logger.WithFields(logrus.Fields{"path": path, "version": reported}).Info("Checked IPAM plugin version")
+	if version.Compare(reported, conf.IPAMMinVersion, "<") {
+		return fmt.Errorf("IPAM plugin %s is version %s, but at least %s is required; the node may be partially upgraded",
+			path, reported, conf.IPAMMinVersion)
+	}
+	return nil
+}
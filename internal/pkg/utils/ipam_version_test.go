@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+var _ = Describe("CheckIPAMPlugin", func() {
+	var dir, origCNIPath string
+	logger := logrus.WithField("test", "ipam-version")
+
+	// writeStub writes a fake IPAM plugin that prints the given output when run with -v.
+	writeStub := func(output string) {
+		script := "#!/bin/sh\nif [ \"$1\" = \"-v\" ]; then echo '" + output + "'; exit 0; fi\nexit 1\n"
+		err := ioutil.WriteFile(filepath.Join(dir, "stub-ipam"), []byte(script), 0755)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	confWithMin := func(min string) types.NetConf {
+		conf := types.NetConf{IPAMMinVersion: min}
+		conf.IPAM.Type = "stub-ipam"
+		return conf
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "calico-cni-ipam-version-")
+		Expect(err).NotTo(HaveOccurred())
+		origCNIPath = os.Getenv("CNI_PATH")
+		Expect(os.Setenv("CNI_PATH", dir)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.Setenv("CNI_PATH", origCNIPath)).To(Succeed())
+		os.RemoveAll(dir)
+	})
+
+	It("accepts a plugin that meets the minimum version", func() {
+		writeStub("v3.16.1")
+		Expect(utils.CheckIPAMPlugin(confWithMin("v3.16.0"), logger)).To(Succeed())
+	})
+
+	It("rejects a plugin older than the minimum version", func() {
+		writeStub("v3.15.2")
+		err := utils.CheckIPAMPlugin(confWithMin("v3.16.0"), logger)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("v3.15.2"))
+	})
+
+	It("rejects a plugin that doesn't report a version", func() {
+		writeStub("")
+		Expect(utils.CheckIPAMPlugin(confWithMin("v3.16.0"), logger)).NotTo(Succeed())
+	})
+
+	It("doesn't run the plugin if no minimum version is configured", func() {
+		writeStub("v1.0.0")
+		Expect(utils.CheckIPAMPlugin(confWithMin(""), logger)).To(Succeed())
+	})
+
+	It("only fails on a missing plugin if a minimum version is configured", func() {
+		Expect(utils.CheckIPAMPlugin(confWithMin(""), logger)).To(Succeed())
+		Expect(utils.CheckIPAMPlugin(confWithMin("v3.16.0"), logger)).NotTo(Succeed())
+	})
+})
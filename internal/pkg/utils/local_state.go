@@ -0,0 +1,217 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/gofrs/flock"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	"github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+const defaultLocalStateDir = "/var/run/calico/cni"
+
+// The local state file caches, for each container on this node that the network has set up, the name of its
+// WorkloadEndpoint, its IPAM handle, its IPs and the name of its interface in the container. It lets node-local
+// tooling find a container's resources without going to the datastore. It's only maintained if local_state is
+// set, and it is never the source of truth: it can always be rebuilt from the datastore with
+// RebuildLocalState.
+
+// LocalStateEntry is the cached state of one container.
+type LocalStateEntry struct {
+	WEPName  string   `json:"wep_name"`
+	HandleID string   `json:"handle_id,omitempty"`
+	IPs      []string `json:"ips"`
+	IfName   string   `json:"if_name"`
+}
+
+// LocalStatePath returns the path of the local state file for the network.
+func LocalStatePath(conf types.NetConf) string {
+	dir := conf.LocalStateDir
+	if dir == "" {
+		dir = defaultLocalStateDir
+	}
+	return filepath.Join(dir, fmt.Sprintf("state-%s.json", conf.Name))
+}
+
+// ReadLocalState returns the local state of the network, keyed by container ID. If the file doesn't exist, the
+// error satisfies os.IsNotExist.
+func ReadLocalState(conf types.NetConf) (map[string]LocalStateEntry, error) {
+	path := LocalStatePath(conf)
+	lock := flock.New(path + ".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := lock.RLock(); err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %v", lock.Path(), err)
+	}
+	defer lock.Unlock()
+	return readLocalStateFile(path)
+}
+
+// WriteLocalState records the result of an ADD in the local state file. Failure to update the file is only
+// logged since the file is just a cache.
+func WriteLocalState(conf types.NetConf, args *skel.CmdArgs, wepName string, result *current.Result, logger *logrus.Entry) {
+	if !conf.LocalState {
+		return
+	}
+	entry := LocalStateEntry{WEPName: wepName, IfName: args.IfName}
+	if conf.IPAM.Type == "calico-ipam" {
+		entry.HandleID = GetEndpointHandleID(conf, conf.Name, args.ContainerID, args.IfName, wepName)
+	}
+	for _, ip := range result.IPs {
+		entry.IPs = append(entry.IPs, ip.Address.String())
+	}
+	err := updateLocalState(conf, func(state map[string]LocalStateEntry) {
+		state[args.ContainerID] = entry
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to write local state")
+	}
+}
+
+// RemoveLocalState removes the container from the local state file. As with WriteLocalState, failure is only
+// logged.
+func RemoveLocalState(conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) {
+	if !conf.LocalState {
+		return
+	}
+	err := updateLocalState(conf, func(state map[string]LocalStateEntry) {
+		delete(state, args.ContainerID)
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to remove container from local state")
+	}
+}
+
+// RebuildLocalState recreates the local state of the network from the WorkloadEndpoints on the node, and writes
+// it to the local state file.
+func RebuildLocalState(
+	ctx context.Context,
+	weps clientv3.WorkloadEndpointInterface,
+	conf types.NetConf,
+	nodename string,
+	logger *logrus.Entry,
+) (map[string]LocalStateEntry, error) {
+	list, err := weps.List(ctx, options.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workload endpoints: %v", err)
+	}
+
+	state := map[string]LocalStateEntry{}
+	for _, wep := range list.Items {
+		if wep.Spec.Node != nodename || wep.Spec.ContainerID == "" {
+			continue
+		}
+		// Endpoints that record a network belong to that network only.
+		if network, ok := wep.Annotations[NetworkAnnotation]; ok && network != conf.Name {
+			continue
+		}
+		entry := LocalStateEntry{
+			WEPName: wep.Name,
+			IPs:     append([]string(nil), wep.Spec.IPNetworks...),
+			IfName:  wep.Spec.Endpoint,
+		}
+		if conf.IPAM.Type == "calico-ipam" {
+			entry.HandleID = GetEndpointHandleID(conf, conf.Name, wep.Spec.ContainerID, wep.Spec.Endpoint, wep.Name)
+		}
+		state[wep.Spec.ContainerID] = entry
+	}
+	logger.WithField("containers", len(state)).Info("Rebuilt local state from the datastore")
+
+	err = updateLocalState(conf, func(s map[string]LocalStateEntry) {
+		for id := range s {
+			delete(s, id)
+		}
+		for id, entry := range state {
+			s[id] = entry
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// LoadLocalState returns the local state of the network, rebuilding it from the datastore if the file is missing
+// or can't be read.
+func LoadLocalState(
+	ctx context.Context,
+	weps clientv3.WorkloadEndpointInterface,
+	conf types.NetConf,
+	nodename string,
+	logger *logrus.Entry,
+) (map[string]LocalStateEntry, error) {
+	state, err := ReadLocalState(conf)
+	if err == nil {
+		return state, nil
+	}
+	if !os.IsNotExist(err) {
+		logger.WithError(err).Warn("Failed to read local state, rebuilding it")
+	}
+	return RebuildLocalState(ctx, weps, conf, nodename, logger)
+}
+
+// updateLocalState applies the update to the local state file under its lock. A corrupt file is replaced.
+func updateLocalState(conf types.NetConf, update func(map[string]LocalStateEntry)) error {
+	path := LocalStatePath(conf)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create local state directory: %v", err)
+	}
+	lock := flock.New(path + ".lock")
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("failed to lock %s: %v", lock.Path(), err)
+	}
+	defer lock.Unlock()
+
+	state, err := readLocalStateFile(path)
+	if err != nil {
+		state = map[string]LocalStateEntry{}
+	}
+	update(state)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it into place so that readers never see a partial file.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readLocalStateFile(path string) (map[string]LocalStateEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := map[string]LocalStateEntry{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return state, nil
+}
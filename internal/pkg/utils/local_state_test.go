@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/current"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// fakeWEPs is a minimal WorkloadEndpoint store that only supports List.
+type fakeWEPs struct {
+	clientv3.WorkloadEndpointInterface
+
+	weps  []api.WorkloadEndpoint
+	lists int
+}
+
+func (f *fakeWEPs) List(_ context.Context, _ options.ListOptions) (*api.WorkloadEndpointList, error) {
+	f.lists++
+	return &api.WorkloadEndpointList{Items: f.weps}, nil
+}
+
+func newStateWEP(name, node, containerID, network string, ips ...string) api.WorkloadEndpoint {
+	wep := api.NewWorkloadEndpoint()
+	wep.Name = name
+	wep.Namespace = "default"
+	wep.Spec.Node = node
+	wep.Spec.ContainerID = containerID
+	wep.Spec.Endpoint = "eth0"
+	wep.Spec.IPNetworks = ips
+	if network != "" {
+		utils.SetNetwork(wep, network)
+	}
+	return *wep
+}
+
+var _ = Describe("Local state", func() {
+	var dir string
+	var conf types.NetConf
+	args := &skel.CmdArgs{ContainerID: "abc123", IfName: "eth0"}
+	logger := logrus.WithField("test", "local-state")
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "calico-cni-state-")
+		Expect(err).NotTo(HaveOccurred())
+		conf = types.NetConf{Name: "net1", LocalState: true, LocalStateDir: dir}
+		conf.IPAM.Type = "calico-ipam"
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	result := &current.Result{IPs: []*current.IPConfig{{
+		Version: "4",
+		Address: net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: net.CIDRMask(32, 32)},
+	}}}
+
+	It("records an ADD and forgets it on DEL", func() {
+		utils.WriteLocalState(conf, args, "node1-k8s-pod1-eth0", result, logger)
+		state, err := utils.ReadLocalState(conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(Equal(map[string]utils.LocalStateEntry{
+			"abc123": {
+				WEPName:  "node1-k8s-pod1-eth0",
+				HandleID: utils.GetHandleID("net1", "abc123", "node1-k8s-pod1-eth0"),
+				IPs:      []string{"10.0.0.1/32"},
+				IfName:   "eth0",
+			},
+		}))
+
+		other := &skel.CmdArgs{ContainerID: "def456", IfName: "eth0"}
+		utils.WriteLocalState(conf, other, "node1-k8s-pod2-eth0", result, logger)
+		utils.RemoveLocalState(conf, args, logger)
+		state, err = utils.ReadLocalState(conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(HaveLen(1))
+		Expect(state).To(HaveKey("def456"))
+	})
+
+	It("does nothing unless local_state is set", func() {
+		conf.LocalState = false
+		utils.WriteLocalState(conf, args, "node1-k8s-pod1-eth0", result, logger)
+		_, err := utils.ReadLocalState(conf)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("rebuilds the state from the datastore if the file is missing", func() {
+		weps := &fakeWEPs{weps: []api.WorkloadEndpoint{
+			newStateWEP("node1-k8s-pod1-eth0", "node1", "abc123", "net1", "10.0.0.1/32"),
+			newStateWEP("node1-k8s-pod2-eth0", "node1", "def456", "", "10.0.0.2/32"),
+			newStateWEP("node1-k8s-pod3-eth0", "node1", "ghi789", "net2", "10.1.0.1/32"),
+			newStateWEP("node2-k8s-pod4-eth0", "node2", "jkl012", "net1", "10.0.0.3/32"),
+		}}
+		state, err := utils.LoadLocalState(context.Background(), weps, conf, "node1", logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(weps.lists).To(Equal(1))
+		Expect(state).To(HaveLen(2))
+		Expect(state).To(HaveKeyWithValue("def456", utils.LocalStateEntry{
+			WEPName:  "node1-k8s-pod2-eth0",
+			HandleID: utils.GetHandleID("net1", "def456", "node1-k8s-pod2-eth0"),
+			IPs:      []string{"10.0.0.2/32"},
+			IfName:   "eth0",
+		}))
+		Expect(state).To(HaveKey("abc123"))
+
+		// The rebuilt state is written out, so the next load doesn't go to the datastore.
+		reloaded, err := utils.LoadLocalState(context.Background(), weps, conf, "node1", logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(weps.lists).To(Equal(1))
+		Expect(reloaded).To(Equal(state))
+	})
+
+	It("rebuilds the state if the file is corrupt", func() {
+		Expect(ioutil.WriteFile(utils.LocalStatePath(conf), []byte("{"), 0600)).To(Succeed())
+		weps := &fakeWEPs{weps: []api.WorkloadEndpoint{
+			newStateWEP("node1-k8s-pod1-eth0", "node1", "abc123", "net1", "10.0.0.1/32"),
+		}}
+		state, err := utils.LoadLocalState(context.Background(), weps, conf, "node1", logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state).To(HaveKey("abc123"))
+	})
+})
@@ -14,7 +14,10 @@
 package utils
 
 import (
+	"fmt"
 	"net"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
 )
 
 var (
@@ -40,3 +43,38 @@ func init() {
 		IPv6AllNet, // Only used if we end up adding a v6 address.
 	}
 }
+
+// Route is a validated container_settings route. A nil GW means the container's usual gateway.
+type Route struct {
+	Dst *net.IPNet
+	GW  net.IP
+}
+
+// ParseContainerRoutes validates the container_settings routes. Each destination must be a CIDR that's listed
+// only once, and a gateway must be an address of the same family.
+func ParseContainerRoutes(routes []types.ContainerRoute) ([]Route, error) {
+	var parsed []Route
+	seen := map[string]bool{}
+	for _, r := range routes {
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid container_settings route destination %q: %v", r.Dst, err)
+		}
+		if seen[dst.String()] {
+			return nil, fmt.Errorf("container_settings route destination %s is listed more than once", dst)
+		}
+		seen[dst.String()] = true
+
+		route := Route{Dst: dst}
+		if r.GW != "" {
+			if route.GW = net.ParseIP(r.GW); route.GW == nil {
+				return nil, fmt.Errorf("invalid gateway %q for container_settings route %s", r.GW, dst)
+			}
+			if (route.GW.To4() == nil) != (dst.IP.To4() == nil) {
+				return nil, fmt.Errorf("gateway %s for container_settings route %s is of the wrong IP family", r.GW, dst)
+			}
+		}
+		parsed = append(parsed, route)
+	}
+	return parsed, nil
+}
@@ -19,6 +19,7 @@ import (
 
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/projectcalico/cni-plugin/pkg/types"
@@ -45,3 +46,14 @@ func CheckForSpuriousDockerAdd(args *skel.CmdArgs,
 	logger *logrus.Entry) (*current.Result, error) {
 	return nil, nil
 }
+
+// HostLinkExists reports whether the host has an interface with the given name.
+func HostLinkExists(name string) (bool, error) {
+	if _, err := netlink.LinkByName(name); err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -245,7 +245,7 @@ func CheckForSpuriousDockerAdd(args *skel.CmdArgs,
 	}
 
 	if lookupRequest {
-		result, err = CreateResultFromEndpoint(endpoint)
+		result, err = CreateResultFromEndpoint(endpoint, conf.IPFamilyOrder)
 		if err == nil {
 			logger.WithField("result", result).Info("Status lookup result")
 		} else {
@@ -273,3 +273,8 @@ func CheckForSpuriousDockerAdd(args *skel.CmdArgs,
 
 	return nil, nil
 }
+
+// HostLinkExists isn't supported on Windows, where workloads don't have a host veth.
+func HostLinkExists(name string) (bool, error) {
+	return false, fmt.Errorf("checking for host interface %s is not supported on Windows", name)
+}
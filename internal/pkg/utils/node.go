@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// EnsureNodeExists creates a minimal Node resource with the given name if there isn't one already. Another
+// CNI operation on the same node may be doing the same thing at the same time, so losing the race to create
+// the Node is not an error.
+func EnsureNodeExists(ctx context.Context, nodes client.NodeInterface, nodename string, logger *logrus.Entry) error {
+	_, err := nodes.Get(ctx, nodename, options.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+		return fmt.Errorf("failed to get node %s: %s", nodename, err)
+	}
+
+	node := api.NewNode()
+	node.Name = nodename
+	logger.WithField("node", nodename).Info("Node does not exist, creating it")
+	if _, err = nodes.Create(ctx, node, options.SetOptions{}); err != nil {
+		if _, ok := err.(cerrors.ErrorResourceAlreadyExists); ok {
+			logger.WithField("node", nodename).Debug("Node was created by another operation")
+			return nil
+		}
+		return fmt.Errorf("failed to create node %s: %s", nodename, err)
+	}
+	return nil
+}
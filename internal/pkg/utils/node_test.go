@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// fakeNodes is a minimal in-memory Node store. Gets are slowed down so that concurrent callers all see the
+// Node as missing before any of them creates it.
+type fakeNodes struct {
+	clientv3.NodeInterface
+
+	lock    sync.Mutex
+	nodes   map[string]*api.Node
+	creates int
+	getErr  error
+}
+
+func (f *fakeNodes) Get(_ context.Context, name string, _ options.GetOptions) (*api.Node, error) {
+	f.lock.Lock()
+	node, ok := f.nodes[name]
+	f.lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+	if !ok {
+		return nil, cerrors.ErrorResourceDoesNotExist{Identifier: name}
+	}
+	return node, nil
+}
+
+func (f *fakeNodes) Create(_ context.Context, node *api.Node, _ options.SetOptions) (*api.Node, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.nodes[node.Name]; ok {
+		return nil, cerrors.ErrorResourceAlreadyExists{Identifier: node.Name}
+	}
+	f.nodes[node.Name] = node
+	f.creates++
+	return node, nil
+}
+
+var _ = Describe("EnsureNodeExists", func() {
+	var nodes *fakeNodes
+	logger := logrus.WithField("test", "node")
+
+	BeforeEach(func() {
+		nodes = &fakeNodes{nodes: map[string]*api.Node{}}
+	})
+
+	It("leaves an existing node alone", func() {
+		nodes.nodes["node1"] = api.NewNode()
+		Expect(utils.EnsureNodeExists(context.Background(), nodes, "node1", logger)).To(Succeed())
+		Expect(nodes.creates).To(Equal(0))
+	})
+
+	It("creates a missing node exactly once under concurrent ADDs", func() {
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- utils.EnsureNodeExists(context.Background(), nodes, "node1", logger)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(nodes.creates).To(Equal(1))
+		Expect(nodes.nodes).To(HaveKey("node1"))
+	})
+
+	It("returns an error if the node can't be read", func() {
+		nodes.getErr = errors.New("connection refused")
+		Expect(utils.EnsureNodeExists(context.Background(), nodes, "node1", logger)).NotTo(Succeed())
+		Expect(nodes.creates).To(Equal(0))
+	})
+})
@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/gofrs/flock"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+const (
+	defaultDatastoreOpTimeout = 30 * time.Second
+	opTokensFile              = "op-tokens"
+)
+
+// opTokenBucket is the state of the node-wide token bucket, as stored on disk.
+type opTokenBucket struct {
+	Tokens  float64 `json:"tokens"`
+	Updated int64   `json:"updated"`
+}
+
+// WaitForDatastoreOpToken blocks until the node-wide token bucket configured by datastore_op_rate has a token,
+// and takes it. It's called once per ADD or DEL, so the limit is on operations rather than on the individual
+// datastore writes they make. The bucket refills at datastore_op_rate tokens per second up to a burst of one
+// second's worth (or one token, if that's more). Its state is kept in a file in the concurrency lock directory
+// so that the limit holds across the separate plugin processes that the runtime spawns. If no token becomes
+// available before the timeout, a "try again later" CNI error is returned so that the runtime retries the
+// operation.
+func WaitForDatastoreOpToken(conf types.NetConf, logger *logrus.Entry) error {
+	if conf.DatastoreOpRate <= 0 {
+		return nil
+	}
+
+	dir := conf.ConcurrencyLockDir
+	if dir == "" {
+		dir = defaultConcurrencyLockDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create concurrency lock directory: %v", err)
+	}
+
+	timeout := defaultDatastoreOpTimeout
+	if conf.DatastoreOpTimeout > 0 {
+		timeout = time.Duration(conf.DatastoreOpTimeout) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	path := filepath.Join(dir, opTokensFile)
+	lock := flock.New(path + ".lock")
+	for {
+		wait, err := takeOpToken(lock, path, conf.DatastoreOpRate)
+		if err != nil {
+			return err
+		}
+		if wait == 0 {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return &cnitypes.Error{
+				Code: cnitypes.ErrTryAgainLater,
+				Msg:  fmt.Sprintf("timed out after %s waiting for a datastore operation token", timeout),
+			}
+		}
+		if wait > remaining {
+			wait = remaining
+		}
+		logger.WithField("wait", wait).Debug("Datastore operation rate limit reached, waiting")
+		time.Sleep(wait)
+	}
+}
+
+// takeOpToken refills the bucket stored at path and takes a token from it if there is one. Otherwise, it
+// returns how long to wait until there will be.
+func takeOpToken(lock *flock.Flock, path string, rate float64) (time.Duration, error) {
+	if err := lock.Lock(); err != nil {
+		return 0, fmt.Errorf("failed to lock %s: %v", lock.Path(), err)
+	}
+	defer lock.Unlock()
+
+	now := time.Now()
+	burst := math.Max(rate, 1)
+	bucket := opTokenBucket{Tokens: burst, Updated: now.UnixNano()}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		// A corrupt file is treated as a full bucket.
+		if err := json.Unmarshal(data, &bucket); err != nil {
+			bucket = opTokenBucket{Tokens: burst, Updated: now.UnixNano()}
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	elapsed := now.Sub(time.Unix(0, bucket.Updated)).Seconds()
+	bucket.Tokens = math.Min(burst, bucket.Tokens+math.Max(elapsed, 0)*rate)
+	bucket.Updated = now.UnixNano()
+
+	var wait time.Duration
+	if bucket.Tokens >= 1 {
+		bucket.Tokens--
+	} else {
+		wait = time.Duration((1 - bucket.Tokens) / rate * float64(time.Second))
+	}
+
+	data, err := json.Marshal(bucket)
+	if err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return 0, err
+	}
+	return wait, nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+var _ = Describe("WaitForDatastoreOpToken", func() {
+	var dir string
+	logger := logrus.WithField("test", "op-rate")
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "calico-cni-op-rate-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("is a no-op when no rate is configured", func() {
+		Expect(utils.WaitForDatastoreOpToken(types.NetConf{ConcurrencyLockDir: dir}, logger)).To(Succeed())
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+
+	It("throttles a burst to the configured rate", func() {
+		conf := types.NetConf{ConcurrencyLockDir: dir, DatastoreOpRate: 20, DatastoreOpTimeout: 10}
+
+		// The first 20 are covered by the burst; the next 10 have to wait for the bucket to refill.
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(utils.WaitForDatastoreOpToken(conf, logger)).To(Succeed())
+			}()
+		}
+		wg.Wait()
+
+		Expect(time.Since(start)).To(BeNumerically(">=", 400*time.Millisecond))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("returns a retryable error when no token is available in time", func() {
+		conf := types.NetConf{ConcurrencyLockDir: dir, DatastoreOpRate: 0.1, DatastoreOpTimeout: 1}
+		Expect(utils.WaitForDatastoreOpToken(conf, logger)).To(Succeed())
+
+		err := utils.WaitForDatastoreOpToken(conf, logger)
+		Expect(err).To(HaveOccurred())
+		cniErr, ok := err.(*cnitypes.Error)
+		Expect(ok).To(BeTrue())
+		Expect(cniErr.Code).To(Equal(cnitypes.ErrTryAgainLater))
+	})
+})
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrCodePoolExhausted is the CNI error code that calico-ipam returns when its IP pools have no free addresses
+// left. Codes from 100 up are left to plugins to define.
+const ErrCodePoolExhausted uint = 110
+
+// ErrPoolExhausted is what a PoolExhaustedError matches with errors.Is, so that callers needn't know the pools.
+var ErrPoolExhausted = errors.New("IP pool exhausted")
+
+// PoolExhaustedError is returned when IPAM couldn't assign an address because the pools that it tried are full.
+type PoolExhaustedError struct {
+	// Family is 4 or 6.
+	Family int `json:"family"`
+	// Pools are the names of the IP pools that were tried.
+	Pools []string `json:"pools"`
+}
+
+func (e *PoolExhaustedError) Error() string {
+	pools := "any IP pool"
+	if len(e.Pools) > 0 {
+		pools = strings.Join(e.Pools, ", ")
+	}
+	return fmt.Sprintf("%v: no free IPv%d addresses in %s", ErrPoolExhausted, e.Family, pools)
+}
+
+func (e *PoolExhaustedError) Unwrap() error {
+	return ErrPoolExhausted
+}
+
+// CNIError returns the error as calico-ipam reports it to the plugin that called it, with the family and pools in
+// the details so that FromIPAMError can rebuild it.
+func (e *PoolExhaustedError) CNIError() *cnitypes.Error {
+	details, _ := json.Marshal(e)
+	return &cnitypes.Error{Code: ErrCodePoolExhausted, Msg: e.Error(), Details: string(details)}
+}
+
+// FromIPAMError turns an error from an IPAM plugin that reports pool exhaustion back into a PoolExhaustedError,
+// and logs it prominently, since it needs an operator to add or grow a pool. Other errors are returned as they are.
+func FromIPAMError(err error, logger *logrus.Entry) error {
+	var cniErr *cnitypes.Error
+	if !errors.As(err, &cniErr) || cniErr.Code != ErrCodePoolExhausted {
+		return err
+	}
+	exhausted := &PoolExhaustedError{}
+	err = exhausted
+	if jsonErr := json.Unmarshal([]byte(cniErr.Details), exhausted); jsonErr != nil || exhausted.Family == 0 {
+		err = fmt.Errorf("%w: %s", ErrPoolExhausted, cniErr.Msg)
+	}
+	logger.WithError(err).Error("IP pool exhausted, no address can be assigned until some are released or pools are added")
+	return err
+}
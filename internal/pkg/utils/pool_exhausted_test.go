@@ -0,0 +1,58 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"errors"
+	"fmt"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+)
+
+var _ = Describe("Pool exhaustion", func() {
+	logger := logrus.WithField("test", "pool exhaustion")
+
+	It("comes back from the IPAM plugin's CNI error with the family and pools", func() {
+		cniErr := (&utils.PoolExhaustedError{Family: 4, Pools: []string{"pool-a", "pool-b"}}).CNIError()
+		Expect(cniErr.Code).To(Equal(utils.ErrCodePoolExhausted))
+		Expect(cniErr.Msg).To(Equal("IP pool exhausted: no free IPv4 addresses in pool-a, pool-b"))
+
+		err := utils.FromIPAMError(fmt.Errorf("delegate failed: %w", cniErr), logger)
+		Expect(errors.Is(err, utils.ErrPoolExhausted)).To(BeTrue())
+		var exhausted *utils.PoolExhaustedError
+		Expect(errors.As(err, &exhausted)).To(BeTrue())
+		Expect(exhausted.Family).To(Equal(4))
+		Expect(exhausted.Pools).To(Equal([]string{"pool-a", "pool-b"}))
+	})
+
+	It("still flags exhaustion if the details can't be parsed", func() {
+		cniErr := &cnitypes.Error{Code: utils.ErrCodePoolExhausted, Msg: "out of addresses", Details: "not json"}
+		err := utils.FromIPAMError(cniErr, logger)
+		Expect(errors.Is(err, utils.ErrPoolExhausted)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("out of addresses")))
+	})
+
+	It("leaves other errors alone", func() {
+		otherErr := &cnitypes.Error{Code: cnitypes.ErrTryAgainLater, Msg: "busy"}
+		Expect(utils.FromIPAMError(otherErr, logger)).To(BeIdenticalTo(otherErr))
+		plainErr := errors.New("exec failed")
+		Expect(utils.FromIPAMError(plainErr, logger)).To(BeIdenticalTo(plainErr))
+		Expect((&utils.PoolExhaustedError{Family: 6}).Error()).To(ContainSubstring("IPv6 addresses in any IP pool"))
+	})
+})
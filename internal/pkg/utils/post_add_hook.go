@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+// PostAddHookInput is the JSON that the post_add_hook command is given on stdin.
+type PostAddHookInput struct {
+	Network      string   `json:"network"`
+	ContainerID  string   `json:"container_id"`
+	Orchestrator string   `json:"orchestrator"`
+	Namespace    string   `json:"namespace,omitempty"`
+	Pod          string   `json:"pod,omitempty"`
+	Interface    string   `json:"interface"`
+	IPs          []string `json:"ips"`
+}
+
+// RunPostAddHook runs the post_add_hook command, if there is one, once an ADD has succeeded, passing it a
+// PostAddHookInput for the workload on stdin. If the command fails, the error is only logged, unless
+// post_add_hook_fatal is set, in which case it's returned so that the ADD fails.
+func RunPostAddHook(ctx context.Context, conf types.NetConf, args *skel.CmdArgs, epIDs *WEPIdentifiers, result *current.Result, logger *logrus.Entry) error {
+	if conf.PostAddHook == "" {
+		return nil
+	}
+	input := PostAddHookInput{
+		Network:      conf.Name,
+		ContainerID:  args.ContainerID,
+		Orchestrator: epIDs.Orchestrator,
+		Namespace:    epIDs.Namespace,
+		Pod:          epIDs.Pod,
+		Interface:    args.IfName,
+		IPs:          []string{},
+	}
+	for _, ip := range result.IPs {
+		input.IPs = append(input.IPs, ip.Address.String())
+	}
+	stdin, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	logger = logger.WithField("hook", conf.PostAddHook)
+	cmd := exec.CommandContext(ctx, conf.PostAddHook)
+	cmd.Stdin = bytes.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("post_add_hook %s failed: %v: %s", conf.PostAddHook, err, strings.TrimSpace(string(out)))
+		if !conf.PostAddHookFatal {
+			logger.WithError(err).Warn("Post-ADD hook failed, ignoring")
+			return nil
+		}
+		return err
+	}
+	logger.WithField("output", string(out)).Debug("Ran post-ADD hook")
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+var _ = Describe("RunPostAddHook", func() {
+	var dir string
+	logger := logrus.WithField("test", "post-add-hook")
+
+	args := &skel.CmdArgs{ContainerID: "abc123", IfName: "eth0"}
+	epIDs := &utils.WEPIdentifiers{}
+	epIDs.Orchestrator = "k8s"
+	epIDs.Namespace = "default"
+	epIDs.Pod = "pod1"
+	result := &current.Result{IPs: []*current.IPConfig{
+		{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: net.CIDRMask(32, 32)}},
+		{Version: "6", Address: net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(128, 128)}},
+	}}
+
+	// writeHook writes a hook that records its stdin in the input file and exits with the given status.
+	writeHook := func(status string) string {
+		path := filepath.Join(dir, "hook")
+		script := "#!/bin/sh\ncat > " + filepath.Join(dir, "input") + "\necho 'hook output'\nexit " + status + "\n"
+		Expect(ioutil.WriteFile(path, []byte(script), 0755)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "calico-cni-post-add-hook-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("passes the workload's details to the hook", func() {
+		conf := types.NetConf{Name: "net1", PostAddHook: writeHook("0")}
+		Expect(utils.RunPostAddHook(context.Background(), conf, args, epIDs, result, logger)).To(Succeed())
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "input"))
+		Expect(err).NotTo(HaveOccurred())
+		var input utils.PostAddHookInput
+		Expect(json.Unmarshal(data, &input)).To(Succeed())
+		Expect(input).To(Equal(utils.PostAddHookInput{
+			Network:      "net1",
+			ContainerID:  "abc123",
+			Orchestrator: "k8s",
+			Namespace:    "default",
+			Pod:          "pod1",
+			Interface:    "eth0",
+			IPs:          []string{"10.0.0.1/32", "fd00::1/128"},
+		}))
+	})
+
+	It("ignores a failure by default", func() {
+		conf := types.NetConf{Name: "net1", PostAddHook: writeHook("1")}
+		Expect(utils.RunPostAddHook(context.Background(), conf, args, epIDs, result, logger)).To(Succeed())
+	})
+
+	It("returns a failure if it's configured to be fatal", func() {
+		conf := types.NetConf{Name: "net1", PostAddHook: writeHook("1"), PostAddHookFatal: true}
+		err := utils.RunPostAddHook(context.Background(), conf, args, epIDs, result, logger)
+		Expect(err).To(MatchError(ContainSubstring("hook output")))
+	})
+
+	It("does nothing if there's no hook", func() {
+		Expect(utils.RunPostAddHook(context.Background(), types.NetConf{}, args, epIDs, result, logger)).To(Succeed())
+	})
+})
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"fmt"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+// ParsePrevResult parses the result of the previous plugin in the chain, if there was one, into
+// conf.PrevResult. The result is in the NetConf's cniVersion, and is converted to the current version.
+func ParsePrevResult(conf *types.NetConf) error {
+	if conf.RawPrevResult == nil {
+		return nil
+	}
+	cniConf := cnitypes.NetConf{CNIVersion: conf.CNIVersion, RawPrevResult: conf.RawPrevResult}
+	if err := version.ParsePrevResult(&cniConf); err != nil {
+		return err
+	}
+	prevResult, err := current.NewResultFromResult(cniConf.PrevResult)
+	if err != nil {
+		return fmt.Errorf("could not convert prevResult: %v", err)
+	}
+	conf.PrevResult = prevResult
+	return nil
+}
+
+// MergePrevResult adds what the previous plugin in the chain reported to Calico's result, so that the result
+// passed down the chain describes everything set up so far. The previous plugin's interfaces come first, so
+// the interface indexes of Calico's IPs are moved along by the number of them. IPs and routes that Calico's
+// result already has aren't repeated. Calico's DNS settings are kept if it has any.
+func MergePrevResult(result, prevResult *current.Result) {
+	if prevResult == nil {
+		return
+	}
+	offset := len(prevResult.Interfaces)
+	for _, ipConf := range result.IPs {
+		if ipConf.Interface != nil {
+			ipConf.Interface = current.Int(*ipConf.Interface + offset)
+		}
+	}
+	result.Interfaces = append(append([]*current.Interface{}, prevResult.Interfaces...), result.Interfaces...)
+
+	var ips []*current.IPConfig
+	for _, prevIP := range prevResult.IPs {
+		if !resultHasIP(result, prevIP) {
+			ips = append(ips, prevIP)
+		}
+	}
+	result.IPs = append(ips, result.IPs...)
+
+	var routes []*cnitypes.Route
+	for _, prevRoute := range prevResult.Routes {
+		if !resultHasRoute(result, prevRoute) {
+			routes = append(routes, prevRoute)
+		}
+	}
+	result.Routes = append(routes, result.Routes...)
+
+	if len(result.DNS.Nameservers) == 0 && result.DNS.Domain == "" && len(result.DNS.Search) == 0 &&
+		len(result.DNS.Options) == 0 {
+		result.DNS = prevResult.DNS
+	}
+}
+
+func resultHasIP(result *current.Result, ipConf *current.IPConfig) bool {
+	for _, existing := range result.IPs {
+		if existing.Address.IP.Equal(ipConf.Address.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func resultHasRoute(result *current.Result, route *cnitypes.Route) bool {
+	for _, existing := range result.Routes {
+		if existing.Dst.String() == route.Dst.String() && existing.GW.Equal(route.GW) {
+			return true
+		}
+	}
+	return false
+}
+
+// NoIPAM returns true if the network config doesn't name an IPAM plugin, in which case the addresses have to be
+// supplied by the ipAddrsNoIpam annotation or by the previous plugin in the chain.
+func NoIPAM(conf types.NetConf) bool {
+	return conf.IPAM.Type == ""
+}
+
+// ResultFromPrevResult returns a result holding the IPs that the previous plugin in the chain reported, for use
+// when there's no IPAM plugin to allocate them. The IPs aren't tied to any of the previous plugin's interfaces,
+// since Calico sets up its own.
+func ResultFromPrevResult(conf types.NetConf) (*current.Result, error) {
+	if conf.PrevResult == nil || len(conf.PrevResult.IPs) == 0 {
+		return nil, fmt.Errorf("no IPAM plugin is configured and there's no prevResult with IPs to use instead")
+	}
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	for _, prevIP := range conf.PrevResult.IPs {
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Version: prevIP.Version,
+			Address: prevIP.Address,
+			Gateway: prevIP.Gateway,
+		})
+	}
+	return result, nil
+}
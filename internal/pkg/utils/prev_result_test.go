@@ -0,0 +1,161 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"net"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+var _ = Describe("prevResult", func() {
+	mustParseCIDR := func(s string) net.IPNet {
+		ip, ipNet, err := net.ParseCIDR(s)
+		Expect(err).NotTo(HaveOccurred())
+		ipNet.IP = ip
+		return *ipNet
+	}
+
+	Describe("ParsePrevResult", func() {
+		It("does nothing without a prevResult", func() {
+			conf := types.NetConf{CNIVersion: "0.3.1"}
+			Expect(utils.ParsePrevResult(&conf)).To(Succeed())
+			Expect(conf.PrevResult).To(BeNil())
+		})
+
+		It("parses a prevResult in the current format", func() {
+			conf := types.NetConf{
+				CNIVersion: "0.3.1",
+				RawPrevResult: map[string]interface{}{
+					"cniVersion": "0.3.1",
+					"interfaces": []interface{}{map[string]interface{}{"name": "br0"}},
+					"ips": []interface{}{
+						map[string]interface{}{"version": "4", "address": "10.1.0.2/24", "interface": 0},
+					},
+				},
+			}
+			Expect(utils.ParsePrevResult(&conf)).To(Succeed())
+			Expect(conf.PrevResult.Interfaces).To(HaveLen(1))
+			Expect(conf.PrevResult.Interfaces[0].Name).To(Equal("br0"))
+			Expect(conf.PrevResult.IPs).To(HaveLen(1))
+			Expect(conf.PrevResult.IPs[0].Address.String()).To(Equal("10.1.0.2/24"))
+		})
+
+		It("converts a prevResult from an older version", func() {
+			conf := types.NetConf{
+				CNIVersion: "0.2.0",
+				RawPrevResult: map[string]interface{}{
+					"cniVersion": "0.2.0",
+					"ip4":        map[string]interface{}{"ip": "10.1.0.2/24"},
+				},
+			}
+			Expect(utils.ParsePrevResult(&conf)).To(Succeed())
+			Expect(conf.PrevResult.IPs).To(HaveLen(1))
+			Expect(conf.PrevResult.IPs[0].Version).To(Equal("4"))
+		})
+
+		It("rejects a prevResult that isn't valid", func() {
+			conf := types.NetConf{
+				CNIVersion:    "0.3.1",
+				RawPrevResult: map[string]interface{}{"ips": "not a list"},
+			}
+			Expect(utils.ParsePrevResult(&conf)).To(MatchError(ContainSubstring("could not parse prevResult")))
+		})
+	})
+
+	Describe("MergePrevResult", func() {
+		It("puts the previous plugin's interfaces, IPs and routes first", func() {
+			prev := &current.Result{
+				Interfaces: []*current.Interface{{Name: "br0"}},
+				IPs: []*current.IPConfig{
+					{Version: "4", Address: mustParseCIDR("10.1.0.2/24"), Interface: current.Int(0)},
+					{Version: "4", Address: mustParseCIDR("192.168.0.5/32")},
+				},
+				Routes: []*cnitypes.Route{
+					{Dst: mustParseCIDR("10.1.0.0/16")},
+					{Dst: mustParseCIDR("0.0.0.0/0")},
+				},
+				DNS: cnitypes.DNS{Nameservers: []string{"10.1.0.1"}},
+			}
+			result := &current.Result{
+				Interfaces: []*current.Interface{{Name: "cali12345"}, {Name: "eth0", Sandbox: "/var/run/netns/a"}},
+				IPs: []*current.IPConfig{
+					{Version: "4", Address: mustParseCIDR("192.168.0.5/32"), Interface: current.Int(1)},
+				},
+				Routes: []*cnitypes.Route{{Dst: mustParseCIDR("0.0.0.0/0")}},
+			}
+
+			utils.MergePrevResult(result, prev)
+
+			Expect(result.Interfaces).To(HaveLen(3))
+			Expect(result.Interfaces[0].Name).To(Equal("br0"))
+			Expect(result.Interfaces[2].Name).To(Equal("eth0"))
+
+			Expect(result.IPs).To(HaveLen(2))
+			Expect(result.IPs[0].Address.String()).To(Equal("10.1.0.2/24"))
+			Expect(*result.IPs[0].Interface).To(Equal(0))
+			Expect(result.IPs[1].Address.String()).To(Equal("192.168.0.5/32"))
+			Expect(*result.IPs[1].Interface).To(Equal(2))
+
+			Expect(result.Routes).To(HaveLen(2))
+			Expect(result.Routes[0].Dst.String()).To(Equal("10.1.0.0/16"))
+			Expect(result.Routes[1].Dst.String()).To(Equal("0.0.0.0/0"))
+
+			Expect(result.DNS.Nameservers).To(Equal([]string{"10.1.0.1"}))
+		})
+
+		It("keeps Calico's DNS settings", func() {
+			prev := &current.Result{DNS: cnitypes.DNS{Nameservers: []string{"10.1.0.1"}}}
+			result := &current.Result{DNS: cnitypes.DNS{Nameservers: []string{"10.96.0.10"}}}
+			utils.MergePrevResult(result, prev)
+			Expect(result.DNS.Nameservers).To(Equal([]string{"10.96.0.10"}))
+		})
+
+		It("does nothing without a prevResult", func() {
+			result := &current.Result{Interfaces: []*current.Interface{{Name: "cali12345"}}}
+			utils.MergePrevResult(result, nil)
+			Expect(result.Interfaces).To(HaveLen(1))
+		})
+	})
+
+	Describe("ResultFromPrevResult", func() {
+		It("takes the previous plugin's IPs without their interfaces", func() {
+			conf := types.NetConf{PrevResult: &current.Result{
+				Interfaces: []*current.Interface{{Name: "br0"}},
+				IPs: []*current.IPConfig{
+					{Version: "4", Address: mustParseCIDR("10.1.0.2/24"), Interface: current.Int(0)},
+				},
+			}}
+			result, err := utils.ResultFromPrevResult(conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(BeEmpty())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("10.1.0.2/24"))
+			Expect(result.IPs[0].Interface).To(BeNil())
+		})
+
+		It("fails without a prevResult that has IPs", func() {
+			_, err := utils.ResultFromPrevResult(types.NetConf{})
+			Expect(err).To(MatchError(ContainSubstring("no IPAM plugin is configured")))
+			_, err = utils.ResultFromPrevResult(types.NetConf{PrevResult: &current.Result{}})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
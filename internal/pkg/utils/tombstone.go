@@ -0,0 +1,94 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+const defaultDelTombstoneDir = "/var/run/calico/cni"
+
+// DEL tombstones record that a DEL completed recently, so that a duplicate DEL arriving shortly afterwards can
+// return straight away without going to the datastore. They are only used if del_tombstone_ttl is set, and
+// expire after that many seconds so that a reused container ID is never ignored for long. An ADD for the same
+// container removes the tombstone.
+
+func delTombstonePath(conf types.NetConf, args *skel.CmdArgs) string {
+	dir := conf.DelTombstoneDir
+	if dir == "" {
+		dir = defaultDelTombstoneDir
+	}
+	return filepath.Join(dir, fmt.Sprintf("del-%s-%s-%s", conf.Name, args.ContainerID, args.IfName))
+}
+
+// HasDelTombstone returns true if there's an unexpired tombstone for a DEL of this container.
+func HasDelTombstone(conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) bool {
+	if conf.DelTombstoneTTL <= 0 {
+		return false
+	}
+	path := delTombstonePath(conf, args)
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if time.Since(info.ModTime()) > time.Duration(conf.DelTombstoneTTL)*time.Second {
+		logger.WithField("path", path).Debug("Removing expired DEL tombstone")
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.WithError(err).Warn("Failed to remove expired DEL tombstone")
+		}
+		return false
+	}
+	return true
+}
+
+// WriteDelTombstone records that the DEL for this container has completed. Failure to write it is only logged
+// since it just means that a duplicate DEL does the full processing again.
+func WriteDelTombstone(conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) {
+	if conf.DelTombstoneTTL <= 0 {
+		return
+	}
+	path := delTombstonePath(conf, args)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		logger.WithError(err).Warn("Failed to create DEL tombstone directory")
+		return
+	}
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		logger.WithError(err).Warn("Failed to write DEL tombstone")
+		return
+	}
+	// WriteFile doesn't update the modification time of an existing empty file, so do that explicitly.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		logger.WithError(err).Warn("Failed to refresh DEL tombstone")
+	}
+}
+
+// RemoveDelTombstone removes any tombstone for this container, so that a later DEL is processed in full.
+func RemoveDelTombstone(conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) {
+	if conf.DelTombstoneTTL <= 0 {
+		return
+	}
+	if err := os.Remove(delTombstonePath(conf, args)); err != nil && !os.IsNotExist(err) {
+		logger.WithError(err).Warn("Failed to remove DEL tombstone")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+var _ = Describe("DEL tombstones", func() {
+	var dir string
+	var conf types.NetConf
+	args := &skel.CmdArgs{ContainerID: "abc123", IfName: "eth0"}
+	logger := logrus.WithField("test", "tombstone")
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "calico-cni-tombstone-")
+		Expect(err).NotTo(HaveOccurred())
+		conf = types.NetConf{Name: "net1", DelTombstoneDir: dir, DelTombstoneTTL: 60}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("records a completed DEL", func() {
+		Expect(utils.HasDelTombstone(conf, args, logger)).To(BeFalse())
+		utils.WriteDelTombstone(conf, args, logger)
+		Expect(utils.HasDelTombstone(conf, args, logger)).To(BeTrue())
+
+		other := &skel.CmdArgs{ContainerID: "def456", IfName: "eth0"}
+		Expect(utils.HasDelTombstone(conf, other, logger)).To(BeFalse())
+	})
+
+	It("is cleared by an ADD", func() {
+		utils.WriteDelTombstone(conf, args, logger)
+		utils.RemoveDelTombstone(conf, args, logger)
+		Expect(utils.HasDelTombstone(conf, args, logger)).To(BeFalse())
+	})
+
+	It("expires after the TTL", func() {
+		utils.WriteDelTombstone(conf, args, logger)
+		files, err := filepath.Glob(filepath.Join(dir, "*"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+
+		old := time.Now().Add(-2 * time.Minute)
+		Expect(os.Chtimes(files[0], old, old)).To(Succeed())
+		Expect(utils.HasDelTombstone(conf, args, logger)).To(BeFalse())
+		_, err = os.Stat(files[0])
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("does nothing when disabled", func() {
+		conf.DelTombstoneTTL = 0
+		utils.WriteDelTombstone(conf, args, logger)
+		Expect(utils.HasDelTombstone(conf, args, logger)).To(BeFalse())
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+})
@@ -16,6 +16,10 @@ package utils
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -24,13 +28,19 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/sirupsen/logrus"
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
@@ -39,7 +49,9 @@ import (
 	"github.com/projectcalico/cni-plugin/pkg/types"
 	"github.com/projectcalico/libcalico-go/lib/apiconfig"
 	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	k8sconversion "github.com/projectcalico/libcalico-go/lib/backend/k8s/conversion"
 	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
 	"github.com/projectcalico/libcalico-go/lib/names"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
 	"github.com/projectcalico/libcalico-go/lib/options"
@@ -56,7 +68,9 @@ func Min(a, b int) int {
 // 1. Nodename field in NetConf
 // 2. Nodename from the file /var/lib/calico/nodename
 // 3. Hostname field in NetConf (DEPRECATED).
-// 4. OS Hostname.
+// 4. OS Hostname, which is always lowercased.
+//
+// With nodename_case_insensitive, the name is lowercased whichever of these it came from.
 func DetermineNodename(conf types.NetConf) (nodename string) {
 	if conf.Nodename != "" {
 		logrus.Debugf("Read node name from CNI conf: %s", conf.Nodename)
@@ -72,6 +86,11 @@ func DetermineNodename(conf types.NetConf) (nodename string) {
 		logrus.Debugf("Read node name from OS Hostname")
 	}
 
+	if conf.NodenameCaseInsensitive && nodename != strings.ToLower(nodename) {
+		logrus.Infof("Lowercasing node name %s", nodename)
+		nodename = strings.ToLower(nodename)
+	}
+
 	logrus.Debugf("Using node name %s", nodename)
 	return
 }
@@ -114,19 +133,184 @@ func MTUFromFile(filename string) (int, error) {
 	return strconv.Atoi(strings.TrimSpace(string(data)))
 }
 
+// Bounds of the veth MTU.
+const (
+	DefaultMTU = 1500
+	minMTU     = 68
+	maxMTU     = 65535
+)
+
+// ResolveMTU returns the MTU to use for the veth: the configured mtu if set, otherwise the value in mtuFile
+// (default /var/lib/calico/mtu) if there is one, otherwise 1500. It returns an error if the MTU is outside
+// 68-65535.
+func ResolveMTU(conf types.NetConf, mtuFile string) (int, error) {
+	mtu := conf.MTU
+	if mtu == 0 {
+		var err error
+		if mtu, err = MTUFromFile(mtuFile); err != nil {
+			return 0, fmt.Errorf("failed to read MTU file: %s", err)
+		}
+	}
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	if mtu < minMTU || mtu > maxMTU {
+		return 0, fmt.Errorf("invalid mtu %d: must be between %d and %d", mtu, minMTU, maxMTU)
+	}
+	return mtu, nil
+}
+
+// ResolveContainerMTU returns the MTU to use for the container side of the veth: container_settings.mtu if set,
+// otherwise hostMTU. It returns an error if the MTU is outside 68-65535, and warns if it's larger than hostMTU,
+// since the host side drops anything larger than its own MTU.
+func ResolveContainerMTU(conf types.NetConf, hostMTU int, logger *logrus.Entry) (int, error) {
+	mtu := conf.ContainerSettings.MTU
+	if mtu == 0 {
+		return hostMTU, nil
+	}
+	if mtu < minMTU || mtu > maxMTU {
+		return 0, fmt.Errorf("invalid container_settings.mtu %d: must be between %d and %d", mtu, minMTU, maxMTU)
+	}
+	if mtu > hostMTU {
+		logger.WithFields(logrus.Fields{"containerMTU": mtu, "hostMTU": hostMTU}).Warn(
+			"container_settings.mtu is larger than the host side's MTU, packets that don't fit will be dropped")
+	}
+	return mtu, nil
+}
+
+const (
+	// maxUpdateAttempts bounds the number of times CreateOrUpdate tries an Update that conflicts with a
+	// concurrent write.
+	maxUpdateAttempts = 3
+	// updateConflictBackoff is how long CreateOrUpdate waits after the first conflict; the wait grows
+	// linearly with each further attempt.
+	updateConflictBackoff = 100 * time.Millisecond
+)
+
 // CreateOrUpdate creates the WorkloadEndpoint if ResourceVersion is not specified,
-// or Update if it's specified.
+// or Update if it's specified. If the Update conflicts with a concurrent write to the
+// endpoint, the latest revision is read back and the fields that the CNI plugin owns are
+// merged onto it, so that changes that other components made to the rest of the endpoint,
+// such as their annotations, aren't lost. The last error is returned if it still conflicts
+// after maxUpdateAttempts.
 func CreateOrUpdate(ctx context.Context, client client.Interface, wep *api.WorkloadEndpoint) (*api.WorkloadEndpoint, error) {
-	if wep.ResourceVersion != "" {
-		return client.WorkloadEndpoints().Update(ctx, wep, options.SetOptions{})
+	if wep.ResourceVersion == "" {
+		return client.WorkloadEndpoints().Create(ctx, wep, options.SetOptions{})
 	}
 
-	return client.WorkloadEndpoints().Create(ctx, wep, options.SetOptions{})
+	for attempt := 1; ; attempt++ {
+		updated, err := client.WorkloadEndpoints().Update(ctx, wep, options.SetOptions{})
+		if _, ok := err.(cerrors.ErrorResourceUpdateConflict); !ok || attempt == maxUpdateAttempts {
+			return updated, err
+		}
+		logrus.WithError(err).WithField("attempt", attempt).Info("WorkloadEndpoint update conflicted, retrying")
+		time.Sleep(time.Duration(attempt) * updateConflictBackoff)
+
+		latest, getErr := client.WorkloadEndpoints().Get(ctx, wep.Namespace, wep.Name, options.GetOptions{})
+		if getErr != nil {
+			return nil, fmt.Errorf("failed to re-read WorkloadEndpoint after update conflict: %v", getErr)
+		}
+		wep = mergeOwnedFields(latest, wep)
+	}
+}
+
+// cniAnnotationPrefix is the prefix of the WorkloadEndpoint annotations that the CNI plugin owns.
+const cniAnnotationPrefix = "cni.projectcalico.org/"
+
+// mergeOwnedFields returns a copy of latest, the endpoint as it is in the datastore, with the fields that the CNI
+// plugin owns taken from wep: the labels, the cni.projectcalico.org annotations, and the IPs, MAC, profiles,
+// ports, container ID, interface name and NATs. The rest of latest is kept as it is.
+func mergeOwnedFields(latest, wep *api.WorkloadEndpoint) *api.WorkloadEndpoint {
+	merged := latest.DeepCopy()
+	merged.Labels = wep.Labels
+	for k := range merged.Annotations {
+		if strings.HasPrefix(k, cniAnnotationPrefix) {
+			delete(merged.Annotations, k)
+		}
+	}
+	for k, v := range wep.Annotations {
+		if !strings.HasPrefix(k, cniAnnotationPrefix) {
+			continue
+		}
+		if merged.Annotations == nil {
+			merged.Annotations = map[string]string{}
+		}
+		merged.Annotations[k] = v
+	}
+	merged.Spec.IPNetworks = wep.Spec.IPNetworks
+	merged.Spec.IPNATs = wep.Spec.IPNATs
+	merged.Spec.MAC = wep.Spec.MAC
+	merged.Spec.Profiles = wep.Spec.Profiles
+	merged.Spec.Ports = wep.Spec.Ports
+	merged.Spec.ContainerID = wep.Spec.ContainerID
+	merged.Spec.InterfaceName = wep.Spec.InterfaceName
+	return merged
 }
 
-// AddIPAM calls through to the configured IPAM plugin.
+// AssignedAtAnnotation records when the workload was first networked by the CNI plugin.
+const AssignedAtAnnotation = "cni.projectcalico.org/assignedAt"
+
+// SetAssignedAt stamps the WorkloadEndpoint with the given time in the assignedAt annotation, unless it
+// is already set. This means that repeated ADDs for the same endpoint keep the time of the original assignment.
+func SetAssignedAt(wep *api.WorkloadEndpoint, now time.Time) {
+	if _, ok := wep.Annotations[AssignedAtAnnotation]; ok {
+		return
+	}
+	if wep.Annotations == nil {
+		wep.Annotations = map[string]string{}
+	}
+	wep.Annotations[AssignedAtAnnotation] = now.UTC().Format(time.RFC3339)
+}
+
+// NetworkAnnotation records the name of the CNI network that most recently set up the WorkloadEndpoint.
+const NetworkAnnotation = "cni.projectcalico.org/network"
+
+// SetNetwork stamps the WorkloadEndpoint with the given CNI network name in the network annotation,
+// replacing any previous value.
+func SetNetwork(wep *api.WorkloadEndpoint, network string) {
+	if wep.Annotations == nil {
+		wep.Annotations = map[string]string{}
+	}
+	wep.Annotations[NetworkAnnotation] = network
+}
+
+// PluginVersionAnnotation records the version of the CNI plugin that most recently set up the WorkloadEndpoint, to
+// help with debugging during a rollout of a new version.
+const PluginVersionAnnotation = "cni.projectcalico.org/pluginVersion"
+
+// PluginVersion is the version of the running plugin, for the pluginVersion annotation. Main sets it.
+var PluginVersion = "unknown"
+
+// SetPluginVersion stamps the WorkloadEndpoint with PluginVersion in the pluginVersion annotation, replacing any
+// previous value.
+func SetPluginVersion(wep *api.WorkloadEndpoint) {
+	if wep.Annotations == nil {
+		wep.Annotations = map[string]string{}
+	}
+	wep.Annotations[PluginVersionAnnotation] = PluginVersion
+}
+
+// HwAddrAnnotation lets a pod pin the MAC address of its container interface.
+const HwAddrAnnotation = "cni.projectcalico.org/hwAddr"
+
+// ParseHwAddr parses the value of the hwAddr annotation, which must be a unicast 48-bit MAC address.
+func ParseHwAddr(value string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse annotation %q: %s", HwAddrAnnotation, err)
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("invalid annotation %q: %s is not a 48-bit MAC address", HwAddrAnnotation, value)
+	}
+	if mac[0]&0x01 != 0 {
+		return nil, fmt.Errorf("invalid annotation %q: %s is a multicast MAC address", HwAddrAnnotation, value)
+	}
+	return mac, nil
+}
+
+// AddIPAM calls through to the configured IPAM plugin, killing it if the context is cancelled.
 // It also contains IPAM plugin specific logic based on the configured plugin.
-func AddIPAM(conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) (*current.Result, error) {
+func AddIPAM(ctx context.Context, conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) (*current.Result, error) {
 	// Check if we're configured to use the Azure IPAM plugin.
 	var an *azure.AzureNetwork
 	if conf.IPAM.Type == "azure-vnet-ipam" {
@@ -142,12 +326,21 @@ func AddIPAM(conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) (*cur
 		}
 	}
 
+	if err := CheckIPAMPlugin(conf, logger); err != nil {
+		return nil, err
+	}
+
 	// Actually call the IPAM plugin.
 	logger.Debugf("Calling IPAM plugin %s", conf.IPAM.Type)
-	ipamResult, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+	restoreArgs, err := AddIgnoreUnknownArgs()
 	if err != nil {
 		return nil, err
 	}
+	ipamResult, err := invoke.DelegateAdd(ctx, conf.IPAM.Type, args.StdinData, nil)
+	restoreArgs()
+	if err != nil {
+		return nil, FromIPAMError(err, logger)
+	}
 	logger.Debugf("IPAM plugin returned: %+v", ipamResult)
 
 	// Convert the IPAM result into the current version.
@@ -193,6 +386,11 @@ func AddIPAM(conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) (*cur
 // It also contains IPAM plugin specific logic based on the configured plugin,
 // and is the logical counterpart to AddIPAM.
 func DeleteIPAM(conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) error {
+	if NoIPAM(conf) {
+		// The addresses came from an annotation or an earlier plugin, so there's nothing for us to release.
+		logger.Info("No IPAM plugin configured, nothing to release")
+		return nil
+	}
 	logger.Info("Calico CNI releasing IP address")
 	logger.WithFields(logrus.Fields{"paths": os.Getenv("CNI_PATH"),
 		"type": conf.IPAM.Type}).Debug("Looking for IPAM plugin in paths")
@@ -246,7 +444,12 @@ func DeleteIPAM(conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) er
 	}
 
 	// Call the CNI plugin.
-	err := ipam.ExecDel(conf.IPAM.Type, args.StdinData)
+	restoreArgs, err := AddIgnoreUnknownArgs()
+	if err != nil {
+		return err
+	}
+	err = execDelWithRetry(conf.IPAM.Type, args.StdinData, logger)
+	restoreArgs()
 	if err != nil {
 		logger.Error(err)
 	} else if ae != nil {
@@ -261,6 +464,49 @@ func DeleteIPAM(conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) er
 	return err
 }
 
+// KeepIPs returns whether the CNI_ARGS of a DEL ask for the workload's IPs to be left reserved, with
+// CALICO_KEEP_IP=1, so that they can be handed to a later ADD, for example when a workload is moved to a new
+// container. The DEL removes the interface and the WorkloadEndpoint as usual, but not the IPAM allocation.
+func KeepIPs(args *skel.CmdArgs) (bool, error) {
+	keepArgs := types.KeepIPArgs{}
+	if err := cnitypes.LoadArgs(IgnoreUnknownArgs(args.Args), &keepArgs); err != nil {
+		return false, fmt.Errorf("failed to parse CALICO_KEEP_IP: %v", err)
+	}
+	return bool(keepArgs.CALICO_KEEP_IP), nil
+}
+
+const (
+	// maxIPAMDelAttempts bounds the number of times DeleteIPAM runs the IPAM plugin's DEL, so that a transient
+	// failure, such as a datastore hiccup, doesn't fail the DEL and leak the address.
+	maxIPAMDelAttempts = 3
+	// ipamDelBackoff is how long DeleteIPAM waits after the first failure; the wait doubles with each further
+	// attempt.
+	ipamDelBackoff = 100 * time.Millisecond
+)
+
+// execDelWithRetry runs the IPAM plugin's DEL, retrying it with backoff if it fails. An "unknown container" error
+// means that there's nothing allocated to release, so it counts as success. Any other error is returned once the
+// attempts are used up.
+func execDelWithRetry(plugin string, netconf []byte, logger *logrus.Entry) error {
+	backoff := ipamDelBackoff
+	for attempt := 1; ; attempt++ {
+		err := ipam.ExecDel(plugin, netconf)
+		if err == nil {
+			return nil
+		}
+		if cniErr, ok := err.(*cnitypes.Error); ok && cniErr.Code == cnitypes.ErrUnknownContainer {
+			logger.WithError(err).Info("IPAM plugin has nothing allocated to the container, treating it as released")
+			return nil
+		}
+		if attempt == maxIPAMDelAttempts {
+			return err
+		}
+		logger.WithError(err).WithField("attempt", attempt).Warn("IPAM release failed, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 // ReplaceHostLocalIPAMPodCIDRs extracts the host-local IPAM config section and replaces our special-case "usePodCidr"
 // subnet value with pod CIDR retrieved by the passed-in getPodCIDR function.  Typically, the passed-in function
 // would access the datastore to retrieve the podCIDR. However, for tear-down we use a dummy value that returns
@@ -307,7 +553,7 @@ func ReplaceHostLocalIPAMPodCIDRs(logger *logrus.Entry, stdinData map[string]int
 		for _, urs := range rangeSets {
 			rs, ok := urs.([]interface{})
 			if !ok {
-				return fmt.Errorf("failed to parse host-local IPAM range set; was expecting a list, not: %v", rs)
+				return fmt.Errorf("failed to parse host-local IPAM range set; was expecting a list, not: %v", urs)
 			}
 			for _, r := range rs {
 				err := replaceHostLocalIPAMPodCIDR(logger, r, getPodCIDR)
@@ -457,22 +703,40 @@ func validateRangeOrSetDefault(rangeData string, expRange string, ipnet *net.IPN
 
 }
 
-// ValidateNetworkName checks that the network name meets felix's expectations
+var (
+	// ErrEmptyNetworkName is returned by ValidateNetworkName if the network has no name, which is a bug in
+	// the CNI config.
+	ErrEmptyNetworkName = errors.New("network name is empty")
+
+	// ErrInvalidNetworkName is returned by ValidateNetworkName if the network name has characters that felix
+	// doesn't support.
+	ErrInvalidNetworkName = errors.New("invalid characters detected in the given network name. " +
+		"Only letters a-z, numbers 0-9, and symbols _.- are supported")
+)
+
+// ValidateNetworkName checks that the network name meets felix's expectations. The error is
+// ErrEmptyNetworkName or ErrInvalidNetworkName.
 func ValidateNetworkName(name string) error {
+	if name == "" {
+		return ErrEmptyNetworkName
+	}
 	matched, err := regexp.MatchString(`^[a-zA-Z0-9_\.\-]+$`, name)
 	if err != nil {
 		return err
 	}
 	if !matched {
-		return errors.New("invalid characters detected in the given network name. " +
-			"Only letters a-z, numbers 0-9, and symbols _.- are supported")
+		return ErrInvalidNetworkName
 	}
 	return nil
 }
 
 // SanitizeMesosLabel converts a string from a valid mesos label to a valid Calico label.
-// Mesos labels have no restriction outside of being unicode.
-func SanitizeMesosLabel(s string) string {
+// Mesos labels have no restriction outside of being unicode. An empty string is returned as it is, but it's an
+// error if a non-empty string has nothing left once sanitized, such as "///" or "...", since it would otherwise
+// turn into an empty label key or value.
+func SanitizeMesosLabel(s string) (string, error) {
+	orig := s
+
 	// Inspired by:
 	// https://github.com/projectcalico/libcalico-go/blob/2ff29bed865c4b364d4fcf1ad214b2bd8d9b4afa/lib/upgrade/converters/names.go#L39-L58
 	invalidChar := regexp.MustCompile("[^-_.a-zA-Z0-9]+")
@@ -493,22 +757,44 @@ func SanitizeMesosLabel(s string) string {
 	// slice is the captured match group.
 	submatches := trailingLeadingDotsDashes.FindStringSubmatch(s)
 	s = submatches[1]
-	return s
+	if s == "" && orig != "" {
+		return "", fmt.Errorf("mesos label %q has no characters that are valid in a Calico label", orig)
+	}
+	return s, nil
 }
 
-// AddIgnoreUnknownArgs appends the 'IgnoreUnknown=1' option to CNI_ARGS before calling the IPAM plugin. Otherwise, it will
+// AddIgnoreUnknownArgs adds the 'IgnoreUnknown=1' option to CNI_ARGS before calling the IPAM plugin. Otherwise, it will
 // complain about the Kubernetes arguments. See https://github.com/kubernetes/kubernetes/pull/24983
-func AddIgnoreUnknownArgs() error {
-	cniArgs := "IgnoreUnknown=1"
-	if os.Getenv("CNI_ARGS") != "" {
-		cniArgs = fmt.Sprintf("%s;%s", cniArgs, os.Getenv("CNI_ARGS"))
+// The returned function puts CNI_ARGS back as it was, and should be called as soon as the IPAM plugin returns.
+func AddIgnoreUnknownArgs() (func(), error) {
+	original, wasSet := os.LookupEnv("CNI_ARGS")
+	if err := os.Setenv("CNI_ARGS", IgnoreUnknownArgs(original)); err != nil {
+		return nil, fmt.Errorf("failed to set IgnoreUnknown=1 in CNI_ARGS: %v", err)
+	}
+	return func() {
+		var err error
+		if wasSet {
+			err = os.Setenv("CNI_ARGS", original)
+		} else {
+			err = os.Unsetenv("CNI_ARGS")
+		}
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to restore CNI_ARGS")
+		}
+	}, nil
+}
+
+// IgnoreUnknownArgs returns the CNI_ARGS string with the 'IgnoreUnknown=1' option added to the front.
+func IgnoreUnknownArgs(cniArgs string) string {
+	if cniArgs == "" {
+		return "IgnoreUnknown=1"
 	}
-	return os.Setenv("CNI_ARGS", cniArgs)
+	return fmt.Sprintf("IgnoreUnknown=1;%s", cniArgs)
 }
 
 // CreateResultFromEndpoint takes a WorkloadEndpoint, extracts IP information
 // and populates that into a CNI Result.
-func CreateResultFromEndpoint(wep *api.WorkloadEndpoint) (*current.Result, error) {
+func CreateResultFromEndpoint(wep *api.WorkloadEndpoint, ipFamilyOrder string) (*current.Result, error) {
 	result := &current.Result{}
 	for _, v := range wep.Spec.IPNetworks {
 		parsedIPConfig := current.IPConfig{}
@@ -529,17 +815,71 @@ func CreateResultFromEndpoint(wep *api.WorkloadEndpoint) (*current.Result, error
 		result.IPs = append(result.IPs, &parsedIPConfig)
 	}
 
+	if err := sortIPsByFamily(result.IPs, ipFamilyOrder); err != nil {
+		return nil, err
+	}
+
 	return result, nil
 }
 
+// AddEndpointInterfaces adds the WorkloadEndpoint's host interface and its container interface, in the
+// container's network namespace, to the CNI Result. The container interface's MAC is the one recorded on the
+// endpoint rather than read from the interface.
+func AddEndpointInterfaces(result *current.Result, wep *api.WorkloadEndpoint, args *skel.CmdArgs) {
+	result.Interfaces = append(result.Interfaces,
+		&current.Interface{Name: wep.Spec.InterfaceName},
+		&current.Interface{Name: wep.Spec.Endpoint, Mac: wep.Spec.MAC, Sandbox: args.Netns},
+	)
+}
+
+// IPAMResultRoutes returns the routes that the IPAM plugin reports in its result, so that a repeated ADD, which
+// builds its result from the WorkloadEndpoint rather than calling the IPAM plugin, can report the same ones.
+// Only host-local reports any, from its config.
+func IPAMResultRoutes(conf types.NetConf) []*cnitypes.Route {
+	if conf.IPAM.Type != "host-local" {
+		return nil
+	}
+	return conf.IPAM.Routes
+}
+
 // PopulateEndpointNets takes a WorkloadEndpoint and a CNI Result, extracts IP address and mask
-// and populates that information into the WorkloadEndpoint.
-func PopulateEndpointNets(wep *api.WorkloadEndpoint, result *current.Result) error {
+// and populates that information into the WorkloadEndpoint. A workload has at most one IPv4 and one
+// IPv6 address, or as many as num_ipv4 and num_ipv6 allow, so a Result with more is rejected. The IPs
+// in the Result are first put in the given ip_family_order (IPv4 first if unset), so that the Result
+// and the WorkloadEndpoint list them the same way.
+func PopulateEndpointNets(wep *api.WorkloadEndpoint, result *current.Result, conf types.NetConf) error {
 	var copyIpNet net.IPNet
 	if len(result.IPs) == 0 {
 		return errors.New("IPAM plugin did not return any IP addresses")
 	}
 
+	max4, max6, err := IPsPerFamily(conf)
+	if err != nil {
+		return err
+	}
+	var num4, num6 int
+	for _, ipNet := range result.IPs {
+		if ipNet.Address.IP.To4() != nil {
+			num4++
+		} else {
+			num6++
+		}
+	}
+	if num4 > max4 {
+		return fmt.Errorf("IPAM plugin returned %d IPv4 addresses, but a workload can only have %d", num4, max4)
+	}
+	if num6 > max6 {
+		return fmt.Errorf("IPAM plugin returned %d IPv6 addresses, but a workload can only have %d", num6, max6)
+	}
+
+	ipFamilyOrder := conf.IPFamilyOrder
+	if ipFamilyOrder == "" {
+		ipFamilyOrder = "v4-first"
+	}
+	if err = sortIPsByFamily(result.IPs, ipFamilyOrder); err != nil {
+		return err
+	}
+
 	for _, ipNet := range result.IPs {
 		copyIpNet = net.IPNet{IP: ipNet.Address.IP, Mask: ipNet.Address.Mask}
 		if ipNet.Version == "4" {
@@ -554,6 +894,62 @@ func PopulateEndpointNets(wep *api.WorkloadEndpoint, result *current.Result) err
 	return nil
 }
 
+// MaxIPsPerFamily is the most that num_ipv4 and num_ipv6 may be set to.
+const MaxIPsPerFamily = 16
+
+// IPsPerFamily returns the number of IPv4 and IPv6 addresses that a workload gets of each family that it's
+// assigned, from num_ipv4 and num_ipv6. Either defaults to one.
+func IPsPerFamily(conf types.NetConf) (int, int, error) {
+	num4, err := ipsPerFamily("num_ipv4", conf.IPAM.NumIPv4)
+	if err != nil {
+		return 0, 0, err
+	}
+	num6, err := ipsPerFamily("num_ipv6", conf.IPAM.NumIPv6)
+	if err != nil {
+		return 0, 0, err
+	}
+	return num4, num6, nil
+}
+
+func ipsPerFamily(field string, num int) (int, error) {
+	if num == 0 {
+		return 1, nil
+	}
+	if num < 0 || num > MaxIPsPerFamily {
+		return 0, fmt.Errorf("invalid %s %d: must be between 1 and %d", field, num, MaxIPsPerFamily)
+	}
+	return num, nil
+}
+
+// ValidateIPFamilyOrder returns an error if the ip_family_order isn't one of the supported values.
+func ValidateIPFamilyOrder(ipFamilyOrder string) error {
+	switch ipFamilyOrder {
+	case "", "v4-first", "v6-first":
+		return nil
+	default:
+		return fmt.Errorf("invalid ip_family_order %q: must be v4-first or v6-first", ipFamilyOrder)
+	}
+}
+
+// sortIPsByFamily puts the IPs of one family before the other, according to the ip_family_order, keeping the
+// order of the IPs within each family. If no order is configured, the IPs are left in the order they came in.
+func sortIPsByFamily(ips []*current.IPConfig, ipFamilyOrder string) error {
+	if err := ValidateIPFamilyOrder(ipFamilyOrder); err != nil {
+		return err
+	}
+	if ipFamilyOrder == "" {
+		return nil
+	}
+	v4First := ipFamilyOrder == "v4-first"
+	isFirst := func(ip *current.IPConfig) bool {
+		return (ip.Address.IP.To4() != nil) == v4First
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		return isFirst(ips[i]) && !isFirst(ips[j])
+	})
+	return nil
+}
+
 type WEPIdentifiers struct {
 	Namespace string
 	WEPName   string
@@ -600,6 +996,16 @@ func GetIdentifiers(args *skel.CmdArgs, nodename string) (*WEPIdentifiers, error
 	return &epIDs, nil
 }
 
+// DetermineHostVethName returns the name of the host side of the workload's veth. A Kubernetes pod's name is
+// derived from its namespace and name, so that it stays the same when the pod's sandbox is recreated. Other
+// workloads use "cali" followed by the start of the container ID.
+func DetermineHostVethName(epIDs *WEPIdentifiers) string {
+	if epIDs.Orchestrator == api.OrchestratorKubernetes {
+		return k8sconversion.NewConverter().VethNameForWorkload(epIDs.Namespace, epIDs.Pod)
+	}
+	return "cali" + epIDs.ContainerID[:Min(11, len(epIDs.ContainerID))]
+}
+
 func GetHandleID(netName, containerID, workload string) string {
 	handleID := fmt.Sprintf("%s.%s", netName, containerID)
 
@@ -612,11 +1018,156 @@ func GetHandleID(netName, containerID, workload string) string {
 	return handleID
 }
 
+// PrimaryInterface is the container interface that a workload's main endpoint is on. With
+// allow_multiple_endpoints, endpoints on any other interface are secondary endpoints.
+const PrimaryInterface = "eth0"
+
+// IsSecondaryEndpoint returns true if an endpoint on the given container interface is one of several that the
+// workload may have, rather than its only or main one.
+func IsSecondaryEndpoint(conf types.NetConf, ifName string) bool {
+	return conf.AllowMultipleEndpoints && ifName != "" && ifName != PrimaryInterface
+}
+
+// The values of veth_name_style, which controls how the host veths of workloads other than Kubernetes pods are
+// named. VethNameStylePrefix, the default, uses the start of the container ID, so container IDs that start
+// the same get the same name. VethNameStyleHash uses a hash of the whole container ID instead.
+const (
+	VethNameStylePrefix = "prefix"
+	VethNameStyleHash   = "hash"
+)
+
+// ValidateVethNameStyle checks the veth_name_style setting.
+func ValidateVethNameStyle(style string) error {
+	switch style {
+	case "", VethNameStylePrefix, VethNameStyleHash:
+		return nil
+	}
+	return fmt.Errorf("invalid veth_name_style %q: must be %q or %q", style, VethNameStylePrefix, VethNameStyleHash)
+}
+
+// ValidateDataplaneOptions checks the settings for the routes and veths that the dataplane sets up.
+func ValidateDataplaneOptions(conf types.NetConf) error {
+	if conf.DefaultRouteMetric != nil && *conf.DefaultRouteMetric < 0 {
+		return fmt.Errorf("invalid default_route_metric %d: must not be negative", *conf.DefaultRouteMetric)
+	}
+	if conf.VethCreateRetries < 0 || conf.VethCreateBackoff < 0 {
+		return fmt.Errorf("invalid veth_create_retries/veth_create_backoff: must not be negative")
+	}
+	if conf.HostRouteTable < 0 {
+		return fmt.Errorf("invalid host_route_table %d: must not be negative", conf.HostRouteTable)
+	}
+	if conf.HostRouteProtocol < 0 || conf.HostRouteProtocol > 255 {
+		return fmt.Errorf("invalid host_route_protocol %d: must be between 0 and 255", conf.HostRouteProtocol)
+	}
+	if conf.IPv6Gateway != "" {
+		if gw := net.ParseIP(conf.IPv6Gateway); gw == nil || gw.To4() != nil || !gw.IsLinkLocalUnicast() {
+			return fmt.Errorf("invalid ipv6_gateway %q: must be an IPv6 link-local address", conf.IPv6Gateway)
+		}
+	}
+	return nil
+}
+
+// MaxInterfaceNameLen is the longest interface name that the kernel allows.
+const MaxInterfaceNameLen = 15
+
+// ApplyForceInterfaceName checks the force_interface_name setting and, if it's set, uses it in place of the
+// container interface name that the runtime asked for. CNI_IFNAME is updated too, so that a delegated IPAM
+// plugin sees the same name. It must be applied on DEL and CHECK as well as ADD, so that they find the endpoint.
+func ApplyForceInterfaceName(conf types.NetConf, args *skel.CmdArgs) error {
+	name := conf.ForceInterfaceName
+	if name == "" {
+		return nil
+	}
+	if len(name) > MaxInterfaceNameLen || name == "." || name == ".." || strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("invalid force_interface_name %q: must be a valid interface name of at most %d characters",
+			name, MaxInterfaceNameLen)
+	}
+	if args.IfName != name {
+		logrus.WithFields(logrus.Fields{"requested": args.IfName, "forced": name}).Debug("Overriding container interface name")
+		args.IfName = name
+	}
+	return os.Setenv("CNI_IFNAME", name)
+}
+
+// HostVethName returns the name of the host side of the veth for an endpoint. It's the workload's name from
+// DetermineHostVethName, other than for a secondary endpoint, which needs a name of its own, so it gets one
+// from a hash of the WorkloadEndpoint's name, and for a workload other than a Kubernetes pod with the "hash"
+// veth_name_style, which gets one from a hash of its container ID.
+func HostVethName(conf types.NetConf, epIDs *WEPIdentifiers) string {
+	if IsSecondaryEndpoint(conf, epIDs.Endpoint) {
+		wepName := epIDs.WEPName
+		if wepName == "" {
+			// The identifiers were checked when they were loaded, so this can't fail.
+			wepName, _ = epIDs.CalculateWorkloadEndpointName(false)
+		}
+		return hashedVethName(wepName)
+	}
+	if conf.VethNameStyle == VethNameStyleHash && epIDs.Orchestrator != api.OrchestratorKubernetes {
+		return hashedVethName(epIDs.ContainerID)
+	}
+	return DetermineHostVethName(epIDs)
+}
+
+// hashedVethName returns a host veth name made from a hash of s, which uses all 15 characters that an interface
+// name may have.
+func hashedVethName(s string) string {
+	h := sha1.New()
+	h.Write([]byte(s))
+	return "cali" + hex.EncodeToString(h.Sum(nil))[:11]
+}
+
+// GetEndpointHandleID returns the IPAM handle for an endpoint's IPs. It's the handle from GetHandleID, with the
+// interface name added for a secondary endpoint, so that the workload's endpoints can be released separately,
+// and behind the network's ipam_handle_prefix, if it has one.
+func GetEndpointHandleID(conf types.NetConf, netName, containerID, ifName, workload string) string {
+	handleID := GetHandleID(netName, containerID, workload)
+	if IsSecondaryEndpoint(conf, ifName) {
+		handleID = fmt.Sprintf("%s.%s", handleID, ifName)
+	}
+	if conf.IPAMHandlePrefix != "" {
+		handleID = fmt.Sprintf("%s.%s", conf.IPAMHandlePrefix, handleID)
+	}
+	return handleID
+}
+
+// validateHandlePrefix checks that ipam_handle_prefix only has the characters that a network name may have,
+// since it becomes part of the same handles.
+func validateHandlePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if !handlePrefixRegexp.MatchString(prefix) {
+		return fmt.Errorf("invalid ipam_handle_prefix %q: only letters a-z, numbers 0-9, and symbols _.- are supported", prefix)
+	}
+	return nil
+}
+
+var handlePrefixRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\.\-]+$`)
+
+// CreateClient returns a Calico client for the datastore configured by the NetConf and the environment. Within a
+// process, calls that resolve to the same client config share one client, so that setting it up is only paid
+// for once per invocation. Inline etcd TLS material is written to new files each time, so a config that uses it
+// gets a new client on each call. With etcd, if the client can't be created with the configured endpoints and
+// etcd_endpoints_backup is set, the backup endpoints are tried instead.
 func CreateClient(conf types.NetConf) (client.Interface, error) {
 	if err := ValidateNetworkName(conf.Name); err != nil {
+		return nil, fmt.Errorf("invalid network name %q: %w", conf.Name, err)
+	}
+	if err := validateHandlePrefix(conf.IPAMHandlePrefix); err != nil {
 		return nil, err
 	}
 
+	// Write any inline etcd TLS material to temporary files so that it can be loaded in the same way as
+	// material provided as file paths. The etcd client connects lazily and reads the files again on each
+	// TLS handshake, so they're kept until the plugin exits; see RemoveInlineEtcdTLSFiles.
+	cleanup, err := WriteInlineEtcdTLSFiles(&conf)
+	if err != nil {
+		return nil, err
+	}
+	inlineTLSLock.Lock()
+	inlineTLSCleanups = append(inlineTLSCleanups, cleanup)
+	inlineTLSLock.Unlock()
+
 	// Use the config file to override environment variables.
 	// These variables will be loaded into the client config.
 	if conf.EtcdAuthority != "" {
@@ -683,26 +1234,176 @@ func CreateClient(conf types.NetConf) (client.Interface, error) {
 		return nil, err
 	}
 
+	// Reuse the client from an earlier call if the config hasn't changed since.
+	clientCache.Lock()
+	defer clientCache.Unlock()
+	if clientCache.client != nil && reflect.DeepEqual(clientCache.spec, clientConfig.Spec) {
+		logrus.Debug("Reusing Calico client")
+		return clientCache.client, nil
+	}
+
 	// Create a new client.
+	spec := clientConfig.Spec
 	calicoClient, err := client.New(*clientConfig)
+	if conf.EtcdEndpointsBackup != "" && clientConfig.Spec.DatastoreType == apiconfig.EtcdV3 {
+		if err == nil {
+			// The etcd client connects lazily, so make a request to find out whether the endpoints work.
+			err = probeDatastore(calicoClient)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("backup", conf.EtcdEndpointsBackup).Warn(
+				"Failed to connect to the etcd endpoints, trying the backup endpoints")
+			clientConfig.Spec.EtcdEndpoints = conf.EtcdEndpointsBackup
+			clientConfig.Spec.EtcdDiscoverySrv = ""
+			calicoClient, err = client.New(*clientConfig)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	clientCache.spec, clientCache.client = spec, calicoClient
 	return calicoClient, nil
 }
 
+// etcdProbeTimeout bounds the request that CreateClient makes to check the primary etcd endpoints before
+// falling back to the backup ones.
+const etcdProbeTimeout = 5 * time.Second
+
+// probeDatastore reads the ClusterInformation to check that the datastore is reachable. The resource not
+// existing still shows that the datastore answered.
+func probeDatastore(calicoClient client.Interface) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdProbeTimeout)
+	defer cancel()
+	_, err := calicoClient.ClusterInformation().Get(ctx, "default", options.GetOptions{})
+	if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+		return nil
+	}
+	return err
+}
+
+var (
+	inlineTLSLock     sync.Mutex
+	inlineTLSCleanups []func()
+
+	// clientCache is the client most recently created by CreateClient and the config it was created from.
+	clientCache struct {
+		sync.Mutex
+		spec   apiconfig.CalicoAPIConfigSpec
+		client client.Interface
+	}
+)
+
+// RemoveInlineEtcdTLSFiles removes the temporary files that CreateClient wrote for inline etcd TLS material.
+// It must only be called once the clients are no longer in use, typically just before the plugin exits.
+func RemoveInlineEtcdTLSFiles() {
+	inlineTLSLock.Lock()
+	defer inlineTLSLock.Unlock()
+	for _, cleanup := range inlineTLSCleanups {
+		cleanup()
+	}
+	inlineTLSCleanups = nil
+}
+
+// PluginMain runs the plugin like skel.PluginMain, removing any temporary files for inline etcd TLS material
+// before it exits.
+func PluginMain(cmdAdd, cmdCheck, cmdDel func(_ *skel.CmdArgs) error, versionInfo version.PluginInfo, about string) {
+	e := skel.PluginMainWithError(cmdAdd, cmdCheck, cmdDel, versionInfo, about)
+	RemoveInlineEtcdTLSFiles()
+	if e != nil {
+		if err := e.Print(); err != nil {
+			logrus.WithError(err).Error("Error writing error JSON to stdout")
+		}
+		os.Exit(1)
+	}
+}
+
+// WriteInlineEtcdTLSFiles writes any base64 encoded etcd TLS material provided inline in the NetConf to
+// temporary files readable only by the owner, and updates the corresponding file path fields to point at them.
+// File paths provided in the NetConf take precedence over inline material. The returned function removes any
+// files that were written and should always be called once the files are no longer needed.
+func WriteInlineEtcdTLSFiles(conf *types.NetConf) (func(), error) {
+	var files []string
+	cleanup := func() {
+		for _, f := range files {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				logrus.WithError(err).WithField("file", f).Warn("Failed to remove temporary etcd TLS file")
+			}
+		}
+	}
+
+	var inlineMaterial = []struct {
+		name   string
+		value  string
+		target *string
+	}{
+		{"etcd_key", conf.EtcdKey, &conf.EtcdKeyFile},
+		{"etcd_cert", conf.EtcdCert, &conf.EtcdCertFile},
+		{"etcd_ca", conf.EtcdCaCert, &conf.EtcdCaCertFile},
+	}
+	for _, m := range inlineMaterial {
+		if m.value == "" {
+			continue
+		}
+		if *m.target != "" {
+			logrus.WithField("field", m.name).Info("Both inline and file etcd TLS material provided, using the file")
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(m.value)
+		if err != nil {
+			cleanup()
+			return func() {}, fmt.Errorf("failed to decode %s: %s", m.name, err)
+		}
+
+		// TempFile creates the file with mode 0600.
+		f, err := ioutil.TempFile("", "calico-cni-"+m.name+"-")
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		files = append(files, f.Name())
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			cleanup()
+			return func() {}, fmt.Errorf("failed to write %s to %s: %s", m.name, f.Name(), err)
+		}
+		logrus.WithField("file", f.Name()).Debugf("Wrote inline %s to temporary file", m.name)
+		*m.target = f.Name()
+	}
+	return cleanup, nil
+}
+
 // ReleaseIPAllocation is called to cleanup IPAM allocations if something goes wrong during
-// CNI ADD execution. It forces the CNI_COMMAND to be DEL.
+// CNI ADD execution. It forces the CNI_COMMAND to be DEL while the IPAM plugin runs, and then puts it back.
 func ReleaseIPAllocation(logger *logrus.Entry, conf types.NetConf, args *skel.CmdArgs) {
+	if conf.DebugKeepFailedInterface {
+		logger.Warn("debug_keep_failed_interface is set, leaving the failed ADD's IP allocations in place")
+		return
+	}
 	logger.Info("Cleaning up IP allocations for failed ADD")
+	original, wasSet := os.LookupEnv("CNI_COMMAND")
 	if err := os.Setenv("CNI_COMMAND", "DEL"); err != nil {
 		// Failed to set CNI_COMMAND to DEL.
 		logger.Warning("Failed to set CNI_COMMAND=DEL")
-	} else {
-		if err := DeleteIPAM(conf, args, logger); err != nil {
-			// Failed to cleanup the IP allocation.
-			logger.Warning("Failed to clean up IP allocations for failed ADD")
+		return
+	}
+	defer func() {
+		var err error
+		if wasSet {
+			err = os.Setenv("CNI_COMMAND", original)
+		} else {
+			err = os.Unsetenv("CNI_COMMAND")
 		}
+		if err != nil {
+			logger.WithError(err).Warning("Failed to restore CNI_COMMAND")
+		}
+	}()
+
+	if err := DeleteIPAM(conf, args, logger); err != nil {
+		// Failed to cleanup the IP allocation.
+		logger.Warning("Failed to clean up IP allocations for failed ADD")
 	}
 }
 
@@ -757,6 +1458,162 @@ func ConfigureLogging(conf types.NetConf) {
 	mw := io.MultiWriter(writers...)
 
 	logrus.SetOutput(mw)
+
+	// Switch to structured output if asked to. The text format is set up by the plugin's main.
+	switch conf.LogFormat {
+	case "", "text":
+		jsonLogging = false
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+		jsonLogging = true
+	default:
+		logrus.WithField("log_format", conf.LogFormat).Warn("Unknown log_format, must be text or json; using text")
+		jsonLogging = false
+	}
+}
+
+// jsonLogging records whether ConfigureLogging set up JSON output.
+var jsonLogging bool
+
+// identifiersHook adds the workload's identifiers to every log entry that doesn't already have them.
+type identifiersHook struct {
+	fields logrus.Fields
+}
+
+func (h identifiersHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h identifiersHook) Fire(entry *logrus.Entry) error {
+	for k, v := range h.fields {
+		if _, ok := entry.Data[k]; !ok {
+			entry.Data[k] = v
+		}
+	}
+	return nil
+}
+
+// AddLogIdentifiers makes every subsequent log entry carry the container ID and, if there is one, the pod name
+// as structured fields. It only has an effect with log_format json, so that the text output is unchanged.
+func AddLogIdentifiers(epIDs *WEPIdentifiers) {
+	if !jsonLogging {
+		return
+	}
+	fields := logrus.Fields{"ContainerID": epIDs.ContainerID}
+	if epIDs.Pod != "" {
+		fields["Pod"] = epIDs.Pod
+		fields["Namespace"] = epIDs.Namespace
+	}
+	logrus.AddHook(identifiersHook{fields: fields})
+}
+
+// ParseIPAMExclude parses the ipam_exclude section of the config. Each entry may be a single IP or a CIDR.
+func ParseIPAMExclude(exclude []string) ([]*net.IPNet, error) {
+	return parseIPsAndCIDRs(exclude, "ipam_exclude")
+}
+
+// ParseIPv4Reserved parses the ipv4_reserved section of the IPAM config, which the Kubernetes plugin fills in from
+// a pod's cni.projectcalico.org/ipv4reserved annotation. Each entry may be a single IPv4 address or an IPv4 CIDR.
+func ParseIPv4Reserved(reserved []string) ([]*net.IPNet, error) {
+	nets, err := parseIPsAndCIDRs(reserved, "ipv4_reserved")
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range nets {
+		if n.IP.To4() == nil {
+			return nil, fmt.Errorf("ipv4_reserved entry %s is not IPv4", reserved[i])
+		}
+	}
+	return nets, nil
+}
+
+// parseIPsAndCIDRs parses a list of single IPs and CIDRs from the named section of the config, turning each IP
+// into a network holding only that address.
+func parseIPsAndCIDRs(entries []string, section string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, e := range entries {
+		if _, ipNet, err := net.ParseCIDR(e); err == nil {
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(e)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP or CIDR in %s: %s", section, e)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// IsExcluded returns true if the IP falls within any of the excluded networks.
+func IsExcluded(ip net.IP, exclude []*net.IPNet) bool {
+	for _, e := range exclude {
+		if e.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CoversIPv4Network returns true if every address in the IPv4 network falls within one of the given networks.
+func CoversIPv4Network(nets []*net.IPNet, network net.IPNet) bool {
+	first, last, ok := ipv4Range(network)
+	if !ok {
+		return false
+	}
+
+	// Clip each network to the one being covered, then check that the ranges leave no gap when taken in order.
+	type ipRange struct{ first, last uint32 }
+	var ranges []ipRange
+	for _, n := range nets {
+		f, l, ok := ipv4Range(*n)
+		if !ok || l < first || f > last {
+			continue
+		}
+		if f < first {
+			f = first
+		}
+		if l > last {
+			l = last
+		}
+		ranges = append(ranges, ipRange{f, l})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first < ranges[j].first })
+
+	next := uint64(first)
+	for _, r := range ranges {
+		if uint64(r.first) > next {
+			return false
+		}
+		if uint64(r.last)+1 > next {
+			next = uint64(r.last) + 1
+		}
+	}
+	return next > uint64(last)
+}
+
+// ipv4Range returns the first and last addresses of an IPv4 network.
+func ipv4Range(n net.IPNet) (first, last uint32, ok bool) {
+	ip := n.IP.To4()
+	ones, bits := n.Mask.Size()
+	if ip == nil || bits == 0 {
+		return 0, 0, false
+	}
+	if bits == 8*net.IPv6len {
+		ones -= 8 * (net.IPv6len - net.IPv4len)
+		if ones < 0 {
+			return 0, 0, false
+		}
+	}
+	mask := binary.BigEndian.Uint32(net.CIDRMask(ones, 8*net.IPv4len))
+	first = binary.BigEndian.Uint32(ip) & mask
+	last = first | ^mask
+	return first, last, true
 }
 
 // ResolvePools takes an array of CIDRs or IP Pool names and resolves it to a slice of pool CIDRs.
@@ -788,7 +1645,7 @@ func ResolvePools(ctx context.Context, c client.Interface, pools []string, isv4
 
 			if cidr == nil {
 				// Unable to resolve this pool to a CIDR - return an error.
-				return nil, fmt.Errorf("error parsing pool %q: %s", p, err)
+				return nil, fmt.Errorf("IP pool %q does not exist: it's neither a CIDR nor the name of an IP pool", p)
 			}
 		}
 
@@ -801,5 +1658,18 @@ func ResolvePools(ctx context.Context, c client.Interface, pools []string, isv4
 		}
 		result = append(result, cnet.IPNet{IPNet: *cidr})
 	}
+
+	// Overlapping pools make it ambiguous where an IP should come from, so reject them.
+	var overlaps []string
+	for i := range result {
+		for j := i + 1; j < len(result); j++ {
+			if result[i].Contains(result[j].IP) || result[j].Contains(result[i].IP) {
+				overlaps = append(overlaps, fmt.Sprintf("%q (%s) and %q (%s)", pools[i], result[i].String(), pools[j], result[j].String()))
+			}
+		}
+	}
+	if len(overlaps) > 0 {
+		return nil, fmt.Errorf("pools must not overlap or be repeated: %s", strings.Join(overlaps, ", "))
+	}
 	return result, nil
 }
@@ -1,16 +1,101 @@
 package utils_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
 	. "github.com/onsi/ginkgo"
 	"github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 
 	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/options"
 )
 
+// conflictingWEPs is a WorkloadEndpoint store whose Updates conflict a given number of times.
+type conflictingWEPs struct {
+	clientv3.WorkloadEndpointInterface
+
+	conflicts int
+	updates   []string
+	gets      int
+
+	// latest, if set, is what Get returns, apart from its ResourceVersion.
+	latest *api.WorkloadEndpoint
+}
+
+func (f *conflictingWEPs) Update(_ context.Context, wep *api.WorkloadEndpoint, _ options.SetOptions) (*api.WorkloadEndpoint, error) {
+	f.updates = append(f.updates, wep.ResourceVersion)
+	if f.conflicts > 0 {
+		f.conflicts--
+		return nil, cerrors.ErrorResourceUpdateConflict{Identifier: wep.Name}
+	}
+	return wep, nil
+}
+
+func (f *conflictingWEPs) Get(_ context.Context, _, name string, _ options.GetOptions) (*api.WorkloadEndpoint, error) {
+	f.gets++
+	wep := api.NewWorkloadEndpoint()
+	if f.latest != nil {
+		wep = f.latest.DeepCopy()
+	}
+	wep.Name = name
+	wep.ResourceVersion = fmt.Sprintf("latest-%d", f.gets)
+	return wep, nil
+}
+
+// fakeIPPools is an IPPool store that only supports List.
+type fakeIPPools struct {
+	clientv3.IPPoolInterface
+
+	pools []api.IPPool
+}
+
+func (f *fakeIPPools) List(_ context.Context, _ options.ListOptions) (*api.IPPoolList, error) {
+	return &api.IPPoolList{Items: f.pools}, nil
+}
+
+type fakePoolClient struct {
+	clientv3.Interface
+	pools *fakeIPPools
+}
+
+func (c fakePoolClient) IPPools() clientv3.IPPoolInterface {
+	return c.pools
+}
+
+type fakeWEPClient struct {
+	clientv3.Interface
+	weps *conflictingWEPs
+}
+
+func (c fakeWEPClient) WorkloadEndpoints() clientv3.WorkloadEndpointInterface {
+	return c.weps
+}
+
 var _ = Describe("utils", func() {
 	table.DescribeTable("Mesos Labels", func(raw, sanitized string) {
-		result := utils.SanitizeMesosLabel(raw)
+		result, err := utils.SanitizeMesosLabel(raw)
+		Expect(err).NotTo(HaveOccurred())
 		Expect(result).To(Equal(sanitized))
 	},
 		table.Entry("valid", "k", "k"),
@@ -18,7 +103,938 @@ var _ = Describe("utils", func() {
 		table.Entry("double periods", "$my..val", "my.val"),
 		table.Entry("special chars", "m$y.val", "m-y.val"),
 		table.Entry("slashes", "//my/val/", "my.val"),
+		table.Entry("a path", "app/frontend", "app.frontend"),
 		table.Entry("mix of special chars",
 			"some_val-with.lots*of^weird#characters", "some_val-with.lots-of-weird-characters"),
+		table.Entry("empty", "", ""),
+	)
+
+	table.DescribeTable("Mesos Labels with nothing valid", func(raw string) {
+		_, err := utils.SanitizeMesosLabel(raw)
+		Expect(err).To(MatchError(fmt.Sprintf("mesos label %q has no characters that are valid in a Calico label", raw)))
+	},
+		table.Entry("slashes", "///"),
+		table.Entry("dots", "..."),
+		table.Entry("dashes", "--"),
+		table.Entry("dots and dashes", ".-.-"),
+		table.Entry("special chars", "$%^"),
+	)
+
+	table.DescribeTable("DetermineHostVethName", func(orchestrator, namespace, pod, containerID, expected string) {
+		epIDs := &utils.WEPIdentifiers{Namespace: namespace}
+		epIDs.Orchestrator = orchestrator
+		epIDs.Pod = pod
+		epIDs.ContainerID = containerID
+		Expect(utils.DetermineHostVethName(epIDs)).To(Equal(expected))
+	},
+		table.Entry("a Kubernetes pod", "k8s", "default", "pod1", "abc123", "calice0906292e2"),
+		table.Entry("a Kubernetes pod in a new sandbox", "k8s", "default", "pod1", "def456", "calice0906292e2"),
+		table.Entry("a short container ID", "cni", "default", "", "abc123", "caliabc123"),
+		table.Entry("a long container ID", "cni", "default", "", "0123456789abcdef", "cali0123456789a"),
+	)
+
+	Context("with veth_name_style", func() {
+		epIDs := func(orchestrator, containerID string) *utils.WEPIdentifiers {
+			ids := &utils.WEPIdentifiers{Namespace: "default"}
+			ids.Orchestrator = orchestrator
+			ids.Pod = "pod1"
+			ids.ContainerID = containerID
+			return ids
+		}
+		hash := types.NetConf{VethNameStyle: utils.VethNameStyleHash}
+
+		It("gives container IDs that share a prefix the same name by default", func() {
+			Expect(utils.HostVethName(types.NetConf{}, epIDs("cni", "0123456789a-one"))).To(Equal("cali0123456789a"))
+			Expect(utils.HostVethName(types.NetConf{VethNameStyle: utils.VethNameStylePrefix}, epIDs("cni", "0123456789a-two"))).
+				To(Equal("cali0123456789a"))
+		})
+
+		It("gives them different names with the hash style", func() {
+			one := utils.HostVethName(hash, epIDs("cni", "0123456789a-one"))
+			two := utils.HostVethName(hash, epIDs("cni", "0123456789a-two"))
+			Expect(one).To(HaveLen(15))
+			Expect(one).To(HavePrefix("cali"))
+			Expect(two).To(HaveLen(15))
+			Expect(one).NotTo(Equal(two))
+			Expect(utils.HostVethName(hash, epIDs("cni", "abc"))).To(HaveLen(15))
+		})
+
+		It("doesn't change the names of Kubernetes pods", func() {
+			Expect(utils.HostVethName(hash, epIDs("k8s", "abc123"))).To(Equal("calice0906292e2"))
+		})
+
+		table.DescribeTable("ValidateVethNameStyle", func(style string, valid bool) {
+			err := utils.ValidateVethNameStyle(style)
+			if valid {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(ContainSubstring("invalid veth_name_style")))
+			}
+		},
+			table.Entry("unset", "", true),
+			table.Entry("prefix", "prefix", true),
+			table.Entry("hash", "hash", true),
+			table.Entry("unknown", "sha1", false),
+		)
+	})
+
+	Describe("ValidateDataplaneOptions", func() {
+		negative := -1
+		table.DescribeTable("checks the route and veth settings", func(conf types.NetConf, expectedErr string) {
+			err := utils.ValidateDataplaneOptions(conf)
+			if expectedErr == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+			}
+		},
+			table.Entry("defaults", types.NetConf{}, ""),
+			table.Entry("negative default_route_metric", types.NetConf{DefaultRouteMetric: &negative}, "invalid default_route_metric"),
+			table.Entry("negative veth_create_retries", types.NetConf{VethCreateRetries: -1}, "invalid veth_create_retries"),
+			table.Entry("negative host_route_table", types.NetConf{HostRouteTable: -1}, "invalid host_route_table"),
+			table.Entry("host_route_protocol too large", types.NetConf{HostRouteProtocol: 256}, "invalid host_route_protocol"),
+			table.Entry("link-local ipv6_gateway", types.NetConf{IPv6Gateway: "fe80::1"}, ""),
+			table.Entry("global ipv6_gateway", types.NetConf{IPv6Gateway: "fd00::1"}, "invalid ipv6_gateway"),
+		)
+	})
+
+	Context("with force_interface_name", func() {
+		var savedIfName string
+		var hadIfName bool
+
+		BeforeEach(func() {
+			savedIfName, hadIfName = os.LookupEnv("CNI_IFNAME")
+		})
+
+		AfterEach(func() {
+			if hadIfName {
+				os.Setenv("CNI_IFNAME", savedIfName)
+			} else {
+				os.Unsetenv("CNI_IFNAME")
+			}
+		})
+
+		It("uses the forced name in place of the runtime's", func() {
+			args := &skel.CmdArgs{IfName: "eth0"}
+			Expect(utils.ApplyForceInterfaceName(types.NetConf{ForceInterfaceName: "net0"}, args)).To(Succeed())
+			Expect(args.IfName).To(Equal("net0"))
+			Expect(os.Getenv("CNI_IFNAME")).To(Equal("net0"))
+		})
+
+		It("leaves the runtime's name alone if it's not set", func() {
+			args := &skel.CmdArgs{IfName: "eth0"}
+			Expect(utils.ApplyForceInterfaceName(types.NetConf{}, args)).To(Succeed())
+			Expect(args.IfName).To(Equal("eth0"))
+		})
+
+		table.DescribeTable("rejects invalid names", func(name string) {
+			args := &skel.CmdArgs{IfName: "eth0"}
+			err := utils.ApplyForceInterfaceName(types.NetConf{ForceInterfaceName: name}, args)
+			Expect(err).To(MatchError(ContainSubstring("invalid force_interface_name")))
+			Expect(args.IfName).To(Equal("eth0"))
+		},
+			table.Entry("longer than 15 characters", "net0123456789abc"),
+			table.Entry("with a slash", "net/0"),
+			table.Entry("with a space", "net 0"),
+			table.Entry("dot", "."),
+		)
+	})
+
+	Context("with allow_multiple_endpoints", func() {
+		multi := types.NetConf{AllowMultipleEndpoints: true}
+		epIDs := func(ifName string) *utils.WEPIdentifiers {
+			ids := &utils.WEPIdentifiers{Namespace: "default"}
+			ids.Node = "node1"
+			ids.Orchestrator = "k8s"
+			ids.Pod = "pod1"
+			ids.ContainerID = "abc123"
+			ids.Endpoint = ifName
+			return ids
+		}
+
+		table.DescribeTable("IsSecondaryEndpoint", func(conf types.NetConf, ifName string, expected bool) {
+			Expect(utils.IsSecondaryEndpoint(conf, ifName)).To(Equal(expected))
+		},
+			table.Entry("eth0", multi, "eth0", false),
+			table.Entry("eth1", multi, "eth1", true),
+			table.Entry("no interface name", multi, "", false),
+			table.Entry("eth1 without the flag", types.NetConf{}, "eth1", false),
+		)
+
+		It("gives a secondary endpoint a host veth of its own", func() {
+			Expect(utils.HostVethName(multi, epIDs("eth0"))).To(Equal("calice0906292e2"))
+			Expect(utils.HostVethName(types.NetConf{}, epIDs("eth1"))).To(Equal("calice0906292e2"))
+
+			eth1 := utils.HostVethName(multi, epIDs("eth1"))
+			Expect(eth1).To(HaveLen(15))
+			Expect(eth1).To(HavePrefix("cali"))
+			Expect(eth1).NotTo(Equal("calice0906292e2"))
+			Expect(utils.HostVethName(multi, epIDs("eth2"))).NotTo(Equal(eth1))
+
+			ids := epIDs("eth1")
+			var err error
+			ids.WEPName, err = ids.CalculateWorkloadEndpointName(false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(utils.HostVethName(multi, ids)).To(Equal(eth1))
+		})
+
+		It("gives a secondary endpoint an IPAM handle of its own", func() {
+			Expect(utils.GetEndpointHandleID(multi, "net1", "abc123", "eth0", "")).To(Equal("net1.abc123"))
+			Expect(utils.GetEndpointHandleID(multi, "net1", "abc123", "eth1", "")).To(Equal("net1.abc123.eth1"))
+			Expect(utils.GetEndpointHandleID(types.NetConf{}, "net1", "abc123", "eth1", "")).To(Equal("net1.abc123"))
+		})
+	})
+
+	table.DescribeTable("GetEndpointHandleID", func(conf types.NetConf, ifName, expected string) {
+		Expect(utils.GetEndpointHandleID(conf, "net1", "abc123", ifName, "")).To(Equal(expected))
+	},
+		table.Entry("no prefix", types.NetConf{}, "eth0", "net1.abc123"),
+		table.Entry("a prefix", types.NetConf{IPAMHandlePrefix: "tenant-a"}, "eth0", "tenant-a.net1.abc123"),
+		table.Entry("a prefix on a secondary endpoint",
+			types.NetConf{IPAMHandlePrefix: "tenant-a", AllowMultipleEndpoints: true}, "eth1", "tenant-a.net1.abc123.eth1"),
+	)
+
+	It("rejects an ipam_handle_prefix with characters that handles can't have", func() {
+		_, err := utils.CreateClient(types.NetConf{Name: "net1", IPAMHandlePrefix: "tenant/a"})
+		Expect(err).To(MatchError(ContainSubstring("invalid ipam_handle_prefix")))
+	})
+
+	Describe("ParseIPAMExclude", func() {
+		It("accepts IPs and CIDRs of both families", func() {
+			exclude, err := utils.ParseIPAMExclude([]string{"10.0.0.1", "10.1.0.0/16", "fd00::1", "fd80::/64"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exclude).To(HaveLen(4))
+
+			Expect(utils.IsExcluded(net.ParseIP("10.0.0.1"), exclude)).To(BeTrue())
+			Expect(utils.IsExcluded(net.ParseIP("10.0.0.2"), exclude)).To(BeFalse())
+			Expect(utils.IsExcluded(net.ParseIP("10.1.200.3"), exclude)).To(BeTrue())
+			Expect(utils.IsExcluded(net.ParseIP("fd00::1"), exclude)).To(BeTrue())
+			Expect(utils.IsExcluded(net.ParseIP("fd00::2"), exclude)).To(BeFalse())
+			Expect(utils.IsExcluded(net.ParseIP("fd80::abcd"), exclude)).To(BeTrue())
+		})
+
+		It("rejects invalid entries", func() {
+			_, err := utils.ParseIPAMExclude([]string{"10.0.0.256"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ParseIPv4Reserved", func() {
+		It("accepts IPv4 addresses and CIDRs", func() {
+			reserved, err := utils.ParseIPv4Reserved([]string{"10.0.0.1", "10.0.1.0/28"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(utils.IsExcluded(net.ParseIP("10.0.0.1"), reserved)).To(BeTrue())
+			Expect(utils.IsExcluded(net.ParseIP("10.0.1.15"), reserved)).To(BeTrue())
+			Expect(utils.IsExcluded(net.ParseIP("10.0.1.16"), reserved)).To(BeFalse())
+		})
+
+		It("rejects IPv6 entries", func() {
+			_, err := utils.ParseIPv4Reserved([]string{"10.0.0.1", "fd00::/64"})
+			Expect(err).To(MatchError("ipv4_reserved entry fd00::/64 is not IPv4"))
+		})
+
+		It("rejects invalid entries", func() {
+			_, err := utils.ParseIPv4Reserved([]string{"gateway"})
+			Expect(err).To(MatchError("invalid IP or CIDR in ipv4_reserved: gateway"))
+		})
+	})
+
+	table.DescribeTable("CoversIPv4Network", func(reserved []string, network string, expected bool) {
+		nets, err := utils.ParseIPv4Reserved(reserved)
+		Expect(err).NotTo(HaveOccurred())
+		_, n, err := net.ParseCIDR(network)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(utils.CoversIPv4Network(nets, *n)).To(Equal(expected))
+	},
+		table.Entry("nothing reserved", nil, "10.0.0.0/30", false),
+		table.Entry("the same CIDR", []string{"10.0.0.0/30"}, "10.0.0.0/30", true),
+		table.Entry("a containing CIDR", []string{"10.0.0.0/8"}, "10.0.0.0/30", true),
+		table.Entry("part of it", []string{"10.0.0.0/31"}, "10.0.0.0/30", false),
+		table.Entry("every address", []string{"10.0.0.3", "10.0.0.0", "10.0.0.2", "10.0.0.1"}, "10.0.0.0/30", true),
+		table.Entry("all but one address", []string{"10.0.0.0", "10.0.0.1", "10.0.0.3"}, "10.0.0.0/30", false),
+		table.Entry("overlapping CIDRs", []string{"10.0.0.0/25", "10.0.0.64/26", "10.0.0.128/25"}, "10.0.0.0/24", true),
+		table.Entry("CIDRs spilling over either end", []string{"9.255.255.0/24", "10.0.0.0/31", "10.0.0.2/31", "10.0.0.0/8"}, "10.0.0.0/30", true),
+		table.Entry("a different network", []string{"10.0.1.0/24"}, "10.0.0.0/24", false),
+		table.Entry("the whole address space", []string{"0.0.0.0/0"}, "255.255.255.0/24", true),
+	)
+
+	table.DescribeTable("ResolveMTU", func(configured int, inFile string, expected int, valid bool) {
+		mtuFile := filepath.Join(os.TempDir(), "calico-cni-no-such-mtu-file")
+		if inFile != "" {
+			f, err := ioutil.TempFile("", "calico-cni-mtu-")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(f.Name())
+			_, err = f.WriteString(inFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+			mtuFile = f.Name()
+		}
+
+		mtu, err := utils.ResolveMTU(types.NetConf{MTU: configured}, mtuFile)
+		if !valid {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mtu).To(Equal(expected))
+	},
+		table.Entry("defaults to 1500", 0, "", 1500, true),
+		table.Entry("uses the configured value", 1410, "", 1410, true),
+		table.Entry("uses the file if not configured", 0, "1480\n", 1480, true),
+		table.Entry("prefers the configured value to the file", 1410, "1480", 1410, true),
+		table.Entry("accepts the minimum", 68, "", 68, true),
+		table.Entry("accepts the maximum", 65535, "", 65535, true),
+		table.Entry("rejects too small a value", 67, "", 0, false),
+		table.Entry("rejects too large a value", 65536, "", 0, false),
+		table.Entry("rejects a negative value", -1, "", 0, false),
+		table.Entry("rejects an invalid value from the file", 0, "10", 0, false),
+	)
+
+	table.DescribeTable("ResolveContainerMTU", func(configured, hostMTU, expected int, valid, warns bool) {
+		logger, hook := test.NewNullLogger()
+		conf := types.NetConf{}
+		conf.ContainerSettings.MTU = configured
+		mtu, err := utils.ResolveContainerMTU(conf, hostMTU, logrus.NewEntry(logger))
+		if !valid {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mtu).To(Equal(expected))
+		if warns {
+			Expect(hook.LastEntry()).NotTo(BeNil())
+			Expect(hook.LastEntry().Level).To(Equal(logrus.WarnLevel))
+		} else {
+			Expect(hook.AllEntries()).To(BeEmpty())
+		}
+	},
+		table.Entry("defaults to the host MTU", 0, 1450, 1450, true, false),
+		table.Entry("uses a smaller value", 1400, 1450, 1400, true, false),
+		table.Entry("warns about a larger value", 9000, 1450, 9000, true, true),
+		table.Entry("rejects too small a value", 67, 1450, 0, false, false),
+		table.Entry("rejects too large a value", 65536, 1450, 0, false, false),
+	)
+
+	Describe("ParseContainerRoutes", func() {
+		It("parses routes with and without a gateway", func() {
+			routes, err := utils.ParseContainerRoutes([]types.ContainerRoute{
+				{Dst: "192.168.0.0/16"},
+				{Dst: "10.1.2.3/24", GW: "10.1.2.1"},
+				{Dst: "fd00:1::/64", GW: "fe80::1"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(3))
+			Expect(routes[0].Dst.String()).To(Equal("192.168.0.0/16"))
+			Expect(routes[0].GW).To(BeNil())
+			Expect(routes[1].Dst.String()).To(Equal("10.1.2.0/24"))
+			Expect(routes[1].GW.String()).To(Equal("10.1.2.1"))
+			Expect(routes[2].GW.String()).To(Equal("fe80::1"))
+		})
+
+		table.DescribeTable("rejects invalid routes", func(routes []types.ContainerRoute, expected string) {
+			_, err := utils.ParseContainerRoutes(routes)
+			Expect(err).To(MatchError(ContainSubstring(expected)))
+		},
+			table.Entry("not a CIDR", []types.ContainerRoute{{Dst: "10.0.0.1"}}, `invalid container_settings route destination "10.0.0.1"`),
+			table.Entry("a bad gateway", []types.ContainerRoute{{Dst: "10.0.0.0/8", GW: "gateway"}}, `invalid gateway "gateway"`),
+			table.Entry("a gateway of the wrong family", []types.ContainerRoute{{Dst: "10.0.0.0/8", GW: "fe80::1"}}, "wrong IP family"),
+			table.Entry("a repeated destination", []types.ContainerRoute{{Dst: "10.0.0.0/8"}, {Dst: "10.1.0.0/8", GW: "10.0.0.1"}},
+				"10.0.0.0/8 is listed more than once"),
+		)
+	})
+
+	table.DescribeTable("ParseHwAddr", func(value string, valid bool) {
+		mac, err := utils.ParseHwAddr(value)
+		if !valid {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(Equal(strings.ToLower(value)))
+	},
+		table.Entry("locally administered", "02:42:ac:11:00:02", true),
+		table.Entry("upper case", "EE:EE:EE:EE:EE:EE", true),
+		table.Entry("malformed", "02:42:ac:11:00", false),
+		table.Entry("not hex", "zz:42:ac:11:00:02", false),
+		table.Entry("multicast", "01:00:5e:00:00:01", false),
+		table.Entry("broadcast", "ff:ff:ff:ff:ff:ff", false),
+		table.Entry("EUI-64", "02:42:ac:11:00:02:00:01", false),
+	)
+
+	Describe("ReplaceHostLocalIPAMPodCIDRs", func() {
+		logger := logrus.WithField("test", "use-pod-cidr")
+		podCIDR := func() (string, error) { return "10.10.1.0/24", nil }
+
+		replace := func(config string) (map[string]interface{}, error) {
+			var stdinData map[string]interface{}
+			Expect(json.Unmarshal([]byte(config), &stdinData)).To(Succeed())
+			err := utils.ReplaceHostLocalIPAMPodCIDRs(logger, stdinData, podCIDR)
+			return stdinData["ipam"].(map[string]interface{}), err
+		}
+
+		It("replaces usePodCidr in the top-level subnet", func() {
+			ipam, err := replace(`{"ipam": {"type": "host-local", "subnet": "usePodCidr"}}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipam["subnet"]).To(Equal("10.10.1.0/24"))
+		})
+
+		It("replaces usePodCidr in only the range entries that use it", func() {
+			ipam, err := replace(`{"ipam": {"type": "host-local", "ranges": [
+				[{"subnet": "usePodCidr", "gateway": "10.10.1.1"}, {"subnet": "192.168.0.0/24"}],
+				[{"subnet": "dead:beef::/96"}]
+			]}}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipam).NotTo(HaveKey("subnet"))
+			Expect(ipam["ranges"]).To(Equal([]interface{}{
+				[]interface{}{
+					map[string]interface{}{"subnet": "10.10.1.0/24", "gateway": "10.10.1.1"},
+					map[string]interface{}{"subnet": "192.168.0.0/24"},
+				},
+				[]interface{}{
+					map[string]interface{}{"subnet": "dead:beef::/96"},
+				},
+			}))
+		})
+
+		It("rejects a range set that isn't a list", func() {
+			_, err := replace(`{"ipam": {"type": "host-local", "ranges": [{"subnet": "usePodCidr"}]}}`)
+			Expect(err).To(MatchError(ContainSubstring("map[subnet:usePodCidr]")))
+		})
+	})
+
+	table.DescribeTable("KeepIPs", func(cniArgs string, keep bool, valid bool) {
+		result, err := utils.KeepIPs(&skel.CmdArgs{Args: cniArgs})
+		if !valid {
+			Expect(err).To(MatchError(ContainSubstring("CALICO_KEEP_IP")))
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(keep))
+	},
+		table.Entry("no args", "", false, true),
+		table.Entry("other args only", "K8S_POD_NAME=pod1;K8S_POD_NAMESPACE=default", false, true),
+		table.Entry("set to 1", "K8S_POD_NAME=pod1;CALICO_KEEP_IP=1", true, true),
+		table.Entry("set to true", "CALICO_KEEP_IP=true", true, true),
+		table.Entry("set to 0", "CALICO_KEEP_IP=0", false, true),
+		table.Entry("invalid", "CALICO_KEEP_IP=maybe", false, false),
 	)
+
+	Describe("AddIgnoreUnknownArgs", func() {
+		var original string
+		var wasSet bool
+
+		BeforeEach(func() {
+			original, wasSet = os.LookupEnv("CNI_ARGS")
+		})
+
+		AfterEach(func() {
+			if wasSet {
+				os.Setenv("CNI_ARGS", original)
+			} else {
+				os.Unsetenv("CNI_ARGS")
+			}
+		})
+
+		It("adds IgnoreUnknown=1 and puts CNI_ARGS back afterwards", func() {
+			os.Setenv("CNI_ARGS", "K8S_POD_NAME=pod1;K8S_POD_NAMESPACE=default")
+			restore, err := utils.AddIgnoreUnknownArgs()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Getenv("CNI_ARGS")).To(Equal("IgnoreUnknown=1;K8S_POD_NAME=pod1;K8S_POD_NAMESPACE=default"))
+
+			restore()
+			Expect(os.Getenv("CNI_ARGS")).To(Equal("K8S_POD_NAME=pod1;K8S_POD_NAMESPACE=default"))
+		})
+
+		It("unsets CNI_ARGS again if it wasn't set", func() {
+			os.Unsetenv("CNI_ARGS")
+			restore, err := utils.AddIgnoreUnknownArgs()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Getenv("CNI_ARGS")).To(Equal("IgnoreUnknown=1"))
+
+			restore()
+			_, set := os.LookupEnv("CNI_ARGS")
+			Expect(set).To(BeFalse())
+		})
+	})
+
+	Describe("ReleaseIPAllocation", func() {
+		var original string
+		var wasSet bool
+
+		BeforeEach(func() {
+			original, wasSet = os.LookupEnv("CNI_COMMAND")
+		})
+
+		AfterEach(func() {
+			if wasSet {
+				os.Setenv("CNI_COMMAND", original)
+			} else {
+				os.Unsetenv("CNI_COMMAND")
+			}
+		})
+
+		It("puts CNI_COMMAND back afterwards", func() {
+			os.Setenv("CNI_COMMAND", "ADD")
+			conf := types.NetConf{}
+			conf.IPAM.Type = "no-such-ipam"
+			args := &skel.CmdArgs{ContainerID: "abc123", StdinData: []byte(`{"ipam": {"type": "no-such-ipam"}}`)}
+			utils.ReleaseIPAllocation(logrus.WithField("test", "release"), conf, args)
+			Expect(os.Getenv("CNI_COMMAND")).To(Equal("ADD"))
+		})
+	})
+
+	Describe("CreateOrUpdate", func() {
+		var weps *conflictingWEPs
+		var wep *api.WorkloadEndpoint
+
+		BeforeEach(func() {
+			weps = &conflictingWEPs{}
+			wep = api.NewWorkloadEndpoint()
+			wep.Name = "node1-k8s-pod1-eth0"
+			wep.Namespace = "default"
+			wep.ResourceVersion = "1"
+			wep.Spec.IPNetworks = []string{"10.0.0.1/32"}
+		})
+
+		It("retries an update that conflicts on the first attempt against the latest revision", func() {
+			weps.conflicts = 1
+			updated, err := utils.CreateOrUpdate(context.Background(), fakeWEPClient{weps: weps}, wep)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(weps.updates).To(Equal([]string{"1", "latest-1"}))
+			Expect(updated.Spec.IPNetworks).To(Equal([]string{"10.0.0.1/32"}))
+		})
+
+		It("gives up after three attempts", func() {
+			weps.conflicts = 10
+			_, err := utils.CreateOrUpdate(context.Background(), fakeWEPClient{weps: weps}, wep)
+			Expect(err).To(BeAssignableToTypeOf(cerrors.ErrorResourceUpdateConflict{}))
+			Expect(weps.updates).To(HaveLen(3))
+		})
+
+		It("keeps other components' changes when it retries", func() {
+			weps.conflicts = 1
+			weps.latest = api.NewWorkloadEndpoint()
+			weps.latest.Annotations = map[string]string{
+				"felix.example.com/state":     "ready",
+				utils.NetworkAnnotation:       "old-network",
+				"cni.projectcalico.org/stale": "gone",
+			}
+			weps.latest.Spec.IPNetworks = []string{"10.0.0.9/32"}
+			weps.latest.Spec.IPv4Gateway = "10.0.0.254"
+			wep.Annotations = map[string]string{utils.NetworkAnnotation: "net1"}
+			wep.Labels = map[string]string{"app": "web"}
+			wep.Spec.Profiles = []string{"net1"}
+			wep.Spec.ContainerID = "container1"
+
+			updated, err := utils.CreateOrUpdate(context.Background(), fakeWEPClient{weps: weps}, wep)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(weps.updates).To(Equal([]string{"1", "latest-1"}))
+			Expect(updated.Annotations).To(Equal(map[string]string{
+				"felix.example.com/state": "ready",
+				utils.NetworkAnnotation:   "net1",
+			}))
+			Expect(updated.Labels).To(Equal(map[string]string{"app": "web"}))
+			Expect(updated.Spec.IPNetworks).To(Equal([]string{"10.0.0.1/32"}))
+			Expect(updated.Spec.Profiles).To(Equal([]string{"net1"}))
+			Expect(updated.Spec.ContainerID).To(Equal("container1"))
+			Expect(updated.Spec.IPv4Gateway).To(Equal("10.0.0.254"))
+		})
+
+		It("doesn't retry an update that succeeds", func() {
+			_, err := utils.CreateOrUpdate(context.Background(), fakeWEPClient{weps: weps}, wep)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(weps.updates).To(HaveLen(1))
+			Expect(weps.gets).To(Equal(0))
+		})
+	})
+
+	Describe("log_format", func() {
+		var savedFormatter logrus.Formatter
+		var savedHooks logrus.LevelHooks
+		var buf *bytes.Buffer
+		epIDs := &utils.WEPIdentifiers{Namespace: "ns1"}
+		epIDs.ContainerID = "abc123"
+		epIDs.Pod = "pod1"
+
+		BeforeEach(func() {
+			savedFormatter = logrus.StandardLogger().Formatter
+			savedHooks = logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+			buf = &bytes.Buffer{}
+		})
+
+		AfterEach(func() {
+			utils.ConfigureLogging(types.NetConf{})
+			logrus.SetFormatter(savedFormatter)
+			logrus.StandardLogger().ReplaceHooks(savedHooks)
+			logrus.SetOutput(os.Stderr)
+		})
+
+		It("writes JSON entries carrying the workload's identifiers", func() {
+			utils.ConfigureLogging(types.NetConf{LogFormat: "json"})
+			logrus.SetOutput(buf)
+			utils.AddLogIdentifiers(epIDs)
+			logrus.WithField("ContainerID", "explicit").Info("first")
+			logrus.Info("second")
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			Expect(lines).To(HaveLen(2))
+			var first, second map[string]interface{}
+			Expect(json.Unmarshal([]byte(lines[0]), &first)).To(Succeed())
+			Expect(json.Unmarshal([]byte(lines[1]), &second)).To(Succeed())
+			Expect(first).To(HaveKeyWithValue("ContainerID", "explicit"))
+			Expect(second).To(HaveKeyWithValue("msg", "second"))
+			Expect(second).To(HaveKeyWithValue("ContainerID", "abc123"))
+			Expect(second).To(HaveKeyWithValue("Pod", "pod1"))
+			Expect(second).To(HaveKeyWithValue("Namespace", "ns1"))
+		})
+
+		It("leaves the text format unchanged by default", func() {
+			utils.ConfigureLogging(types.NetConf{})
+			utils.AddLogIdentifiers(epIDs)
+			Expect(logrus.StandardLogger().Formatter).To(Equal(savedFormatter))
+			Expect(logrus.StandardLogger().Hooks).To(BeEmpty())
+		})
+	})
+
+	Describe("log_file_path", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "calico-cni-log-")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			utils.ConfigureLogging(types.NetConf{})
+			logrus.SetOutput(os.Stderr)
+			os.RemoveAll(dir)
+		})
+
+		It("writes to the log file, creating its directory", func() {
+			path := filepath.Join(dir, "cni", "cni.log")
+			utils.ConfigureLogging(types.NetConf{LogFilePath: path, LogFileMaxSize: 1, LogFileMaxCount: 2})
+			logrus.Info("written to the log file")
+
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("written to the log file"))
+		})
+
+		It("carries on logging if the log file can't be opened", func() {
+			// A file where the log directory should be makes the log file impossible to create.
+			blocker := filepath.Join(dir, "blocker")
+			Expect(ioutil.WriteFile(blocker, nil, 0600)).To(Succeed())
+			utils.ConfigureLogging(types.NetConf{LogFilePath: filepath.Join(blocker, "cni.log")})
+			Expect(func() { logrus.Info("still logging") }).NotTo(Panic())
+		})
+	})
+
+	Describe("DetermineNodename", func() {
+		var nodenameFile string
+
+		BeforeEach(func() {
+			f, err := ioutil.TempFile("", "calico-cni-nodename-")
+			Expect(err).NotTo(HaveOccurred())
+			// calico/node writes the node name that it was given, which may be a mixed-case hostname.
+			_, err = f.WriteString("Worker-1.Example.COM")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+			nodenameFile = f.Name()
+		})
+
+		AfterEach(func() {
+			os.Remove(nodenameFile)
+		})
+
+		It("uses a mixed-case hostname as it is by default", func() {
+			Expect(utils.DetermineNodename(types.NetConf{NodenameFile: nodenameFile})).To(Equal("Worker-1.Example.COM"))
+			Expect(utils.DetermineNodename(types.NetConf{Nodename: "Worker-2"})).To(Equal("Worker-2"))
+		})
+
+		It("lowercases a mixed-case hostname with nodename_case_insensitive", func() {
+			conf := types.NetConf{NodenameFile: nodenameFile, NodenameCaseInsensitive: true}
+			Expect(utils.DetermineNodename(conf)).To(Equal("worker-1.example.com"))
+			conf = types.NetConf{Nodename: "Worker-2", NodenameCaseInsensitive: true}
+			Expect(utils.DetermineNodename(conf)).To(Equal("worker-2"))
+		})
+	})
+
+	Describe("ResolvePools", func() {
+		pool := api.NewIPPool()
+		pool.Name = "pool1"
+		pool.Spec.CIDR = "10.0.0.0/16"
+		c := fakePoolClient{pools: &fakeIPPools{pools: []api.IPPool{*pool}}}
+
+		table.DescribeTable("overlap detection",
+			func(pools []string, isv4 bool, expected []string, errSubstr string) {
+				result, err := utils.ResolvePools(context.Background(), c, pools, isv4)
+				if errSubstr != "" {
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring(errSubstr))
+					return
+				}
+				Expect(err).NotTo(HaveOccurred())
+				var got []string
+				for _, r := range result {
+					got = append(got, r.String())
+				}
+				Expect(got).To(Equal(expected))
+			},
+			table.Entry("disjoint IPv4 pools", []string{"10.0.0.0/24", "10.0.1.0/24"}, true, []string{"10.0.0.0/24", "10.0.1.0/24"}, ""),
+			table.Entry("disjoint IPv6 pools", []string{"fd00::/64", "fd00:1::/64"}, false, []string{"fd00::/64", "fd00:1::/64"}, ""),
+			table.Entry("pool name and disjoint CIDR", []string{"pool1", "10.1.0.0/24"}, true, []string{"10.0.0.0/16", "10.1.0.0/24"}, ""),
+			table.Entry("exact duplicates", []string{"10.0.0.0/24", "10.0.0.0/24"}, true, nil,
+				`"10.0.0.0/24" (10.0.0.0/24) and "10.0.0.0/24" (10.0.0.0/24)`),
+			table.Entry("subset", []string{"10.0.0.0/16", "10.0.1.0/24"}, true, nil,
+				`"10.0.0.0/16" (10.0.0.0/16) and "10.0.1.0/24" (10.0.1.0/24)`),
+			table.Entry("superset listed second", []string{"10.0.1.0/24", "10.0.0.0/16"}, true, nil,
+				`"10.0.1.0/24" (10.0.1.0/24) and "10.0.0.0/16" (10.0.0.0/16)`),
+			table.Entry("pool name overlapping a CIDR", []string{"pool1", "10.0.5.0/24"}, true, nil,
+				`"pool1" (10.0.0.0/16) and "10.0.5.0/24" (10.0.5.0/24)`),
+			table.Entry("IPv6 subset", []string{"fd00::/48", "fd00::/64"}, false, nil, `"fd00::/48" (fd00::/48) and "fd00::/64" (fd00::/64)`),
+			table.Entry("pool name", []string{"pool1"}, true, []string{"10.0.0.0/16"}, ""),
+			table.Entry("unknown pool name", []string{"pool-a"}, true, nil, `IP pool "pool-a" does not exist`),
+			table.Entry("pool name of the wrong family", []string{"pool1"}, false, nil, "isn't a IPv6 address"),
+		)
+
+		It("names every overlapping pair", func() {
+			_, err := utils.ResolvePools(context.Background(), c, []string{"10.0.0.0/16", "10.0.1.0/24", "10.0.2.0/24"}, true)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`"10.0.0.0/16" (10.0.0.0/16) and "10.0.1.0/24" (10.0.1.0/24)`))
+			Expect(err.Error()).To(ContainSubstring(`"10.0.0.0/16" (10.0.0.0/16) and "10.0.2.0/24" (10.0.2.0/24)`))
+		})
+	})
+
+	Describe("ValidateNetworkName", func() {
+		table.DescribeTable("network names",
+			func(name string, expected error) {
+				err := utils.ValidateNetworkName(name)
+				if expected == nil {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(Equal(expected))
+				}
+			},
+			table.Entry("valid name", "k8s-pod-network_1.0", nil),
+			table.Entry("empty name", "", utils.ErrEmptyNetworkName),
+			table.Entry("name with a space", "pod network", utils.ErrInvalidNetworkName),
+		)
+
+		It("is wrapped by CreateClient", func() {
+			_, err := utils.CreateClient(types.NetConf{Name: ""})
+			Expect(errors.Is(err, utils.ErrEmptyNetworkName)).To(BeTrue())
+
+			_, err = utils.CreateClient(types.NetConf{Name: "pod network"})
+			Expect(errors.Is(err, utils.ErrInvalidNetworkName)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring(`"pod network"`))
+		})
+	})
+
+	Describe("SetAssignedAt", func() {
+		It("sets the annotation once and leaves it unchanged afterwards", func() {
+			wep := api.NewWorkloadEndpoint()
+			first := time.Date(2020, 6, 1, 12, 30, 0, 0, time.UTC)
+			utils.SetAssignedAt(wep, first)
+			Expect(wep.Annotations).To(HaveKeyWithValue(utils.AssignedAtAnnotation, "2020-06-01T12:30:00Z"))
+
+			utils.SetAssignedAt(wep, first.Add(time.Hour))
+			Expect(wep.Annotations).To(HaveKeyWithValue(utils.AssignedAtAnnotation, "2020-06-01T12:30:00Z"))
+		})
+
+		It("preserves other annotations", func() {
+			wep := api.NewWorkloadEndpoint()
+			wep.Annotations = map[string]string{"foo": "bar"}
+			utils.SetAssignedAt(wep, time.Now())
+			Expect(wep.Annotations).To(HaveKeyWithValue("foo", "bar"))
+			Expect(wep.Annotations).To(HaveKey(utils.AssignedAtAnnotation))
+		})
+	})
+
+	Describe("IP family ordering", func() {
+		v4 := &current.IPConfig{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: net.CIDRMask(26, 32)}}
+		v4b := &current.IPConfig{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(26, 32)}}
+		v6 := &current.IPConfig{Version: "6", Address: net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(122, 128)}}
+
+		table.DescribeTable("PopulateEndpointNets",
+			func(order string, ips []*current.IPConfig, expected []string) {
+				wep := api.NewWorkloadEndpoint()
+				result := &current.Result{}
+				for _, ip := range ips {
+					copied := *ip
+					result.IPs = append(result.IPs, &copied)
+				}
+				err := utils.PopulateEndpointNets(wep, result, types.NetConf{IPFamilyOrder: order})
+				if expected == nil {
+					Expect(err).To(HaveOccurred())
+					return
+				}
+				Expect(err).NotTo(HaveOccurred())
+				Expect(wep.Spec.IPNetworks).To(Equal(expected))
+				for i, ip := range result.IPs {
+					Expect(ip.Address.IP.String()).To(Equal(strings.Split(expected[i], "/")[0]))
+				}
+			},
+			table.Entry("dual-stack, unset puts IPv4 first", "", []*current.IPConfig{v6, v4}, []string{"10.0.0.1/32", "fd00::1/128"}),
+			table.Entry("dual-stack, v4-first", "v4-first", []*current.IPConfig{v6, v4}, []string{"10.0.0.1/32", "fd00::1/128"}),
+			table.Entry("dual-stack, v6-first", "v6-first", []*current.IPConfig{v4, v6}, []string{"fd00::1/128", "10.0.0.1/32"}),
+			table.Entry("IPv4 only", "", []*current.IPConfig{v4}, []string{"10.0.0.1/32"}),
+			table.Entry("IPv6 only", "", []*current.IPConfig{v6}, []string{"fd00::1/128"}),
+			table.Entry("two IPv4 addresses are rejected", "", []*current.IPConfig{v4, v4b}, nil),
+			table.Entry("two IPv4 addresses are rejected alongside IPv6", "", []*current.IPConfig{v4, v6, v4b}, nil),
+			table.Entry("no addresses are rejected", "", []*current.IPConfig{}, nil),
+		)
+
+		It("allows as many addresses of a family as num_ipv4 and num_ipv6", func() {
+			conf := types.NetConf{}
+			conf.IPAM.NumIPv4 = 2
+			wep := api.NewWorkloadEndpoint()
+			result := &current.Result{IPs: []*current.IPConfig{v6, v4, v4b}}
+			Expect(utils.PopulateEndpointNets(wep, result, conf)).To(Succeed())
+			Expect(wep.Spec.IPNetworks).To(Equal([]string{"10.0.0.1/32", "10.0.0.2/32", "fd00::1/128"}))
+
+			wep = api.NewWorkloadEndpoint()
+			result = &current.Result{IPs: []*current.IPConfig{v6, v6}}
+			Expect(utils.PopulateEndpointNets(wep, result, conf)).To(MatchError(ContainSubstring("2 IPv6 addresses")))
+		})
+
+		table.DescribeTable("IPsPerFamily",
+			func(num4, num6, expected4, expected6 int) {
+				conf := types.NetConf{}
+				conf.IPAM.NumIPv4 = num4
+				conf.IPAM.NumIPv6 = num6
+				got4, got6, err := utils.IPsPerFamily(conf)
+				if expected4 == 0 {
+					Expect(err).To(HaveOccurred())
+					return
+				}
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got4).To(Equal(expected4))
+				Expect(got6).To(Equal(expected6))
+			},
+			table.Entry("unset", 0, 0, 1, 1),
+			table.Entry("set", 2, 3, 2, 3),
+			table.Entry("the maximum", utils.MaxIPsPerFamily, 1, utils.MaxIPsPerFamily, 1),
+			table.Entry("too many IPv4", utils.MaxIPsPerFamily+1, 0, 0, 0),
+			table.Entry("negative IPv6", 0, -1, 0, 0),
+		)
+
+		table.DescribeTable("CreateResultFromEndpoint",
+			func(order string, expected []string) {
+				wep := api.NewWorkloadEndpoint()
+				wep.Spec.IPNetworks = []string{"fd00::1/128", "10.0.0.1/32", "fd00::2/128"}
+				result, err := utils.CreateResultFromEndpoint(wep, order)
+				Expect(err).NotTo(HaveOccurred())
+				var got []string
+				for _, ip := range result.IPs {
+					got = append(got, ip.Address.String())
+				}
+				Expect(got).To(Equal(expected))
+			},
+			table.Entry("unset keeps the endpoint order", "", []string{"fd00::1/128", "10.0.0.1/32", "fd00::2/128"}),
+			table.Entry("v4-first", "v4-first", []string{"10.0.0.1/32", "fd00::1/128", "fd00::2/128"}),
+			table.Entry("v6-first", "v6-first", []string{"fd00::1/128", "fd00::2/128", "10.0.0.1/32"}),
+		)
+
+		It("rejects an unknown order", func() {
+			Expect(utils.ValidateIPFamilyOrder("v5-first")).NotTo(Succeed())
+			_, err := utils.CreateResultFromEndpoint(api.NewWorkloadEndpoint(), "v5-first")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("AddEndpointInterfaces", func() {
+		It("reports the host interface and the container interface with the recorded MAC", func() {
+			wep := api.NewWorkloadEndpoint()
+			wep.Spec.InterfaceName = "cali12345678901"
+			wep.Spec.Endpoint = "eth0"
+			wep.Spec.MAC = "ee:ee:ee:ee:ee:ee"
+			result, err := utils.CreateResultFromEndpoint(wep, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			utils.AddEndpointInterfaces(result, wep, &skel.CmdArgs{Netns: "/var/run/netns/test"})
+			Expect(result.Interfaces).To(Equal([]*current.Interface{
+				{Name: "cali12345678901"},
+				{Name: "eth0", Mac: "ee:ee:ee:ee:ee:ee", Sandbox: "/var/run/netns/test"},
+			}))
+		})
+	})
+
+	Describe("IPAMResultRoutes", func() {
+		routes := []*cnitypes.Route{{Dst: net.IPNet{IP: net.IPv4(10, 1, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}}}
+
+		It("returns host-local's routes", func() {
+			conf := types.NetConf{}
+			conf.IPAM.Type = "host-local"
+			conf.IPAM.Routes = routes
+			Expect(utils.IPAMResultRoutes(conf)).To(Equal(routes))
+		})
+
+		It("returns nothing for calico-ipam", func() {
+			conf := types.NetConf{}
+			conf.IPAM.Type = "calico-ipam"
+			conf.IPAM.Routes = routes
+			Expect(utils.IPAMResultRoutes(conf)).To(BeNil())
+		})
+
+		It("parses the routes from the IPAM config", func() {
+			conf := types.NetConf{}
+			Expect(json.Unmarshal([]byte(`{"ipam": {"type": "host-local", "routes": [{"dst": "10.1.0.0/16"}]}}`), &conf)).To(Succeed())
+			Expect(utils.IPAMResultRoutes(conf)).To(HaveLen(1))
+			Expect(utils.IPAMResultRoutes(conf)[0].Dst.String()).To(Equal("10.1.0.0/16"))
+		})
+	})
+
+	Describe("SetNetwork", func() {
+		It("sets the annotation and replaces it if the network changes", func() {
+			wep := api.NewWorkloadEndpoint()
+			utils.SetNetwork(wep, "net1")
+			Expect(wep.Annotations).To(HaveKeyWithValue(utils.NetworkAnnotation, "net1"))
+
+			utils.SetNetwork(wep, "net2")
+			Expect(wep.Annotations).To(HaveKeyWithValue(utils.NetworkAnnotation, "net2"))
+		})
+	})
+
+	Describe("SetPluginVersion", func() {
+		It("sets the annotation to the running plugin's version", func() {
+			defer func(v string) { utils.PluginVersion = v }(utils.PluginVersion)
+			utils.PluginVersion = "v3.17.0"
+
+			wep := api.NewWorkloadEndpoint()
+			wep.Annotations = map[string]string{utils.PluginVersionAnnotation: "v3.16.0"}
+			utils.SetPluginVersion(wep)
+			Expect(wep.Annotations).To(HaveKeyWithValue(utils.PluginVersionAnnotation, "v3.17.0"))
+			Expect(wep.Labels).NotTo(HaveKey(utils.PluginVersionAnnotation))
+		})
+	})
+
+	Describe("WriteInlineEtcdTLSFiles", func() {
+		encode := func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		}
+
+		It("prefers file paths over inline material", func() {
+			conf := types.NetConf{
+				EtcdCert:     encode("cert-data"),
+				EtcdCertFile: "/path/to/cert",
+			}
+			cleanup, err := utils.WriteInlineEtcdTLSFiles(&conf)
+			Expect(err).NotTo(HaveOccurred())
+			defer cleanup()
+			Expect(conf.EtcdCertFile).To(Equal("/path/to/cert"))
+			Expect(conf.EtcdKeyFile).To(BeEmpty())
+			Expect(conf.EtcdCaCertFile).To(BeEmpty())
+		})
+
+		It("rejects material that isn't base64 encoded", func() {
+			conf := types.NetConf{
+				EtcdKey: "not base64!",
+			}
+			cleanup, err := utils.WriteInlineEtcdTLSFiles(&conf)
+			Expect(err).To(HaveOccurred())
+			cleanup()
+			Expect(conf.EtcdKeyFile).To(BeEmpty())
+		})
+	})
 })
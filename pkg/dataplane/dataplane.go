@@ -45,6 +45,53 @@ type Dataplane interface {
 	CleanUpNamespace(args *skel.CmdArgs) error
 }
 
+// interfaceChecker is implemented by dataplanes that can tell whether the container interface exists.
+type interfaceChecker interface {
+	ContainerInterfaceExists(args *skel.CmdArgs) (bool, error)
+}
+
+// ContainerInterfaceExists reports whether the container interface named in args exists. It returns false if
+// the dataplane can't tell.
+func ContainerInterfaceExists(d Dataplane, args *skel.CmdArgs) bool {
+	c, ok := d.(interfaceChecker)
+	if !ok {
+		return false
+	}
+	exists, err := c.ContainerInterfaceExists(args)
+	return err == nil && exists
+}
+
+// networkChecker is implemented by dataplanes that can verify the networking that DoNetworking set up.
+type networkChecker interface {
+	CheckNetworking(args *skel.CmdArgs, hostVethName string, ipNetworks []string) error
+}
+
+// CheckNetworking returns an error if the container's networking has drifted from what ADD set up. Dataplanes
+// that can't check are assumed to be fine.
+func CheckNetworking(d Dataplane, args *skel.CmdArgs, hostVethName string, ipNetworks []string) error {
+	c, ok := d.(networkChecker)
+	if !ok {
+		return nil
+	}
+	return c.CheckNetworking(args, hostVethName, ipNetworks)
+}
+
+// hostVethRemover is implemented by dataplanes that can remove a host-side veth by name.
+type hostVethRemover interface {
+	RemoveHostVeth(name string) error
+}
+
+// RemoveStaleHostVeth removes the host side of a veth that an endpoint recorded under a name other than the one
+// the plugin would now choose, so that it isn't left behind when the veth is recreated under the new name.
+// Dataplanes that don't name their host interfaces leave it alone.
+func RemoveStaleHostVeth(d Dataplane, name string) error {
+	r, ok := d.(hostVethRemover)
+	if !ok {
+		return nil
+	}
+	return r.RemoveHostVeth(name)
+}
+
 func GetDataplane(conf types.NetConf, logger *logrus.Entry) (Dataplane, error) {
 	name, ok := conf.DataplaneOptions["type"]
 	if !ok {
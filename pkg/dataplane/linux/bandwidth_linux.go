@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linux
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+)
+
+// Bandwidth limits are enforced with token bucket filters. Traffic to the workload is shaped by a tbf qdisc on
+// the host side of its veth. Traffic from the workload arrives on the host side's ingress, which can't be
+// shaped directly, so an ingress qdisc redirects it to an ifb device that has its own tbf qdisc. This is the
+// same arrangement as the bandwidth CNI plugin uses.
+const (
+	// tbfLatencyUsec is the longest that a packet may wait in a token bucket filter's queue.
+	tbfLatencyUsec = 25000
+	// tbfBurstUsec is how much of the rate the bucket can save up, as a time. tbfMinBurst, in bytes, is a floor
+	// on it so that the bucket can always hold a full sized, possibly GSO, packet.
+	tbfBurstUsec = 100000
+	tbfMinBurst  = 64 * 1024
+)
+
+// ifbName returns the name of the ifb device that shapes the traffic from the container's interface. It
+// mustn't start with "cali", since Felix treats those interfaces as workload interfaces.
+func ifbName(args *skel.CmdArgs) string {
+	h := sha1.New()
+	h.Write([]byte(fmt.Sprintf("%s/%s", args.ContainerID, args.IfName)))
+	return "cbw" + hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// setUpBandwidth applies the workload's bandwidth limits to the host side of its veth.
+func (d *linuxDataplane) setUpBandwidth(args *skel.CmdArgs, hostVeth netlink.Link, bw utils.Bandwidth) error {
+	// Start from a clean slate, in case an earlier ADD for the container got part way.
+	d.deleteLinkIfExists(ifbName(args))
+
+	if bw.IngressRate > 0 {
+		d.logger.WithField("rate", bw.IngressRate).Info("Limiting the bandwidth of traffic to the workload")
+		if err := addTBF(hostVeth.Attrs().Index, bw.IngressRate); err != nil {
+			return fmt.Errorf("failed to limit ingress bandwidth on %q: %v", hostVeth.Attrs().Name, err)
+		}
+	}
+
+	if bw.EgressRate > 0 {
+		d.logger.WithField("rate", bw.EgressRate).Info("Limiting the bandwidth of traffic from the workload")
+		if err := d.addEgressShaping(args, hostVeth, bw.EgressRate); err != nil {
+			return fmt.Errorf("failed to limit egress bandwidth on %q: %v", hostVeth.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// addEgressShaping redirects the traffic arriving from the workload to an ifb device, and shapes it there.
+func (d *linuxDataplane) addEgressShaping(args *skel.CmdArgs, hostVeth netlink.Link, rate uint64) error {
+	err := netlink.LinkAdd(&netlink.Ifb{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:  ifbName(args),
+			Flags: net.FlagUp,
+			MTU:   hostVeth.Attrs().MTU,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add ifb device: %v", err)
+	}
+	ifb, err := netlink.LinkByName(ifbName(args))
+	if err != nil {
+		return err
+	}
+
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err = netlink.QdiscAdd(ingress); err != nil {
+		return fmt.Errorf("failed to add ingress qdisc: %v", err)
+	}
+
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Parent:    ingress.QdiscAttrs.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifb.Attrs().Index,
+		Actions: []netlink.Action{
+			&netlink.MirredAction{
+				MirredAction: netlink.TCA_EGRESS_REDIR,
+				Ifindex:      ifb.Attrs().Index,
+			},
+		},
+	}
+	if err = netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to add redirect filter: %v", err)
+	}
+
+	return addTBF(ifb.Attrs().Index, rate)
+}
+
+// removeBandwidth removes the ifb device for the container's interface, if there is one. The qdiscs on the host
+// side of the veth go with the veth.
+func (d *linuxDataplane) removeBandwidth(args *skel.CmdArgs) {
+	d.deleteLinkIfExists(ifbName(args))
+}
+
+// addTBF adds a root token bucket filter qdisc, limiting the link to the rate in bits per second.
+func addTBF(linkIndex int, rate uint64) error {
+	rateBytes := rate / 8
+	burst := rateBytes * tbfBurstUsec / netlink.TIME_UNITS_PER_SEC
+	if burst < tbfMinBurst {
+		burst = tbfMinBurst
+	}
+	buffer := tbfTime2Tick(burst * netlink.TIME_UNITS_PER_SEC / rateBytes)
+	limit := rateBytes*tbfLatencyUsec/netlink.TIME_UNITS_PER_SEC + burst
+
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rateBytes,
+		Buffer: clampUint32(buffer),
+		Limit:  clampUint32(limit),
+	}
+	return netlink.QdiscAdd(qdisc)
+}
+
+func tbfTime2Tick(usec uint64) uint64 {
+	return uint64(float64(usec) * float64(netlink.TickInUsec()))
+}
+
+func clampUint32(v uint64) uint32 {
+	if v > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(v)
+}
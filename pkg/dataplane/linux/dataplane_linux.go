@@ -16,10 +16,13 @@ package linux
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
@@ -30,25 +33,105 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
 	"github.com/projectcalico/cni-plugin/pkg/types"
 	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
 	calicoclient "github.com/projectcalico/libcalico-go/lib/clientv3"
 )
 
+const defaultVethCreateBackoff = 100 * time.Millisecond
+
+// defaultIPv4Gateway is the link-local address that the container's IPv4 routes go via by default. The host
+// side of the veth answers ARP for it by proxy ARP, so it doesn't need to be configured anywhere.
+var defaultIPv4Gateway = net.IPv4(169, 254, 1, 1)
+
 type linuxDataplane struct {
-	allowIPForwarding bool
-	mtu               int
-	logger            *logrus.Entry
+	allowIPForwarding  bool
+	proxyARP           bool
+	hostForwarding     bool
+	hostRouteTable     int
+	hostRouteProtocol  int
+	sendGratuitousARP  bool
+	mtu                int
+	containerMTU       int
+	defaultRouteMetric *int
+	ipv4Gateway        net.IP
+	ipv6Gateway        net.IP
+	customRoutes       []utils.Route
+	additionalIface    bool
+	vethCreateRetries  int
+	vethCreateBackoff  time.Duration
+	logger             *logrus.Entry
+
+	// linkAdd creates a link. It's netlink.LinkAdd other than in tests.
+	linkAdd func(netlink.Link) error
 }
 
 func NewLinuxDataplane(conf types.NetConf, logger *logrus.Entry) *linuxDataplane {
+	backoff := defaultVethCreateBackoff
+	if conf.VethCreateBackoff > 0 {
+		backoff = time.Duration(conf.VethCreateBackoff) * time.Millisecond
+	}
+	ipv4Gateway, ipv6Gateway := containerGateways(conf, logger)
+	hostRouteTable, hostRouteProtocol := syscall.RT_TABLE_MAIN, syscall.RTPROT_BOOT
+	if conf.HostRouteTable > 0 {
+		hostRouteTable = conf.HostRouteTable
+	}
+	if conf.HostRouteProtocol > 0 {
+		hostRouteProtocol = conf.HostRouteProtocol
+	}
+	customRoutes, err := utils.ParseContainerRoutes(conf.ContainerSettings.Routes)
+	if err != nil {
+		logger.WithError(err).Warn("Ignoring invalid container_settings.routes")
+	}
 	return &linuxDataplane{
-		allowIPForwarding: conf.ContainerSettings.AllowIPForwarding,
-		mtu:               conf.MTU,
-		logger:            logger,
+		allowIPForwarding:  conf.ContainerSettings.AllowIPForwarding,
+		proxyARP:           conf.ProxyARP == nil || *conf.ProxyARP,
+		hostForwarding:     conf.HostForwarding == nil || *conf.HostForwarding,
+		hostRouteTable:     hostRouteTable,
+		hostRouteProtocol:  hostRouteProtocol,
+		sendGratuitousARP:  conf.SendGratuitousARP,
+		mtu:                conf.MTU,
+		containerMTU:       conf.ContainerSettings.MTU,
+		defaultRouteMetric: conf.DefaultRouteMetric,
+		ipv4Gateway:        ipv4Gateway,
+		ipv6Gateway:        ipv6Gateway,
+		customRoutes:       customRoutes,
+		additionalIface:    conf.AdditionalInterface,
+		vethCreateRetries:  conf.VethCreateRetries,
+		vethCreateBackoff:  backoff,
+		logger:             logger,
+		linkAdd:            netlink.LinkAdd,
 	}
 }
 
+// containerGateways returns the gateways for the container's IPv4 and IPv6 routes. A nil IPv6 gateway means
+// that the host side of the veth's own link-local address is used.
+func containerGateways(conf types.NetConf, logger *logrus.Entry) (v4, v6 net.IP) {
+	v4, v6 = defaultIPv4Gateway, net.ParseIP(conf.IPv6Gateway)
+	if conf.ContainerSettings.Gateway == "" {
+		return
+	}
+
+	gw := net.ParseIP(conf.ContainerSettings.Gateway)
+	switch {
+	case gw == nil || gw.IsUnspecified() || gw.IsLoopback() || gw.IsMulticast() || gw.Equal(net.IPv4bcast):
+		logger.WithField("gateway", conf.ContainerSettings.Gateway).Warn(
+			"Ignoring invalid container_settings.gateway, it must be a unicast IPv4 address or an IPv6 link-local address")
+	case gw.To4() != nil:
+		v4 = gw.To4()
+	case !gw.IsLinkLocalUnicast():
+		logger.WithField("gateway", conf.ContainerSettings.Gateway).Warn(
+			"Ignoring container_settings.gateway, an IPv6 gateway must be a link-local address")
+	case v6 != nil:
+		logger.WithField("gateway", conf.ContainerSettings.Gateway).Warn(
+			"Ignoring container_settings.gateway in favour of ipv6_gateway")
+	default:
+		v6 = gw
+	}
+	return
+}
+
 func (d *linuxDataplane) DoNetworking(
 	ctx context.Context,
 	calicoClient calicoclient.Interface,
@@ -65,12 +148,14 @@ func (d *linuxDataplane) DoNetworking(
 
 	d.logger.Infof("Setting the host side veth name to %s", hostVethName)
 
+	bandwidth, err := utils.ParseBandwidth(annotations)
+	if err != nil {
+		return "", "", err
+	}
+
 	// Clean up if hostVeth exists.
-	if oldHostVeth, err := netlink.LinkByName(hostVethName); err == nil {
-		if err = netlink.LinkDel(oldHostVeth); err != nil {
-			return "", "", fmt.Errorf("failed to delete old hostVeth %v: %v", hostVethName, err)
-		}
-		d.logger.Infof("Cleaning old hostVeth: %v", hostVethName)
+	if err = d.removeStaleHostVeth(hostVethName); err != nil {
+		return "", "", err
 	}
 
 	err = ns.WithNetNSPath(args.Netns, func(hostNS ns.NetNS) error {
@@ -82,7 +167,7 @@ func (d *linuxDataplane) DoNetworking(
 			PeerName: hostVethName,
 		}
 
-		if err := netlink.LinkAdd(veth); err != nil {
+		if err := d.createVeth(veth); err != nil {
 			d.logger.Errorf("Error adding veth %+v: %s", veth, err)
 			return err
 		}
@@ -141,6 +226,27 @@ func (d *linuxDataplane) DoNetworking(
 			return err
 		}
 
+		// The veth is created with the host side's MTU at both ends.
+		if d.containerMTU != 0 && d.containerMTU != d.mtu {
+			if err = netlink.LinkSetMTU(contVeth, d.containerMTU); err != nil {
+				return fmt.Errorf("failed to set MTU of %q to %d: %v", contVethName, d.containerMTU, err)
+			}
+		}
+
+		// Pin the container's MAC if the workload asked for one. This must be done before the link is up.
+		if hwAddr := annotations[utils.HwAddrAnnotation]; hwAddr != "" {
+			mac, err := utils.ParseHwAddr(hwAddr)
+			if err != nil {
+				return err
+			}
+			if err = netlink.LinkSetHardwareAddr(contVeth, mac); err != nil {
+				return fmt.Errorf("failed to set MAC of %q to %s: %v", contVethName, mac, err)
+			}
+			if contVeth, err = netlink.LinkByName(contVethName); err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", contVethName, err)
+			}
+		}
+
 		// Explicitly set the veth to UP state; the veth won't get a link local address unless it's set to UP state.
 		if err = netlink.LinkSetUp(contVeth); err != nil {
 			return fmt.Errorf("failed to set %q up: %w", contVethName, err)
@@ -153,94 +259,22 @@ func (d *linuxDataplane) DoNetworking(
 		// At this point, the virtual ethernet pair has been created, and both ends have the right names.
 		// Both ends of the veth are still in the container's network namespace.
 
-		// Do the per-IP version set-up.  Add gateway routes etc.
+		// Do the per-IP version set-up.  Add gateway routes etc.  Only the routes for the families that have
+		// been assigned an address are programmed, so a single-stack pod has no routes for the other family.
 		if hasIPv4 {
-			// Add a connected route to a dummy next hop so that a default route can be set
-			gw := net.IPv4(169, 254, 1, 1)
-			gwNet := &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)}
-			err := netlink.RouteAdd(
-				&netlink.Route{
-					LinkIndex: contVeth.Attrs().Index,
-					Scope:     netlink.SCOPE_LINK,
-					Dst:       gwNet,
-				},
-			)
-
-			if err != nil {
-				return fmt.Errorf("failed to add route inside the container: %v", err)
-			}
-
-			for _, r := range routes {
-				if r.IP.To4() == nil {
-					d.logger.WithField("route", r).Debug("Skipping non-IPv4 route")
-					continue
-				}
-				d.logger.WithField("route", r).Debug("Adding IPv4 route")
-				if err = ip.AddRoute(r, gw, contVeth); err != nil {
-					return fmt.Errorf("failed to add IPv4 route for %v via %v: %v", r, gw, err)
-				}
+			if err = d.setupIPv4ContainerRoutes(contVeth, routes); err != nil {
+				return err
 			}
+		} else {
+			d.logger.Debug("No IPv4 address assigned, skipping IPv4 container routes")
 		}
 
 		if hasIPv6 {
-			// Make sure ipv6 is enabled in the container/pod network namespace.
-			// Without these sysctls enabled, interfaces will come up but they won't get a link local IPv6 address
-			// which is required to add the default IPv6 route.
-			if err = writeProcSys("/proc/sys/net/ipv6/conf/all/disable_ipv6", "0"); err != nil {
-				return fmt.Errorf("failed to set net.ipv6.conf.all.disable_ipv6=0: %s", err)
-			}
-
-			if err = writeProcSys("/proc/sys/net/ipv6/conf/default/disable_ipv6", "0"); err != nil {
-				return fmt.Errorf("failed to set net.ipv6.conf.default.disable_ipv6=0: %s", err)
-			}
-
-			if err = writeProcSys("/proc/sys/net/ipv6/conf/lo/disable_ipv6", "0"); err != nil {
-				return fmt.Errorf("failed to set net.ipv6.conf.lo.disable_ipv6=0: %s", err)
-			}
-
-			// Retry several times as the LL can take a several micro/miliseconds to initialize and we may be too fast
-			// after these sysctls
-			var err error
-			var addresses []netlink.Addr
-			for i := 0; i < 10; i++ {
-				// No need to add a dummy next hop route as the host veth device will already have an IPv6
-				// link local address that can be used as a next hop.
-				// Just fetch the address of the host end of the veth and use it as the next hop.
-				addresses, err = netlink.AddrList(hostVeth, netlink.FAMILY_V6)
-				if err != nil {
-					d.logger.Errorf("Error listing IPv6 addresses for the host side of the veth pair: %s", err)
-				}
-
-				if len(addresses) < 1 {
-					// If the hostVeth doesn't have an IPv6 address then this host probably doesn't
-					// support IPv6. Since a IPv6 address has been allocated that can't be used,
-					// return an error.
-					err = fmt.Errorf("failed to get IPv6 addresses for host side of the veth pair")
-				}
-				if err == nil {
-					break
-				}
-
-				d.logger.Infof("No IPv6 set on interface, retrying..")
-				time.Sleep(50 * time.Millisecond)
-			}
-
-			if err != nil {
+			if err = d.setupIPv6ContainerRoutes(hostVeth, contVeth, routes); err != nil {
 				return err
 			}
-
-			hostIPv6Addr := addresses[0].IP
-
-			for _, r := range routes {
-				if r.IP.To4() != nil {
-					d.logger.WithField("route", r).Debug("Skipping non-IPv6 route")
-					continue
-				}
-				d.logger.WithField("route", r).Debug("Adding IPv6 route")
-				if err = ip.AddRoute(r, hostIPv6Addr, contVeth); err != nil {
-					return fmt.Errorf("failed to add IPv6 route for %v via %v: %v", r, hostIPv6Addr, err)
-				}
-			}
+		} else {
+			d.logger.Debug("No IPv6 address assigned, skipping IPv6 container routes")
 		}
 
 		// Now add the IPs to the container side of the veth.
@@ -284,15 +318,315 @@ func (d *linuxDataplane) DoNetworking(
 		return "", "", fmt.Errorf("failed to set %q up: %v", hostVethName, err)
 	}
 
+	// If the container's IPv6 routes go via a configured gateway, give the host side of the veth that address
+	// so that it answers for it. This has to be done here since moving the veth between namespaces drops its
+	// addresses.
+	if hasIPv6 && d.ipv6Gateway != nil {
+		gwNet := &net.IPNet{IP: d.ipv6Gateway, Mask: net.CIDRMask(128, 128)}
+		if err = netlink.AddrAdd(hostVeth, &netlink.Addr{IPNet: gwNet, Scope: int(netlink.SCOPE_LINK)}); err != nil {
+			return "", "", fmt.Errorf("failed to add IPv6 gateway %v to %q: %v", d.ipv6Gateway, hostVethName, err)
+		}
+	}
+
 	// Now that the host side of the veth is moved, state set to UP, and configured with sysctls, we can add the routes to it in the host namespace.
-	err = SetupRoutes(hostVeth, result)
+	err = setupHostRoutes(hostVeth, result, d.hostRouteTable, d.hostRouteProtocol)
 	if err != nil {
 		return "", "", fmt.Errorf("error adding host side routes for interface: %s, error: %s", hostVeth.Attrs().Name, err)
 	}
 
+	if err = d.setUpBandwidth(args, hostVeth, bandwidth); err != nil {
+		return "", "", err
+	}
+
+	// Now that both ends are up, announce the container's addresses if configured to.
+	if d.sendGratuitousARP {
+		d.sendGratuitousARPs(args, result)
+	}
+
 	return hostVethName, contVethMAC, err
 }
 
+// setupIPv4ContainerRoutes programs the IPv4 routes inside the container namespace.  A connected route to the
+// gateway (by default the dummy link-local next hop 169.254.1.1) is added so that the remaining IPv4 routes can
+// be installed via that next hop.
+func (d *linuxDataplane) setupIPv4ContainerRoutes(contVeth netlink.Link, routes []*net.IPNet) error {
+	var v4Routes []*net.IPNet
+	for _, r := range routes {
+		if r.IP.To4() == nil {
+			d.logger.WithField("route", r).Debug("Skipping non-IPv4 route")
+			continue
+		}
+		v4Routes = append(v4Routes, r)
+	}
+	if len(v4Routes) == 0 && d.additionalIface {
+		// Nothing to route via the gateway on an additional interface, so don't add the gateway route
+		// either since it would clash with the one on the primary interface.
+		d.logger.Debug("No IPv4 routes requested for additional interface, skipping IPv4 gateway route")
+		return nil
+	}
+
+	gw := d.ipv4Gateway
+	gwNet := &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)}
+	err := netlink.RouteAdd(
+		&netlink.Route{
+			LinkIndex: contVeth.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       gwNet,
+		},
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to add route inside the container: %v", err)
+	}
+
+	for _, r := range v4Routes {
+		d.logger.WithField("route", r).Debug("Adding IPv4 route")
+		if err = d.addContainerRoute(r, gw, contVeth); err != nil {
+			return fmt.Errorf("failed to add IPv4 route for %v via %v: %v", r, gw, err)
+		}
+	}
+	return d.addCustomRoutes(contVeth, false, v4Routes, gw)
+}
+
+// setupIPv6ContainerRoutes programs the IPv6 routes inside the container namespace, using the link-local address
+// of the host side of the veth as the next hop.
+func (d *linuxDataplane) setupIPv6ContainerRoutes(hostVeth, contVeth netlink.Link, routes []*net.IPNet) error {
+	// Make sure ipv6 is enabled in the container/pod network namespace.
+	// Without these sysctls enabled, interfaces will come up but they won't get a link local IPv6 address
+	// which is required to add the default IPv6 route.
+	if err := writeProcSys("/proc/sys/net/ipv6/conf/all/disable_ipv6", "0"); err != nil {
+		return fmt.Errorf("failed to set net.ipv6.conf.all.disable_ipv6=0: %s", err)
+	}
+
+	if err := writeProcSys("/proc/sys/net/ipv6/conf/default/disable_ipv6", "0"); err != nil {
+		return fmt.Errorf("failed to set net.ipv6.conf.default.disable_ipv6=0: %s", err)
+	}
+
+	if err := writeProcSys("/proc/sys/net/ipv6/conf/lo/disable_ipv6", "0"); err != nil {
+		return fmt.Errorf("failed to set net.ipv6.conf.lo.disable_ipv6=0: %s", err)
+	}
+
+	// Route via the configured gateway if there is one, otherwise via the host side's link-local address.
+	hostIPv6Addr := d.ipv6Gateway
+	if hostIPv6Addr == nil {
+		var err error
+		if hostIPv6Addr, err = d.hostLinkLocalAddr(hostVeth); err != nil {
+			return err
+		}
+	}
+
+	var v6Routes []*net.IPNet
+	for _, r := range routes {
+		if r.IP.To4() != nil {
+			d.logger.WithField("route", r).Debug("Skipping non-IPv6 route")
+			continue
+		}
+		d.logger.WithField("route", r).Debug("Adding IPv6 route")
+		if err := d.addContainerRoute(r, hostIPv6Addr, contVeth); err != nil {
+			return fmt.Errorf("failed to add IPv6 route for %v via %v: %v", r, hostIPv6Addr, err)
+		}
+		v6Routes = append(v6Routes, r)
+	}
+	return d.addCustomRoutes(contVeth, true, v6Routes, hostIPv6Addr)
+}
+
+// addCustomRoutes adds the container_settings routes of one IP family, other than any for a destination that
+// already has a route. A route without a gateway of its own goes via gw; one with a gateway is added as on-link,
+// since the container's addresses aren't in a subnet that the gateway could be in. An additional interface
+// doesn't get them, so that they stay on the primary interface. They go with the netns, so DEL needn't remove
+// them.
+func (d *linuxDataplane) addCustomRoutes(contVeth netlink.Link, ipv6 bool, existing []*net.IPNet, gw net.IP) error {
+	if d.additionalIface {
+		return nil
+	}
+	for _, r := range d.customRoutes {
+		if (r.Dst.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		if containsNet(existing, r.Dst) {
+			d.logger.WithField("route", r.Dst).Info("Skipping container_settings route that duplicates an existing route")
+			continue
+		}
+		route := &netlink.Route{
+			LinkIndex: contVeth.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       r.Dst,
+			Gw:        gw,
+		}
+		if r.GW != nil {
+			route.Gw = r.GW
+			route.Flags = int(netlink.FLAG_ONLINK)
+		}
+		d.logger.WithFields(logrus.Fields{"route": r.Dst, "gateway": route.Gw}).Debug("Adding container_settings route")
+		if err := netlink.RouteAdd(route); err != nil {
+			return fmt.Errorf("failed to add container_settings route for %v via %v: %v", r.Dst, route.Gw, err)
+		}
+	}
+	return nil
+}
+
+func containsNet(nets []*net.IPNet, n *net.IPNet) bool {
+	for _, existing := range nets {
+		if existing.String() == n.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// hostLinkLocalAddr returns the IPv6 link-local address of the host side of the veth, waiting for it to be
+// assigned if necessary.
+func (d *linuxDataplane) hostLinkLocalAddr(hostVeth netlink.Link) (net.IP, error) {
+	// Retry several times as the LL can take a several micro/miliseconds to initialize and we may be too fast
+	// after these sysctls
+	var err error
+	var addresses []netlink.Addr
+	for i := 0; i < 10; i++ {
+		// No need to add a dummy next hop route as the host veth device will already have an IPv6
+		// link local address that can be used as a next hop.
+		// Just fetch the address of the host end of the veth and use it as the next hop.
+		addresses, err = netlink.AddrList(hostVeth, netlink.FAMILY_V6)
+		if err != nil {
+			d.logger.Errorf("Error listing IPv6 addresses for the host side of the veth pair: %s", err)
+		}
+
+		if len(addresses) < 1 {
+			// If the hostVeth doesn't have an IPv6 address then this host probably doesn't
+			// support IPv6. Since a IPv6 address has been allocated that can't be used,
+			// return an error.
+			err = fmt.Errorf("failed to get IPv6 addresses for host side of the veth pair")
+		}
+		if err == nil {
+			break
+		}
+
+		d.logger.Infof("No IPv6 set on interface, retrying..")
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return addresses[0].IP, nil
+}
+
+// isLinkGone returns true if err shows that a link we tried to delete no longer exists. That's expected when
+// racing with the kernel, which removes both ends of a veth when either end's namespace is destroyed.
+func isLinkGone(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return true
+	}
+	return err == ip.ErrLinkNotFound || errors.Is(err, syscall.ENODEV)
+}
+
+// isNetNSGone returns true if the error shows that the netns path no longer exists.
+func isNetNSGone(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return true
+	}
+	return errors.Is(err, syscall.ENOENT)
+}
+
+// createVeth creates the veth pair. When a lot of pods are started at once, the kernel can briefly run short
+// of resources, so transient failures are retried (with backoff) as configured. Any partially created
+// interface is removed before retrying and if we run out of retries.
+func (d *linuxDataplane) createVeth(veth *netlink.Veth) error {
+	backoff := d.vethCreateBackoff
+	for attempt := 0; ; attempt++ {
+		err := d.linkAdd(veth)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.ENOMEM) && !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+		d.deleteLinkIfExists(veth.Name)
+		if attempt >= d.vethCreateRetries {
+			return fmt.Errorf("failed to create veth after %d attempts: %w", attempt+1, err)
+		}
+		d.logger.WithError(err).WithField("attempt", attempt+1).Warn("Transient failure creating veth, will retry")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// removeStaleHostVeth removes a link that already has the host veth's name, so that the new pair can take it.
+// That's usually the host side of a pair from an earlier ADD for the container, but it may be an orphan: a link
+// that isn't a veth, or one whose peer can't be found. Neither kind can be reused, so both are deleted, and the
+// name is checked to be free so that the new pair's host side isn't confused with the old link.
+func (d *linuxDataplane) removeStaleHostVeth(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil
+	}
+	logger := d.logger.WithField("hostVeth", name)
+	if _, peerIndex, err := ip.GetVethPeerIfindex(name); err != nil || peerIndex <= 0 {
+		logger.WithError(err).Warn("Found an orphaned link with the host veth's name, removing it")
+	} else {
+		logger.Info("Cleaning old hostVeth")
+	}
+
+	if err = netlink.LinkDel(link); err != nil && !isLinkGone(err) {
+		return fmt.Errorf("failed to delete old hostVeth %v: %v", name, err)
+	}
+	if _, err = netlink.LinkByName(name); err == nil {
+		return fmt.Errorf("failed to delete old hostVeth %v: it still exists", name)
+	}
+	return nil
+}
+
+// RemoveHostVeth deletes the named host veth if it exists. Links of any other type are left alone, since an
+// endpoint's recorded interface name can't be trusted to refer to something the plugin created.
+func (d *linuxDataplane) RemoveHostVeth(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil
+	}
+	logger := d.logger.WithField("hostVeth", name)
+	if _, ok := link.(*netlink.Veth); !ok {
+		logger.WithField("type", link.Type()).Warn("Link isn't a veth, leaving it in place")
+		return nil
+	}
+	logger.Info("Removing stale hostVeth")
+	if err = netlink.LinkDel(link); err != nil && !isLinkGone(err) {
+		return fmt.Errorf("failed to delete stale hostVeth %v: %v", name, err)
+	}
+	return nil
+}
+
+func (d *linuxDataplane) deleteLinkIfExists(name string) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return
+	}
+	if err := netlink.LinkDel(link); err != nil && !isLinkGone(err) {
+		d.logger.WithError(err).WithField("link", name).Warn("Failed to clean up partially created link")
+	}
+}
+
+// addContainerRoute adds a route via the given gateway inside the container. Default routes are given the
+// configured default route metric, if there is one, so that operators can choose which interface wins when a
+// pod has more than one.
+func (d *linuxDataplane) addContainerRoute(dst *net.IPNet, gw net.IP, contVeth netlink.Link) error {
+	route := &netlink.Route{
+		LinkIndex: contVeth.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       dst,
+		Gw:        gw,
+	}
+	if ones, _ := dst.Mask.Size(); ones == 0 && d.defaultRouteMetric != nil {
+		route.Priority = *d.defaultRouteMetric
+	}
+	return netlink.RouteAdd(route)
+}
+
 func disableDAD(contVethName string) error {
 	logrus.WithField("interface", contVethName).Info("Disabling DAD on interface.")
 	dadSysctl := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_dad", contVethName)
@@ -304,6 +638,11 @@ func disableDAD(contVethName string) error {
 
 // SetupRoutes sets up the routes for the host side of the veth pair.
 func SetupRoutes(hostVeth netlink.Link, result *current.Result) error {
+	return setupHostRoutes(hostVeth, result, syscall.RT_TABLE_MAIN, syscall.RTPROT_BOOT)
+}
+
+// setupHostRoutes adds the routes for the host side of the veth pair to the given table, with the given protocol.
+func setupHostRoutes(hostVeth netlink.Link, result *current.Result, table, protocol int) error {
 
 	// Go through all the IPs and add routes for each IP in the result.
 	for _, ipAddr := range result.IPs {
@@ -311,6 +650,8 @@ func SetupRoutes(hostVeth netlink.Link, result *current.Result) error {
 			LinkIndex: hostVeth.Attrs().Index,
 			Scope:     netlink.SCOPE_LINK,
 			Dst:       &ipAddr.Address,
+			Table:     table,
+			Protocol:  protocol,
 		}
 		err := netlink.RouteAdd(&route)
 
@@ -320,7 +661,8 @@ func SetupRoutes(hostVeth netlink.Link, result *current.Result) error {
 			// Route already exists, but not necessarily pointing to the same interface.
 			case syscall.EEXIST:
 				// List all the routes for the interface.
-				routes, err := netlink.RouteList(hostVeth, netlink.FAMILY_ALL)
+				routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL,
+					&netlink.Route{LinkIndex: route.LinkIndex, Table: table}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
 				if err != nil {
 					return fmt.Errorf("error listing routes")
 				}
@@ -351,56 +693,72 @@ func SetupRoutes(hostVeth netlink.Link, result *current.Result) error {
 	return nil
 }
 
-// configureSysctls configures necessary sysctls required for the host side of the veth pair for IPv4 and/or IPv6.
-func (d *linuxDataplane) configureSysctls(hostVethName string, hasIPv4, hasIPv6 bool) error {
-	var err error
+// hostSysctl is a sysctl that ADD sets on the host side of the veth.
+type hostSysctl struct {
+	path  string
+	value string
+}
 
-	if hasIPv4 {
-		// Normally, the kernel has a delay before responding to proxy ARP but we know
-		// that's not needed in a Calico network so we disable it.
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv4/neigh/%s/proxy_delay", hostVethName), "0"); err != nil {
-			return fmt.Errorf("failed to set net.ipv4.neigh.%s.proxy_delay=0: %s", hostVethName, err)
-		}
+func (s hostSysctl) String() string {
+	return fmt.Sprintf("%s=%s", strings.Replace(strings.TrimPrefix(s.path, "/proc/sys/"), "/", ".", -1), s.value)
+}
 
-		// Enable proxy ARP, this makes the host respond to all ARP requests with its own
-		// MAC. We install explicit routes into the containers network
-		// namespace and we use a link-local address for the gateway.  Turing on proxy ARP
-		// means that we don't need to assign the link local address explicitly to each
-		// host side of the veth, which is one fewer thing to maintain and one fewer
-		// thing we may clash over.
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", hostVethName), "1"); err != nil {
-			return fmt.Errorf("failed to set net.ipv4.conf.%s.proxy_arp=1: %s", hostVethName, err)
+// hostSysctls returns the sysctls to set on the host side of the veth pair for IPv4 and/or IPv6, in the order
+// they must be set. Proxy ARP/NDP and forwarding are left out if proxy_arp or host_forwarding are turned off.
+func (d *linuxDataplane) hostSysctls(hostVethName string, hasIPv4, hasIPv6 bool) []hostSysctl {
+	var sysctls []hostSysctl
+	if hasIPv4 {
+		if d.proxyARP {
+			// Normally, the kernel has a delay before responding to proxy ARP but we know
+			// that's not needed in a Calico network so we disable it.
+			sysctls = append(sysctls, hostSysctl{fmt.Sprintf("/proc/sys/net/ipv4/neigh/%s/proxy_delay", hostVethName), "0"})
+
+			// Enable proxy ARP, this makes the host respond to all ARP requests with its own
+			// MAC. We install explicit routes into the containers network
+			// namespace and we use a link-local address for the gateway.  Turing on proxy ARP
+			// means that we don't need to assign the link local address explicitly to each
+			// host side of the veth, which is one fewer thing to maintain and one fewer
+			// thing we may clash over.
+			sysctls = append(sysctls, hostSysctl{fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", hostVethName), "1"})
 		}
 
-		// Enable IP forwarding of packets coming _from_ this interface.  For packets to
-		// be forwarded in both directions we need this flag to be set on the fabric-facing
-		// interface too (or for the global default to be set).
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/forwarding", hostVethName), "1"); err != nil {
-			return fmt.Errorf("failed to set net.ipv4.conf.%s.forwarding=1: %s", hostVethName, err)
+		if d.hostForwarding {
+			// Enable IP forwarding of packets coming _from_ this interface.  For packets to
+			// be forwarded in both directions we need this flag to be set on the fabric-facing
+			// interface too (or for the global default to be set).
+			sysctls = append(sysctls, hostSysctl{fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/forwarding", hostVethName), "1"})
 		}
 	}
 
 	if hasIPv6 {
 		// Make sure ipv6 is enabled on the hostVeth interface in the host network namespace.
 		// Interfaces won't get a link local address without this sysctl set to 0.
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", hostVethName), "0"); err != nil {
-			return fmt.Errorf("failed to set net.ipv6.conf.%s.disable_ipv6=0: %s", hostVethName, err)
+		sysctls = append(sysctls, hostSysctl{fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", hostVethName), "0"})
+
+		if d.proxyARP {
+			// Enable proxy NDP, similarly to proxy ARP, described above in IPv4 section.
+			sysctls = append(sysctls, hostSysctl{fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/proxy_ndp", hostVethName), "1"})
 		}
 
-		// Enable proxy NDP, similarly to proxy ARP, described above in IPv4 section.
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/proxy_ndp", hostVethName), "1"); err != nil {
-			return fmt.Errorf("failed to set net.ipv6.conf.%s.proxy_ndp=1: %s", hostVethName, err)
+		if d.hostForwarding {
+			// Enable IP forwarding of packets coming _from_ this interface.  For packets to
+			// be forwarded in both directions we need this flag to be set on the fabric-facing
+			// interface too (or for the global default to be set).
+			sysctls = append(sysctls, hostSysctl{fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/forwarding", hostVethName), "1"})
 		}
+	}
+	return sysctls
+}
 
-		// Enable IP forwarding of packets coming _from_ this interface.  For packets to
-		// be forwarded in both directions we need this flag to be set on the fabric-facing
-		// interface too (or for the global default to be set).
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/forwarding", hostVethName), "1"); err != nil {
-			return fmt.Errorf("failed to set net.ipv6.conf.%s.forwarding=1: %s", hostVethName, err)
+// configureSysctls configures necessary sysctls required for the host side of the veth pair for IPv4 and/or IPv6.
+func (d *linuxDataplane) configureSysctls(hostVethName string, hasIPv4, hasIPv6 bool) error {
+	for _, s := range d.hostSysctls(hostVethName, hasIPv4, hasIPv6) {
+		if err := writeProcSys(s.path, s.value); err != nil {
+			return fmt.Errorf("failed to set %s: %s", s, err)
 		}
 	}
 
-	if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_ra", hostVethName), "0"); err != nil {
+	if err := writeProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_ra", hostVethName), "0"); err != nil {
 		d.logger.Warnf("failed to set net.ipv6.conf.%s.accept_ra=0: %s", hostVethName, err)
 	}
 
@@ -457,7 +815,84 @@ func writeProcSys(path, value string) error {
 	return err
 }
 
+// ContainerInterfaceExists returns whether the container interface exists in the container's namespace.
+func (d *linuxDataplane) ContainerInterfaceExists(args *skel.CmdArgs) (bool, error) {
+	if args.Netns == "" {
+		return false, nil
+	}
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		_, err := netlink.LinkByName(args.IfName)
+		return err
+	})
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return false, nil
+	} else if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CheckNetworking verifies that the host side of the veth exists with the sysctls that ADD sets, and that the
+// container interface has each of the endpoint's IPs.
+func (d *linuxDataplane) CheckNetworking(args *skel.CmdArgs, hostVethName string, ipNetworks []string) error {
+	var ips []net.IP
+	hasIPv4, hasIPv6 := false, false
+	for _, ipNet := range ipNetworks {
+		ip, _, err := net.ParseCIDR(ipNet)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint IP %s: %v", ipNet, err)
+		}
+		ips = append(ips, ip)
+		if ip.To4() != nil {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
+		}
+	}
+
+	if _, err := netlink.LinkByName(hostVethName); err != nil {
+		return fmt.Errorf("failed to find host veth %s: %v", hostVethName, err)
+	}
+	for _, s := range d.hostSysctls(hostVethName, hasIPv4, hasIPv6) {
+		actual, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", s.path, err)
+		}
+		if strings.TrimSpace(string(actual)) != s.value {
+			return fmt.Errorf("%s is %s, expected %s", s.path, strings.TrimSpace(string(actual)), s.value)
+		}
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		contVeth, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to find container interface %s: %v", args.IfName, err)
+		}
+		addrs, err := netlink.AddrList(contVeth, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses of %s: %v", args.IfName, err)
+		}
+		for _, ip := range ips {
+			found := false
+			for _, addr := range addrs {
+				if addr.IP.Equal(ip) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("container interface %s is missing IP %s", args.IfName, ip)
+			}
+		}
+		return nil
+	})
+}
+
 func (d *linuxDataplane) CleanUpNamespace(args *skel.CmdArgs) error {
+	// The ifb device for any bandwidth limits is in the host namespace, so it has to go whether or not the
+	// container's namespace is still around.
+	d.removeBandwidth(args)
+
 	// Only try to delete the device if a namespace was passed in.
 	if args.Netns != "" {
 		d.logger.WithFields(logrus.Fields{
@@ -469,14 +904,25 @@ func (d *linuxDataplane) CleanUpNamespace(args *skel.CmdArgs) error {
 			return err
 		})
 
-		if devErr == nil {
+		if isNetNSGone(devErr) {
+			// The namespace was torn down before we got here, taking the interface with it.
+			d.logger.WithError(devErr).Info("netns no longer exists, no need to clean up.")
+		} else if devErr == nil {
 			d.logger.Infof("Calico CNI deleting device in netns %s", args.Netns)
 			// Deleting the veth has been seen to hang on some kernel version. Timeout the command if it takes too long.
 			ch := make(chan error, 1)
 
 			go func() {
+				// Deleting the link takes its addresses of both families, and their routes and neighbour entries,
+				// with it. Check that it's really gone, so that nothing of the pod's is left in the namespace.
 				err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-					return ip.DelLinkByName(args.IfName)
+					if err := ip.DelLinkByName(args.IfName); err != nil {
+						return err
+					}
+					if _, err := netlink.LinkByName(args.IfName); err == nil {
+						return fmt.Errorf("%s still exists in netns %s after deleting it", args.IfName, args.Netns)
+					}
+					return nil
 				})
 
 				ch <- err
@@ -484,7 +930,10 @@ func (d *linuxDataplane) CleanUpNamespace(args *skel.CmdArgs) error {
 
 			select {
 			case err := <-ch:
-				if err != nil {
+				if isLinkGone(err) || isNetNSGone(err) {
+					// The kernel got there first, e.g. because the namespace was being torn down.
+					d.logger.WithField("ifName", args.IfName).Info("veth was removed before we could delete it.")
+				} else if err != nil {
 					return err
 				} else {
 					d.logger.Infof("Calico CNI deleted device in netns %s", args.Netns)
@@ -495,6 +944,10 @@ func (d *linuxDataplane) CleanUpNamespace(args *skel.CmdArgs) error {
 		} else {
 			d.logger.WithField("ifName", args.IfName).Info("veth does not exist, no need to clean up.")
 		}
+	} else {
+		// Some runtimes don't pass the namespace on DEL. The interface goes away with the namespace, so there's
+		// nothing to do here; the IPAM allocation and endpoint are still cleaned up by the caller.
+		d.logger.Info("No netns passed to DEL, skipping interface teardown.")
 	}
 
 	return nil
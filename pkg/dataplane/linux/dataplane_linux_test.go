@@ -0,0 +1,284 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linux
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+var _ = Describe("veth creation", func() {
+	var d *linuxDataplane
+	var calls int
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "calitestveth0"}, PeerName: "calitestveth1"}
+
+	// failFirst returns a linkAdd that fails the first n calls with the given error.
+	failFirst := func(n int, err error) func(netlink.Link) error {
+		return func(netlink.Link) error {
+			calls++
+			if calls <= n {
+				return err
+			}
+			return nil
+		}
+	}
+
+	BeforeEach(func() {
+		calls = 0
+		d = NewLinuxDataplane(types.NetConf{VethCreateRetries: 3, VethCreateBackoff: 1}, logrus.WithField("test", "veth"))
+	})
+
+	It("should retry a transient failure", func() {
+		d.linkAdd = failFirst(2, syscall.ENOMEM)
+		Expect(d.createVeth(veth)).To(Succeed())
+		Expect(calls).To(Equal(3))
+	})
+
+	It("should retry EBUSY", func() {
+		d.linkAdd = failFirst(1, syscall.EBUSY)
+		Expect(d.createVeth(veth)).To(Succeed())
+		Expect(calls).To(Equal(2))
+	})
+
+	It("should give up once the retries are exhausted", func() {
+		d.linkAdd = failFirst(10, syscall.ENOMEM)
+		err := d.createVeth(veth)
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Is(err, syscall.ENOMEM)).To(BeTrue())
+		Expect(calls).To(Equal(4))
+	})
+
+	It("should not retry a permanent failure", func() {
+		d.linkAdd = failFirst(10, syscall.EEXIST)
+		Expect(d.createVeth(veth)).To(Equal(syscall.EEXIST))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("should not retry by default", func() {
+		d = NewLinuxDataplane(types.NetConf{}, logrus.WithField("test", "veth"))
+		d.linkAdd = failFirst(1, syscall.ENOMEM)
+		Expect(d.createVeth(veth)).To(HaveOccurred())
+		Expect(calls).To(Equal(1))
+	})
+})
+
+var _ = Describe("DEL with no netns", func() {
+	It("should skip the interface teardown", func() {
+		d := NewLinuxDataplane(types.NetConf{}, logrus.WithField("test", "del"))
+		args := &skel.CmdArgs{ContainerID: "abcd", IfName: "eth0"}
+		Expect(d.ContainerInterfaceExists(args)).To(BeFalse())
+		Expect(d.CleanUpNamespace(args)).To(Succeed())
+	})
+})
+
+var _ = Describe("RemoveHostVeth", func() {
+	It("should do nothing if the link doesn't exist", func() {
+		d := NewLinuxDataplane(types.NetConf{}, logrus.WithField("test", "stale"))
+		Expect(d.RemoveHostVeth("calidoesnotexist")).To(Succeed())
+	})
+})
+
+var _ = Describe("isLinkGone", func() {
+	It("should recognise the errors for a link that has already been removed", func() {
+		Expect(isLinkGone(netlink.LinkNotFoundError{})).To(BeTrue())
+		Expect(isLinkGone(ip.ErrLinkNotFound)).To(BeTrue())
+		Expect(isLinkGone(syscall.ENODEV)).To(BeTrue())
+	})
+
+	It("should not hide other errors", func() {
+		Expect(isLinkGone(nil)).To(BeFalse())
+		Expect(isLinkGone(syscall.EPERM)).To(BeFalse())
+		Expect(isLinkGone(errors.New("failed to lookup \"eth0\": permission denied"))).To(BeFalse())
+	})
+})
+
+var _ = Describe("isNetNSGone", func() {
+	It("should recognise a netns path that no longer exists", func() {
+		Expect(isNetNSGone(ns.NSPathNotExistErr{})).To(BeTrue())
+		Expect(isNetNSGone(fmt.Errorf("failed to open netns: %w", syscall.ENOENT))).To(BeTrue())
+	})
+
+	It("should not hide other errors", func() {
+		Expect(isNetNSGone(nil)).To(BeFalse())
+		Expect(isNetNSGone(ns.NSPathNotNSErr{})).To(BeFalse())
+		Expect(isNetNSGone(syscall.EPERM)).To(BeFalse())
+	})
+
+	It("should make cleaning up a deleted netns a no-op", func() {
+		d := &linuxDataplane{logger: logrus.WithField("test", "cleanup")}
+		args := &skel.CmdArgs{Netns: "/var/run/netns/calico-test-does-not-exist", IfName: "eth0"}
+		Expect(d.CleanUpNamespace(args)).To(Succeed())
+	})
+})
+
+var _ = Describe("host sysctls", func() {
+	table.DescribeTable("hostSysctls",
+		func(proxyARP, hostForwarding, hasIPv4, hasIPv6 bool, expected []string) {
+			d := &linuxDataplane{proxyARP: proxyARP, hostForwarding: hostForwarding}
+			var got []string
+			for _, s := range d.hostSysctls("cali1", hasIPv4, hasIPv6) {
+				got = append(got, s.String())
+			}
+			Expect(got).To(Equal(expected))
+		},
+		table.Entry("defaults, dual stack", true, true, true, true, []string{
+			"net.ipv4.neigh.cali1.proxy_delay=0",
+			"net.ipv4.conf.cali1.proxy_arp=1",
+			"net.ipv4.conf.cali1.forwarding=1",
+			"net.ipv6.conf.cali1.disable_ipv6=0",
+			"net.ipv6.conf.cali1.proxy_ndp=1",
+			"net.ipv6.conf.cali1.forwarding=1",
+		}),
+		table.Entry("proxy ARP off", false, true, true, true, []string{
+			"net.ipv4.conf.cali1.forwarding=1",
+			"net.ipv6.conf.cali1.disable_ipv6=0",
+			"net.ipv6.conf.cali1.forwarding=1",
+		}),
+		table.Entry("host forwarding off", true, false, true, false, []string{
+			"net.ipv4.neigh.cali1.proxy_delay=0",
+			"net.ipv4.conf.cali1.proxy_arp=1",
+		}),
+		table.Entry("both off, IPv4", false, false, true, false, nil),
+		table.Entry("both off, IPv6 still enables IPv6", false, false, false, true, []string{
+			"net.ipv6.conf.cali1.disable_ipv6=0",
+		}),
+	)
+
+	It("defaults both on", func() {
+		d := NewLinuxDataplane(types.NetConf{}, logrus.WithField("test", "sysctls"))
+		Expect(d.proxyARP).To(BeTrue())
+		Expect(d.hostForwarding).To(BeTrue())
+
+		off := false
+		d = NewLinuxDataplane(types.NetConf{ProxyARP: &off, HostForwarding: &off}, logrus.WithField("test", "sysctls"))
+		Expect(d.proxyARP).To(BeFalse())
+		Expect(d.hostForwarding).To(BeFalse())
+	})
+})
+
+var _ = Describe("host routes", func() {
+	It("should default to the main table and the boot protocol", func() {
+		d := NewLinuxDataplane(types.NetConf{}, logrus.WithField("test", "routes"))
+		Expect(d.hostRouteTable).To(Equal(syscall.RT_TABLE_MAIN))
+		Expect(d.hostRouteProtocol).To(Equal(syscall.RTPROT_BOOT))
+	})
+
+	It("should use the configured table and protocol", func() {
+		d := NewLinuxDataplane(types.NetConf{HostRouteTable: 100, HostRouteProtocol: 80}, logrus.WithField("test", "routes"))
+		Expect(d.hostRouteTable).To(Equal(100))
+		Expect(d.hostRouteProtocol).To(Equal(80))
+	})
+})
+
+var _ = Describe("container gateways", func() {
+	logger := logrus.WithField("test", "gateway")
+
+	table.DescribeTable("containerGateways",
+		func(gateway, ipv6Gateway, expectedV4, expectedV6 string) {
+			conf := types.NetConf{IPv6Gateway: ipv6Gateway}
+			conf.ContainerSettings.Gateway = gateway
+			v4, v6 := containerGateways(conf, logger)
+			Expect(v4.String()).To(Equal(expectedV4))
+			if expectedV6 == "" {
+				Expect(v6).To(BeNil())
+			} else {
+				Expect(v6.String()).To(Equal(expectedV6))
+			}
+		},
+		table.Entry("defaults", "", "", "169.254.1.1", ""),
+		table.Entry("custom IPv4 gateway", "169.254.2.2", "", "169.254.2.2", ""),
+		table.Entry("in-subnet IPv4 gateway", "10.65.0.1", "", "10.65.0.1", ""),
+		table.Entry("IPv6 link-local gateway", "fe80::1", "", "169.254.1.1", "fe80::1"),
+		table.Entry("ipv6_gateway takes precedence", "fe80::1", "fe80::2", "169.254.1.1", "fe80::2"),
+		table.Entry("non-link-local IPv6 falls back", "fd00::1", "", "169.254.1.1", ""),
+		table.Entry("garbage falls back", "not-an-ip", "", "169.254.1.1", ""),
+		table.Entry("unspecified falls back", "0.0.0.0", "", "169.254.1.1", ""),
+		table.Entry("multicast falls back", "224.0.0.1", "", "169.254.1.1", ""),
+		table.Entry("broadcast falls back", "255.255.255.255", "", "169.254.1.1", ""),
+	)
+
+	It("should return an IPv4 gateway in 4-byte form", func() {
+		conf := types.NetConf{}
+		conf.ContainerSettings.Gateway = "169.254.2.2"
+		v4, _ := containerGateways(conf, logger)
+		Expect(v4).To(Equal(net.IPv4(169, 254, 2, 2).To4()))
+	})
+})
+
+var _ = Describe("ifbName", func() {
+	It("should give each container interface its own valid, non-workload name", func() {
+		eth0 := ifbName(&skel.CmdArgs{ContainerID: "abcd", IfName: "eth0"})
+		Expect(eth0).To(HaveLen(15))
+		Expect(eth0).NotTo(HavePrefix("cali"))
+		Expect(ifbName(&skel.CmdArgs{ContainerID: "abcd", IfName: "eth0"})).To(Equal(eth0))
+		Expect(ifbName(&skel.CmdArgs{ContainerID: "abcd", IfName: "net1"})).NotTo(Equal(eth0))
+		Expect(ifbName(&skel.CmdArgs{ContainerID: "efgh", IfName: "eth0"})).NotTo(Equal(eth0))
+	})
+})
+
+var _ = Describe("neighbor announcements", func() {
+	mac := net.HardwareAddr{0xee, 0xee, 0xee, 0xee, 0xee, 0x01}
+
+	It("should build a broadcast ARP announcement", func() {
+		frame := gratuitousARPFrame(mac, net.ParseIP("10.0.0.5"))
+		Expect(frame).To(Equal([]byte{
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xee, 0xee, 0xee, 0xee, 0xee, 0x01, 0x08, 0x06,
+			0x00, 0x01, 0x08, 0x00, 6, 4, 0x00, 0x01,
+			0xee, 0xee, 0xee, 0xee, 0xee, 0x01, 10, 0, 0, 5,
+			0, 0, 0, 0, 0, 0, 10, 0, 0, 5,
+		}))
+	})
+
+	It("should build an unsolicited neighbor advertisement with a valid checksum", func() {
+		ip := net.ParseIP("fd00::5")
+		frame := neighborAdvertFrame(mac, ip)
+		Expect(frame).To(HaveLen(14 + 40 + 32))
+		Expect(frame[:14]).To(Equal([]byte{0x33, 0x33, 0, 0, 0, 1, 0xee, 0xee, 0xee, 0xee, 0xee, 0x01, 0x86, 0xdd}))
+
+		ip6 := frame[14:]
+		Expect(ip6[6]).To(BeEquivalentTo(58))
+		Expect(ip6[7]).To(BeEquivalentTo(255))
+		Expect(net.IP(ip6[8:24]).Equal(ip)).To(BeTrue())
+		Expect(net.IP(ip6[24:40]).String()).To(Equal("ff02::1"))
+
+		na := ip6[40:]
+		Expect(na[0]).To(BeEquivalentTo(136))
+		Expect(na[4]).To(BeEquivalentTo(0x20), "only the override flag should be set")
+		Expect(net.IP(na[8:24]).Equal(ip)).To(BeTrue())
+		Expect(na[24:32]).To(Equal([]byte{2, 1, 0xee, 0xee, 0xee, 0xee, 0xee, 0x01}))
+
+		// Checksumming the message with its checksum in place gives zero.
+		Expect(icmpv6Checksum(ip6[8:24], ip6[24:40], na)).To(BeZero())
+	})
+
+	It("should convert to network byte order", func() {
+		n := htons(0x0806)
+		Expect((*[2]byte)(unsafe.Pointer(&n))[:]).To(Equal([]byte{0x08, 0x06}))
+	})
+})
@@ -0,0 +1,180 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// Gratuitous ARPs and unsolicited neighbor advertisements announce the container's addresses, with its MAC, to
+// whatever is listening on the other side of its veth, so that stale neighbor entries for the addresses are
+// replaced straight away when a workload's IP moves.
+const (
+	ethTypeIPv4 = 0x0800
+	ethTypeARP  = 0x0806
+	ethTypeIPv6 = 0x86dd
+
+	arpOpRequest = 1
+
+	icmpv6NeighborAdvert   = 136
+	ndOptTargetLinkLayer   = 2
+	ndFlagOverride         = 0x20000000
+	ndHopLimit             = 255
+	ndAdvertPayloadLength  = 32
+	ipv6HeaderLength       = 40
+	ethernetHeaderLength   = 14
+	arpPacketLength        = 28
+	icmpv6ProtocolNumber   = 58
+	ipv6VersionTrafficFlow = 6 << 28
+)
+
+var (
+	ethBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	// The all-nodes multicast address, and the Ethernet address that it maps to.
+	ipv6AllNodes    = net.ParseIP("ff02::1")
+	ethIPv6AllNodes = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+)
+
+// sendGratuitousARPs sends a gratuitous ARP for each of the container's IPv4 addresses, and an unsolicited
+// neighbor advertisement for each of its IPv6 addresses, from the container interface. Failures are logged
+// rather than returned, since the workload is networked either way.
+func (d *linuxDataplane) sendGratuitousARPs(args *skel.CmdArgs, result *current.Result) {
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		contVeth, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+		attrs := contVeth.Attrs()
+		for _, addr := range result.IPs {
+			var ethType uint16
+			var frame []byte
+			if ip4 := addr.Address.IP.To4(); ip4 != nil {
+				ethType, frame = ethTypeARP, gratuitousARPFrame(attrs.HardwareAddr, ip4)
+			} else {
+				ethType, frame = ethTypeIPv6, neighborAdvertFrame(attrs.HardwareAddr, addr.Address.IP)
+			}
+			if err = sendFrame(attrs.Index, ethType, frame); err != nil {
+				return fmt.Errorf("failed to announce %v on %q: %v", addr.Address.IP, args.IfName, err)
+			}
+			d.logger.WithField("IP", addr.Address.IP).Debug("Announced container IP")
+		}
+		return nil
+	})
+	if err != nil {
+		d.logger.WithError(err).Warn("Failed to send gratuitous ARP")
+	}
+}
+
+// sendFrame sends a complete Ethernet frame out of the given interface.
+func sendFrame(ifIndex int, ethType uint16, frame []byte) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethType)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	to := &syscall.SockaddrLinklayer{
+		Ifindex:  ifIndex,
+		Protocol: htons(ethType),
+		Halen:    6,
+	}
+	copy(to.Addr[:], frame[:6])
+	return syscall.Sendto(fd, frame, 0, to)
+}
+
+// gratuitousARPFrame returns a broadcast ARP request in which both the sender and the target are ip, as RFC 5227
+// describes for an ARP announcement.
+func gratuitousARPFrame(mac net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, ethernetHeaderLength+arpPacketLength)
+	putEthernetHeader(frame, ethBroadcast, mac, ethTypeARP)
+	arp := frame[ethernetHeaderLength:]
+	binary.BigEndian.PutUint16(arp[0:], 1) // Ethernet
+	binary.BigEndian.PutUint16(arp[2:], ethTypeIPv4)
+	arp[4] = 6
+	arp[5] = 4
+	binary.BigEndian.PutUint16(arp[6:], arpOpRequest)
+	copy(arp[8:14], mac)
+	copy(arp[14:18], ip.To4())
+	// The target hardware address is left zero.
+	copy(arp[24:28], ip.To4())
+	return frame
+}
+
+// neighborAdvertFrame returns an unsolicited neighbor advertisement for ip, sent to all nodes, with the override
+// flag set so that receivers replace any existing entry, as RFC 4861 section 7.2.6 describes.
+func neighborAdvertFrame(mac net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, ethernetHeaderLength+ipv6HeaderLength+ndAdvertPayloadLength)
+	putEthernetHeader(frame, ethIPv6AllNodes, mac, ethTypeIPv6)
+
+	ip6 := frame[ethernetHeaderLength:]
+	binary.BigEndian.PutUint32(ip6[0:], ipv6VersionTrafficFlow)
+	binary.BigEndian.PutUint16(ip6[4:], ndAdvertPayloadLength)
+	ip6[6] = icmpv6ProtocolNumber
+	ip6[7] = ndHopLimit
+	copy(ip6[8:24], ip.To16())
+	copy(ip6[24:40], ipv6AllNodes)
+
+	na := ip6[ipv6HeaderLength:]
+	na[0] = icmpv6NeighborAdvert
+	binary.BigEndian.PutUint32(na[4:], ndFlagOverride)
+	copy(na[8:24], ip.To16())
+	na[24] = ndOptTargetLinkLayer
+	na[25] = 1 // In units of 8 bytes.
+	copy(na[26:32], mac)
+	binary.BigEndian.PutUint16(na[2:], icmpv6Checksum(ip6[8:24], ip6[24:40], na))
+	return frame
+}
+
+func putEthernetHeader(frame []byte, dst, src net.HardwareAddr, ethType uint16) {
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:], ethType)
+}
+
+// icmpv6Checksum returns the checksum of an ICMPv6 message, whose own checksum field is zero, including the IPv6
+// pseudo-header.
+func icmpv6Checksum(src, dst, msg []byte) uint16 {
+	pseudo := make([]byte, 0, 40+len(msg))
+	pseudo = append(pseudo, src...)
+	pseudo = append(pseudo, dst...)
+	pseudo = append(pseudo, 0, 0, byte(len(msg)>>8), byte(len(msg)), 0, 0, 0, icmpv6ProtocolNumber)
+	pseudo = append(pseudo, msg...)
+	var sum uint32
+	for i := 0; i+1 < len(pseudo); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudo[i:]))
+	}
+	if len(pseudo)%2 == 1 {
+		sum += uint32(pseudo[len(pseudo)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// htons converts a 16-bit value to network byte order, as the packet socket calls expect.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
@@ -39,7 +39,9 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/ipam"
 	"github.com/projectcalico/libcalico-go/lib/logutils"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
 
+	"github.com/projectcalico/cni-plugin/internal/pkg/buildinfo"
 	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
 	"github.com/projectcalico/cni-plugin/pkg/types"
 	"github.com/projectcalico/cni-plugin/pkg/upgrade"
@@ -66,7 +68,9 @@ func Main(version string) {
 	}
 
 	if *versionFlag {
+		// Only the version goes to stdout, since it's what callers parse. The rest of the build info is for people.
 		fmt.Println(version)
+		fmt.Fprintln(os.Stderr, buildinfo.Get(version))
 		os.Exit(0)
 	}
 
@@ -106,8 +110,8 @@ func Main(version string) {
 		os.Exit(0)
 	}
 
-	skel.PluginMain(cmdAdd, nil, cmdDel,
-		cniSpecVersion.PluginSupports("0.1.0", "0.2.0", "0.3.0", "0.3.1"),
+	utils.PluginMain(cmdAdd, nil, cmdDel,
+		buildinfo.PluginInfo(cniSpecVersion.PluginSupports("0.1.0", "0.2.0", "0.3.0", "0.3.1"), version),
 		"Calico CNI IPAM "+version)
 }
 
@@ -126,6 +130,10 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	utils.ConfigureLogging(conf)
 
+	if err := validatePoolStrategy(conf.IPAMPoolStrategy); err != nil {
+		return err
+	}
+
 	calicoClient, err := utils.CreateClient(conf)
 	if err != nil {
 		return err
@@ -135,13 +143,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
+	utils.AddLogIdentifiers(epIDs)
 
 	epIDs.WEPName, err = epIDs.CalculateWorkloadEndpointName(false)
 	if err != nil {
 		return fmt.Errorf("error constructing WorkloadEndpoint name: %s", err)
 	}
 
-	handleID := utils.GetHandleID(conf.Name, args.ContainerID, epIDs.WEPName)
+	handleID := utils.GetEndpointHandleID(conf, conf.Name, args.ContainerID, args.IfName, epIDs.WEPName)
 
 	logger := logrus.WithFields(logrus.Fields{
 		"Workload":    epIDs.WEPName,
@@ -182,7 +191,9 @@ func cmdAdd(args *skel.CmdArgs) error {
 		assignIPWithLock := func() error {
 			unlock := acquireIPAMLockBestEffort(conf.IPAMLockFile)
 			defer unlock()
-			return calicoClient.IPAM().AssignIP(ctx, assignArgs)
+			return utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) error {
+				return calicoClient.IPAM().AssignIP(ctx, assignArgs)
+			})
 		}
 		err := assignIPWithLock()
 		if err != nil {
@@ -211,20 +222,29 @@ func cmdAdd(args *skel.CmdArgs) error {
 			logger.WithField("result.IPs", ipamArgs.IP).Info("Appending an IPv4 address to the result")
 		}
 	} else {
-		// Default to assigning an IPv4 address
-		num4 := 1
+		// Default to assigning IPv4 addresses, num_ipv4 of them.
+		perFamily4, perFamily6, err := utils.IPsPerFamily(conf)
+		if err != nil {
+			return err
+		}
+		num4 := perFamily4
 		if conf.IPAM.AssignIpv4 != nil && *conf.IPAM.AssignIpv4 == "false" {
 			num4 = 0
 		}
 
-		// Default to NOT assigning an IPv6 address
+		// Default to NOT assigning IPv6 addresses.
 		num6 := 0
 		if conf.IPAM.AssignIpv6 != nil && *conf.IPAM.AssignIpv6 == "true" {
-			num6 = 1
+			num6 = perFamily6
 		}
 
 		logger.Infof("Calico CNI IPAM request count IPv4=%d IPv6=%d", num4, num6)
 
+		exclude, err := utils.ParseIPAMExclude(conf.IPAMExclude)
+		if err != nil {
+			return err
+		}
+
 		v4pools, err := utils.ResolvePools(ctx, calicoClient, conf.IPAM.IPv4Pools, true)
 		if err != nil {
 			return err
@@ -235,6 +255,34 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return err
 		}
 
+		// Addresses reserved within the pools are excluded like any others, but a pool that's reserved in its
+		// entirety can't be assigned from at all, so it's dropped up front.
+		reserved, err := utils.ParseIPv4Reserved(conf.IPAM.IPv4Reserved)
+		if err != nil {
+			return err
+		}
+		if num4 > 0 && len(reserved) > 0 {
+			if v4pools, err = dropReservedPools(ctx, calicoClient, nodename, v4pools, reserved, logger); err != nil {
+				return err
+			}
+		}
+		exclude = append(exclude, reserved...)
+
+		if conf.CheckPoolFamilies {
+			if err := checkPoolFamilies(ctx, calicoClient, num4, num6, v4pools, v6pools); err != nil {
+				return err
+			}
+		}
+
+		if conf.IPAMPoolStrategy == poolStrategyMostFree {
+			if num4 > 0 {
+				v4pools = mostFreePool(ctx, calicoClient, nodename, v4pools, 4, logger)
+			}
+			if num6 > 0 {
+				v6pools = mostFreePool(ctx, calicoClient, nodename, v6pools, 6, logger)
+			}
+		}
+
 		logger.Debugf("Calico CNI IPAM handle=%s", handleID)
 		var maxBlocks int
 		if conf.WindowsUseSingleNetwork {
@@ -270,65 +318,56 @@ func cmdAdd(args *skel.CmdArgs) error {
 			// on the API server by a factor of the number of concurrent requests.
 			unlock := acquireIPAMLockBestEffort(conf.IPAMLockFile)
 			defer unlock()
-			return calicoClient.IPAM().AutoAssign(ctx, assignArgs)
+			var v4, v6 []cnet.IPNet
+			err := utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) (err error) {
+				v4, v6, err = calicoClient.IPAM().AutoAssign(ctx, assignArgs)
+				return
+			})
+			return v4, v6, err
 		}
 		assignedV4, assignedV6, err := autoAssignWithLock(calicoClient, ctx, assignArgs)
 		logger.Infof("Calico CNI IPAM assigned addresses IPv4=%v IPv6=%v", assignedV4, assignedV6)
 		if err != nil {
+			releaseAssigned(ctx, calicoClient, assignedV4, assignedV6, logger)
 			return err
 		}
 
-		// Check if IPv4 address assignment fails but IPv6 address assignment succeeds. Release IPs for the successful IPv6 address assignment.
-		if num4 == 1 && len(assignedV4) != num4 {
-			if num6 == 1 && len(assignedV6) != 0 {
-				logger.Infof("Assigned IPv6 addresses but failed to assign IPv4 addresses. Releasing %d IPv6 addresses", len(assignedV6))
-				// Free the assigned IPv6 addresses when v4 address assignment fails.
-				v6IPs := []cnet.IP{}
-				for _, v6 := range assignedV6 {
-					v6IPs = append(v6IPs, *cnet.ParseIP(v6.IP.String()))
-				}
-				_, err := calicoClient.IPAM().ReleaseIPs(ctx, v6IPs)
-				if err != nil {
-					log.Errorf("Error releasing IPv6 addresses %+v on IPv4 address assignment failure: %s", v6IPs, err)
-				}
+		// Swap out any addresses that the config says must never be handed to a workload.
+		if len(exclude) > 0 {
+			assignedV4, assignedV6, err = replaceExcludedIPs(ctx, calicoClient, assignArgs, assignedV4, assignedV6, exclude, autoAssignWithLock, logger)
+			if err != nil {
+				return err
 			}
 		}
 
-		// Check if IPv6 address assignment fails but IPv4 address assignment succeeds. Release IPs for the successful IPv4 address assignment.
-		if num6 == 1 && len(assignedV6) != num6 {
-			if num4 == 1 && len(assignedV4) != 0 {
-				logger.Infof("Assigned IPv4 addresses but failed to assign IPv6 addresses. Releasing %d IPv4 addresses", len(assignedV4))
-				// Free the assigned IPv4 addresses when v4 address assignment fails.
-				v4IPs := []cnet.IP{}
-				for _, v4 := range assignedV4 {
-					v4IPs = append(v4IPs, *cnet.ParseIP(v4.IP.String()))
-				}
-				_, err := calicoClient.IPAM().ReleaseIPs(ctx, v4IPs)
-				if err != nil {
-					log.Errorf("Error releasing IPv4 addresses %+v on IPv6 address assignment failure: %s", v4IPs, err)
-				}
+		// If either family came up short, release everything that was assigned, so that a workload never ends
+		// up with only some of its addresses.
+		// AutoAssign returns fewer addresses than it was asked for, rather than an error, when the pools are full.
+		if len(assignedV4) != num4 || len(assignedV6) != num6 {
+			releaseAssigned(ctx, calicoClient, assignedV4, assignedV6, logger)
+			exhausted := &utils.PoolExhaustedError{Family: 4}
+			logger.Errorf("Failed to request %d IPv4 and %d IPv6 addresses. IPAM allocated only %d and %d",
+				num4, num6, len(assignedV4), len(assignedV6))
+			if len(assignedV4) != num4 {
+				exhausted.Pools = triedPoolNames(ctx, calicoClient, v4pools, 4, logger)
+			} else {
+				exhausted.Family = 6
+				exhausted.Pools = triedPoolNames(ctx, calicoClient, v6pools, 6, logger)
 			}
+			return exhausted.CNIError()
 		}
 
-		if num4 == 1 {
-			if len(assignedV4) != num4 {
-				return fmt.Errorf("failed to request %d IPv4 addresses. IPAM allocated only %d", num4, len(assignedV4))
-			}
-			ipV4Network := net.IPNet{IP: assignedV4[0].IP, Mask: assignedV4[0].Mask}
+		for _, v4 := range assignedV4 {
 			r.IPs = append(r.IPs, &current.IPConfig{
 				Version: "4",
-				Address: ipV4Network,
+				Address: net.IPNet{IP: v4.IP, Mask: v4.Mask},
 			})
 		}
 
-		if num6 == 1 {
-			if len(assignedV6) != num6 {
-				return fmt.Errorf("failed to request %d IPv6 addresses. IPAM allocated only %d", num6, len(assignedV6))
-			}
-			ipV6Network := net.IPNet{IP: assignedV6[0].IP, Mask: assignedV6[0].Mask}
+		for _, v6 := range assignedV6 {
 			r.IPs = append(r.IPs, &current.IPConfig{
 				Version: "6",
-				Address: ipV6Network,
+				Address: net.IPNet{IP: v6.IP, Mask: v6.Mask},
 			})
 		}
 
@@ -339,6 +378,173 @@ func cmdAdd(args *skel.CmdArgs) error {
 	return cnitypes.PrintResult(r, conf.CNIVersion)
 }
 
+// triedPoolNames returns the names of the enabled IP pools of the given family that AutoAssign could have used:
+// those in pools, or all of them if pools is empty. It's only used to report pool exhaustion, so it falls back
+// to the CIDRs if the pools can't be listed.
+func triedPoolNames(ctx context.Context, calicoClient client.Interface, pools []cnet.IPNet, family int, logger *logrus.Entry) []string {
+	var names []string
+	list, err := calicoClient.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to list IP pools to report which are exhausted")
+		for _, p := range pools {
+			names = append(names, p.String())
+		}
+		return names
+	}
+	for _, p := range list.Items {
+		_, cidr, err := cnet.ParseCIDR(p.Spec.CIDR)
+		if err != nil || p.Spec.Disabled || cidr.Version() != family {
+			continue
+		}
+		if len(pools) == 0 || containsPool(pools, *cidr) {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+func containsPool(pools []cnet.IPNet, cidr cnet.IPNet) bool {
+	for _, p := range pools {
+		if p.String() == cidr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseAssigned releases the addresses that were assigned for an ADD that's going to fail.
+func releaseAssigned(ctx context.Context, calicoClient client.Interface, assignedV4, assignedV6 []cnet.IPNet, logger *logrus.Entry) {
+	ips := appendIPs(nil, assignedV4, assignedV6)
+	if len(ips) == 0 {
+		return
+	}
+	logger.Infof("Failed to assign all the requested addresses. Releasing %d addresses", len(ips))
+	if _, err := calicoClient.IPAM().ReleaseIPs(ctx, ips); err != nil {
+		logger.WithError(err).Errorf("Error releasing addresses %+v after a failed assignment", ips)
+	}
+}
+
+// checkPoolFamilies makes sure that there's an IP pool to assign from for each IP family we've been asked for,
+// so that a misconfiguration gives a clear error up front rather than a partial assignment failure. It's only
+// called when check_pool_families is set, since it costs an extra list of the IP pools on every ADD.
+func checkPoolFamilies(ctx context.Context, calicoClient client.Interface, num4, num6 int, v4pools, v6pools []cnet.IPNet) error {
+	// Pools that were explicitly configured have already been checked by ResolvePools.
+	need4 := num4 > 0 && len(v4pools) == 0
+	need6 := num6 > 0 && len(v6pools) == 0
+	if !need4 && !need6 {
+		return nil
+	}
+
+	pools, err := calicoClient.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list IP pools: %v", err)
+	}
+	var have4, have6 bool
+	for _, p := range pools.Items {
+		if p.Spec.Disabled {
+			continue
+		}
+		_, cidr, err := cnet.ParseCIDR(p.Spec.CIDR)
+		if err != nil {
+			continue
+		}
+		if cidr.Version() == 4 {
+			have4 = true
+		} else {
+			have6 = true
+		}
+	}
+
+	if need4 && !have4 {
+		return fmt.Errorf("assign_ipv4 requested but no IPv4 pool exists")
+	}
+	if need6 && !have6 {
+		return fmt.Errorf("assign_ipv6 requested but no IPv6 pool exists")
+	}
+	return nil
+}
+
+// maxExcludeRetries is the number of times we'll ask for a replacement for an excluded address before giving up.
+const maxExcludeRetries = 5
+
+type autoAssignFn func(calicoClient client.Interface, ctx context.Context, assignArgs ipam.AutoAssignArgs) ([]cnet.IPNet, []cnet.IPNet, error)
+
+// replaceExcludedIPs replaces any of the assigned addresses that fall within the ipam_exclude or ipv4_reserved
+// lists with newly assigned ones. The excluded addresses are held until we're done so that we don't simply get
+// them back again, then released. If we can't get a usable set of addresses, everything is released.
+func replaceExcludedIPs(
+	ctx context.Context,
+	calicoClient client.Interface,
+	assignArgs ipam.AutoAssignArgs,
+	assignedV4, assignedV6 []cnet.IPNet,
+	exclude []*net.IPNet,
+	autoAssign autoAssignFn,
+	logger *logrus.Entry,
+) ([]cnet.IPNet, []cnet.IPNet, error) {
+	var good4, good6 []cnet.IPNet
+	var held []cnet.IP
+	releaseHeld := func() {
+		if len(held) == 0 {
+			return
+		}
+		logger.WithField("IPs", held).Info("Releasing excluded addresses")
+		if _, err := calicoClient.IPAM().ReleaseIPs(ctx, held); err != nil {
+			logger.WithError(err).Error("Failed to release excluded addresses")
+		}
+	}
+	defer releaseHeld()
+
+	for attempt := 0; ; attempt++ {
+		var bad4, bad6 int
+		good4, bad4, held = filterExcluded(good4, assignedV4, exclude, held)
+		good6, bad6, held = filterExcluded(good6, assignedV6, exclude, held)
+		if bad4 == 0 && bad6 == 0 {
+			return good4, good6, nil
+		}
+		if attempt == maxExcludeRetries {
+			// Release the usable addresses too, since we're not going to return them.
+			held = appendIPs(held, good4, good6)
+			return nil, nil, fmt.Errorf("failed to assign an address outside of ipam_exclude and ipv4_reserved after %d attempts", maxExcludeRetries)
+		}
+
+		logger.WithFields(logrus.Fields{"IPv4": bad4, "IPv6": bad6}).Info("Assigned excluded addresses, requesting replacements")
+		assignArgs.Num4 = bad4
+		assignArgs.Num6 = bad6
+		var err error
+		assignedV4, assignedV6, err = autoAssign(calicoClient, ctx, assignArgs)
+		if err != nil || len(assignedV4) != bad4 || len(assignedV6) != bad6 {
+			held = appendIPs(held, good4, good6, assignedV4, assignedV6)
+			if err == nil {
+				err = fmt.Errorf("failed to assign replacements for excluded addresses")
+			}
+			return nil, nil, err
+		}
+	}
+}
+
+// filterExcluded appends the assigned addresses that aren't excluded to keep, and the ones that are to held.
+func filterExcluded(keep, assigned []cnet.IPNet, exclude []*net.IPNet, held []cnet.IP) ([]cnet.IPNet, int, []cnet.IP) {
+	var excluded int
+	for _, a := range assigned {
+		if utils.IsExcluded(a.IP, exclude) {
+			held = append(held, cnet.IP{IP: a.IP})
+			excluded++
+			continue
+		}
+		keep = append(keep, a)
+	}
+	return keep, excluded, held
+}
+
+func appendIPs(ips []cnet.IP, nets ...[]cnet.IPNet) []cnet.IP {
+	for _, n := range nets {
+		for _, a := range n {
+			ips = append(ips, cnet.IP{IP: a.IP})
+		}
+	}
+	return ips
+}
+
 type unlockFn func()
 
 // acquireIPAMLockBestEffort attempts to acquire the IPAM file lock, blocking if needed.  If an error occurs
@@ -391,13 +597,14 @@ func cmdDel(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
+	utils.AddLogIdentifiers(epIDs)
 
 	epIDs.WEPName, err = epIDs.CalculateWorkloadEndpointName(false)
 	if err != nil {
 		return fmt.Errorf("error constructing WorkloadEndpoint name: %s", err)
 	}
 
-	handleID := utils.GetHandleID(conf.Name, args.ContainerID, epIDs.WEPName)
+	handleID := utils.GetEndpointHandleID(conf, conf.Name, args.ContainerID, args.IfName, epIDs.WEPName)
 	logger := logrus.WithFields(logrus.Fields{
 		"Workload":    epIDs.WEPName,
 		"ContainerID": epIDs.ContainerID,
@@ -416,7 +623,12 @@ func cmdDel(args *skel.CmdArgs) error {
 	unlock := acquireIPAMLockBestEffort(conf.IPAMLockFile)
 	defer unlock()
 
-	if err := calicoClient.IPAM().ReleaseByHandle(ctx, handleID); err != nil {
+	// Releasing by handle only needs the handle and its blocks, which outlive the IP pool they were carved
+	// from, so this works even if the pool has been disabled or deleted since the ADD.
+	err = utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) error {
+		return calicoClient.IPAM().ReleaseByHandle(ctx, handleID)
+	})
+	if err != nil {
 		if _, ok := err.(errors.ErrorResourceDoesNotExist); !ok {
 			logger.WithError(err).Error("Failed to release address")
 			return err
@@ -433,7 +645,10 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 
 	logger.Info("Releasing address using workloadID")
-	if err := calicoClient.IPAM().ReleaseByHandle(ctx, workloadID); err != nil {
+	err = utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) error {
+		return calicoClient.IPAM().ReleaseByHandle(ctx, workloadID)
+	})
+	if err != nil {
 		if _, ok := err.(errors.ErrorResourceDoesNotExist); !ok {
 			logger.WithError(err).Error("Failed to release address")
 			return err
@@ -0,0 +1,177 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipamplugin
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// Values for ipam_pool_strategy.
+const (
+	poolStrategyAny      = "any"
+	poolStrategyMostFree = "most-free"
+)
+
+func validatePoolStrategy(strategy string) error {
+	switch strategy {
+	case "", poolStrategyAny, poolStrategyMostFree:
+		return nil
+	default:
+		return fmt.Errorf("invalid ipam_pool_strategy %q: must be %s or %s", strategy, poolStrategyAny, poolStrategyMostFree)
+	}
+}
+
+// mostFreePool narrows the candidate pools for an IP family down to the one with the most free addresses. The
+// candidates are the given pools or, if there aren't any, the enabled pools of that family that can be used on
+// the node. This is best effort: if the utilization can't be worked out, the pools are returned unchanged so that
+// IPAM falls back to the "any" strategy.
+func mostFreePool(
+	ctx context.Context,
+	calicoClient client.Interface,
+	nodename string,
+	pools []cnet.IPNet,
+	version int,
+	logger *logrus.Entry,
+) []cnet.IPNet {
+	logger = logger.WithField("ipVersion", version)
+	candidates := pools
+	if len(candidates) == 0 {
+		var err error
+		if candidates, err = nodePools(ctx, calicoClient, nodename, version); err != nil {
+			logger.WithError(err).Warn("Failed to find IP pools for the node, falling back to any pool")
+			return pools
+		}
+	}
+	if len(candidates) < 2 {
+		return pools
+	}
+
+	cidrs := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		cidrs = append(cidrs, c.String())
+	}
+	usage, err := calicoClient.IPAM().GetUtilization(ctx, ipam.GetUtilizationArgs{Pools: cidrs})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to get IP pool utilization, falling back to any pool")
+		return pools
+	}
+
+	best := 0
+	var bestFree *big.Int
+	for i, c := range candidates {
+		free := freeAddresses(c, usage)
+		logger.WithFields(logrus.Fields{"pool": c.String(), "free": free}).Debug("IP pool utilization")
+		if bestFree == nil || free.Cmp(bestFree) > 0 {
+			best, bestFree = i, free
+		}
+	}
+	logger.WithField("pool", candidates[best].String()).Info("Assigning from the IP pool with the most free addresses")
+	return []cnet.IPNet{candidates[best]}
+}
+
+// dropReservedPools removes the IPv4 pools that are entirely reserved from the candidates, returning an error if
+// that leaves none. The candidates are the given pools or, if there aren't any, the enabled IPv4 pools that can be
+// used on the node; if those can't be looked up, the pools are returned unchanged and reserved addresses are only
+// skipped as they're assigned.
+func dropReservedPools(
+	ctx context.Context,
+	calicoClient client.Interface,
+	nodename string,
+	pools []cnet.IPNet,
+	reserved []*net.IPNet,
+	logger *logrus.Entry,
+) ([]cnet.IPNet, error) {
+	candidates := pools
+	if len(candidates) == 0 {
+		var err error
+		if candidates, err = nodePools(ctx, calicoClient, nodename, 4); err != nil {
+			logger.WithError(err).Warn("Failed to find IP pools for the node, not checking them against ipv4_reserved")
+			return pools, nil
+		}
+	}
+	if len(candidates) == 0 {
+		return pools, nil
+	}
+
+	var usable []cnet.IPNet
+	for _, c := range candidates {
+		if utils.CoversIPv4Network(reserved, c.IPNet) {
+			logger.WithField("pool", c.String()).Info("Every address in the IP pool is reserved, skipping it")
+			continue
+		}
+		usable = append(usable, c)
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("ipv4_reserved covers every address in the IPv4 pools %v", candidates)
+	}
+	if len(usable) == len(candidates) {
+		return pools, nil
+	}
+	return usable, nil
+}
+
+// nodePools returns the CIDRs of the enabled pools of the given IP version that can be used on the node.
+func nodePools(ctx context.Context, calicoClient client.Interface, nodename string, version int) ([]cnet.IPNet, error) {
+	node, err := calicoClient.Nodes().Get(ctx, nodename, options.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	poolList, err := calicoClient.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []cnet.IPNet
+	for _, p := range poolList.Items {
+		if p.Spec.Disabled {
+			continue
+		}
+		_, cidr, err := cnet.ParseCIDR(p.Spec.CIDR)
+		if err != nil || cidr.Version() != version {
+			continue
+		}
+		if selects, err := p.SelectsNode(*node); err != nil || !selects {
+			continue
+		}
+		result = append(result, *cidr)
+	}
+	return result, nil
+}
+
+// freeAddresses returns the number of addresses in the pool that aren't allocated in any of its blocks.
+func freeAddresses(pool cnet.IPNet, usage []*ipam.PoolUtilization) *big.Int {
+	ones, bits := pool.Mask.Size()
+	free := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	for _, u := range usage {
+		if u.CIDR.String() != pool.String() {
+			continue
+		}
+		for _, b := range u.Blocks {
+			free.Sub(free, big.NewInt(int64(b.Capacity-b.Available)))
+		}
+	}
+	return free
+}
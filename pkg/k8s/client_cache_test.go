@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+)
+
+// Nothing listens on this endpoint; the clientset only connects when it's first used. The token is only used for
+// https servers, so the endpoint has to be one for a rotated token to change the config.
+func clientCacheConf(token string) types.NetConf {
+	conf := types.NetConf{}
+	conf.Kubernetes.K8sAPIRoot = "https://127.0.0.1:6443"
+	conf.Policy.K8sAuthToken = token
+	return conf
+}
+
+var _ = Describe("NewK8sClient caching", func() {
+	logger := logrus.WithField("test", "k8s-client-cache")
+
+	It("reuses the clientset while the config is the same", func() {
+		c1, err := NewK8sClient(clientCacheConf("token-1"), logger)
+		Expect(err).NotTo(HaveOccurred())
+		c2, err := NewK8sClient(clientCacheConf("token-1"), logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c2).To(BeIdenticalTo(c1))
+	})
+
+	It("creates a new clientset when the token is rotated", func() {
+		c1, err := NewK8sClient(clientCacheConf("token-1"), logger)
+		Expect(err).NotTo(HaveOccurred())
+		c2, err := NewK8sClient(clientCacheConf("token-2"), logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c2).NotTo(BeIdenticalTo(c1))
+
+		// Going back to the first token doesn't return the clientset for the second.
+		c3, err := NewK8sClient(clientCacheConf("token-1"), logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c3).NotTo(BeIdenticalTo(c2))
+	})
+})
+
+// BenchmarkNewK8sClient compares repeated calls with the same config, which share a clientset, against calls that
+// alternate between two tokens and so set up a new clientset each time.
+func BenchmarkNewK8sClient(b *testing.B) {
+	logger := logrus.WithField("test", "k8s-client-cache")
+
+	b.Run("same config", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := NewK8sClient(clientCacheConf("token-1"), logger); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("changing config", func(b *testing.B) {
+		confs := []types.NetConf{clientCacheConf("token-1"), clientCacheConf("token-2")}
+		for i := 0; i < b.N; i++ {
+			if _, err := NewK8sClient(confs[i%2], logger); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -21,17 +21,23 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
-	"github.com/containernetworking/plugins/pkg/ipam"
 
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
@@ -41,6 +47,8 @@ import (
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
 	"github.com/projectcalico/libcalico-go/lib/options"
 
+	"github.com/projectcalico/cni-plugin/internal/pkg/metrics"
+	"github.com/projectcalico/cni-plugin/internal/pkg/tracing"
 	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
 	"github.com/projectcalico/cni-plugin/internal/pkg/utils/cri"
 	"github.com/projectcalico/cni-plugin/pkg/dataplane"
@@ -109,7 +117,7 @@ func CmdAddK8s(ctx context.Context, args *skel.CmdArgs, conf types.NetConf, epID
 		getRealPodCIDR := func() (string, error) {
 			if cachedPodCidr == "" {
 				var err error
-				cachedPodCidr, err = getPodCidr(client, conf, epIDs.Node)
+				cachedPodCidr, err = getPodCidr(client.CoreV1().Nodes(), conf, epIDs.Node)
 				if err != nil {
 					return "", err
 				}
@@ -171,9 +179,15 @@ func CmdAddK8s(ctx context.Context, args *skel.CmdArgs, conf types.NetConf, epID
 		}
 		logger.WithField("routes", routes).Info("Using custom routes from CNI configuration.")
 	}
+	if conf.AdditionalInterface {
+		// A second endpoint for the pod leaves the routes to the first.
+		logger.Debug("Not adding routes for a secondary interface")
+		routes = nil
+	}
 
 	labels := make(map[string]string)
 	annot := make(map[string]string)
+	annotNS := make(map[string]string)
 
 	var ports []api.EndpointPort
 	var profiles []string
@@ -184,13 +198,17 @@ func CmdAddK8s(ctx context.Context, args *skel.CmdArgs, conf types.NetConf, epID
 	// run the plugin under Kubernetes without needing it to access the
 	// Kubernetes API
 	if conf.Policy.PolicyType == "k8s" {
-		annotNS, err := getK8sNSInfo(client, epIDs.Namespace)
+		annotNS, err = getK8sNSInfo(client, epIDs.Namespace)
 		if err != nil {
 			return nil, err
 		}
 		logger.WithField("NS Annotations", annotNS).Debug("Fetched K8s namespace annotations")
 
-		labels, annot, ports, profiles, generateName, err = getK8sPodInfo(client, epIDs.Pod, epIDs.Namespace)
+		podOpts, err := podGetOptions(conf.Kubernetes.PodReadConsistency)
+		if err != nil {
+			return nil, err
+		}
+		labels, annot, ports, profiles, generateName, err = getK8sPodInfo(client.CoreV1().Pods(epIDs.Namespace), epIDs.Pod, podOpts)
 		if err != nil {
 			return nil, err
 		}
@@ -198,144 +216,89 @@ func CmdAddK8s(ctx context.Context, args *skel.CmdArgs, conf types.NetConf, epID
 		logger.WithField("annotations", annot).Debug("Fetched K8s annotations")
 		logger.WithField("ports", ports).Debug("Fetched K8s ports")
 		logger.WithField("profiles", profiles).Debug("Generated profiles")
-
-		// Check for calico IPAM specific annotations and set them if needed.
-		if conf.IPAM.Type == "calico-ipam" {
-
-			var v4pools, v6pools string
-
-			// Sets  the Namespace annotation for IP pools as default
-			v4pools = annotNS["cni.projectcalico.org/ipv4pools"]
-			v6pools = annotNS["cni.projectcalico.org/ipv6pools"]
-
-			// Gets the POD annotation for IP Pools and overwrites Namespace annotation if it exists
-			v4poolpod := annot["cni.projectcalico.org/ipv4pools"]
-			if len(v4poolpod) != 0 {
-				v4pools = v4poolpod
-			}
-			v6poolpod := annot["cni.projectcalico.org/ipv6pools"]
-			if len(v6poolpod) != 0 {
-				v6pools = v6poolpod
-			}
-
-			if len(v4pools) != 0 || len(v6pools) != 0 {
-				var stdinData map[string]interface{}
-				if err := json.Unmarshal(args.StdinData, &stdinData); err != nil {
-					return nil, err
-				}
-				var v4PoolSlice, v6PoolSlice []string
-
-				if len(v4pools) > 0 {
-					if err := json.Unmarshal([]byte(v4pools), &v4PoolSlice); err != nil {
-						logger.WithField("IPv4Pool", v4pools).Error("Error parsing IPv4 IPPools")
-						return nil, err
-					}
-
-					if _, ok := stdinData["ipam"].(map[string]interface{}); !ok {
-						return nil, errors.New("data on stdin was of unexpected type")
-					}
-					stdinData["ipam"].(map[string]interface{})["ipv4_pools"] = v4PoolSlice
-					logger.WithField("ipv4_pools", v4pools).Debug("Setting IPv4 Pools")
-				}
-				if len(v6pools) > 0 {
-					if err := json.Unmarshal([]byte(v6pools), &v6PoolSlice); err != nil {
-						logger.WithField("IPv6Pool", v6pools).Error("Error parsing IPv6 IPPools")
-						return nil, err
-					}
-
-					if _, ok := stdinData["ipam"].(map[string]interface{}); !ok {
-						return nil, errors.New("data on stdin was of unexpected type")
-					}
-					stdinData["ipam"].(map[string]interface{})["ipv6_pools"] = v6PoolSlice
-					logger.WithField("ipv6_pools", v6pools).Debug("Setting IPv6 Pools")
-				}
-
-				newData, err := json.Marshal(stdinData)
-				if err != nil {
-					logger.WithField("stdinData", stdinData).Error("Error Marshaling data")
-					return nil, err
-				}
-				args.StdinData = newData
-				logger.Debug("Updated stdin data")
-			}
-		}
 	}
 
-	ipAddrsNoIpam := annot["cni.projectcalico.org/ipAddrsNoIpam"]
-	ipAddrs := annot["cni.projectcalico.org/ipAddrs"]
-
-	// Switch based on which annotations are passed or not passed.
-	switch {
-	case ipAddrs == "" && ipAddrsNoIpam == "":
-		// Call the IPAM plugin.
-		result, err = utils.AddIPAM(conf, args, logger)
+	// Work out which pools the IPAM plugin should allocate from and pass them on to it.
+	if conf.IPAM.Type == "calico-ipam" {
+		newData, err := setIPAMPools(ctx, calicoClient, conf, epIDs.Node, annot, annotNS, args.StdinData, logger)
 		if err != nil {
 			return nil, err
 		}
+		args.StdinData = newData
+		logger.Debug("Updated stdin data")
+	}
 
-	case ipAddrs != "" && ipAddrsNoIpam != "":
-		// Can't have both ipAddrs and ipAddrsNoIpam annotations at the same time.
-		e := fmt.Errorf("can't have both annotations: 'ipAddrs' and 'ipAddrsNoIpam' in use at the same time")
-		logger.Error(e)
-		return nil, e
-
-	case ipAddrsNoIpam != "":
-		// Validate that we're allowed to use this feature.
-		if conf.IPAM.Type != "calico-ipam" {
-			e := fmt.Errorf("ipAddrsNoIpam is not compatible with configured IPAM: %s", conf.IPAM.Type)
-			logger.Error(e)
-			return nil, e
-		}
-		if !conf.FeatureControl.IPAddrsNoIpam {
-			e := fmt.Errorf("requested feature is not enabled: ip_addrs_no_ipam")
-			logger.Error(e)
-			return nil, e
-		}
-
-		// ipAddrsNoIpam annotation is set so bypass IPAM, and set the IPs manually.
-		overriddenResult, err := overrideIPAMResult(ipAddrsNoIpam, logger)
-		if err != nil {
-			return nil, err
-		}
-		logger.Debugf("Bypassing IPAM to set the result to: %+v", overriddenResult)
+	// Check whether the pod has asked to start with ingress blocked. This is validated before IPAM is
+	// called so that a misconfiguration doesn't leave an allocation behind.
+	startupBlocked, err := getStartupBlocked(ctx, calicoClient, conf, annot, logger)
+	if err != nil {
+		return nil, err
+	}
 
-		// Convert overridden IPAM result into current Result.
-		// This method fill in all the empty fields necessory for CNI output according to spec.
-		result, err = current.NewResultFromResult(overriddenResult)
-		if err != nil {
+	// Likewise check any requested policy tier up front.
+	policyTier, err := getPolicyTier(conf, annot)
+	if err != nil {
+		return nil, err
+	}
+	disableNATOutgoing, err := getDisableNATOutgoing(annot)
+	if err != nil {
+		return nil, err
+	}
+	noProfile, err := getNoProfile(annot)
+	if err != nil {
+		return nil, err
+	}
+	if hwAddr := annot[utils.HwAddrAnnotation]; hwAddr != "" {
+		if _, err = utils.ParseHwAddr(hwAddr); err != nil {
 			return nil, err
 		}
-
-		if len(result.IPs) == 0 {
-			return nil, errors.New("failed to build result")
+	}
+	if _, err = utils.ParseBandwidth(annot); err != nil {
+		return nil, err
+	}
+	dns, err := utils.ResultDNS(conf, annot)
+	if err != nil {
+		return nil, err
+	}
+	secondaryIPs, err := getSecondaryIPs(annot, logger)
+	if err != nil {
+		return nil, err
+	}
+	extraLabels, err := annotationLabels(conf.AnnotationLabelPrefix, annot)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range extraLabels {
+		if existing, ok := labels[k]; ok {
+			logger.WithFields(logrus.Fields{"label": k, "value": existing}).Warn(
+				"Pod already has a label that an annotation would set, keeping the pod's label")
+			continue
 		}
+		labels[k] = v
+	}
 
-	case ipAddrs != "":
-		// Validate that we're allowed to use this feature.
-		if conf.IPAM.Type != "calico-ipam" {
-			e := fmt.Errorf("ipAddrs is not compatible with configured IPAM: %s", conf.IPAM.Type)
-			logger.Error(e)
-			return nil, e
+	_, ipamSpan := tracing.Start(ctx, "ipam-allocate")
+	ipamSpan.SetAttribute("ipam.type", conf.IPAM.Type)
+	result, err = assignIPs(ctx, conf, args, endpoint, calicoClient, annot, logger)
+	ipamSpan.Finish(err)
+	if err != nil {
+		return nil, metrics.IPAMFailure(err)
+	}
+	if conf.RequirePoolForStaticIPs && annot["cni.projectcalico.org/ipAddrsNoIpam"] != "" {
+		var ips []net.IP
+		for _, ipConf := range result.IPs {
+			ips = append(ips, ipConf.Address.IP)
 		}
-
-		// If the endpoint already exists, we need to attempt to release the previous IP addresses here
-		// since the ADD call will fail when it tries to reallocate the same IPs. releaseIPAddrs assumes
-		// that Calico IPAM is in use, which is OK here since only Calico IPAM supports the ipAddrs
-		// annotation.
-		if endpoint != nil {
-			logger.Info("Endpoint already exists and ipAddrs is set. Release any old IPs")
-			if err := releaseIPAddrs(endpoint.Spec.IPNetworks, calicoClient, logger); err != nil {
-				return nil, fmt.Errorf("failed to release ipAddrs: %s", err)
-			}
+		for _, ipConf := range secondaryIPs {
+			ips = append(ips, ipConf.Address.IP)
 		}
-
-		// When ipAddrs annotation is set, we call out to the configured IPAM plugin
-		// requesting the specific IP addresses included in the annotation.
-		result, err = ipAddrsResult(ipAddrs, conf, args, logger)
-		if err != nil {
+		if err = checkStaticIPsInPools(ctx, calicoClient, ips); err != nil {
 			return nil, err
 		}
-		logger.Debugf("IPAM result set to: %+v", result)
+	}
+	// Set before networking, since the Windows dataplane may replace it with the runtime's DNS config.
+	if dns != nil {
+		result.DNS = *dns
 	}
 
 	// Configure the endpoint (creating if required).
@@ -353,22 +316,47 @@ func CmdAddK8s(ctx context.Context, args *skel.CmdArgs, conf types.NetConf, epID
 	endpoint.Spec.Pod = epIDs.Pod
 	endpoint.Spec.Ports = ports
 	endpoint.Spec.IPNetworks = []string{}
+	utils.SetAssignedAt(endpoint, time.Now())
+	utils.SetNetwork(endpoint, conf.Name)
+	utils.SetPluginVersion(endpoint)
+	if policyTier != "" {
+		endpoint.Annotations[policyTierAnnotation] = policyTier
+	} else {
+		delete(endpoint.Annotations, policyTierAnnotation)
+	}
+	if disableNATOutgoing {
+		endpoint.Annotations[natOutgoingAnnotation] = "false"
+	} else {
+		delete(endpoint.Annotations, natOutgoingAnnotation)
+	}
 
 	// Set the profileID according to whether Kubernetes policy is required.
 	// If it's not, then just use the network name (which is the normal behavior)
-	// otherwise use one based on the Kubernetes pod's profile(s).
-	if conf.Policy.PolicyType == "k8s" {
+	// otherwise use one based on the Kubernetes pod's profile(s). If the profiles
+	// are managed out-of-band, leave them as they are.
+	if noProfile || (conf.ManageProfile != nil && !*conf.ManageProfile) {
+		logger.Info("Profiles are managed out-of-band, not setting them")
+	} else if conf.Policy.PolicyType == "k8s" {
 		endpoint.Spec.Profiles = profiles
 	} else {
 		endpoint.Spec.Profiles = []string{conf.Name}
 	}
+	if startupBlocked {
+		logger.WithField("profile", startupBlockedProfile).Info("Pod requested to start blocked, attaching profile")
+		endpoint.Spec.Profiles = append(endpoint.Spec.Profiles, startupBlockedProfile)
+	}
 
 	// Populate the endpoint with the output from the IPAM plugin.
-	if err = utils.PopulateEndpointNets(endpoint, result); err != nil {
+	if err = utils.PopulateEndpointNets(endpoint, result, conf); err != nil {
 		// Cleanup IP allocation and return the error.
 		utils.ReleaseIPAllocation(logger, conf, args)
 		return nil, err
 	}
+	// Secondary IPs go after the primary ones so that they don't change which address the pod is known by.
+	for _, ipConf := range secondaryIPs {
+		result.IPs = append(result.IPs, ipConf)
+		endpoint.Spec.IPNetworks = append(endpoint.Spec.IPNetworks, ipConf.Address.String())
+	}
 	logger.WithField("endpoint", endpoint).Info("Populated endpoint")
 	logger.Infof("Calico CNI using IPs: %s", endpoint.Spec.IPNetworks)
 
@@ -379,13 +367,28 @@ func CmdAddK8s(ctx context.Context, args *skel.CmdArgs, conf types.NetConf, epID
 	}
 
 	// Whether the endpoint existed or not, the veth needs (re)creating.
-	desiredVethName := k8sconversion.NewConverter().VethNameForWorkload(epIDs.Namespace, epIDs.Pod)
+	desiredVethName := utils.HostVethName(conf, &epIDs)
+	if staleVethName := endpoint.Spec.InterfaceName; staleVethName != "" && staleVethName != desiredVethName {
+		// The endpoint records a different host interface, e.g. one named before the veth naming changed. That
+		// veth would otherwise be left behind, so remove it before creating the new one; the endpoint is
+		// updated with the new name below.
+		logger.WithFields(logrus.Fields{"staleVeth": staleVethName, "desiredVeth": desiredVethName}).Warn(
+			"Endpoint's interface name doesn't match the expected veth name, replacing it")
+		if err = dataplane.RemoveStaleHostVeth(d, staleVethName); err != nil {
+			logger.WithError(err).Error("Error removing stale host veth")
+			releaseIPAM()
+			return nil, err
+		}
+	}
+	_, vethSpan := tracing.Start(ctx, "veth-setup")
+	vethSpan.SetAttribute("host_veth", desiredVethName)
 	hostVethName, contVethMac, err := d.DoNetworking(
 		ctx, calicoClient, args, result, desiredVethName, routes, endpoint, annot)
+	vethSpan.Finish(err)
 	if err != nil {
 		logger.WithError(err).Error("Error setting up networking")
 		releaseIPAM()
-		return nil, err
+		return nil, utils.NamespaceFailure(err)
 	}
 
 	mac, err := net.ParseMAC(contVethMac)
@@ -430,63 +433,85 @@ func CmdAddK8s(ctx context.Context, args *skel.CmdArgs, conf types.NetConf, epID
 			releaseIPAM()
 			return nil, err
 		}
-
-		// Get IPv4 and IPv6 targets for NAT
-		var podnetV4, podnetV6 net.IPNet
-		for _, ipNet := range result.IPs {
-			if ipNet.Address.IP.To4() != nil {
-				podnetV4 = ipNet.Address
-				netmask, _ := podnetV4.Mask.Size()
-				if netmask != 32 {
-					return nil, fmt.Errorf("PodIP %v is not a valid IPv4: Mask size is %d, not 32", ipNet, netmask)
-				}
-			} else {
-				podnetV6 = ipNet.Address
-				netmask, _ := podnetV6.Mask.Size()
-				if netmask != 128 {
-					return nil, fmt.Errorf("PodIP %v is not a valid IPv6: Mask size is %d, not 128", ipNet, netmask)
-				}
-			}
-		}
-
-		for _, ip := range ips {
-			if strings.Contains(ip, ":") {
-				endpoint.Spec.IPNATs = append(endpoint.Spec.IPNATs, api.IPNAT{
-					InternalIP: podnetV6.IP.String(),
-					ExternalIP: ip,
-				})
-			} else {
-				endpoint.Spec.IPNATs = append(endpoint.Spec.IPNATs, api.IPNAT{
-					InternalIP: podnetV4.IP.String(),
-					ExternalIP: ip,
-				})
-			}
+		ipNATs, err := floatingIPNATs(ips, result.IPs)
+		if err != nil {
+			releaseIPAM()
+			return nil, err
 		}
+		endpoint.Spec.IPNATs = append(endpoint.Spec.IPNATs, ipNATs...)
 		logger.WithField("endpoint", endpoint).Info("Added floatingIPs to endpoint")
 	}
 
 	// Write the endpoint object (either the newly created one, or the updated one)
-	if _, err := utils.CreateOrUpdate(ctx, calicoClient, endpoint); err != nil {
+	_, wepSpan := tracing.Start(ctx, "wep-write")
+	err = utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) (err error) {
+		_, err = utils.CreateOrUpdate(ctx, calicoClient, endpoint)
+		return
+	})
+	wepSpan.Finish(err)
+	if err != nil {
 		logger.WithError(err).Error("Error creating/updating endpoint in datastore.")
 		releaseIPAM()
-		return nil, err
+		return nil, metrics.DatastoreFailure(err)
 	}
 	logger.Info("Wrote updated endpoint to datastore")
 
-	// Add the interface created above to the CNI result.
-	result.Interfaces = append(result.Interfaces, &current.Interface{
-		Name: endpoint.Spec.InterfaceName},
-	)
+	// Add the interfaces created above to the CNI result.
+	utils.AddEndpointInterfaces(result, endpoint, args)
 
 	return result, nil
 }
 
+// DryRunAddK8s fills in the IP pools that an ADD for the pod would ask calico-ipam to allocate from. Like
+// CmdAddK8s, it takes the pod's and namespace's annotations into account if the policy type is "k8s". It only
+// reads from the Kubernetes API and the datastore.
+func DryRunAddK8s(
+	ctx context.Context,
+	conf types.NetConf,
+	epIDs utils.WEPIdentifiers,
+	calicoClient calicoclient.Interface,
+	report *utils.DryRunReport,
+	logger *logrus.Entry,
+) error {
+	if conf.IPAM.Type != "calico-ipam" {
+		return nil
+	}
+
+	annot := map[string]string{}
+	annotNS := map[string]string{}
+	if conf.Policy.PolicyType == "k8s" {
+		client, err := NewK8sClient(conf, logger)
+		if err != nil {
+			return err
+		}
+		if annotNS, err = getK8sNSInfo(client, epIDs.Namespace); err != nil {
+			return err
+		}
+		podOpts, err := podGetOptions(conf.Kubernetes.PodReadConsistency)
+		if err != nil {
+			return err
+		}
+		if _, annot, _, _, _, err = getK8sPodInfo(client.CoreV1().Pods(epIDs.Namespace), epIDs.Pod, podOpts); err != nil {
+			return err
+		}
+	}
+
+	v4, v6, err := lookUpIPAMPools(ctx, calicoClient, conf, epIDs.Node, annot, annotNS, logger)
+	if err != nil {
+		return err
+	}
+	report.IPv4Pools, report.IPv4PoolSource = v4.Pools, v4.Source
+	report.IPv6Pools, report.IPv6PoolSource = v6.Pools, v6.Source
+	return nil
+}
+
 // CmdDelK8s performs CNI DEL processing when running under Kubernetes. In Kubernetes, we identify workload endpoints based on their
 // pod name and namespace rather than container ID, so we may receive multiple DEL calls for the same pod, but with different container IDs.
 // As such, we must only delete the workload endpoint when the provided CNI_CONATAINERID matches the value on the WorkloadEndpoint. If they do not match,
-// it means the DEL is for an old sandbox and the pod is still running. We should still clean up IPAM allocations, since they are identified by the
-// container ID rather than the pod name and namespace. If they do match, then we can delete the workload endpoint.
-func CmdDelK8s(ctx context.Context, c calicoclient.Interface, epIDs utils.WEPIdentifiers, args *skel.CmdArgs, conf types.NetConf, logger *logrus.Entry) error {
+// it means the DEL is for an old sandbox and the pod is still running, so we leave both the workload endpoint and the IPAM allocations alone
+// and only clean up the old sandbox's interface. Any IPs the old sandbox still holds are left for IPAM garbage collection. If they do match,
+// then we can delete the workload endpoint and release its IPs.
+func CmdDelK8s(ctx context.Context, c calicoclient.Interface, epIDs utils.WEPIdentifiers, args *skel.CmdArgs, conf types.NetConf, summary *utils.DelSummary, logger *logrus.Entry) error {
 	d, err := dataplane.GetDataplane(conf, logger)
 	if err != nil {
 		return err
@@ -504,14 +529,22 @@ func CmdDelK8s(ctx context.Context, c calicoclient.Interface, epIDs utils.WEPIde
 		}
 	}
 
+	// Set if the WorkloadEndpoint belongs to a different container, in which case this DEL is for an old sandbox
+	// and must leave the endpoint and the IPAM allocations alone.
+	staleContainer := false
+	var deletedWEP *api.WorkloadEndpoint
 	for attempts := 5; attempts >= 0; attempts-- {
-		wep, err := c.WorkloadEndpoints().Get(ctx, epIDs.Namespace, epIDs.WEPName, options.GetOptions{})
+		var wep *api.WorkloadEndpoint
+		err := utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) (err error) {
+			wep, err = c.WorkloadEndpoints().Get(ctx, epIDs.Namespace, epIDs.WEPName, options.GetOptions{})
+			return
+		})
 		if err != nil {
 			if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
 				// Could not connect to datastore (connection refused, unauthorized, etc.)
 				// so we have no way of knowing/checking ContainerID. To protect the endpoint
 				// from false DEL, we return the error without deleting/cleaning up.
-				return err
+				return metrics.DatastoreFailure(err)
 			}
 
 			// The WorkloadEndpoint doesn't exist for some reason. We should still try to clean up any IPAM allocations
@@ -520,18 +553,24 @@ func CmdDelK8s(ctx context.Context, c calicoclient.Interface, epIDs utils.WEPIde
 		} else if wep.Spec.ContainerID != "" && args.ContainerID != wep.Spec.ContainerID {
 			// If the ContainerID is populated and doesn't match the CNI_CONTAINERID provided for this execution, then
 			// we shouldn't delete the workload endpoint. We identify workload endpoints based on pod name and namespace, which means
-			// we can receive DEL commands for an old sandbox for a currently running pod. However, we key IPAM allocations based on the
-			// CNI_CONTAINERID, so we should still do that below for this case.
-			logger.WithField("WorkloadEndpoint", wep).Warning("CNI_CONTAINERID does not match WorkloadEndpoint ConainerID, don't delete WEP.")
-		} else if _, err = c.WorkloadEndpoints().Delete(
-			ctx,
-			wep.Namespace,
-			wep.Name,
-			options.DeleteOptions{
-				ResourceVersion: wep.ResourceVersion,
-				UID:             &wep.UID,
-			},
-		); err != nil {
+			// we can receive DEL commands for an old sandbox for a currently running pod. Although we key IPAM allocations based
+			// on the CNI_CONTAINERID, the IPAM plugin also releases by the pod's legacy workload ID, which could take an IP away
+			// from the running pod, so leave IPAM alone too. Anything the old sandbox still holds is left for IPAM garbage
+			// collection.
+			logger.WithField("WorkloadEndpoint", wep).Warning("CNI_CONTAINERID does not match WorkloadEndpoint ContainerID, don't delete WEP or release IPs.")
+			staleContainer = true
+		} else if err = utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) error {
+			_, err := c.WorkloadEndpoints().Delete(
+				ctx,
+				wep.Namespace,
+				wep.Name,
+				options.DeleteOptions{
+					ResourceVersion: wep.ResourceVersion,
+					UID:             &wep.UID,
+				},
+			)
+			return err
+		}); err != nil {
 			// Delete the WorkloadEndpoint object from the datastore, passing revision information from the
 			// queried resource above in order to prevent conflicts.
 			switch err := err.(type) {
@@ -543,7 +582,7 @@ func CmdDelK8s(ctx context.Context, c calicoclient.Interface, epIDs utils.WEPIde
 				// a few times and then return the error.  kubelet should then retry the whole DEL later.
 				if attempts == 0 {
 					logger.WithField("endpoint", wep).Warn("Endpoint was modified before it could be deleted.  Giving up.")
-					return fmt.Errorf("error deleting endpoint: endpoint was modified before it could be deleted: %v", err)
+					return metrics.DatastoreFailure(fmt.Errorf("error deleting endpoint: endpoint was modified before it could be deleted: %v", err))
 				}
 				logger.WithField("endpoint", wep).Info("Endpoint was modified before it could be deleted.  Retrying...")
 				continue
@@ -551,30 +590,272 @@ func CmdDelK8s(ctx context.Context, c calicoclient.Interface, epIDs utils.WEPIde
 				// Defensive: shouldn't be hittable any more since KDD now supports pod deletion.
 				logger.WithField("endpoint", wep).WithError(err).Warn("Deleting pod returned ErrorOperationNotSupported.")
 			default:
-				return err
+				return metrics.DatastoreFailure(err)
 			}
+		} else {
+			summary.EndpointDeleted = true
+			summary.ReleasedIPs = wep.Spec.IPNetworks
+			deletedWEP = wep
 		}
 		break
 	}
 
 	// Clean up namespace by removing the interfaces.
 	logger.Info("Cleaning up netns")
+	summary.InterfaceFound = dataplane.ContainerInterfaceExists(d, args)
 	err = d.CleanUpNamespace(args)
 	if err != nil {
+		if args.Netns != "" {
+			return utils.NamespaceFailure(err)
+		}
+		// The runtime didn't pass a netns, typically because the container has already gone, so there's no
+		// interface left that could still be using the IPs. Release them regardless.
+		logger.WithError(err).Warn("Failed to clean up without a netns, releasing the IPs anyway")
+	} else {
+		summary.InterfaceRemoved = summary.InterfaceFound
+	}
+
+	if staleContainer {
+		logger.Info("Teardown processing complete, leaving the running container's IP address(es) alone.")
+		return nil
+	}
+
+	// The runtime can ask for the IPs to be left reserved for a later ADD. The handle stays allocated until a DEL
+	// without CALICO_KEEP_IP releases it.
+	if keepIPs, err := utils.KeepIPs(args); err != nil {
 		return err
+	} else if keepIPs {
+		summary.ReleasedIPs = nil
+		logger.Info("Teardown processing complete, CALICO_KEEP_IP is set so leaving the IP address(es) reserved.")
+		return nil
 	}
 
-	// Release the IP address for this container by calling the configured IPAM plugin.
+	// Release the IP address for this container by calling the configured IPAM plugin, along with any that were
+	// allocated before the network was renamed.
 	logger.Info("Releasing IP address(es)")
+	recordedErr := utils.ReleaseRecordedNetworkIPs(ctx, c, conf, args, deletedWEP, logger)
 	err = utils.DeleteIPAM(conf, args, logger)
 	if err != nil {
-		return err
+		return metrics.IPAMFailure(err)
+	}
+	if recordedErr != nil {
+		return metrics.IPAMFailure(recordedErr)
 	}
 
 	logger.Info("Teardown processing complete.")
 	return nil
 }
 
+// startupBlockedProfile is the name of the profile attached to pods that request to start with ingress blocked.
+// The profile is managed outside of the CNI plugin and must already exist.
+const startupBlockedProfile = "block-ingress"
+
+// getStartupBlocked parses the "cni.projectcalico.org/startupBlocked" annotation and returns whether the
+// startup blocked profile should be attached to the endpoint. It returns an error if the annotation is set but
+// the feature is not enabled, the value isn't a boolean, or the profile doesn't exist.
+func getStartupBlocked(ctx context.Context, calico calicoclient.Interface, conf types.NetConf, annot map[string]string, logger *logrus.Entry) (bool, error) {
+	value := annot["cni.projectcalico.org/startupBlocked"]
+	if value == "" {
+		return false, nil
+	}
+	if !conf.FeatureControl.StartupBlocked {
+		return false, fmt.Errorf("requested feature is not enabled: startup_blocked")
+	}
+	blocked, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse annotation \"cni.projectcalico.org/startupBlocked\": %s", err)
+	}
+	if !blocked {
+		return false, nil
+	}
+
+	// The profile must already exist - we never create it ourselves.
+	if _, err := calico.Profiles().Get(ctx, startupBlockedProfile, options.GetOptions{}); err != nil {
+		logger.WithError(err).WithField("profile", startupBlockedProfile).Error("Failed to get startup blocked profile")
+		return false, fmt.Errorf("startup blocked profile %q is not available: %s", startupBlockedProfile, err)
+	}
+	return true, nil
+}
+
+// policyTierAnnotation records the policy tier that a pod belongs to. The plugin copies it onto the
+// WorkloadEndpoint for other tooling to act on; it doesn't affect how the pod is networked.
+const policyTierAnnotation = "cni.projectcalico.org/policyTier"
+
+// getPolicyTier returns the policy tier requested by the pod's annotations, if any, making sure that it is one
+// of the tiers allowed by the config.
+func getPolicyTier(conf types.NetConf, annot map[string]string) (string, error) {
+	tier := annot[policyTierAnnotation]
+	if tier == "" {
+		return "", nil
+	}
+	for _, t := range conf.Policy.AllowedTiers {
+		if t == tier {
+			return tier, nil
+		}
+	}
+	return "", fmt.Errorf("policy tier %q requested by annotation %q is not in allowed_tiers", tier, policyTierAnnotation)
+}
+
+// natOutgoingAnnotation lets a pod opt out of source NAT for its outgoing traffic, whatever the natOutgoing
+// setting of the pool its IP came from. The plugin only records it on the WorkloadEndpoint; it's up to the
+// dataplane to act on it.
+const natOutgoingAnnotation = "cni.projectcalico.org/natOutgoing"
+
+// getDisableNATOutgoing returns whether the pod's annotations ask for source NAT to be disabled. Setting the
+// annotation to true is allowed but has no effect, since the pool setting already applies.
+func getDisableNATOutgoing(annot map[string]string) (bool, error) {
+	value := annot[natOutgoingAnnotation]
+	if value == "" {
+		return false, nil
+	}
+	natOutgoing, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse annotation %q: %s", natOutgoingAnnotation, err)
+	}
+	return !natOutgoing, nil
+}
+
+// noProfileAnnotation lets a pod opt out of the profiles that the plugin would otherwise attach to its
+// WorkloadEndpoint, for pods whose policy is managed out-of-band.
+const noProfileAnnotation = "cni.projectcalico.org/noProfile"
+
+// getNoProfile returns whether the pod's annotations ask for no profiles to be attached.
+func getNoProfile(annot map[string]string) (bool, error) {
+	value := annot[noProfileAnnotation]
+	if value == "" {
+		return false, nil
+	}
+	noProfile, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse annotation %q: %s", noProfileAnnotation, err)
+	}
+	return noProfile, nil
+}
+
+// annotationLabels returns the labels that the pod's annotations under the annotation_label_prefix give its
+// endpoint. The prefix is stripped from each key, and what's left of the key and the value are sanitized to make
+// valid labels. It's an error if either is still invalid, for example if it's too long.
+func annotationLabels(prefix string, annot map[string]string) (map[string]string, error) {
+	labels := map[string]string{}
+	if prefix == "" {
+		return labels, nil
+	}
+	for annotation, value := range annot {
+		if !strings.HasPrefix(annotation, prefix) {
+			continue
+		}
+		k, err := utils.SanitizeMesosLabel(strings.TrimPrefix(annotation, prefix))
+		if err == nil && k == "" {
+			err = fmt.Errorf("annotation %q has no label key after the prefix", annotation)
+		}
+		if err != nil {
+			return nil, err
+		}
+		v, err := utils.SanitizeMesosLabel(value)
+		if err != nil {
+			return nil, err
+		}
+		if errs := validation.IsQualifiedName(k); len(errs) != 0 {
+			return nil, fmt.Errorf("annotation %q gives an invalid label key %q: %s", annotation, k, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(v); len(errs) != 0 {
+			return nil, fmt.Errorf("annotation %q gives an invalid label value %q: %s", annotation, v, strings.Join(errs, "; "))
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// secondaryIPsAnnotation lists extra addresses for the pod's interface, on top of the ones from the
+// ipAddrsNoIpam annotation. Unlike ipAddrsNoIpam it may list several addresses of the same family.
+const secondaryIPsAnnotation = "cni.projectcalico.org/secondaryIPs"
+
+// floatingIPNATs returns the 1:1 NAT mappings for the pod's floatingIPs annotation. Each floating IP maps to the
+// pod's first address of the same family, which is its primary one if it has secondary IPs.
+func floatingIPNATs(floatingIPs []string, podIPs []*current.IPConfig) ([]api.IPNAT, error) {
+	var podIPv4, podIPv6 net.IP
+	for _, ipConf := range podIPs {
+		ones, _ := ipConf.Address.Mask.Size()
+		if ipConf.Address.IP.To4() != nil {
+			if podIPv4 != nil {
+				continue
+			}
+			if ones != 32 {
+				return nil, fmt.Errorf("PodIP %v is not a valid IPv4: Mask size is %d, not 32", ipConf, ones)
+			}
+			podIPv4 = ipConf.Address.IP
+		} else {
+			if podIPv6 != nil {
+				continue
+			}
+			if ones != 128 {
+				return nil, fmt.Errorf("PodIP %v is not a valid IPv6: Mask size is %d, not 128", ipConf, ones)
+			}
+			podIPv6 = ipConf.Address.IP
+		}
+	}
+
+	var ipNATs []api.IPNAT
+	for _, s := range floatingIPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid floating IP %q", s)
+		}
+		internal, family := podIPv6, "IPv6"
+		if ip.To4() != nil {
+			internal, family = podIPv4, "IPv4"
+		}
+		if internal == nil {
+			return nil, fmt.Errorf("floating IP %s can't be used, since the pod has no %s address", s, family)
+		}
+		ipNATs = append(ipNATs, api.IPNAT{InternalIP: internal.String(), ExternalIP: ip.String()})
+	}
+	return ipNATs, nil
+}
+
+// getSecondaryIPs returns the addresses from the pod's secondaryIPs annotation, if any. The annotation is
+// only allowed alongside ipAddrsNoIpam, and none of its addresses may repeat another.
+func getSecondaryIPs(annot map[string]string, logger *logrus.Entry) ([]*current.IPConfig, error) {
+	value := annot[secondaryIPsAnnotation]
+	if value == "" {
+		return nil, nil
+	}
+	primary := annot["cni.projectcalico.org/ipAddrsNoIpam"]
+	if primary == "" {
+		return nil, fmt.Errorf("annotation %q can only be used with \"cni.projectcalico.org/ipAddrsNoIpam\"", secondaryIPsAnnotation)
+	}
+	ips, err := parseIPAddrs(value, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse IPs %s for annotation %q: %s", value, secondaryIPsAnnotation, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("annotation %q specified but empty", secondaryIPsAnnotation)
+	}
+
+	seen := map[string]bool{}
+	if primaryIPs, err := parseIPAddrs(primary, logger); err == nil {
+		for _, ip := range primaryIPs {
+			if ipAddr := net.ParseIP(ip); ipAddr != nil {
+				seen[ipAddr.String()] = true
+			}
+		}
+	}
+	var result []*current.IPConfig
+	for _, ip := range ips {
+		ipAddr := net.ParseIP(ip)
+		if ipAddr == nil {
+			return nil, fmt.Errorf("invalid IP format in annotation %q: %s", secondaryIPsAnnotation, ip)
+		}
+		if seen[ipAddr.String()] {
+			return nil, fmt.Errorf("IP %s is listed more than once in annotations %q and \"cni.projectcalico.org/ipAddrsNoIpam\"",
+				ip, secondaryIPsAnnotation)
+		}
+		seen[ipAddr.String()] = true
+		result = append(result, hostIPConfig(ipAddr))
+	}
+	return result, nil
+}
+
 // releaseIPAddrs calls directly into Calico IPAM to release the specified IP addresses.
 // NOTE: This function assumes Calico IPAM is in use, and calls into it directly rather than calling the IPAM plugin.
 func releaseIPAddrs(ipAddrs []string, calico calicoclient.Interface, logger *logrus.Entry) error {
@@ -600,18 +881,133 @@ func releaseIPAddrs(ipAddrs []string, calico calicoclient.Interface, logger *log
 	return nil
 }
 
-// ipAddrsResult parses the ipAddrs annotation and calls the configured IPAM plugin for
-// each IP passed to it by setting the IP field in CNI_ARGS, and returns the result of calling the IPAM plugin.
-// Example annotation value string: "[\"10.0.0.1\", \"2001:db8::1\"]"
-func ipAddrsResult(ipAddrs string, conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) (*current.Result, error) {
-	logger.Infof("Parsing annotation \"cni.projectcalico.org/ipAddrs\":%s", ipAddrs)
+// assignIPs gets the IP addresses for the pod, either from the configured IPAM plugin or, depending on the
+// pod's annotations, from the ipAddrs or ipAddrsNoIpam annotations.
+func assignIPs(
+	ctx context.Context,
+	conf types.NetConf,
+	args *skel.CmdArgs,
+	endpoint *api.WorkloadEndpoint,
+	calicoClient calicoclient.Interface,
+	annot map[string]string,
+	logger *logrus.Entry,
+) (*current.Result, error) {
+	ipAddrsNoIpam := annot["cni.projectcalico.org/ipAddrsNoIpam"]
+	ipAddrs := annot["cni.projectcalico.org/ipAddrs"]
 
-	// We need to make sure there is only one IPv4 and/or one IPv6
-	// passed in, since CNI spec only supports one of each right now.
-	ipList, err := validateAndExtractIPs(ipAddrs, "cni.projectcalico.org/ipAddrs", logger)
-	if err != nil {
-		return nil, err
+	// Switch based on which annotations are passed or not passed.
+	var result *current.Result
+	var err error
+	switch {
+	case ipAddrs == "" && ipAddrsNoIpam == "":
+		// If pod_reuse_ip is set and the pod's endpoint was created for a different container (e.g. the pod
+		// sandbox is being recreated), hand the endpoint's IPs over to the new container rather than allocating
+		// new ones. Only Calico IPAM tracks handles, so this is limited to calico-ipam.
+		if conf.PodReuseIP && conf.IPAM.Type == "calico-ipam" && endpoint != nil &&
+			endpoint.Spec.ContainerID != "" && endpoint.Spec.ContainerID != args.ContainerID {
+			if err = utils.InheritEndpointIPs(ctx, calicoClient, conf, args, endpoint, logger); err == nil {
+				return utils.CreateResultFromEndpoint(endpoint, conf.IPFamilyOrder)
+			}
+			logger.WithError(err).Warn("Failed to reuse the pod's IPs, allocating new ones")
+		}
+
+		if utils.NoIPAM(conf) {
+			// Without an IPAM plugin, the addresses have to come from the previous plugin in the chain.
+			if result, err = utils.ResultFromPrevResult(conf); err != nil {
+				return nil, errors.New("no IPAM plugin is configured, so the pod needs the " +
+					"\"cni.projectcalico.org/ipAddrsNoIpam\" annotation or a prevResult with IPs to supply its addresses")
+			}
+			logger.WithField("result", result).Info("No IPAM plugin configured, using the IPs from prevResult")
+			return result, nil
+		}
+
+		// Call the IPAM plugin.
+		result, err = utils.AddIPAM(ctx, conf, args, logger)
+		if err != nil {
+			return nil, err
+		}
+
+	case ipAddrs != "" && ipAddrsNoIpam != "":
+		// Can't have both ipAddrs and ipAddrsNoIpam annotations at the same time.
+		e := fmt.Errorf("can't have both annotations: 'ipAddrs' and 'ipAddrsNoIpam' in use at the same time")
+		logger.Error(e)
+		return nil, e
+
+	case ipAddrsNoIpam != "":
+		// Validate that we're allowed to use this feature. It needs either Calico IPAM, or no IPAM plugin at all.
+		if conf.IPAM.Type != "calico-ipam" && !utils.NoIPAM(conf) {
+			e := fmt.Errorf("ipAddrsNoIpam is not compatible with configured IPAM: %s", conf.IPAM.Type)
+			logger.Error(e)
+			return nil, e
+		}
+		if !conf.FeatureControl.IPAddrsNoIpam {
+			e := fmt.Errorf("requested feature is not enabled: ip_addrs_no_ipam")
+			logger.Error(e)
+			return nil, e
+		}
+
+		// ipAddrsNoIpam annotation is set so bypass IPAM, and set the IPs manually.
+		overriddenResult, err := overrideIPAMResult(ipAddrsNoIpam, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugf("Bypassing IPAM to set the result to: %+v", overriddenResult)
+
+		// Convert overridden IPAM result into current Result.
+		// This method fill in all the empty fields necessory for CNI output according to spec.
+		result, err = current.NewResultFromResult(overriddenResult)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(result.IPs) == 0 {
+			return nil, errors.New("failed to build result")
+		}
+
+	case ipAddrs != "":
+		// Validate that we're allowed to use this feature.
+		if conf.IPAM.Type != "calico-ipam" {
+			e := fmt.Errorf("ipAddrs is not compatible with configured IPAM: %s", conf.IPAM.Type)
+			logger.Error(e)
+			return nil, e
+		}
+
+		// Check the requested addresses before touching any that the endpoint already has. We need to make sure
+		// there is only one IPv4 and/or one IPv6 passed in, since CNI spec only supports one of each right now.
+		var ipList []net.IP
+		if ipList, err = validateAndExtractIPs(ipAddrs, "cni.projectcalico.org/ipAddrs", logger); err != nil {
+			return nil, err
+		}
+		if err = checkAssignFamilies(ipList, conf); err != nil {
+			return nil, err
+		}
+
+		// If the endpoint already exists, we need to attempt to release the previous IP addresses here
+		// since the ADD call will fail when it tries to reallocate the same IPs. releaseIPAddrs assumes
+		// that Calico IPAM is in use, which is OK here since only Calico IPAM supports the ipAddrs
+		// annotation.
+		if endpoint != nil {
+			logger.Info("Endpoint already exists and ipAddrs is set. Release any old IPs")
+			if err := releaseIPAddrs(endpoint.Spec.IPNetworks, calicoClient, logger); err != nil {
+				return nil, fmt.Errorf("failed to release ipAddrs: %s", err)
+			}
+		}
+
+		// When ipAddrs annotation is set, we call out to the configured IPAM plugin
+		// requesting the specific IP addresses included in the annotation.
+		result, err = ipAddrsResult(ctx, ipList, conf, args, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugf("IPAM result set to: %+v", result)
 	}
+	return result, nil
+}
+
+// ipAddrsResult calls the configured IPAM plugin for each IP from the ipAddrs annotation by setting the IP field
+// in CNI_ARGS, and returns the result of calling the IPAM plugin.
+func ipAddrsResult(ctx context.Context, ipList []net.IP, conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) (*current.Result, error) {
+	logger.Infof("Requesting IPs from annotation \"cni.projectcalico.org/ipAddrs\": %v", ipList)
 
 	result := current.Result{}
 
@@ -620,9 +1016,15 @@ func ipAddrsResult(ipAddrs string, conf types.NetConf, args *skel.CmdArgs, logge
 	// from the IPAM plugin.
 	for _, ip := range ipList {
 		// Call callIPAMWithIP with the ip address.
-		r, err := callIPAMWithIP(ip, conf, args, logger)
+		r, err := callIPAMWithIP(ctx, ip, conf, args, logger)
 		if err != nil {
-			return nil, fmt.Errorf("error getting IP from IPAM: %s", err)
+			if len(result.IPs) > 0 {
+				// Don't leave the pod with only some of the IPs it asked for. They're all assigned under
+				// the same handle, so this releases the ones that succeeded.
+				logger.WithField("assignedIPs", result.IPs).Info("Releasing the IPs assigned so far")
+				utils.ReleaseIPAllocation(logger, conf, args)
+			}
+			return nil, fmt.Errorf("error getting IP %s from IPAM: %s", ip, err)
 		}
 
 		result.IPs = append(result.IPs, r.IPs[0])
@@ -632,10 +1034,24 @@ func ipAddrsResult(ipAddrs string, conf types.NetConf, args *skel.CmdArgs, logge
 	return &result, nil
 }
 
+// checkAssignFamilies returns an error if the ipAddrs annotation asks for an address of a family that the IPAM
+// config explicitly turns off with assign_ipv4 or assign_ipv6, rather than leaving calico-ipam to assign it anyway.
+func checkAssignFamilies(ips []net.IP, conf types.NetConf) error {
+	for _, ip := range ips {
+		if ip.To4() != nil && conf.IPAM.AssignIpv4 != nil && *conf.IPAM.AssignIpv4 == "false" {
+			return fmt.Errorf("annotation \"cni.projectcalico.org/ipAddrs\" requests IPv4 address %s but assign_ipv4 is false", ip)
+		}
+		if ip.To4() == nil && conf.IPAM.AssignIpv6 != nil && *conf.IPAM.AssignIpv6 == "false" {
+			return fmt.Errorf("annotation \"cni.projectcalico.org/ipAddrs\" requests IPv6 address %s but assign_ipv6 is false", ip)
+		}
+	}
+	return nil
+}
+
 // callIPAMWithIP sets CNI_ARGS with the IP and calls the IPAM plugin with it
 // to get current.Result and then it unsets the IP field from CNI_ARGS ENV var,
 // so it doesn't pollute the subsequent requests.
-func callIPAMWithIP(ip net.IP, conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) (*current.Result, error) {
+func callIPAMWithIP(ctx context.Context, ip net.IP, conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) (*current.Result, error) {
 
 	// Save the original value of the CNI_ARGS ENV var for backup.
 	originalArgs := os.Getenv("CNI_ARGS")
@@ -654,9 +1070,13 @@ func callIPAMWithIP(ip net.IP, conf types.NetConf, args *skel.CmdArgs, logger *l
 		logger.Errorf("'IP' variable already set in CNI_ARGS environment variable.")
 	}
 
+	if err := utils.CheckIPAMPlugin(conf, logger); err != nil {
+		return nil, err
+	}
+
 	// Request the provided IP address using the IP CNI_ARG.
 	// See: https://github.com/containernetworking/cni/blob/master/CONVENTIONS.md#cni_args for more info.
-	newArgs := originalArgs + ";IP=" + ip.String()
+	newArgs := utils.IgnoreUnknownArgs(originalArgs) + ";IP=" + ip.String()
 	logger.Debugf("New CNI_ARGS=%s", newArgs)
 
 	// Set CNI_ARGS to the new value.
@@ -667,7 +1087,7 @@ func callIPAMWithIP(ip net.IP, conf types.NetConf, args *skel.CmdArgs, logger *l
 
 	// Run the IPAM plugin.
 	logger.Debugf("Calling IPAM plugin %s", conf.IPAM.Type)
-	r, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+	r, err := invoke.DelegateAdd(ctx, conf.IPAM.Type, args.StdinData, nil)
 	if err != nil {
 		// Restore the CNI_ARGS ENV var to it's original value,
 		// so the subsequent calls don't get polluted by the old IP value.
@@ -721,25 +1141,7 @@ func overrideIPAMResult(ipAddrsNoIpam string, logger *logrus.Entry) (*current.Re
 	// Go through all the IPs passed in as annotation value and populate
 	// the result variable with IP4 and/or IP6 IPs.
 	for _, ip := range ipList {
-		var version string
-		var mask net.IPMask
-
-		if ip.To4() != nil {
-			version = "4"
-			mask = net.CIDRMask(32, 32)
-
-		} else {
-			version = "6"
-			mask = net.CIDRMask(128, 128)
-		}
-
-		ipConf := &current.IPConfig{
-			Version: version,
-			Address: net.IPNet{
-				IP:   ip,
-				Mask: mask,
-			},
-		}
+		ipConf := hostIPConfig(ip)
 		result.IPs = append(result.IPs, ipConf)
 		logger.Debugf("Adding IPv%s: %s to result", ipConf.Version, ip.String())
 	}
@@ -747,6 +1149,14 @@ func overrideIPAMResult(ipAddrsNoIpam string, logger *logrus.Entry) (*current.Re
 	return &result, nil
 }
 
+// hostIPConfig returns the IPConfig for a single address, with a /32 or /128 mask.
+func hostIPConfig(ip net.IP) *current.IPConfig {
+	if ip.To4() != nil {
+		return &current.IPConfig{Version: "4", Address: net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}}
+	}
+	return &current.IPConfig{Version: "6", Address: net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}}
+}
+
 // validateAndExtractIPs is a utility function that validates the passed IP list to make sure
 // there is one IPv4 and/or one IPv6 and then returns the slice of IPs.
 func validateAndExtractIPs(ipAddrs string, annotation string, logger *logrus.Entry) ([]net.IP, error) {
@@ -853,8 +1263,30 @@ func NewK8sClient(conf types.NetConf, logger *logrus.Entry) (*kubernetes.Clients
 		return nil, err
 	}
 
+	// Reuse the clientset from an earlier call if the resolved config hasn't changed since, so that its
+	// connections to the API server are reused too. The kubeconfig is still read every time, so a rotated token
+	// changes the config and gets a new clientset. A token file is re-read by the clientset itself.
+	k8sClientCache.Lock()
+	defer k8sClientCache.Unlock()
+	if k8sClientCache.client != nil && reflect.DeepEqual(k8sClientCache.config, config) {
+		logger.Debug("Reusing Kubernetes client")
+		return k8sClientCache.client, nil
+	}
+
 	// Create the clientset
-	return kubernetes.NewForConfig(config)
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	k8sClientCache.config, k8sClientCache.client = rest.CopyConfig(config), client
+	return client, nil
+}
+
+// k8sClientCache is the clientset most recently created by NewK8sClient and the config it was created from.
+var k8sClientCache struct {
+	sync.Mutex
+	config *rest.Config
+	client *kubernetes.Clientset
 }
 
 func getK8sNSInfo(client *kubernetes.Clientset, podNamespace string) (annotations map[string]string, err error) {
@@ -866,8 +1298,27 @@ func getK8sNSInfo(client *kubernetes.Clientset, podNamespace string) (annotation
 	return ns.Annotations, nil
 }
 
-func getK8sPodInfo(client *kubernetes.Clientset, podName, podNamespace string) (labels map[string]string, annotations map[string]string, ports []api.EndpointPort, profiles []string, generateName string, err error) {
-	pod, err := client.CoreV1().Pods(string(podNamespace)).Get(context.Background(), podName, metav1.GetOptions{})
+// podGetter is the part of the pods client that's needed to read a pod.
+type podGetter interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Pod, error)
+}
+
+// podGetOptions returns the options to read the pod with for the given pod_read_consistency setting.
+func podGetOptions(consistency string) (metav1.GetOptions, error) {
+	switch consistency {
+	case "", "direct":
+		// An empty resource version means the API server must return the most recent version of the pod.
+		return metav1.GetOptions{}, nil
+	case "cache":
+		// A resource version of "0" lets the API server answer from its watch cache.
+		return metav1.GetOptions{ResourceVersion: "0"}, nil
+	default:
+		return metav1.GetOptions{}, fmt.Errorf("invalid pod_read_consistency %q: must be \"cache\" or \"direct\"", consistency)
+	}
+}
+
+func getK8sPodInfo(pods podGetter, podName string, opts metav1.GetOptions) (labels map[string]string, annotations map[string]string, ports []api.EndpointPort, profiles []string, generateName string, err error) {
+	pod, err := pods.Get(context.Background(), podName, opts)
 	logrus.Debugf("pod info %+v", pod)
 	if err != nil {
 		return nil, nil, nil, nil, "", err
@@ -888,19 +1339,27 @@ func getK8sPodInfo(client *kubernetes.Clientset, podName, podNamespace string) (
 	return labels, pod.Annotations, ports, profiles, generateName, nil
 }
 
-func getPodCidr(client *kubernetes.Clientset, conf types.NetConf, nodename string) (string, error) {
+// nodeGetter is the part of the nodes client that's needed to read a node.
+type nodeGetter interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Node, error)
+}
+
+// getPodCidr returns the node's PodCIDR, for host-local IPAM's "usePodCidr" subnet. It's looked up before the IPAM
+// plugin is called, so a node without one fails the ADD with an error that says so, rather than host-local's
+// complaint about the subnet that it's given.
+func getPodCidr(nodes nodeGetter, conf types.NetConf, nodename string) (string, error) {
 	// Pull the node name out of the config if it's set. Defaults to nodename
 	if conf.Kubernetes.NodeName != "" {
 		nodename = conf.Kubernetes.NodeName
 	}
 
-	node, err := client.CoreV1().Nodes().Get(context.Background(), nodename, metav1.GetOptions{})
+	node, err := nodes.Get(context.Background(), nodename, metav1.GetOptions{})
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to get node %s to look up its PodCIDR for host-local IPAM: %v", nodename, err)
 	}
 
 	if node.Spec.PodCIDR == "" {
-		return "", fmt.Errorf("no podCidr for node %s", nodename)
+		return "", fmt.Errorf("node %s has no PodCIDR assigned, which host-local IPAM's usePodCidr subnet needs", nodename)
 	}
 	return node.Spec.PodCIDR, nil
 }
@@ -0,0 +1,357 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+)
+
+// stalePodGetter simulates an API server whose watch cache hasn't yet caught up with an update to the pod.
+type stalePodGetter struct {
+	cached, latest *corev1.Pod
+}
+
+func (s *stalePodGetter) Get(_ context.Context, _ string, opts metav1.GetOptions) (*corev1.Pod, error) {
+	if opts.ResourceVersion == "0" {
+		return s.cached, nil
+	}
+	return s.latest, nil
+}
+
+var _ = Describe("pod_read_consistency", func() {
+	var pods *stalePodGetter
+
+	BeforeEach(func() {
+		cached := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default", ResourceVersion: "1"},
+			Spec:       corev1.PodSpec{NodeName: "node1"},
+		}
+		latest := cached.DeepCopy()
+		latest.ResourceVersion = "2"
+		latest.Annotations = map[string]string{"cni.projectcalico.org/ipAddrs": `["10.0.0.1"]`}
+		pods = &stalePodGetter{cached: cached, latest: latest}
+	})
+
+	It("reads the latest pod by default and with direct", func() {
+		for _, consistency := range []string{"", "direct"} {
+			opts, err := podGetOptions(consistency)
+			Expect(err).NotTo(HaveOccurred())
+			_, annot, _, _, _, err := getK8sPodInfo(pods, "pod1", opts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(annot).To(HaveKey("cni.projectcalico.org/ipAddrs"), consistency)
+		}
+	})
+
+	It("allows a cached read with cache", func() {
+		opts, err := podGetOptions("cache")
+		Expect(err).NotTo(HaveOccurred())
+		_, annot, _, _, _, err := getK8sPodInfo(pods, "pod1", opts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(annot).NotTo(HaveKey("cni.projectcalico.org/ipAddrs"))
+	})
+
+	It("rejects an unknown setting", func() {
+		_, err := podGetOptions("eventual")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("getPolicyTier", func() {
+	conf := types.NetConf{Policy: types.Policy{AllowedTiers: []string{"security", "platform"}}}
+
+	It("returns nothing when the annotation isn't set", func() {
+		tier, err := getPolicyTier(conf, map[string]string{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tier).To(BeEmpty())
+	})
+
+	It("returns an allowed tier", func() {
+		tier, err := getPolicyTier(conf, map[string]string{policyTierAnnotation: "platform"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tier).To(Equal("platform"))
+	})
+
+	It("rejects a tier that isn't allowed", func() {
+		_, err := getPolicyTier(conf, map[string]string{policyTierAnnotation: "default"})
+		Expect(err).To(MatchError(ContainSubstring(`policy tier "default"`)))
+	})
+
+	It("rejects every tier if none are allowed", func() {
+		_, err := getPolicyTier(types.NetConf{}, map[string]string{policyTierAnnotation: "security"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("getDisableNATOutgoing", func() {
+	It("leaves the pool setting alone when the annotation isn't set", func() {
+		disable, err := getDisableNATOutgoing(map[string]string{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(disable).To(BeFalse())
+	})
+
+	It("disables source NAT when the annotation is false", func() {
+		disable, err := getDisableNATOutgoing(map[string]string{natOutgoingAnnotation: "false"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(disable).To(BeTrue())
+	})
+
+	It("leaves the pool setting alone when the annotation is true", func() {
+		disable, err := getDisableNATOutgoing(map[string]string{natOutgoingAnnotation: "true"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(disable).To(BeFalse())
+	})
+
+	It("rejects a value that isn't a boolean", func() {
+		_, err := getDisableNATOutgoing(map[string]string{natOutgoingAnnotation: "sometimes"})
+		Expect(err).To(MatchError(ContainSubstring(natOutgoingAnnotation)))
+	})
+})
+
+var _ = Describe("getNoProfile", func() {
+	It("attaches profiles when the annotation isn't set", func() {
+		noProfile, err := getNoProfile(map[string]string{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(noProfile).To(BeFalse())
+	})
+
+	It("skips the profiles when the annotation is true", func() {
+		noProfile, err := getNoProfile(map[string]string{noProfileAnnotation: "true"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(noProfile).To(BeTrue())
+	})
+
+	It("rejects a value that isn't a boolean", func() {
+		_, err := getNoProfile(map[string]string{noProfileAnnotation: "maybe"})
+		Expect(err).To(MatchError(ContainSubstring(noProfileAnnotation)))
+	})
+})
+
+var _ = Describe("getSecondaryIPs", func() {
+	logger := logrus.WithField("test", "secondaryIPs")
+	annot := func(primary, secondary string) map[string]string {
+		a := map[string]string{secondaryIPsAnnotation: secondary}
+		if primary != "" {
+			a["cni.projectcalico.org/ipAddrsNoIpam"] = primary
+		}
+		return a
+	}
+
+	It("returns nothing when the annotation isn't set", func() {
+		ips, err := getSecondaryIPs(map[string]string{"cni.projectcalico.org/ipAddrsNoIpam": `["10.0.0.1"]`}, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(BeEmpty())
+	})
+
+	It("returns several addresses of each family as host routes", func() {
+		ips, err := getSecondaryIPs(annot(`["10.0.0.1", "fd00::1"]`, `["10.0.0.2", "10.0.0.3", "fd00::2"]`), logger)
+		Expect(err).NotTo(HaveOccurred())
+		var addrs []string
+		for _, ip := range ips {
+			addrs = append(addrs, ip.Address.String())
+		}
+		Expect(addrs).To(Equal([]string{"10.0.0.2/32", "10.0.0.3/32", "fd00::2/128"}))
+		Expect(ips[0].Version).To(Equal("4"))
+		Expect(ips[2].Version).To(Equal("6"))
+	})
+
+	It("requires ipAddrsNoIpam", func() {
+		_, err := getSecondaryIPs(annot("", `["10.0.0.2"]`), logger)
+		Expect(err).To(MatchError(ContainSubstring("can only be used with")))
+	})
+
+	It("rejects an address that repeats the primary one", func() {
+		_, err := getSecondaryIPs(annot(`["10.0.0.1"]`, `["10.0.0.2", "10.0.0.1"]`), logger)
+		Expect(err).To(MatchError(ContainSubstring("10.0.0.1 is listed more than once")))
+	})
+
+	It("rejects an address listed twice", func() {
+		_, err := getSecondaryIPs(annot(`["10.0.0.1"]`, `["fd00::2", "fd00:0::2"]`), logger)
+		Expect(err).To(MatchError(ContainSubstring("listed more than once")))
+	})
+
+	It("rejects an invalid address", func() {
+		_, err := getSecondaryIPs(annot(`["10.0.0.1"]`, `["10.0.0.300"]`), logger)
+		Expect(err).To(MatchError(ContainSubstring("invalid IP format")))
+	})
+
+	It("rejects an empty list", func() {
+		_, err := getSecondaryIPs(annot(`["10.0.0.1"]`, `[]`), logger)
+		Expect(err).To(MatchError(ContainSubstring("specified but empty")))
+	})
+})
+
+var _ = Describe("checkAssignFamilies", func() {
+	conf := func(assignIPv4, assignIPv6 string) types.NetConf {
+		c := types.NetConf{}
+		if assignIPv4 != "" {
+			c.IPAM.AssignIpv4 = &assignIPv4
+		}
+		if assignIPv6 != "" {
+			c.IPAM.AssignIpv6 = &assignIPv6
+		}
+		return c
+	}
+	ips := func(addrs ...string) []net.IP {
+		var parsed []net.IP
+		for _, a := range addrs {
+			parsed = append(parsed, net.ParseIP(a))
+		}
+		return parsed
+	}
+
+	table.DescribeTable("checks the requested families against the assign flags",
+		func(c types.NetConf, requested []net.IP, expectedErr string) {
+			err := checkAssignFamilies(requested, c)
+			if expectedErr == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+			}
+		},
+		table.Entry("IPv4 with both enabled", conf("true", "true"), ips("10.0.0.1"), ""),
+		table.Entry("IPv4 and IPv6 with both enabled", conf("true", "true"), ips("10.0.0.1", "fd00::1"), ""),
+		table.Entry("IPv4 with the flags unset", conf("", ""), ips("10.0.0.1"), ""),
+		table.Entry("IPv6 with assign_ipv6 unset", conf("", ""), ips("fd00::1"), ""),
+		table.Entry("IPv4 with assign_ipv4 false", conf("false", "true"), ips("10.0.0.1"),
+			"requests IPv4 address 10.0.0.1 but assign_ipv4 is false"),
+		table.Entry("IPv6 with assign_ipv6 false", conf("true", "false"), ips("fd00::1"),
+			"requests IPv6 address fd00::1 but assign_ipv6 is false"),
+		table.Entry("IPv4 and IPv6 with assign_ipv4 false", conf("false", "true"), ips("10.0.0.1", "fd00::1"),
+			"assign_ipv4 is false"),
+		table.Entry("IPv4 and IPv6 with assign_ipv6 false", conf("true", "false"), ips("10.0.0.1", "fd00::1"),
+			"assign_ipv6 is false"),
+		table.Entry("IPv6 with assign_ipv4 false", conf("false", "true"), ips("fd00::1"), ""),
+		table.Entry("IPv4 with assign_ipv6 false", conf("true", "false"), ips("10.0.0.1"), ""),
+	)
+})
+
+var _ = Describe("floatingIPNATs", func() {
+	podIPs := func(cidrs ...string) []*current.IPConfig {
+		var ips []*current.IPConfig
+		for _, c := range cidrs {
+			ip, ipNet, err := net.ParseCIDR(c)
+			Expect(err).NotTo(HaveOccurred())
+			ipNet.IP = ip
+			ips = append(ips, &current.IPConfig{Address: *ipNet})
+		}
+		return ips
+	}
+
+	It("maps each floating IP to the pod's first address of the same family", func() {
+		ipNATs, err := floatingIPNATs([]string{"1.1.1.1", "2001:647f::21"},
+			podIPs("10.0.0.1/32", "fd00::1/128", "10.0.0.2/32"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipNATs).To(Equal([]api.IPNAT{
+			{InternalIP: "10.0.0.1", ExternalIP: "1.1.1.1"},
+			{InternalIP: "fd00::1", ExternalIP: "2001:647f::21"},
+		}))
+	})
+
+	It("rejects an invalid floating IP", func() {
+		_, err := floatingIPNATs([]string{"1.1.1.300"}, podIPs("10.0.0.1/32"))
+		Expect(err).To(MatchError(`invalid floating IP "1.1.1.300"`))
+	})
+
+	It("rejects a floating IP when the pod has no address of its family", func() {
+		_, err := floatingIPNATs([]string{"1.1.1.1", "2001:647f::21"}, podIPs("10.0.0.1/32"))
+		Expect(err).To(MatchError("floating IP 2001:647f::21 can't be used, since the pod has no IPv6 address"))
+	})
+
+	It("rejects a pod address that isn't a host address", func() {
+		_, err := floatingIPNATs([]string{"1.1.1.1"}, podIPs("10.0.0.1/24"))
+		Expect(err).To(MatchError(ContainSubstring("Mask size is 24, not 32")))
+	})
+})
+
+// fakeNodeGetter returns the node with the given name, if it has it.
+type fakeNodeGetter map[string]*corev1.Node
+
+func (f fakeNodeGetter) Get(_ context.Context, name string, _ metav1.GetOptions) (*corev1.Node, error) {
+	if node, ok := f[name]; ok {
+		return node, nil
+	}
+	return nil, fmt.Errorf("nodes %q not found", name)
+}
+
+var _ = Describe("getPodCidr", func() {
+	nodes := fakeNodeGetter{
+		"node1": {ObjectMeta: metav1.ObjectMeta{Name: "node1"}, Spec: corev1.NodeSpec{PodCIDR: "10.0.0.0/24"}},
+		"node2": {ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+	}
+
+	It("returns the node's PodCIDR", func() {
+		Expect(getPodCidr(nodes, types.NetConf{}, "node1")).To(Equal("10.0.0.0/24"))
+	})
+
+	It("prefers the node name from the config", func() {
+		conf := types.NetConf{}
+		conf.Kubernetes.NodeName = "node1"
+		Expect(getPodCidr(nodes, conf, "other")).To(Equal("10.0.0.0/24"))
+	})
+
+	It("explains that a node has no PodCIDR", func() {
+		_, err := getPodCidr(nodes, types.NetConf{}, "node2")
+		Expect(err).To(MatchError(ContainSubstring("node node2 has no PodCIDR assigned")))
+	})
+
+	It("explains that the node couldn't be read", func() {
+		_, err := getPodCidr(nodes, types.NetConf{}, "node3")
+		Expect(err).To(MatchError(ContainSubstring("failed to get node node3 to look up its PodCIDR")))
+	})
+})
+
+var _ = Describe("annotationLabels", func() {
+	const prefix = "label.projectcalico.org/"
+
+	It("copies the annotations under the prefix, with the prefix stripped", func() {
+		labels, err := annotationLabels(prefix, map[string]string{
+			prefix + "team":                 "payments",
+			prefix + "tier":                 "back end",
+			"cni.projectcalico.org/ipAddrs": `["10.0.0.1"]`,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(labels).To(Equal(map[string]string{"team": "payments", "tier": "back-end"}))
+	})
+
+	It("does nothing without a prefix", func() {
+		labels, err := annotationLabels("", map[string]string{prefix + "team": "payments"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(labels).To(BeEmpty())
+	})
+
+	It("rejects an annotation that's only the prefix", func() {
+		_, err := annotationLabels(prefix, map[string]string{prefix: "payments"})
+		Expect(err).To(MatchError(ContainSubstring("has no label key after the prefix")))
+	})
+
+	It("rejects a value that's too long to be a label", func() {
+		_, err := annotationLabels(prefix, map[string]string{prefix + "team": strings.Repeat("a", 64)})
+		Expect(err).To(MatchError(ContainSubstring("invalid label value")))
+	})
+})
@@ -0,0 +1,344 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	calicoclient "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+const (
+	ipv4PoolsAnnotation = "cni.projectcalico.org/ipv4pools"
+	ipv6PoolsAnnotation = "cni.projectcalico.org/ipv6pools"
+
+	// ipv4ReservedAnnotation lists IPv4 addresses and CIDRs, such as gateways and VIPs, that the pod mustn't be
+	// given from within its pools.
+	ipv4ReservedAnnotation = "cni.projectcalico.org/ipv4reserved"
+)
+
+// Where a pool selection came from, in order of precedence.
+const (
+	poolSourcePod       = "pod annotation"
+	poolSourceNamespace = "namespace annotation"
+	poolSourceNode      = "node selector"
+	poolSourceNetConf   = "netconf"
+	poolSourceDefault   = "cluster default"
+)
+
+// poolSelection is the pools chosen for one IP family. An empty list means that the IPAM plugin should use
+// its own defaults.
+type poolSelection struct {
+	Pools  []string
+	Source string
+}
+
+// selectIPAMPools works out which IP pools a pod's addresses should come from. Each IP family is chosen
+// independently, taking the first of these that applies:
+//
+//  1. The pools listed in the pod's cni.projectcalico.org/ipv4pools or ipv6pools annotation.
+//  2. The pools listed in the same annotation on the pod's namespace.
+//  3. The enabled pools with a node selector that picks out this node specifically. Pools without a node
+//     selector, or with all(), match every node so don't count.
+//  4. The ipv4_pools or ipv6_pools from the NetConf.
+//  5. Nothing, leaving the IPAM plugin to use any enabled pool that matches the node.
+//
+// Pools chosen by annotation are normally passed through as they are for the IPAM plugin to resolve, but if
+// they are all known pools and none of them can be used on this node, that's an error since it would
+// otherwise only fail later on in IPAM.
+//
+// The node and pools are nil if setIPAMPools skipped looking them up, in which case step 3 doesn't apply.
+func selectIPAMPools(
+	conf types.NetConf,
+	podAnnot, nsAnnot map[string]string,
+	node *api.Node,
+	pools []api.IPPool,
+) (v4, v6 poolSelection, err error) {
+	v4, err = selectFamilyPools(4, ipv4PoolsAnnotation, conf.IPAM.IPv4Pools, podAnnot, nsAnnot, node, pools)
+	if err != nil {
+		return
+	}
+	v6, err = selectFamilyPools(6, ipv6PoolsAnnotation, conf.IPAM.IPv6Pools, podAnnot, nsAnnot, node, pools)
+	return
+}
+
+func selectFamilyPools(
+	version int,
+	annotation string,
+	confPools []string,
+	podAnnot, nsAnnot map[string]string,
+	node *api.Node,
+	pools []api.IPPool,
+) (poolSelection, error) {
+	for _, a := range []struct {
+		annot  map[string]string
+		source string
+	}{{podAnnot, poolSourcePod}, {nsAnnot, poolSourceNamespace}} {
+		value := a.annot[annotation]
+		if value == "" {
+			continue
+		}
+		var requested []string
+		if err := json.Unmarshal([]byte(value), &requested); err != nil {
+			return poolSelection{}, fmt.Errorf("failed to parse %s %q: %s", a.source, annotation, err)
+		}
+		if err := checkPoolsFamily(requested, version, pools); err != nil {
+			return poolSelection{}, fmt.Errorf("pools from %s %q: %s", a.source, annotation, err)
+		}
+		if err := checkPoolsUsableOnNode(requested, node, pools); err != nil {
+			return poolSelection{}, fmt.Errorf("pools from %s %q: %s", a.source, annotation, err)
+		}
+		return poolSelection{Pools: requested, Source: a.source}, nil
+	}
+
+	if node != nil {
+		var matched []string
+		for _, p := range pools {
+			if p.Spec.Disabled || p.Spec.NodeSelector == "" || p.Spec.NodeSelector == "all()" {
+				continue
+			}
+			_, cidr, err := cnet.ParseCIDR(p.Spec.CIDR)
+			if err != nil || cidr.Version() != version {
+				continue
+			}
+			selects, err := p.SelectsNode(*node)
+			if err != nil {
+				return poolSelection{}, fmt.Errorf("invalid node selector on pool %s: %s", p.Name, err)
+			}
+			if selects {
+				matched = append(matched, p.Spec.CIDR)
+			}
+		}
+		if len(matched) > 0 {
+			return poolSelection{Pools: matched, Source: poolSourceNode}, nil
+		}
+	}
+
+	if len(confPools) > 0 {
+		return poolSelection{Pools: confPools, Source: poolSourceNetConf}, nil
+	}
+	return poolSelection{Source: poolSourceDefault}, nil
+}
+
+// checkPoolsFamily returns an error if any of the requested pools is a CIDR, or the name of a known pool, of
+// the wrong IP version. Unknown pool names are left for the IPAM plugin to report on.
+func checkPoolsFamily(requested []string, version int, pools []api.IPPool) error {
+	for _, r := range requested {
+		cidr := r
+		if _, _, err := cnet.ParseCIDR(r); err != nil {
+			pool := findPool(r, pools)
+			if pool == nil {
+				continue
+			}
+			cidr = pool.Spec.CIDR
+		}
+		if _, c, err := cnet.ParseCIDR(cidr); err == nil && c.Version() != version {
+			return fmt.Errorf("%s is not an IPv%d pool", r, version)
+		}
+	}
+	return nil
+}
+
+// checkPoolsUsableOnNode returns an error if every one of the requested pools is a known pool that can't
+// be used on the node, either because it's disabled or because its node selector doesn't match.
+func checkPoolsUsableOnNode(requested []string, node *api.Node, pools []api.IPPool) error {
+	if node == nil || len(requested) == 0 {
+		return nil
+	}
+	for _, r := range requested {
+		pool := findPool(r, pools)
+		if pool == nil {
+			// Leave unknown pools for the IPAM plugin to report on.
+			return nil
+		}
+		if pool.Spec.Disabled {
+			continue
+		}
+		if selects, err := pool.SelectsNode(*node); err != nil || selects {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of %v can be used on node %s", requested, node.Name)
+}
+
+// findPool returns the pool with the given name or CIDR, if there is one.
+func findPool(nameOrCIDR string, pools []api.IPPool) *api.IPPool {
+	for i := range pools {
+		if pools[i].Name == nameOrCIDR || pools[i].Spec.CIDR == nameOrCIDR {
+			return &pools[i]
+		}
+	}
+	if _, cidr, err := cnet.ParseCIDR(nameOrCIDR); err == nil {
+		for i := range pools {
+			if _, pc, err := cnet.ParseCIDR(pools[i].Spec.CIDR); err == nil && pc.String() == cidr.String() {
+				return &pools[i]
+			}
+		}
+	}
+	return nil
+}
+
+// setIPAMPools selects the pools to use with lookUpIPAMPools and writes them into the IPAM section of the
+// NetConf that's passed to the IPAM plugin, along with any addresses reserved by the pod's annotation.
+func setIPAMPools(
+	ctx context.Context,
+	calicoClient calicoclient.Interface,
+	conf types.NetConf,
+	nodename string,
+	podAnnot, nsAnnot map[string]string,
+	stdinData []byte,
+	logger *logrus.Entry,
+) ([]byte, error) {
+	reserved, err := parseIPv4Reserved(podAnnot)
+	if err != nil {
+		return nil, err
+	}
+	v4, v6, err := lookUpIPAMPools(ctx, calicoClient, conf, nodename, podAnnot, nsAnnot, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(stdinData, &data); err != nil {
+		return nil, err
+	}
+	ipamData, ok := data["ipam"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("data on stdin was of unexpected type")
+	}
+	for key, sel := range map[string]poolSelection{"ipv4_pools": v4, "ipv6_pools": v6} {
+		if len(sel.Pools) > 0 {
+			ipamData[key] = sel.Pools
+		} else {
+			delete(ipamData, key)
+		}
+	}
+	if len(reserved) > 0 {
+		logger.WithField("ipv4_reserved", reserved).Debug("Pod reserves addresses within its pools")
+		ipamData["ipv4_reserved"] = reserved
+	}
+	return json.Marshal(data)
+}
+
+// parseIPv4Reserved returns the addresses listed in the pod's ipv4reserved annotation. They're checked here so
+// that a bad annotation is reported against the pod, but it's the IPAM plugin that applies them.
+func parseIPv4Reserved(podAnnot map[string]string) ([]string, error) {
+	value := podAnnot[ipv4ReservedAnnotation]
+	if value == "" {
+		return nil, nil
+	}
+	var reserved []string
+	if err := json.Unmarshal([]byte(value), &reserved); err != nil {
+		return nil, fmt.Errorf("failed to parse %s %q: %s", poolSourcePod, ipv4ReservedAnnotation, err)
+	}
+	if _, err := utils.ParseIPv4Reserved(reserved); err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %s", poolSourcePod, ipv4ReservedAnnotation, err)
+	}
+	return reserved, nil
+}
+
+// lookUpIPAMPools looks up the node and pools and selects the pools to use with selectIPAMPools. If the NetConf
+// already names pools for each IP family that will be assigned, the lookups are skipped: the pod and namespace
+// annotations still apply, but node selectors aren't consulted and the NetConf's pools are used as they are.
+func lookUpIPAMPools(
+	ctx context.Context,
+	calicoClient calicoclient.Interface,
+	conf types.NetConf,
+	nodename string,
+	podAnnot, nsAnnot map[string]string,
+	logger *logrus.Entry,
+) (v4, v6 poolSelection, err error) {
+	var node *api.Node
+	var pools []api.IPPool
+	if netConfNamesPools(conf) {
+		logger.Debug("NetConf names the IP pools, not looking up node selectors")
+	} else {
+		node, err = calicoClient.Nodes().Get(ctx, nodename, options.GetOptions{})
+		if err != nil {
+			if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+				err = fmt.Errorf("failed to get node %s: %s", nodename, err)
+				return
+			}
+			node = nil
+		}
+		var poolList *api.IPPoolList
+		poolList, err = calicoClient.IPPools().List(ctx, options.ListOptions{})
+		if err != nil {
+			err = fmt.Errorf("failed to list IP pools: %s", err)
+			return
+		}
+		pools = poolList.Items
+	}
+
+	v4, v6, err = selectIPAMPools(conf, podAnnot, nsAnnot, node, pools)
+	if err != nil {
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"ipv4_pools": v4.Pools, "ipv4_source": v4.Source,
+		"ipv6_pools": v6.Pools, "ipv6_source": v6.Source,
+	}).Debug("Selected IP pools")
+	return
+}
+
+// netConfNamesPools returns true if the NetConf names the pools to use for every IP family that the IPAM plugin
+// will assign. IPv4 is assigned unless assign_ipv4 is "false", IPv6 only if assign_ipv6 is "true".
+func netConfNamesPools(conf types.NetConf) bool {
+	assign4 := conf.IPAM.AssignIpv4 == nil || *conf.IPAM.AssignIpv4 != "false"
+	assign6 := conf.IPAM.AssignIpv6 != nil && *conf.IPAM.AssignIpv6 == "true"
+	if !assign4 && !assign6 {
+		return false
+	}
+	return (!assign4 || len(conf.IPAM.IPv4Pools) > 0) && (!assign6 || len(conf.IPAM.IPv6Pools) > 0)
+}
+
+// checkStaticIPsInPools returns an error if any of the addresses that bypass IPAM isn't in an IP pool.
+func checkStaticIPsInPools(ctx context.Context, calicoClient calicoclient.Interface, ips []net.IP) error {
+	poolList, err := calicoClient.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list IP pools: %s", err)
+	}
+	return staticIPsInPools(ips, poolList.Items)
+}
+
+// staticIPsInPools returns an error naming the first of the addresses that isn't in any of the pools.
+func staticIPsInPools(ips []net.IP, pools []api.IPPool) error {
+	for _, ip := range ips {
+		found := false
+		for _, p := range pools {
+			_, cidr, err := net.ParseCIDR(p.Spec.CIDR)
+			if err == nil && cidr.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("IP %s is not in any IP pool, and require_pool_for_static_ips is set", ip)
+		}
+	}
+	return nil
+}
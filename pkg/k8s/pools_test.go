@@ -0,0 +1,217 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+)
+
+func testPool(name, cidr, selector string, disabled bool) api.IPPool {
+	return api.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       api.IPPoolSpec{CIDR: cidr, NodeSelector: selector, Disabled: disabled},
+	}
+}
+
+var _ = Describe("selectIPAMPools", func() {
+	pools := []api.IPPool{
+		testPool("default-v4", "10.0.0.0/16", "all()", false),
+		testPool("default-v6", "fd00::/64", "", false),
+		testPool("rack-a", "10.1.0.0/24", "rack == 'a'", false),
+		testPool("rack-a-v6", "fd01::/64", "rack == 'a'", false),
+		testPool("rack-b", "10.2.0.0/24", "rack == 'b'", false),
+		testPool("rack-a-disabled", "10.3.0.0/24", "rack == 'a'", true),
+	}
+	rackA := &api.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-a", Labels: map[string]string{"rack": "a"}},
+	}
+	unlabelled := &api.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-x"}}
+
+	v4Annot := func(v string) map[string]string { return map[string]string{ipv4PoolsAnnotation: v} }
+	conf := func(v4, v6 []string) types.NetConf {
+		var c types.NetConf
+		c.IPAM.IPv4Pools = v4
+		c.IPAM.IPv6Pools = v6
+		return c
+	}
+
+	DescribeTable("pool precedence",
+		func(c types.NetConf, podAnnot, nsAnnot map[string]string, node *api.Node, v4, v6 poolSelection) {
+			gotV4, gotV6, err := selectIPAMPools(c, podAnnot, nsAnnot, node, pools)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gotV4).To(Equal(v4))
+			Expect(gotV6).To(Equal(v6))
+		},
+		Entry("nothing set",
+			types.NetConf{}, nil, nil, unlabelled,
+			poolSelection{Source: poolSourceDefault}, poolSelection{Source: poolSourceDefault}),
+		Entry("netconf pools",
+			conf([]string{"10.0.0.0/16"}, []string{"fd00::/64"}), nil, nil, unlabelled,
+			poolSelection{Pools: []string{"10.0.0.0/16"}, Source: poolSourceNetConf},
+			poolSelection{Pools: []string{"fd00::/64"}, Source: poolSourceNetConf}),
+		Entry("node selector beats netconf",
+			conf([]string{"10.0.0.0/16"}, nil), nil, nil, rackA,
+			poolSelection{Pools: []string{"10.1.0.0/24"}, Source: poolSourceNode},
+			poolSelection{Pools: []string{"fd01::/64"}, Source: poolSourceNode}),
+		Entry("no node falls through to netconf",
+			conf([]string{"10.0.0.0/16"}, nil), nil, nil, nil,
+			poolSelection{Pools: []string{"10.0.0.0/16"}, Source: poolSourceNetConf},
+			poolSelection{Source: poolSourceDefault}),
+		Entry("namespace annotation beats node selector",
+			types.NetConf{}, nil, v4Annot(`["default-v4"]`), rackA,
+			poolSelection{Pools: []string{"default-v4"}, Source: poolSourceNamespace},
+			poolSelection{Pools: []string{"fd01::/64"}, Source: poolSourceNode}),
+		Entry("pod annotation beats namespace annotation",
+			types.NetConf{}, v4Annot(`["rack-a"]`), v4Annot(`["default-v4"]`), rackA,
+			poolSelection{Pools: []string{"rack-a"}, Source: poolSourcePod},
+			poolSelection{Pools: []string{"fd01::/64"}, Source: poolSourceNode}),
+		Entry("families are chosen independently",
+			conf(nil, []string{"fd02::/64"}),
+			map[string]string{ipv6PoolsAnnotation: `["fd00::/64"]`}, v4Annot(`["10.0.0.0/16"]`), unlabelled,
+			poolSelection{Pools: []string{"10.0.0.0/16"}, Source: poolSourceNamespace},
+			poolSelection{Pools: []string{"fd00::/64"}, Source: poolSourcePod}),
+		Entry("unknown annotated pools are passed through",
+			types.NetConf{}, v4Annot(`["10.9.0.0/24"]`), nil, rackA,
+			poolSelection{Pools: []string{"10.9.0.0/24"}, Source: poolSourcePod},
+			poolSelection{Pools: []string{"fd01::/64"}, Source: poolSourceNode}),
+		Entry("only the ipv6pools annotation",
+			types.NetConf{}, map[string]string{ipv6PoolsAnnotation: `["default-v6"]`}, nil, unlabelled,
+			poolSelection{Source: poolSourceDefault},
+			poolSelection{Pools: []string{"default-v6"}, Source: poolSourcePod}),
+		Entry("only the ipv4pools annotation",
+			types.NetConf{}, v4Annot(`["default-v4"]`), nil, unlabelled,
+			poolSelection{Pools: []string{"default-v4"}, Source: poolSourcePod},
+			poolSelection{Source: poolSourceDefault}),
+		Entry("annotated pools only need one usable on the node",
+			types.NetConf{}, v4Annot(`["rack-b", "rack-a"]`), nil, rackA,
+			poolSelection{Pools: []string{"rack-b", "rack-a"}, Source: poolSourcePod},
+			poolSelection{Pools: []string{"fd01::/64"}, Source: poolSourceNode}),
+	)
+
+	DescribeTable("conflicts",
+		func(podAnnot, nsAnnot map[string]string, node *api.Node, errSubstring string) {
+			_, _, err := selectIPAMPools(types.NetConf{}, podAnnot, nsAnnot, node, pools)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(errSubstring))
+		},
+		Entry("pod annotation names a pool for another node",
+			v4Annot(`["rack-b"]`), nil, rackA, "none of [rack-b] can be used on node node-a"),
+		Entry("namespace annotation CIDR selects another node",
+			nil, v4Annot(`["10.2.0.0/24"]`), rackA, "namespace annotation"),
+		Entry("annotated pool is disabled",
+			v4Annot(`["rack-a-disabled"]`), nil, rackA, "none of [rack-a-disabled]"),
+		Entry("pod annotation isn't valid JSON",
+			v4Annot(`rack-a`), nil, rackA, "failed to parse pod annotation"),
+		Entry("IPv6 CIDR in the ipv4pools annotation",
+			v4Annot(`["10.0.0.0/16", "fd00::/64"]`), nil, rackA, "fd00::/64 is not an IPv4 pool"),
+		Entry("IPv6 pool name in the ipv4pools annotation",
+			v4Annot(`["default-v6"]`), nil, nil, "default-v6 is not an IPv4 pool"),
+		Entry("IPv4 CIDR in the ipv6pools annotation",
+			map[string]string{ipv6PoolsAnnotation: `["10.0.0.0/16"]`}, nil, rackA, "10.0.0.0/16 is not an IPv6 pool"),
+		Entry("pod conflict isn't hidden by a usable namespace pool",
+			v4Annot(`["rack-b"]`), v4Annot(`["rack-a"]`), rackA, "pod annotation"),
+	)
+
+	Describe("setIPAMPools", func() {
+		str := func(s string) *string { return &s }
+		stdin := []byte(`{"ipam": {"type": "calico-ipam"}}`)
+		v6Annot := func(v string) map[string]string { return map[string]string{ipv6PoolsAnnotation: v} }
+
+		DescribeTable("skips the datastore lookups when the NetConf names the pools",
+			func(assign4, assign6 *string, v4Pools, v6Pools []string, expected string) {
+				c := conf(v4Pools, v6Pools)
+				c.IPAM.AssignIpv4 = assign4
+				c.IPAM.AssignIpv6 = assign6
+				Expect(netConfNamesPools(c)).To(BeTrue())
+
+				// A nil client would panic if it were used.
+				data, err := setIPAMPools(context.Background(), nil, c, "node-a",
+					v6Annot(`["fd02::/64"]`), nil, stdin, logrus.WithField("test", "pools"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(data).To(MatchJSON(expected))
+			},
+			Entry("IPv4 only", nil, nil, []string{"10.0.0.0/16"}, nil,
+				`{"ipam": {"type": "calico-ipam", "ipv4_pools": ["10.0.0.0/16"], "ipv6_pools": ["fd02::/64"]}}`),
+			Entry("IPv6 only", str("false"), str("true"), nil, []string{"fd00::/64"},
+				`{"ipam": {"type": "calico-ipam", "ipv6_pools": ["fd02::/64"]}}`),
+			Entry("dual stack", nil, str("true"), []string{"10.0.0.0/16"}, []string{"fd00::/64"},
+				`{"ipam": {"type": "calico-ipam", "ipv4_pools": ["10.0.0.0/16"], "ipv6_pools": ["fd02::/64"]}}`),
+		)
+
+		It("passes the pod's reserved addresses to the IPAM plugin", func() {
+			c := conf([]string{"10.0.0.0/16"}, nil)
+			annot := map[string]string{ipv4ReservedAnnotation: `["10.0.0.1", "10.0.0.64/26"]`}
+			data, err := setIPAMPools(context.Background(), nil, c, "node-a", annot, nil, stdin, logrus.WithField("test", "pools"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(MatchJSON(
+				`{"ipam": {"type": "calico-ipam", "ipv4_pools": ["10.0.0.0/16"], "ipv4_reserved": ["10.0.0.1", "10.0.0.64/26"]}}`))
+		})
+
+		DescribeTable("rejects an invalid ipv4reserved annotation",
+			func(value, expected string) {
+				c := conf([]string{"10.0.0.0/16"}, nil)
+				annot := map[string]string{ipv4ReservedAnnotation: value}
+				_, err := setIPAMPools(context.Background(), nil, c, "node-a", annot, nil, stdin, logrus.WithField("test", "pools"))
+				Expect(err).To(MatchError(ContainSubstring(expected)))
+			},
+			Entry("not a list", `"10.0.0.1"`, "failed to parse pod annotation"),
+			Entry("not an address", `["gateway"]`, "invalid IP or CIDR in ipv4_reserved: gateway"),
+			Entry("an IPv6 address", `["fd00::1"]`, "ipv4_reserved entry fd00::1 is not IPv4"),
+		)
+
+		DescribeTable("looks up the node selectors otherwise",
+			func(assign4, assign6 *string, v4Pools, v6Pools []string) {
+				c := conf(v4Pools, v6Pools)
+				c.IPAM.AssignIpv4 = assign4
+				c.IPAM.AssignIpv6 = assign6
+				Expect(netConfNamesPools(c)).To(BeFalse())
+			},
+			Entry("no pools", nil, nil, nil, nil),
+			Entry("dual stack with only IPv4 pools", nil, str("true"), []string{"10.0.0.0/16"}, nil),
+			Entry("dual stack with only IPv6 pools", nil, str("true"), nil, []string{"fd00::/64"}),
+			Entry("nothing to assign", str("false"), nil, []string{"10.0.0.0/16"}, nil),
+		)
+	})
+})
+
+var _ = Describe("staticIPsInPools", func() {
+	pools := []api.IPPool{
+		testPool("default-v4", "10.0.0.0/16", "all()", false),
+		testPool("default-v6", "fd00::/64", "", false),
+	}
+
+	It("accepts addresses within the pools", func() {
+		Expect(staticIPsInPools([]net.IP{net.ParseIP("10.0.1.1"), net.ParseIP("fd00::10")}, pools)).To(Succeed())
+	})
+
+	It("rejects an address outside them", func() {
+		err := staticIPsInPools([]net.IP{net.ParseIP("10.0.1.1"), net.ParseIP("10.1.0.1")}, pools)
+		Expect(err).To(MatchError("IP 10.1.0.1 is not in any IP pool, and require_pool_for_static_ips is set"))
+	})
+
+	It("rejects any address when there are no pools", func() {
+		Expect(staticIPsInPools([]net.IP{net.ParseIP("fd00::10")}, nil)).NotTo(Succeed())
+	})
+})
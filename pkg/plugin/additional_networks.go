@@ -0,0 +1,406 @@
+// Copyright (c) 2020 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/metrics"
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/dataplane"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// additionalNetwork holds everything needed to ADD or DEL one of the networks listed in the
+// additional_networks section of the NetConf.
+type additionalNetwork struct {
+	conf   types.NetConf
+	args   *skel.CmdArgs
+	wepIDs utils.WEPIdentifiers
+	logger *logrus.Entry
+}
+
+// additionalNetworkIfName returns the name of the container interface for the additional network at
+// the given index, e.g. "net1" for the first one.
+func additionalNetworkIfName(idx int) string {
+	return fmt.Sprintf("net%d", idx+1)
+}
+
+// isAdditionalNetworkEndpoint returns whether the WorkloadEndpoint belongs to one of the additional_networks
+// rather than to the main network.
+func isAdditionalNetworkEndpoint(conf types.NetConf, wep *api.WorkloadEndpoint) bool {
+	network := wep.Annotations[utils.NetworkAnnotation]
+	for _, n := range conf.AdditionalNetworks {
+		if n.Name == network {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAdditionalNetworks checks that the additional_networks section of the NetConf can be honoured.
+func validateAdditionalNetworks(conf types.NetConf) error {
+	if len(conf.AdditionalNetworks) == 0 {
+		return nil
+	}
+	if !conf.FeatureControl.AdditionalNetworks {
+		return errors.New("requested feature is not enabled: additional_networks")
+	}
+	if conf.DatastoreType == "kubernetes" {
+		return errors.New("additional_networks is not supported with the kubernetes datastore")
+	}
+
+	seen := map[string]bool{conf.Name: true}
+	for _, n := range conf.AdditionalNetworks {
+		if err := utils.ValidateNetworkName(n.Name); err != nil {
+			return fmt.Errorf("invalid additional network name %q: %w", n.Name, err)
+		}
+		if seen[n.Name] {
+			return fmt.Errorf("duplicate network name in additional_networks: %s", n.Name)
+		}
+		seen[n.Name] = true
+		if n.IPAM == nil {
+			return fmt.Errorf("no IPAM configured for additional network %s", n.Name)
+		}
+	}
+	return nil
+}
+
+// getAdditionalNetworks builds the per-network config for each of the additional networks. The NetConf
+// for each network is the original NetConf with the name and IPAM sections swapped out, so that the
+// datastore and logging config is shared with the primary network.
+func getAdditionalNetworks(args *skel.CmdArgs, conf types.NetConf, wepIDs utils.WEPIdentifiers, logger *logrus.Entry) ([]additionalNetwork, error) {
+	if err := validateAdditionalNetworks(conf); err != nil {
+		return nil, err
+	}
+
+	var nets []additionalNetwork
+	for i, n := range conf.AdditionalNetworks {
+		var stdinData map[string]interface{}
+		if err := json.Unmarshal(args.StdinData, &stdinData); err != nil {
+			return nil, err
+		}
+		stdinData["name"] = n.Name
+		stdinData["ipam"] = n.IPAM
+		delete(stdinData, "additional_networks")
+
+		netArgs := *args
+		netArgs.IfName = additionalNetworkIfName(i)
+		var err error
+		netArgs.StdinData, err = json.Marshal(stdinData)
+		if err != nil {
+			return nil, err
+		}
+
+		netConf := types.NetConf{}
+		if err := json.Unmarshal(netArgs.StdinData, &netConf); err != nil {
+			return nil, fmt.Errorf("failed to load netconf for additional network %s: %v", n.Name, err)
+		}
+		netConf.AdditionalInterface = true
+
+		netIDs := wepIDs
+		netIDs.Endpoint = netArgs.IfName
+		netIDs.WEPName, err = netIDs.CalculateWorkloadEndpointName(false)
+		if err != nil {
+			return nil, fmt.Errorf("error constructing WorkloadEndpoint name: %s", err)
+		}
+
+		nets = append(nets, additionalNetwork{
+			conf:   netConf,
+			args:   &netArgs,
+			wepIDs: netIDs,
+			logger: logger.WithFields(logrus.Fields{
+				"Network":          n.Name,
+				"WorkloadEndpoint": netIDs.WEPName,
+			}),
+		})
+	}
+	return nets, nil
+}
+
+// withIfName runs f with CNI_IFNAME set to the interface of the additional network, so that the IPAM
+// plugin sees the right interface, then restores the original value.
+func (n *additionalNetwork) withIfName(f func() error) error {
+	orig := os.Getenv("CNI_IFNAME")
+	if err := os.Setenv("CNI_IFNAME", n.args.IfName); err != nil {
+		return err
+	}
+	defer os.Setenv("CNI_IFNAME", orig)
+	return f()
+}
+
+// hostVethName returns the name of the host side veth for the additional network. It's named in the same way
+// as the workload's own veth, so veth_name_style applies, but from identifiers suffixed with the container
+// interface name, so that it can't clash with the one for the primary interface.
+func (n *additionalNetwork) hostVethName() string {
+	ids := n.wepIDs
+	ids.Pod = fmt.Sprintf("%s/%s", ids.Pod, n.args.IfName)
+	suffix := "-" + n.args.IfName
+	if n.conf.VethNameStyle != utils.VethNameStyleHash {
+		// The prefix style only uses the first 11 characters of the container ID, so make room for the suffix.
+		ids.ContainerID = ids.ContainerID[:utils.Min(11-len(suffix), len(ids.ContainerID))]
+	}
+	ids.ContainerID += suffix
+	return utils.HostVethName(n.conf, &ids)
+}
+
+// setupAdditionalNetworks attaches the workload to each of the networks in the additional_networks
+// section of the NetConf. Each network gets its own IP allocation, container interface and
+// WorkloadEndpoint. The labels (and, under Kubernetes, the profiles) are copied from the primary endpoint.
+// On error, any additional networks that were already set up are torn down again.
+func setupAdditionalNetworks(
+	ctx context.Context,
+	calicoClient clientv3.Interface,
+	args *skel.CmdArgs,
+	conf types.NetConf,
+	wepIDs utils.WEPIdentifiers,
+	logger *logrus.Entry,
+) error {
+	nets, err := getAdditionalNetworks(args, conf, wepIDs, logger)
+	if err != nil || len(nets) == 0 {
+		return err
+	}
+
+	var primary *api.WorkloadEndpoint
+	err = utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) (err error) {
+		primary, err = calicoClient.WorkloadEndpoints().Get(ctx, wepIDs.Namespace, wepIDs.WEPName, options.GetOptions{})
+		return
+	})
+	if err != nil {
+		return fmt.Errorf("error getting primary WorkloadEndpoint: %v", err)
+	}
+
+	for i := range nets {
+		if err = nets[i].setup(ctx, calicoClient, primary); err != nil {
+			if conf.DebugKeepFailedInterface {
+				logger.Warn("debug_keep_failed_interface is set, leaving the additional networks in place")
+				return err
+			}
+			teardownNetworks(ctx, calicoClient, nets[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *additionalNetwork) setup(ctx context.Context, calicoClient clientv3.Interface, primary *api.WorkloadEndpoint) (err error) {
+	var existing *api.WorkloadEndpoint
+	err = utils.WithDatastoreTimeout(ctx, n.conf, func(ctx context.Context) (err error) {
+		existing, err = calicoClient.WorkloadEndpoints().Get(ctx, n.wepIDs.Namespace, n.wepIDs.WEPName, options.GetOptions{})
+		return
+	})
+	if err == nil && existing.Spec.ContainerID == n.wepIDs.ContainerID {
+		n.logger.Info("Additional network is already set up")
+		return nil
+	} else if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			return metrics.DatastoreFailure(err)
+		}
+		existing = nil
+	}
+
+	n.logger.Info("Setting up additional network")
+	var result *current.Result
+	err = n.withIfName(func() (err error) {
+		result, err = utils.AddIPAM(ctx, n.conf, n.args, n.logger)
+		return
+	})
+	if err != nil {
+		return metrics.IPAMFailure(fmt.Errorf("failed to assign IPs for additional network %s: %v", n.conf.Name, err))
+	}
+	defer func() {
+		if err != nil {
+			n.cleanUpFailedSetup()
+		}
+	}()
+
+	// If the endpoint was left behind by an earlier sandbox of the same workload, update it in place, keeping
+	// its revision so that the write fails rather than clobbering a concurrent change.
+	endpoint := existing
+	if endpoint == nil {
+		endpoint = api.NewWorkloadEndpoint()
+		endpoint.Name = n.wepIDs.WEPName
+		endpoint.Namespace = n.wepIDs.Namespace
+	} else {
+		n.logger.WithField("endpoint", existing).Info("Updating endpoint left by an earlier container")
+	}
+	endpoint.Labels = primary.Labels
+	utils.SetAssignedAt(endpoint, time.Now())
+	utils.SetNetwork(endpoint, n.conf.Name)
+	utils.SetPluginVersion(endpoint)
+	endpoint.Spec.Endpoint = n.wepIDs.Endpoint
+	endpoint.Spec.Node = n.wepIDs.Node
+	endpoint.Spec.Orchestrator = n.wepIDs.Orchestrator
+	endpoint.Spec.ContainerID = n.wepIDs.ContainerID
+	endpoint.Spec.Pod = primary.Spec.Pod
+	manageProfile := n.conf.ManageProfile == nil || *n.conf.ManageProfile
+	if n.wepIDs.Orchestrator == api.OrchestratorKubernetes {
+		endpoint.Spec.Profiles = primary.Spec.Profiles
+	} else if manageProfile {
+		endpoint.Spec.Profiles = []string{n.conf.Name}
+	}
+	endpoint.Spec.IPNetworks = []string{}
+	if err = utils.PopulateEndpointNets(endpoint, result, n.conf); err != nil {
+		return err
+	}
+
+	d, err := dataplane.GetDataplane(n.conf, n.logger)
+	if err != nil {
+		return err
+	}
+
+	// The additional interfaces don't get any routes; the default route stays on the primary interface.
+	hostVethName, contVethMac, err := d.DoNetworking(
+		ctx, calicoClient, n.args, result, n.hostVethName(), nil, endpoint, map[string]string{})
+	if err != nil {
+		return utils.NamespaceFailure(err)
+	}
+	endpoint.Spec.MAC = contVethMac
+	endpoint.Spec.InterfaceName = hostVethName
+
+	err = utils.WithDatastoreTimeout(ctx, n.conf, func(ctx context.Context) (err error) {
+		if existing != nil {
+			_, err = calicoClient.WorkloadEndpoints().Update(ctx, endpoint, options.SetOptions{})
+		} else {
+			_, err = utils.CreateOrUpdate(ctx, calicoClient, endpoint)
+		}
+		return
+	})
+	if err != nil {
+		return metrics.DatastoreFailure(err)
+	}
+	n.logger.WithField("endpoint", endpoint).Info("Wrote endpoint for additional network to datastore")
+
+	if n.conf.Policy.PolicyType == "" && manageProfile {
+		return createProfileIfMissing(ctx, calicoClient, n.conf, n.wepIDs.Orchestrator, n.logger)
+	}
+	return nil
+}
+
+// cleanUpFailedSetup releases the IPs and removes the container interface that a failed setup of the additional
+// network left behind. Unlike teardown, it leaves the WorkloadEndpoint alone, since setup only writes it as its
+// last step and any endpoint that's there may belong to an earlier sandbox.
+func (n *additionalNetwork) cleanUpFailedSetup() {
+	_ = n.withIfName(func() error {
+		utils.ReleaseIPAllocation(n.logger, n.conf, n.args)
+		return nil
+	})
+	if n.conf.DebugKeepFailedInterface {
+		n.logger.Warn("debug_keep_failed_interface is set, leaving the failed ADD's container interface in place")
+	} else if d, err := dataplane.GetDataplane(n.conf, n.logger); err != nil {
+		n.logger.WithError(err).Warn("Failed to get dataplane to clean up")
+	} else if err := d.CleanUpNamespace(n.args); err != nil {
+		n.logger.WithError(err).Warn("Failed to clean up container interface")
+	}
+}
+
+// teardownAdditionalNetworks releases the IPs, WorkloadEndpoints and container interfaces of each of the
+// networks in the additional_networks section of the NetConf. It carries on past errors so that as much as
+// possible is cleaned up, returning the first error seen. A network whose WorkloadEndpoint belongs to a
+// different container only has its container interface removed, since the DEL is for an old sandbox.
+func teardownAdditionalNetworks(
+	ctx context.Context,
+	calicoClient clientv3.Interface,
+	args *skel.CmdArgs,
+	conf types.NetConf,
+	wepIDs utils.WEPIdentifiers,
+	logger *logrus.Entry,
+) error {
+	nets, err := getAdditionalNetworks(args, conf, wepIDs, logger)
+	if err != nil {
+		return err
+	}
+	return teardownNetworks(ctx, calicoClient, nets)
+}
+
+func teardownNetworks(ctx context.Context, calicoClient clientv3.Interface, nets []additionalNetwork) error {
+	var firstErr error
+	for i := range nets {
+		if err := nets[i].teardown(ctx, calicoClient); err != nil {
+			nets[i].logger.WithError(err).Warn("Failed to tear down additional network")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (n *additionalNetwork) teardown(ctx context.Context, calicoClient clientv3.Interface) error {
+	n.logger.Info("Tearing down additional network")
+	var wep *api.WorkloadEndpoint
+	err := utils.WithDatastoreTimeout(ctx, n.conf, func(ctx context.Context) (err error) {
+		wep, err = calicoClient.WorkloadEndpoints().Get(ctx, n.wepIDs.Namespace, n.wepIDs.WEPName, options.GetOptions{})
+		return
+	})
+	staleContainer := false
+	if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			// Without the endpoint there's no way to check the ContainerID, so don't risk tearing down the
+			// running container's network.
+			return metrics.DatastoreFailure(err)
+		}
+		n.logger.Info("Endpoint object does not exist, no need to clean up.")
+	} else if wep.Spec.ContainerID != "" && n.args.ContainerID != wep.Spec.ContainerID {
+		// As for the primary endpoint, the DEL is for an old sandbox of a workload that's still running, so the
+		// endpoint and its IPs belong to the new sandbox. Anything the old sandbox still holds is left for IPAM
+		// garbage collection.
+		n.logger.WithField("endpoint", wep).Warning("CNI_CONTAINERID does not match WorkloadEndpoint ContainerID, don't delete WEP or release IPs.")
+		staleContainer = true
+	} else if err = utils.WithDatastoreTimeout(ctx, n.conf, func(ctx context.Context) error {
+		_, err := calicoClient.WorkloadEndpoints().Delete(ctx, wep.Namespace, wep.Name, options.DeleteOptions{
+			ResourceVersion: wep.ResourceVersion,
+			UID:             &wep.UID,
+		})
+		return err
+	}); err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			return metrics.DatastoreFailure(err)
+		}
+		n.logger.Info("Endpoint object does not exist, no need to clean up.")
+	}
+
+	d, err := dataplane.GetDataplane(n.conf, n.logger)
+	if err != nil {
+		return err
+	}
+	if err = d.CleanUpNamespace(n.args); err != nil {
+		return utils.NamespaceFailure(err)
+	}
+	if staleContainer {
+		return nil
+	}
+
+	keepIPs, err := utils.KeepIPs(n.args)
+	if err != nil || keepIPs {
+		return err
+	}
+	err = n.withIfName(func() error {
+		return utils.DeleteIPAM(n.conf, n.args, n.logger)
+	})
+	return metrics.IPAMFailure(err)
+}
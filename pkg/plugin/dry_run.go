@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+	"github.com/projectcalico/cni-plugin/pkg/k8s"
+	"github.com/projectcalico/cni-plugin/pkg/types"
+	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// dryRunAdd prints what an ADD would do for the workload, whose WorkloadEndpoint name has already been worked
+// out. The endpoint is the workload's existing endpoint, if there is one.
+func dryRunAdd(
+	ctx context.Context,
+	calicoClient clientv3.Interface,
+	conf types.NetConf,
+	wepIDs *utils.WEPIdentifiers,
+	endpoint *api.WorkloadEndpoint,
+	logger *logrus.Entry,
+) error {
+	report := utils.NewDryRunReport("ADD", conf, wepIDs)
+	report.EndpointExists = endpoint != nil
+
+	switch {
+	case wepIDs.Orchestrator == api.OrchestratorKubernetes:
+		// Kubernetes pods get a fresh allocation even if the endpoint exists.
+		if err := k8s.DryRunAddK8s(ctx, conf, *wepIDs, calicoClient, report, logger); err != nil {
+			return err
+		}
+	case endpoint != nil:
+		// Other workloads keep the existing endpoint's IPs, without calling IPAM.
+		report.IPs = endpoint.Spec.IPNetworks
+	case conf.IPAM.Type == "calico-ipam":
+		if len(conf.IPAM.IPv4Pools) > 0 {
+			report.IPv4Pools, report.IPv4PoolSource = conf.IPAM.IPv4Pools, "netconf"
+		}
+		if len(conf.IPAM.IPv6Pools) > 0 {
+			report.IPv6Pools, report.IPv6PoolSource = conf.IPAM.IPv6Pools, "netconf"
+		}
+	}
+
+	// Make sure that calico-ipam would be able to resolve the pools.
+	if conf.IPAM.Type == "calico-ipam" {
+		if _, err := utils.ResolvePools(ctx, calicoClient, report.IPv4Pools, true); err != nil {
+			return fmt.Errorf("invalid IPv4 pools: %s", err)
+		}
+		if _, err := utils.ResolvePools(ctx, calicoClient, report.IPv6Pools, false); err != nil {
+			return fmt.Errorf("invalid IPv6 pools: %s", err)
+		}
+	}
+
+	logger.Info("Dry run, not setting up the workload")
+	return report.Write(os.Stdout)
+}
+
+// dryRunDel prints what a DEL would do for the workload.
+func dryRunDel(conf types.NetConf, epIDs *utils.WEPIdentifiers, logger *logrus.Entry) error {
+	ctx := context.Background()
+	calicoClient, err := connectToDatastore(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	epIDs.WEPName, err = epIDs.CalculateWorkloadEndpointName(false)
+	if err != nil {
+		return fmt.Errorf("error constructing WorkloadEndpoint name: %s", err)
+	}
+	report := utils.NewDryRunReport("DEL", conf, epIDs)
+
+	wep, err := calicoClient.WorkloadEndpoints().Get(ctx, epIDs.Namespace, epIDs.WEPName, options.GetOptions{})
+	if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			return err
+		}
+	} else {
+		report.EndpointExists = true
+		report.IPs = wep.Spec.IPNetworks
+	}
+	if conf.IPAM.Type == "calico-ipam" {
+		report.HandleID = utils.GetEndpointHandleID(conf, conf.Name, epIDs.ContainerID, epIDs.Endpoint, epIDs.WEPName)
+	}
+
+	logger.Info("Dry run, not tearing down the workload")
+	return report.Write(os.Stdout)
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
+)
+
+// garbageCollect cleans up this node's WorkloadEndpoints whose host veth has gone, using the datastore in the
+// CNI config file at path, and prints a report of them.
+func garbageCollect(path string, dryRun bool) error {
+	conf, err := utils.LoadNetConfFile(path)
+	if err != nil {
+		return err
+	}
+	utils.ConfigureLogging(conf)
+
+	ctx := context.Background()
+	calicoClient, err := connectToDatastore(ctx, conf)
+	defer utils.RemoveInlineEtcdTLSFiles()
+	if err != nil {
+		return err
+	}
+
+	nodename := utils.DetermineNodename(conf)
+	logger := logrus.WithField("Node", nodename)
+	report, err := utils.CollectOrphanedEndpoints(ctx, calicoClient, conf, nodename, dryRun, utils.HostLinkExists, logger)
+	if err != nil {
+		return err
+	}
+	return report.Write(os.Stdout)
+}
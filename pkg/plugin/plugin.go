@@ -24,29 +24,37 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
 	cniSpecVersion "github.com/containernetworking/cni/pkg/version"
-	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"github.com/projectcalico/cni-plugin/internal/pkg/buildinfo"
+	"github.com/projectcalico/cni-plugin/internal/pkg/metrics"
+	"github.com/projectcalico/cni-plugin/internal/pkg/tracing"
 	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
 	"github.com/projectcalico/cni-plugin/pkg/dataplane"
 	"github.com/projectcalico/cni-plugin/pkg/k8s"
 	"github.com/projectcalico/cni-plugin/pkg/types"
+	"github.com/projectcalico/libcalico-go/lib/apiconfig"
 	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
 	"github.com/projectcalico/libcalico-go/lib/clientv3"
 	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
 	"github.com/projectcalico/libcalico-go/lib/logutils"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
 	"github.com/projectcalico/libcalico-go/lib/options"
 )
 
 const testConnectionTimeout = 2 * time.Second
 
+// addCleanupTimeout bounds the clean up after an ADD has failed part way, e.g. by exceeding add_timeout.
+const addCleanupTimeout = 10 * time.Second
+
 func init() {
 	// This ensures that main runs only on main thread (thread group leader).
 	// since namespace ops (unshare, setns) are done for a single thread, we
@@ -67,6 +75,7 @@ func testConnection() error {
 
 	// Create a new client.
 	calicoClient, err := utils.CreateClient(conf)
+	defer utils.RemoveInlineEtcdTLSFiles()
 	if err != nil {
 		return err
 	}
@@ -102,7 +111,33 @@ func testConnection() error {
 	return nil
 }
 
+// validateConfig checks the settings in the NetConf that don't need the datastore. ADD, DEL and CHECK all call it,
+// so that a bad value is rejected in the same way whichever command sees it first.
+func validateConfig(conf types.NetConf) error {
+	if err := validateAdditionalNetworks(conf); err != nil {
+		return err
+	}
+	if _, _, err := profileLabels(conf.Name, conf.ProfileLabelStyle); err != nil {
+		return err
+	}
+	if _, err := profileEgressRules(conf.DefaultProfileEgress, conf.DefaultProfileEgressCIDRs); err != nil {
+		return err
+	}
+	if err := utils.ValidateIPFamilyOrder(conf.IPFamilyOrder); err != nil {
+		return err
+	}
+	if _, err := utils.ParseContainerRoutes(conf.ContainerSettings.Routes); err != nil {
+		return err
+	}
+	if err := utils.ValidateVethNameStyle(conf.VethNameStyle); err != nil {
+		return err
+	}
+	return utils.ValidateDataplaneOptions(conf)
+}
+
 func cmdAdd(args *skel.CmdArgs) (err error) {
+	op := metrics.Start("add")
+
 	// Defer a panic recover, so that in case we panic we can still return
 	// a proper error to the runtime.
 	defer func() {
@@ -118,15 +153,37 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 		if err != nil {
 			logrus.WithError(err).Error("Final result of CNI ADD was an error.")
 		}
+		op.Finish(err, logrus.WithField("ContainerID", args.ContainerID))
+		if err != nil {
+			// Report the error in the CNI format, with a code for the kind of failure.
+			err = utils.ToCNIError(err)
+		}
 	}()
 
 	// Unmarshal the network config, and perform validation
 	conf := types.NetConf{}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to load netconf: %v", err)
+		return utils.InvalidConfig(fmt.Errorf("failed to load netconf: %v", err))
 	}
 
 	utils.ConfigureLogging(conf)
+	configureMetrics(op, conf)
+
+	if conf.DebugKeepFailedInterface {
+		logrus.Warn("debug_keep_failed_interface is set: a failed ADD will leave its interface and IPs behind. " +
+			"This is for debugging only and leaks IPs, don't use it in production")
+	}
+
+	// Validate the config up front, so that a bad config doesn't leak an IP for the primary network.
+	if err := validateConfig(conf); err != nil {
+		return utils.InvalidConfig(err)
+	}
+	if err := utils.ApplyForceInterfaceName(conf, args); err != nil {
+		return utils.InvalidConfig(err)
+	}
+	if err := utils.ParsePrevResult(&conf); err != nil {
+		return utils.InvalidConfig(err)
+	}
 
 	nodeNameFile := "/var/lib/calico/nodename"
 	if conf.NodenameFile != "" {
@@ -143,43 +200,71 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 	}
 
 	// Determine MTU to use.
-	if mtu, err := utils.MTUFromFile("/var/lib/calico/mtu"); err != nil {
-		return fmt.Errorf("failed to read MTU file: %s", err)
-	} else if conf.MTU == 0 && mtu != 0 {
-		// No MTU specified in config, but an MTU file was found on disk.
-		// Use the value from the file.
-		logrus.WithField("mtu", mtu).Debug("Using MTU from /var/lib/calico/mtu")
-		conf.MTU = mtu
+	if conf.MTU, err = utils.ResolveMTU(conf, "/var/lib/calico/mtu"); err != nil {
+		return
+	}
+	if conf.ContainerSettings.MTU, err = utils.ResolveContainerMTU(conf, conf.MTU, logrus.NewEntry(logrus.StandardLogger())); err != nil {
+		return
 	}
+	logrus.WithFields(logrus.Fields{"mtu": conf.MTU, "containerMTU": conf.ContainerSettings.MTU}).Debug("Using MTU")
 
 	// Determine which node name to use.
 	nodename := utils.DetermineNodename(conf)
+	op.Node = nodename
 
 	// Extract WEP identifiers such as pod name, pod namespace (for k8s), containerID, IfName.
 	wepIDs, err := utils.GetIdentifiers(args, nodename)
 	if err != nil {
 		return
 	}
+	utils.AddLogIdentifiers(wepIDs)
+	op.Orchestrator = wepIDs.Orchestrator
 
 	logrus.WithField("EndpointIDs", wepIDs).Debug("Extracted identifiers")
 
-	calicoClient, err := utils.CreateClient(conf)
+	// This container may be being reused, so make sure its next DEL isn't skipped.
+	if !conf.DryRun {
+		utils.RemoveDelTombstone(conf, args, logrus.WithField("ContainerID", wepIDs.ContainerID))
+	}
+
+	// Limit the number of operations on this node that hit the datastore at once, if configured to.
+	release, err := utils.AcquireConcurrencySlot(conf, logrus.WithField("ContainerID", wepIDs.ContainerID))
 	if err != nil {
 		return
 	}
+	defer release()
 
-	ctx := context.Background()
-	ci, err := calicoClient.ClusterInformation().Get(ctx, "default", options.GetOptions{})
-	if err != nil {
-		err = fmt.Errorf("error getting ClusterInformation: %v", err)
+	// Likewise limit the rate at which they do so.
+	if err = utils.WaitForDatastoreOpToken(conf, logrus.WithField("ContainerID", wepIDs.ContainerID)); err != nil {
 		return
 	}
-	if !*ci.Spec.DatastoreReady {
-		logrus.Info("Upgrade may be in progress, ready flag is not set")
-		err = fmt.Errorf("Calico is currently not ready to process requests")
+
+	// Trace the ADD if configured to. The spans are exported once it completes.
+	tracer := newTracer(conf, logrus.WithField("ContainerID", wepIDs.ContainerID))
+	ctx, addSpan := tracing.Start(tracing.WithTracer(context.Background(), tracer), "cni-add")
+	setSpanIdentifiers(addSpan, wepIDs)
+	defer func() {
+		addSpan.Finish(err)
+		tracer.Flush(logrus.WithField("ContainerID", wepIDs.ContainerID))
+	}()
+
+	if conf.AddTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(conf.AddTimeout)*time.Second)
+		defer cancel()
+	}
+
+	calicoClient, err := connectToDatastore(ctx, conf)
+	if err != nil {
 		return
 	}
 
+	if conf.AutoCreateNode && !conf.DryRun {
+		if err = utils.EnsureNodeExists(ctx, calicoClient.Nodes(), wepIDs.Node, logrus.WithField("ContainerID", wepIDs.ContainerID)); err != nil {
+			return
+		}
+	}
+
 	// Remove the endpoint field (IfName) from the wepIDs so we can get a WEP name prefix.
 	// We use the WEP name prefix (e.g. prefix: "node1-k8s-mypod--1-", full name: "node1-k8s-mypod--1-eth0"
 	// to list all the WEPs so if we have a WEP with a different IfName (e.g. "node1-k8s-mypod--1-eth1")
@@ -195,8 +280,13 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 	}
 
 	// Check if there's an existing endpoint by listing the existing endpoints based on the WEP name prefix.
-	endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{Name: wepPrefix, Namespace: wepIDs.Namespace, Prefix: true})
+	var endpoints *api.WorkloadEndpointList
+	err = utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) (err error) {
+		endpoints, err = calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{Name: wepPrefix, Namespace: wepIDs.Namespace, Prefix: true})
+		return
+	})
 	if err != nil {
+		err = metrics.DatastoreFailure(err)
 		return
 	}
 
@@ -225,22 +315,25 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 	// 3. ContainerID
 	// 4. Pod name (only for k8s)
 	// Note we don't use the interface name (endpoint) for this match.
-	// If we find a match from the returned list then we've found the workload endpoint,
-	// and we reuse that even if it has a different interface name, because
-	// we only support one interface per pod right now.
 	// For example, you have a WEP for a k8s pod "mypod-1", and IfName "eth0" on node "node1", that will result in
 	// a WEP name "node1-k8s-mypod--1-eth0" in the datastore, now you're trying to schedule another pod "mypod",
 	// IfName "eth0" and node "node1", so we do a prefix list to get all the endpoints for that workload, with
 	// the prefix "node1-k8s-mypod-". Now this search would return any existing endpoints for "mypod", but it will also
 	// list "node1-k8s-mypod--1-eth0" which is not the same WorkloadEndpoint, so to avoid that, we go through the
 	// list of returned WEPs from the prefix list and call NameMatches() based on all the
-	// identifiers (pod name, containerID, node name, orchestrator), but omit the IfName (Endpoint field) since we can
-	// only have one interface per pod right now, and NameMatches() will return true if the WEP matches the identifiers.
+	// identifiers (pod name, containerID, node name, orchestrator), but omit the IfName (Endpoint field), and
+	// NameMatches() will return true if the WEP matches the identifiers.
 	// It is possible that none of the WEPs in the list match the identifiers, which means we don't already have an
 	// existing WEP to reuse. See `names.WorkloadEndpointIdentifiers` GoDoc comments for more details.
+	//
+	// Of the matches, we reuse the one for this interface. A match for another interface means the workload
+	// already has an endpoint. Unless allow_multiple_endpoints is set, that's an error, since the workload can only
+	// have one; otherwise, this interface gets an endpoint of its own. The endpoints of any additional_networks are
+	// ignored, since they're managed alongside the workload's main endpoint.
 	if len(endpoints.Items) > 0 {
 		logger.Debugf("List of WorkloadEndpoints %v", endpoints.Items)
-		for _, ep := range endpoints.Items {
+		var otherEndpoint *api.WorkloadEndpoint
+		for i, ep := range endpoints.Items {
 			var match bool
 			match, err = wepIDs.WorkloadEndpointIdentifiers.NameMatches(ep.Name)
 			if err != nil {
@@ -249,20 +342,41 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 				err = fmt.Errorf("invalid WorkloadEndpoint identifiers: %v", wepIDs.WorkloadEndpointIdentifiers)
 				return
 			}
+			if !match || isAdditionalNetworkEndpoint(conf, &ep) {
+				continue
+			}
 
-			if match {
-				logger.Debugf("Found a match for WorkloadEndpoint: %v", ep)
-				endpoint = &ep
-				// Assign the WEP name to wepIDs' WEPName field.
-				wepIDs.WEPName = endpoint.Name
-				// Put the endpoint name from the matched WEP in the identifiers.
-				wepIDs.Endpoint = ep.Spec.Endpoint
-				logger.Infof("Calico CNI found existing endpoint: %v", endpoint)
-				break
+			if ep.Spec.Endpoint != args.IfName {
+				logger.Debugf("Found a WorkloadEndpoint for another interface: %v", ep)
+				if otherEndpoint == nil {
+					otherEndpoint = &endpoints.Items[i]
+				}
+				continue
 			}
+
+			logger.Debugf("Found a match for WorkloadEndpoint: %v", ep)
+			endpoint = &endpoints.Items[i]
+			// Assign the WEP name to wepIDs' WEPName field.
+			wepIDs.WEPName = endpoint.Name
+			// Put the endpoint name from the matched WEP in the identifiers.
+			wepIDs.Endpoint = ep.Spec.Endpoint
+			logger.Infof("Calico CNI found existing endpoint: %v", endpoint)
+			break
+		}
+
+		if endpoint == nil && otherEndpoint != nil && !conf.AllowMultipleEndpoints {
+			err = fmt.Errorf("workload already has an endpoint %s for interface %q, and only one endpoint is allowed; "+
+				"set allow_multiple_endpoints to give interface %q an endpoint of its own",
+				otherEndpoint.Name, otherEndpoint.Spec.Endpoint, args.IfName)
+			return
 		}
 	}
 
+	// A second endpoint for the workload doesn't get the default routes, which go via the first.
+	if utils.IsSecondaryEndpoint(conf, args.IfName) {
+		conf.AdditionalInterface = true
+	}
+
 	// If we don't find a match from the existing WorkloadEndpoints then we calculate
 	// the WEP name with the IfName passed in so we can create the WorkloadEndpoint later in the process.
 	if endpoint == nil {
@@ -274,6 +388,28 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 		}
 	}
 
+	if conf.DryRun {
+		err = dryRunAdd(ctx, calicoClient, conf, wepIDs, endpoint, logger)
+		return
+	}
+
+	// Whether this ADD owns the workload's state, and so should undo it if it fails part way: for an existing
+	// non-Kubernetes endpoint, we're just adding a profile to it and its IPs and interface belong to the earlier ADD.
+	ownsState := wepIDs.Orchestrator == api.OrchestratorKubernetes || endpoint == nil
+
+	// If we run out of time, undo whatever we've done so that the retry starts from a clean slate.
+	if conf.AddTimeout > 0 {
+		defer func() {
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				if ownsState {
+					logger.Warn("ADD timed out, cleaning up")
+					cleanUpFailedAdd(calicoClient, args, conf, *wepIDs, logger)
+				}
+				err = fmt.Errorf("ADD did not complete within add_timeout of %ds: %v", conf.AddTimeout, err)
+			}
+		}()
+	}
+
 	// Collect the result in this variable - this is ultimately what gets "returned" by this function by printing
 	// it to stdout.
 	var result *current.Result
@@ -292,8 +428,14 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 			return
 		}
 
-		// use the CNI network name as the Calico profile.
+		var dns *cnitypes.DNS
+		if dns, err = utils.ResultDNS(conf, nil); err != nil {
+			return
+		}
+
+		// use the CNI network name as the Calico profile, unless the profiles are managed out-of-band.
 		profileID := conf.Name
+		manageProfile := conf.ManageProfile == nil || *conf.ManageProfile
 
 		endpointAlreadyExisted := endpoint != nil
 		if endpointAlreadyExisted {
@@ -311,45 +453,45 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 					break
 				}
 			}
-			if !foundProfile {
+			if !foundProfile && manageProfile {
 				logger.Infof("Calico CNI appending profile: %s\n", profileID)
 				endpoint.Spec.Profiles = append(endpoint.Spec.Profiles, profileID)
 			}
-			result, err = utils.CreateResultFromEndpoint(endpoint)
+			utils.SetNetwork(endpoint, conf.Name)
+			utils.SetPluginVersion(endpoint)
+			// Make sure the endpoint's IPs are still reserved, so that a repeated ADD can't lose them.
+			if err = utils.ReassertEndpointIPs(ctx, calicoClient, conf, args, *wepIDs, endpoint, logger); err != nil {
+				return
+			}
+			result, err = utils.CreateResultFromEndpoint(endpoint, conf.IPFamilyOrder)
 			logger.WithField("result", result).Debug("Created result from endpoint")
 			if err != nil {
 				return
 			}
+			// Report the same routes as the first ADD; its interfaces are added once the endpoint is written.
+			result.Routes = utils.IPAMResultRoutes(conf)
+			if dns != nil {
+				result.DNS = *dns
+			}
 		} else {
 			// There's no existing endpoint, so we need to do the following:
 			// 1) Call the configured IPAM plugin to get IP address(es)
 			// 2) Configure the Calico endpoint
 			// 3) Create the veth, configuring it on both the host and container namespace.
 
-			// 1) Run the IPAM plugin and make sure there's an IP address returned.
-			logger.WithFields(logrus.Fields{"paths": os.Getenv("CNI_PATH"),
-				"type": conf.IPAM.Type}).Debug("Looking for IPAM plugin in paths")
-			var ipamResult cnitypes.Result
-			ipamResult, err = ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
-			logger.WithField("IPAM result", ipamResult).Info("Got result from IPAM plugin")
-			if err != nil {
+			// 1) Run the IPAM plugin and make sure there's an IP address returned. Without an IPAM plugin, the
+			// addresses have to come from the previous plugin in the chain.
+			if utils.NoIPAM(conf) {
+				if result, err = utils.ResultFromPrevResult(conf); err != nil {
+					return
+				}
+				logger.WithField("result", result).Info("No IPAM plugin configured, using the IPs from prevResult")
+			} else if result, err = runIPAM(ctx, conf, args, logger); err != nil {
 				return
 			}
-
-			// Convert IPAM result into current Result.
-			// IPAM result has a bunch of fields that are optional for an IPAM plugin
-			// but required for a CNI plugin, so this is to populate those fields.
-			// See CNI Spec doc for more details.
-			result, err = current.NewResultFromResult(ipamResult)
-			if err != nil {
-				utils.ReleaseIPAllocation(logger, conf, args)
-				return
-			}
-
-			if len(result.IPs) == 0 {
-				utils.ReleaseIPAllocation(logger, conf, args)
-				err = errors.New("IPAM plugin returned no IP addresses in result")
-				return
+			// Set before networking, since the Windows dataplane may replace it with the runtime's DNS config.
+			if dns != nil {
+				result.DNS = *dns
 			}
 
 			// Parse endpoint labels passed in by Mesos, and store in a map.
@@ -357,8 +499,17 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 			for _, label := range conf.Args.Mesos.NetworkInfo.Labels.Labels {
 				// Sanitize mesos labels so that they pass the k8s label validation,
 				// as mesos labels accept any unicode value.
-				k := utils.SanitizeMesosLabel(label.Key)
-				v := utils.SanitizeMesosLabel(label.Value)
+				var k, v string
+				if k, err = utils.SanitizeMesosLabel(label.Key); err == nil && k == "" {
+					err = errors.New("mesos label has an empty key")
+				}
+				if err == nil {
+					v, err = utils.SanitizeMesosLabel(label.Value)
+				}
+				if err != nil {
+					utils.ReleaseIPAllocation(logger, conf, args)
+					return
+				}
 
 				if label.Key == "projectcalico.org/namespace" {
 					wepIDs.Namespace = v
@@ -376,10 +527,15 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 			endpoint.Spec.Orchestrator = wepIDs.Orchestrator
 			endpoint.Spec.ContainerID = wepIDs.ContainerID
 			endpoint.Labels = labels
-			endpoint.Spec.Profiles = []string{profileID}
+			if manageProfile {
+				endpoint.Spec.Profiles = []string{profileID}
+			}
+			utils.SetAssignedAt(endpoint, time.Now())
+			utils.SetNetwork(endpoint, conf.Name)
+			utils.SetPluginVersion(endpoint)
 
 			logger.WithField("endpoint", endpoint).Debug("Populated endpoint (without nets)")
-			if err = utils.PopulateEndpointNets(endpoint, result); err != nil {
+			if err = utils.PopulateEndpointNets(endpoint, result, conf); err != nil {
 				// Cleanup IP allocation and return the error.
 				utils.ReleaseIPAllocation(logger, conf, args)
 				return
@@ -395,14 +551,21 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 				return
 			}
 
-			// Select the first 11 characters of the containerID for the host veth.
 			var hostVethName, contVethMac string
-			desiredVethName := "cali" + args.ContainerID[:utils.Min(11, len(args.ContainerID))]
+			desiredVethName := utils.HostVethName(conf, wepIDs)
+			routes := utils.DefaultRoutes
+			if conf.AdditionalInterface {
+				routes = nil
+			}
+			_, vethSpan := tracing.Start(ctx, "veth-setup")
+			vethSpan.SetAttribute("host_veth", desiredVethName)
 			hostVethName, contVethMac, err = d.DoNetworking(
-				ctx, calicoClient, args, result, desiredVethName, utils.DefaultRoutes, endpoint, map[string]string{})
+				ctx, calicoClient, args, result, desiredVethName, routes, endpoint, map[string]string{})
+			vethSpan.Finish(err)
 			if err != nil {
 				// Cleanup IP allocation and return the error.
 				utils.ReleaseIPAllocation(logger, conf, args)
+				err = utils.NamespaceFailure(err)
 				return
 			}
 
@@ -416,74 +579,58 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 		}
 
 		// Write the endpoint object (either the newly created one, or the updated one with a new ProfileIDs).
-		if _, err = utils.CreateOrUpdate(ctx, calicoClient, endpoint); err != nil {
+		_, wepSpan := tracing.Start(ctx, "wep-write")
+		err = utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) (err error) {
+			_, err = utils.CreateOrUpdate(ctx, calicoClient, endpoint)
+			return
+		})
+		wepSpan.Finish(err)
+		if err != nil {
 			if !endpointAlreadyExisted {
 				// Only clean up the IP allocation if this was a new endpoint.  Otherwise,
 				// we'd release the IP that is already attached to the existing endpoint.
 				utils.ReleaseIPAllocation(logger, conf, args)
 			}
+			err = metrics.DatastoreFailure(err)
 			return
 		}
 
 		logger.WithField("endpoint", endpoint).Info("Wrote endpoint to datastore")
 
-		// Add the interface created above to the CNI result.
-		result.Interfaces = append(result.Interfaces, &current.Interface{
-			Name: endpoint.Spec.InterfaceName},
-		)
+		// Add the endpoint's interfaces to the CNI result. For an existing endpoint, this reports the MAC that
+		// the first ADD recorded, so that the result is the same as that ADD's.
+		utils.AddEndpointInterfaces(result, endpoint, args)
 	}
 
-	// Handle profile creation - this is only done if there isn't a specific policy handler.
-	if conf.Policy.PolicyType == "" {
+	// Handle profile creation - this is only done if there isn't a specific policy handler and the profiles
+	// aren't managed out-of-band.
+	if conf.Policy.PolicyType == "" && (conf.ManageProfile == nil || *conf.ManageProfile) {
 		logger.Debug("Handling profiles")
-		// Start by checking if the profile already exists. If it already exists then there is no work to do.
-		// The CNI plugin never updates a profile.
-		exists := true
-		_, err = calicoClient.Profiles().Get(ctx, conf.Name, options.GetOptions{})
-		if err != nil {
-			_, ok := err.(cerrors.ErrorResourceDoesNotExist)
-			if ok {
-				exists = false
-			} else {
-				// Cleanup IP allocation and return the error.
-				utils.ReleaseIPAllocation(logger, conf, args)
-				return
-			}
+		if err = createProfileIfMissing(ctx, calicoClient, conf, wepIDs.Orchestrator, logger); err != nil {
+			// Cleanup IP allocation and return the error.
+			utils.ReleaseIPAllocation(logger, conf, args)
+			return
 		}
+	}
 
-		if !exists {
-			// The profile doesn't exist so needs to be created. The rules vary depending on whether k8s is being used.
-			// Under k8s (without full policy support) the rule is permissive and allows all traffic.
-			// Otherwise, incoming traffic is only allowed from profiles with the same tag.
-			logger.Infof("Calico CNI creating profile: %s", conf.Name)
-			var inboundRules []api.Rule
-			if wepIDs.Orchestrator == api.OrchestratorKubernetes {
-				inboundRules = []api.Rule{{Action: api.Allow}}
-			} else {
-				inboundRules = []api.Rule{{Action: api.Allow, Source: api.EntityRule{Selector: fmt.Sprintf("has(%s)", conf.Name)}}}
-			}
-
-			profile := &api.Profile{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: conf.Name,
-				},
-				Spec: api.ProfileSpec{
-					Egress:        []api.Rule{{Action: api.Allow}},
-					Ingress:       inboundRules,
-					LabelsToApply: map[string]string{conf.Name: ""},
-				},
-			}
-
-			logger.WithField("profile", profile).Info("Creating profile")
-
-			if _, err = calicoClient.Profiles().Create(ctx, profile, options.SetOptions{}); err != nil {
-				// Cleanup IP allocation and return the error.
-				utils.ReleaseIPAllocation(logger, conf, args)
-				return
+	// Attach the workload to any additional networks.
+	if len(conf.AdditionalNetworks) > 0 {
+		if err = setupAdditionalNetworks(ctx, calicoClient, args, conf, *wepIDs, logger); err != nil {
+			// Undo the primary network as well, so that the workload isn't left half attached.
+			if ownsState {
+				logger.WithError(err).Warn("Failed to set up additional networks, cleaning up")
+				cleanUpFailedAdd(calicoClient, args, conf, *wepIDs, logger)
 			}
+			return
 		}
 	}
 
+	// Don't report success if we ran out of time, even if every step completed; the runtime has likely given up.
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+
 	// Set Gateway to nil. Calico IPAM doesn't set it, but host-local does.
 	// We modify IPs subnet received from the IPAM plugin (host-local),
 	// so Gateway isn't valid anymore. It is also not used anywhere by Calico.
@@ -491,12 +638,173 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 		ip.Gateway = nil
 	}
 
+	if err = utils.RunPostAddHook(ctx, conf, args, wepIDs, result, logger); err != nil {
+		// If the hook ran out of time, the add_timeout handling cleans up.
+		if ownsState && ctx.Err() == nil {
+			logger.WithError(err).Warn("Post-ADD hook failed, cleaning up")
+			cleanUpFailedAdd(calicoClient, args, conf, *wepIDs, logger)
+		}
+		return
+	}
+
+	utils.WriteLocalState(conf, args, wepIDs.WEPName, result, logger)
+
+	// If there's a plugin before Calico in the chain, pass on what it set up as well.
+	utils.MergePrevResult(result, conf.PrevResult)
+
 	// Print result to stdout, in the format defined by the requested cniVersion.
 	err = cnitypes.PrintResult(result, conf.CNIVersion)
 	return
 }
 
+// connectToDatastore creates the Calico client and checks that the datastore is ready to process requests.
+func connectToDatastore(ctx context.Context, conf types.NetConf) (calicoClient clientv3.Interface, err error) {
+	_, span := tracing.Start(ctx, "datastore-connect")
+	defer func() {
+		span.Finish(err)
+	}()
+
+	calicoClient, err = utils.CreateClient(conf)
+	if err != nil {
+		return nil, metrics.DatastoreFailure(err)
+	}
+
+	// Reading the ready flag is the first thing to touch the datastore, so it's also the check that the datastore
+	// can be reached at all. It happens before anything is set up for the workload, and it's given a short
+	// timeout so that an unreachable datastore fails the operation quickly, with nothing for DEL to clean up.
+	timeout := utils.DatastoreProbeTimeout(conf)
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ci, err := calicoClient.ClusterInformation().Get(probeCtx, "default", options.GetOptions{})
+	if err != nil {
+		if probeCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return nil, metrics.DatastoreFailure(fmt.Errorf("datastore is unreachable: no response within %s: %v", timeout, err))
+		}
+		return nil, metrics.DatastoreFailure(fmt.Errorf("error getting ClusterInformation: %v", err))
+	}
+	if !*ci.Spec.DatastoreReady {
+		logrus.Info("Upgrade may be in progress, ready flag is not set")
+		return nil, metrics.DatastoreFailure(fmt.Errorf("Calico is currently not ready to process requests"))
+	}
+	return calicoClient, nil
+}
+
+// configureMetrics sets the Pushgateway that an operation's metrics go to, and its datastore type label, from
+// the NetConf. The datastore type defaults as it does for the Calico client.
+func configureMetrics(op *metrics.Operation, conf types.NetConf) {
+	op.Gateway = conf.MetricsPushGateway
+	op.DatastoreType = conf.DatastoreType
+	if op.DatastoreType == "" {
+		op.DatastoreType = os.Getenv("DATASTORE_TYPE")
+	}
+	if op.DatastoreType == "" {
+		op.DatastoreType = string(apiconfig.EtcdV3)
+	}
+}
+
+// newTracer returns a tracer that exports to the configured otel_endpoint, or nil if tracing isn't
+// configured. A bad endpoint disables tracing rather than failing the operation.
+func newTracer(conf types.NetConf, logger *logrus.Entry) *tracing.Tracer {
+	if conf.OtelEndpoint == "" {
+		return nil
+	}
+	exporter, err := tracing.NewOTLPExporter(conf.OtelEndpoint)
+	if err != nil {
+		logger.WithError(err).Warn("Tracing disabled")
+		return nil
+	}
+	return tracing.NewTracer(exporter)
+}
+
+// setSpanIdentifiers records the workload's identifiers on a span.
+func setSpanIdentifiers(span *tracing.Span, wepIDs *utils.WEPIdentifiers) {
+	span.SetAttribute("container_id", wepIDs.ContainerID)
+	span.SetAttribute("orchestrator", wepIDs.Orchestrator)
+	span.SetAttribute("node", wepIDs.Node)
+	if wepIDs.Pod != "" {
+		span.SetAttribute("pod", wepIDs.Pod)
+		span.SetAttribute("namespace", wepIDs.Namespace)
+	}
+}
+
+// cleanUpFailedAdd removes the IP allocation, container interface and WorkloadEndpoint that an ADD may have
+// created before it failed. It uses its own context, since the ADD's may have expired.
+func cleanUpFailedAdd(calicoClient clientv3.Interface, args *skel.CmdArgs, conf types.NetConf, wepIDs utils.WEPIdentifiers, logger *logrus.Entry) {
+	ctx, cancel := context.WithTimeout(context.Background(), addCleanupTimeout)
+	defer cancel()
+
+	utils.ReleaseIPAllocation(logger, conf, args)
+
+	if conf.DebugKeepFailedInterface {
+		logger.Warn("debug_keep_failed_interface is set, leaving the failed ADD's container interface in place")
+	} else if d, err := dataplane.GetDataplane(conf, logger); err != nil {
+		logger.WithError(err).Warn("Failed to get dataplane to clean up")
+	} else if err := d.CleanUpNamespace(args); err != nil {
+		logger.WithError(err).Warn("Failed to clean up container interface")
+	}
+
+	// Only delete the endpoint if it's ours; it may belong to a newer ADD for the same pod.
+	wep, err := calicoClient.WorkloadEndpoints().Get(ctx, wepIDs.Namespace, wepIDs.WEPName, options.GetOptions{})
+	if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			logger.WithError(err).Warn("Failed to get endpoint to clean up")
+		}
+		return
+	}
+	if wep.Spec.ContainerID != wepIDs.ContainerID {
+		return
+	}
+	_, err = calicoClient.WorkloadEndpoints().Delete(ctx, wep.Namespace, wep.Name, options.DeleteOptions{
+		ResourceVersion: wep.ResourceVersion,
+		UID:             &wep.UID,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to delete endpoint")
+	}
+}
+
+// runIPAM calls the configured IPAM plugin and converts its result to the current version, making sure that it
+// returned at least one IP.
+func runIPAM(ctx context.Context, conf types.NetConf, args *skel.CmdArgs, logger *logrus.Entry) (*current.Result, error) {
+	logger.WithFields(logrus.Fields{"paths": os.Getenv("CNI_PATH"),
+		"type": conf.IPAM.Type}).Debug("Looking for IPAM plugin in paths")
+	if err := utils.CheckIPAMPlugin(conf, logger); err != nil {
+		return nil, err
+	}
+	restoreArgs, err := utils.AddIgnoreUnknownArgs()
+	if err != nil {
+		return nil, err
+	}
+	_, ipamSpan := tracing.Start(ctx, "ipam-allocate")
+	ipamSpan.SetAttribute("ipam.type", conf.IPAM.Type)
+	ipamResult, err := invoke.DelegateAdd(ctx, conf.IPAM.Type, args.StdinData, nil)
+	restoreArgs()
+	ipamSpan.Finish(err)
+	logger.WithField("IPAM result", ipamResult).Info("Got result from IPAM plugin")
+	if err != nil {
+		return nil, metrics.IPAMFailure(utils.FromIPAMError(err, logger))
+	}
+
+	// Convert IPAM result into current Result.
+	// IPAM result has a bunch of fields that are optional for an IPAM plugin
+	// but required for a CNI plugin, so this is to populate those fields.
+	// See CNI Spec doc for more details.
+	result, err := current.NewResultFromResult(ipamResult)
+	if err != nil {
+		utils.ReleaseIPAllocation(logger, conf, args)
+		return nil, err
+	}
+
+	if len(result.IPs) == 0 {
+		utils.ReleaseIPAllocation(logger, conf, args)
+		return nil, errors.New("IPAM plugin returned no IP addresses in result")
+	}
+	return result, nil
+}
+
 func cmdDel(args *skel.CmdArgs) (err error) {
+	op := metrics.Start("del")
+
 	// Defer a panic recover, so that in case we panic we can still return
 	// a proper error to the runtime.
 	defer func() {
@@ -512,15 +820,30 @@ func cmdDel(args *skel.CmdArgs) (err error) {
 		if err != nil {
 			logrus.WithError(err).Error("Final result of CNI DEL was an error.")
 		}
+		op.Finish(err, logrus.WithField("ContainerID", args.ContainerID))
+		if err != nil {
+			// Report the error in the CNI format, with a code for the kind of failure.
+			err = utils.ToCNIError(err)
+		}
 	}()
 
 	conf := types.NetConf{}
 	if err = json.Unmarshal(args.StdinData, &conf); err != nil {
-		err = fmt.Errorf("failed to load netconf: %v", err)
+		err = utils.InvalidConfig(fmt.Errorf("failed to load netconf: %v", err))
 		return
 	}
 
 	utils.ConfigureLogging(conf)
+	configureMetrics(op, conf)
+
+	if err = validateConfig(conf); err != nil {
+		err = utils.InvalidConfig(err)
+		return
+	}
+	if err = utils.ApplyForceInterfaceName(conf, args); err != nil {
+		err = utils.InvalidConfig(err)
+		return
+	}
 
 	nodeNameFile := "/var/lib/calico/nodename"
 	if conf.NodenameFile != "" {
@@ -539,30 +862,74 @@ func cmdDel(args *skel.CmdArgs) (err error) {
 
 	// Determine which node name to use.
 	nodename := utils.DetermineNodename(conf)
+	op.Node = nodename
 
 	var epIDs *utils.WEPIdentifiers
 	epIDs, err = utils.GetIdentifiers(args, nodename)
 	if err != nil {
 		return
 	}
+	utils.AddLogIdentifiers(epIDs)
+	op.Orchestrator = epIDs.Orchestrator
 	logger := logrus.WithFields(logrus.Fields{"ContainerID": epIDs.ContainerID})
 
-	var calicoClient clientv3.Interface
-	calicoClient, err = utils.CreateClient(conf)
-	if err != nil {
+	// The runtime can ask for the workload's IPs to be left reserved for a later ADD.
+	var keepIPs bool
+	if keepIPs, err = utils.KeepIPs(args); err != nil {
 		return
 	}
 
-	ctx := context.Background()
-	var ci *api.ClusterInformation
-	ci, err = calicoClient.ClusterInformation().Get(ctx, "default", options.GetOptions{})
+	if conf.DryRun {
+		err = dryRunDel(conf, epIDs, logger)
+		return
+	}
+
+	// Report what the DEL did in a single line at the end, whatever the outcome.
+	summary := utils.NewDelSummary(conf, epIDs)
+	defer func() {
+		summary.Log(logger, err)
+	}()
+
+	// Skip duplicate DELs that arrive soon after one that completed.
+	if utils.HasDelTombstone(conf, args, logger) {
+		logger.Info("DEL already completed for this container, nothing to do")
+		return
+	}
+	defer func() {
+		if err == nil {
+			// A DEL that kept the IPs doesn't leave a tombstone, so that a later DEL can still release them.
+			if !keepIPs {
+				utils.WriteDelTombstone(conf, args, logger)
+			}
+			utils.RemoveLocalState(conf, args, logger)
+		}
+	}()
+
+	// Limit the number of operations on this node that hit the datastore at once, if configured to.
+	var release func()
+	release, err = utils.AcquireConcurrencySlot(conf, logger)
 	if err != nil {
-		err = fmt.Errorf("error getting ClusterInformation: %v", err)
 		return
 	}
-	if !*ci.Spec.DatastoreReady {
-		logrus.Info("Upgrade may be in progress, ready flag is not set")
-		err = fmt.Errorf("Calico is currently not ready to process requests")
+	defer release()
+
+	// Likewise limit the rate at which they do so.
+	if err = utils.WaitForDatastoreOpToken(conf, logger); err != nil {
+		return
+	}
+
+	// Trace the DEL if configured to. The spans are exported once it completes.
+	tracer := newTracer(conf, logger)
+	ctx, delSpan := tracing.Start(tracing.WithTracer(context.Background(), tracer), "cni-del")
+	setSpanIdentifiers(delSpan, epIDs)
+	defer func() {
+		delSpan.Finish(err)
+		tracer.Flush(logger)
+	}()
+
+	var calicoClient clientv3.Interface
+	calicoClient, err = connectToDatastore(ctx, conf)
+	if err != nil {
 		return
 	}
 
@@ -580,24 +947,56 @@ func cmdDel(args *skel.CmdArgs) (err error) {
 		"ContainerID":      epIDs.ContainerID,
 	}).Debug("Extracted identifiers")
 
+	// Tear down any additional networks first, so that they are cleaned up whichever orchestrator is in use.
+	var additionalErr error
+	if len(conf.AdditionalNetworks) > 0 {
+		additionalErr = teardownAdditionalNetworks(ctx, calicoClient, args, conf, *epIDs, logger)
+	}
+	defer func() {
+		if err == nil {
+			err = additionalErr
+		}
+	}()
+
 	// Handle k8s specific bits of handling the DEL.
 	if epIDs.Orchestrator == api.OrchestratorKubernetes {
-		err = k8s.CmdDelK8s(ctx, calicoClient, *epIDs, args, conf, logger)
+		err = k8s.CmdDelK8s(ctx, calicoClient, *epIDs, args, conf, summary, logger)
 		return
 	}
 
 	// Release the IP address by calling the configured IPAM plugin.
-	ipamErr := utils.DeleteIPAM(conf, args, logger)
+	var ipamErr error
+	if keepIPs {
+		logger.Info("CALICO_KEEP_IP is set, leaving the IP address(es) reserved")
+	} else {
+		ipamErr = metrics.IPAMFailure(utils.DeleteIPAM(conf, args, logger))
+	}
 
 	// Delete the WorkloadEndpoint object from the datastore.
-	if _, err = calicoClient.WorkloadEndpoints().Delete(ctx, epIDs.Namespace, epIDs.WEPName, options.DeleteOptions{}); err != nil {
+	var wep *api.WorkloadEndpoint
+	err = utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) (err error) {
+		wep, err = calicoClient.WorkloadEndpoints().Delete(ctx, epIDs.Namespace, epIDs.WEPName, options.DeleteOptions{})
+		return
+	})
+	if err != nil {
 		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
 			// Log and proceed with the clean up if WEP doesn't exist.
 			logger.WithField("WorkloadEndpoint", epIDs.WEPName).Info("Endpoint object does not exist, no need to clean up.")
 			err = nil
 		} else {
+			err = metrics.DatastoreFailure(err)
 			return
 		}
+	} else if wep != nil && keepIPs {
+		summary.EndpointDeleted = true
+	} else if wep != nil {
+		summary.EndpointDeleted = true
+		summary.ReleasedIPs = wep.Spec.IPNetworks
+
+		// Release any IPs that were allocated before the network was renamed.
+		if recordedErr := utils.ReleaseRecordedNetworkIPs(ctx, calicoClient, conf, args, wep, logger); recordedErr != nil && ipamErr == nil {
+			ipamErr = metrics.IPAMFailure(recordedErr)
+		}
 	}
 
 	// Clean up namespace by removing the interfaces.
@@ -607,10 +1006,13 @@ func cmdDel(args *skel.CmdArgs) (err error) {
 		return
 	}
 
+	summary.InterfaceFound = dataplane.ContainerInterfaceExists(d, args)
 	err = d.CleanUpNamespace(args)
 	if err != nil {
+		err = utils.NamespaceFailure(err)
 		return
 	}
+	summary.InterfaceRemoved = summary.InterfaceFound
 
 	// Return the IPAM error if there was one. The IPAM error will be lost if there was also an error in cleaning up
 	// the device or endpoint, but crucially, the user will know the overall operation failed.
@@ -618,6 +1020,187 @@ func cmdDel(args *skel.CmdArgs) (err error) {
 	return
 }
 
+// cmdCheck verifies that the networking ADD set up for the container is still in place: that its
+// WorkloadEndpoint exists, that the host side of its veth exists with the expected name and sysctls, and that
+// the container interface has the endpoint's IPs.
+func cmdCheck(args *skel.CmdArgs) (err error) {
+	defer func() {
+		if err != nil {
+			logrus.WithError(err).Error("Final result of CNI CHECK was an error.")
+		}
+	}()
+
+	conf := types.NetConf{}
+	if err = json.Unmarshal(args.StdinData, &conf); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	utils.ConfigureLogging(conf)
+
+	if err = validateConfig(conf); err != nil {
+		return err
+	}
+	if err = utils.ApplyForceInterfaceName(conf, args); err != nil {
+		return err
+	}
+
+	// The prevResult that CHECK is given includes whatever earlier plugins in the chain set up. Only Calico's own
+	// part of it is checked, against the WorkloadEndpoint, but it must at least be valid.
+	if err = utils.ParsePrevResult(&conf); err != nil {
+		return err
+	}
+
+	nodename := utils.DetermineNodename(conf)
+	epIDs, err := utils.GetIdentifiers(args, nodename)
+	if err != nil {
+		return err
+	}
+	utils.AddLogIdentifiers(epIDs)
+	logger := logrus.WithFields(logrus.Fields{"ContainerID": epIDs.ContainerID})
+
+	epIDs.WEPName, err = epIDs.CalculateWorkloadEndpointName(false)
+	if err != nil {
+		return fmt.Errorf("error constructing WorkloadEndpoint name: %s", err)
+	}
+
+	ctx := context.Background()
+	calicoClient, err := connectToDatastore(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	var wep *api.WorkloadEndpoint
+	err = utils.WithDatastoreTimeout(ctx, conf, func(ctx context.Context) (err error) {
+		wep, err = calicoClient.WorkloadEndpoints().Get(ctx, epIDs.Namespace, epIDs.WEPName, options.GetOptions{})
+		return
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get WorkloadEndpoint %s: %v", epIDs.WEPName, err)
+	}
+	if wep.Spec.ContainerID != "" && wep.Spec.ContainerID != args.ContainerID {
+		return fmt.Errorf("WorkloadEndpoint %s belongs to container %s", epIDs.WEPName, wep.Spec.ContainerID)
+	}
+
+	// The host veth name is derived the same way as during ADD.
+	hostVethName := utils.HostVethName(conf, epIDs)
+	if wep.Spec.InterfaceName != hostVethName {
+		return fmt.Errorf("WorkloadEndpoint %s has interface %s, expected %s", epIDs.WEPName, wep.Spec.InterfaceName, hostVethName)
+	}
+
+	d, err := dataplane.GetDataplane(conf, logger)
+	if err != nil {
+		return err
+	}
+	if err = dataplane.CheckNetworking(d, args, hostVethName, wep.Spec.IPNetworks); err != nil {
+		return err
+	}
+	logger.WithField("WorkloadEndpoint", epIDs.WEPName).Info("CHECK found the container's networking intact")
+	return nil
+}
+
+// createProfileIfMissing creates the default profile for the named network if it doesn't already exist.
+// The CNI plugin never updates a profile.
+func createProfileIfMissing(ctx context.Context, calicoClient clientv3.Interface, conf types.NetConf, orchestrator string, logger *logrus.Entry) error {
+	name := conf.Name
+
+	// Start by checking if the profile already exists. If it already exists then there is no work to do.
+	_, err := calicoClient.Profiles().Get(ctx, name, options.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+		return err
+	}
+
+	// The profile doesn't exist so needs to be created. The rules vary depending on whether k8s is being used.
+	// Under k8s (without full policy support) the rule is permissive and allows all traffic.
+	// Otherwise, incoming traffic is only allowed from profiles with the same tag.
+	logger.Infof("Calico CNI creating profile: %s", name)
+	labels, selector, err := profileLabels(name, conf.ProfileLabelStyle)
+	if err != nil {
+		return err
+	}
+	outboundRules, err := profileEgressRules(conf.DefaultProfileEgress, conf.DefaultProfileEgressCIDRs)
+	if err != nil {
+		return err
+	}
+	var inboundRules []api.Rule
+	if orchestrator == api.OrchestratorKubernetes {
+		inboundRules = []api.Rule{{Action: api.Allow}}
+	} else {
+		inboundRules = []api.Rule{{Action: api.Allow, Source: api.EntityRule{Selector: selector}}}
+	}
+
+	profile := &api.Profile{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: api.ProfileSpec{
+			Egress:        outboundRules,
+			Ingress:       inboundRules,
+			LabelsToApply: labels,
+		},
+	}
+
+	logger.WithField("profile", profile).Info("Creating profile")
+	_, err = calicoClient.Profiles().Create(ctx, profile, options.SetOptions{})
+	return err
+}
+
+// networkLabelKey is the label key used for the "key-value" profile_label_style.
+const networkLabelKey = "projectcalico.org/network"
+
+// profileLabels returns the labels that the profile for the named network applies to its endpoints, and a
+// selector that matches them, in the given profile_label_style.
+func profileLabels(name, style string) (map[string]string, string, error) {
+	switch style {
+	case "", "legacy":
+		return map[string]string{name: ""}, fmt.Sprintf("has(%s)", name), nil
+	case "key-value":
+		return map[string]string{networkLabelKey: name}, fmt.Sprintf("%s == '%s'", networkLabelKey, name), nil
+	default:
+		return nil, "", fmt.Errorf("invalid profile_label_style %q: must be legacy or key-value", style)
+	}
+}
+
+// profileEgressRules returns the egress rules for the profile of a network, according to the
+// default_profile_egress mode.
+func profileEgressRules(mode string, cidrs []string) ([]api.Rule, error) {
+	switch mode {
+	case "", "allow":
+		return []api.Rule{{Action: api.Allow}}, nil
+	case "deny":
+		return []api.Rule{{Action: api.Deny}}, nil
+	case "allow-cidrs":
+		if len(cidrs) == 0 {
+			return nil, errors.New("default_profile_egress allow-cidrs requires default_profile_egress_cidrs")
+		}
+		nets := make([]string, 0, len(cidrs))
+		for _, c := range cidrs {
+			_, ipn, err := cnet.ParseCIDROrIP(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q in default_profile_egress_cidrs: %s", c, err)
+			}
+			nets = append(nets, ipn.String())
+		}
+		return []api.Rule{
+			{Action: api.Allow, Destination: api.EntityRule{Nets: nets}},
+			{Action: api.Deny},
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid default_profile_egress %q: must be allow, deny or allow-cidrs", mode)
+	}
+}
+
+// ignoreUnknownArgs wraps a command so that the plugin's own parsing of CNI_ARGS skips the arguments that it
+// doesn't know about. The environment is left alone; it only gets 'IgnoreUnknown=1' while the IPAM plugin runs.
+func ignoreUnknownArgs(cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		args.Args = utils.IgnoreUnknownArgs(args.Args)
+		return cmd(args)
+	}
+}
+
 func Main(version string) {
 	// Set up logging formatting.
 	logrus.SetFormatter(&logutils.Formatter{})
@@ -638,6 +1221,14 @@ func Main(version string) {
 	// takes a little while to start up.
 	testConnectionFlag := flagSet.Bool("t", false, "Test datastore connection")
 
+	// Print the effective config from the given CNI config file on "-config-dump", for bug reports.
+	configDumpFlag := flagSet.String("config-dump", "", "Print the effective config from the given CNI config file")
+
+	// Clean up this node's WorkloadEndpoints whose host interface has gone on "-gc", using the datastore in the
+	// given CNI config file. With "-dry-run", only report them.
+	gcFlag := flagSet.String("gc", "", "Clean up orphaned WorkloadEndpoints, using the given CNI config file")
+	dryRunFlag := flagSet.Bool("dry-run", false, "With -gc, only report the orphaned WorkloadEndpoints")
+
 	err := flagSet.Parse(os.Args[1:])
 	if err != nil {
 		cniError := cnitypes.Error{
@@ -649,7 +1240,9 @@ func Main(version string) {
 		os.Exit(1)
 	}
 	if *versionFlag {
+		// Only the version goes to stdout, since it's what callers parse. The rest of the build info is for people.
 		fmt.Println(version)
+		fmt.Fprintln(os.Stderr, buildinfo.Get(version))
 		os.Exit(0)
 	}
 	if *testConnectionFlag {
@@ -667,18 +1260,35 @@ func Main(version string) {
 		os.Exit(1)
 	}
 
-	if err := utils.AddIgnoreUnknownArgs(); err != nil {
-		logrus.WithError(err).Error("Failed to set IgnoreUnknown=1")
+	if *configDumpFlag != "" {
+		if err = utils.DumpConfig(*configDumpFlag, os.Stdout); err == nil {
+			os.Exit(0)
+		}
+		cniError := cnitypes.Error{
+			Code:    100,
+			Msg:     "failed to dump config",
+			Details: err.Error(),
+		}
+		cniError.Print()
+		os.Exit(1)
+	}
+
+	if *gcFlag != "" {
+		if err = garbageCollect(*gcFlag, *dryRunFlag); err == nil {
+			os.Exit(0)
+		}
+		logrus.WithError(err).Error("garbage collection failed")
 		cniError := cnitypes.Error{
 			Code:    100,
-			Msg:     "failed to set IgnoreUnknown=1",
+			Msg:     "garbage collection failed",
 			Details: err.Error(),
 		}
 		cniError.Print()
 		os.Exit(1)
 	}
 
-	skel.PluginMain(cmdAdd, nil, cmdDel,
-		cniSpecVersion.PluginSupports("0.1.0", "0.2.0", "0.3.0", "0.3.1"),
+	utils.PluginVersion = buildinfo.Get(version).Version
+	utils.PluginMain(ignoreUnknownArgs(cmdAdd), ignoreUnknownArgs(cmdCheck), ignoreUnknownArgs(cmdDel),
+		buildinfo.PluginInfo(cniSpecVersion.PluginSupports("0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0"), version),
 		"Calico CNI plugin "+version)
 }
@@ -18,6 +18,7 @@ import (
 	"net"
 
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
 )
 
 // Policy is a struct to hold policy config (which currently happens to also contain some K8s config)
@@ -28,12 +29,17 @@ type Policy struct {
 	K8sClientCertificate    string `json:"k8s_client_certificate"`
 	K8sClientKey            string `json:"k8s_client_key"`
 	K8sCertificateAuthority string `json:"k8s_certificate_authority"`
+
+	// AllowedTiers lists the policy tier names that pods may request with the policyTier annotation.
+	AllowedTiers []string `json:"allowed_tiers,omitempty"`
 }
 
 // FeatureControl is a struct which controls which features are enabled in Calico.
 type FeatureControl struct {
-	IPAddrsNoIpam bool `json:"ip_addrs_no_ipam"`
-	FloatingIPs   bool `json:"floating_ips"`
+	IPAddrsNoIpam      bool `json:"ip_addrs_no_ipam"`
+	FloatingIPs        bool `json:"floating_ips"`
+	StartupBlocked     bool `json:"startup_blocked"`
+	AdditionalNetworks bool `json:"additional_networks"`
 }
 
 // Kubernetes a K8s specific struct to hold config
@@ -41,6 +47,11 @@ type Kubernetes struct {
 	K8sAPIRoot string `json:"k8s_api_root"`
 	Kubeconfig string `json:"kubeconfig"`
 	NodeName   string `json:"node_name"`
+
+	// PodReadConsistency controls how the pod is read during ADD. "direct" (the default) always reads the
+	// latest version of the pod, so annotations added just before the pod started are seen. "cache" allows
+	// the API server to answer from its watch cache, which is cheaper but may return a stale pod.
+	PodReadConsistency string `json:"pod_read_consistency,omitempty"`
 }
 
 type Args struct {
@@ -77,21 +88,41 @@ type NetConf struct {
 		AssignIpv6 *string  `json:"assign_ipv6"`
 		IPv4Pools  []string `json:"ipv4_pools,omitempty"`
 		IPv6Pools  []string `json:"ipv6_pools,omitempty"`
+
+		// NumIPv4 and NumIPv6 are how many addresses of each family calico-ipam assigns, for the families that
+		// it assigns at all. Zero means one.
+		NumIPv4 int `json:"num_ipv4,omitempty"`
+		NumIPv6 int `json:"num_ipv6,omitempty"`
+
+		// Routes are host-local's routes, which it reports in its result. They're also reported by a repeated ADD,
+		// which doesn't call the IPAM plugin.
+		Routes []*types.Route `json:"routes,omitempty"`
+
+		// IPv4Reserved lists IPv4 addresses and CIDRs within the selected pools that mustn't be assigned. The
+		// Kubernetes plugin sets it from the pod's cni.projectcalico.org/ipv4reserved annotation.
+		IPv4Reserved []string `json:"ipv4_reserved,omitempty"`
 	} `json:"ipam,omitempty"`
 	Args                 Args                   `json:"args"`
 	MTU                  int                    `json:"mtu"`
 	Nodename             string                 `json:"nodename"`
 	NodenameFile         string                 `json:"nodename_file"`
 	IPAMLockFile         string                 `json:"ipam_lock_file"`
+	IPAMExclude          []string               `json:"ipam_exclude,omitempty"`
+	IPAMMinVersion       string                 `json:"ipam_min_version,omitempty"`
+	CheckPoolFamilies    bool                   `json:"check_pool_families,omitempty"`
+	IPAMPoolStrategy     string                 `json:"ipam_pool_strategy,omitempty"`
+	PodReuseIP           bool                   `json:"pod_reuse_ip,omitempty"`
 	NodenameFileOptional bool                   `json:"nodename_file_optional"`
 	DatastoreType        string                 `json:"datastore_type"`
 	EtcdEndpoints        string                 `json:"etcd_endpoints"`
+	EtcdEndpointsBackup  string                 `json:"etcd_endpoints_backup,omitempty"`
 	EtcdDiscoverySrv     string                 `json:"etcd_discovery_srv"`
 	LogLevel             string                 `json:"log_level"`
 	LogFilePath          string                 `json:"log_file_path"`
 	LogFileMaxSize       int                    `json:"log_file_max_size"`
 	LogFileMaxAge        int                    `json:"log_file_max_age"`
 	LogFileMaxCount      int                    `json:"log_file_max_count"`
+	LogFormat            string                 `json:"log_format,omitempty"`
 	Policy               Policy                 `json:"policy"`
 	Kubernetes           Kubernetes             `json:"kubernetes"`
 	FeatureControl       FeatureControl         `json:"feature_control"`
@@ -99,10 +130,175 @@ type NetConf struct {
 	EtcdKeyFile          string                 `json:"etcd_key_file"`
 	EtcdCertFile         string                 `json:"etcd_cert_file"`
 	EtcdCaCertFile       string                 `json:"etcd_ca_cert_file"`
+	EtcdKey              string                 `json:"etcd_key"`
+	EtcdCert             string                 `json:"etcd_cert"`
+	EtcdCaCert           string                 `json:"etcd_ca"`
 	ContainerSettings    ContainerSettings      `json:"container_settings,omitempty"`
 	IncludeDefaultRoutes bool                   `json:"include_default_routes,omitempty"`
+	DefaultRouteMetric   *int                   `json:"default_route_metric,omitempty"`
 	DataplaneOptions     map[string]interface{} `json:"dataplane_options,omitempty"`
 
+	// IPv6Gateway, if set, is the IPv6 link-local address that a container's IPv6 routes go via. The address is
+	// added to the host side of the veth. By default the host side's own link-local address is used.
+	IPv6Gateway string `json:"ipv6_gateway,omitempty"`
+
+	// ProxyARP and HostForwarding control the sysctls that ADD sets on the host side of the veth; both default to
+	// true. With ProxyARP false, proxy_arp, proxy_delay and proxy_ndp are left alone, so something else must
+	// answer for the container's gateway. With HostForwarding false, the interface's forwarding sysctls are left
+	// alone for them to be managed externally. Forwarding within the container is container_settings'
+	// allow_ip_forwarding.
+	ProxyARP       *bool `json:"proxy_arp,omitempty"`
+	HostForwarding *bool `json:"host_forwarding,omitempty"`
+
+	// HostRouteTable and HostRouteProtocol are the routing table and protocol number of the route to the
+	// container that ADD adds via the host side of the veth, so that policy routing and route-management tooling
+	// can tell the routes apart. They default to the main table and the "boot" protocol.
+	HostRouteTable    int `json:"host_route_table,omitempty"`
+	HostRouteProtocol int `json:"host_route_protocol,omitempty"`
+
+	// SendGratuitousARP makes ADD announce the container's addresses once its veth is up: a gratuitous ARP for
+	// each IPv4 address and an unsolicited neighbor advertisement for each IPv6 one, sent from the container
+	// interface. This replaces stale neighbor entries when an address moves from one workload to another.
+	SendGratuitousARP bool `json:"send_gratuitous_arp,omitempty"`
+
+	// VethCreateRetries is the number of times to retry creating the veth pair if the kernel reports a
+	// transient failure (ENOMEM or EBUSY), waiting VethCreateBackoff milliseconds (default 100) before the
+	// first retry and doubling the wait each time after.
+	VethCreateRetries int `json:"veth_create_retries,omitempty"`
+	VethCreateBackoff int `json:"veth_create_backoff,omitempty"`
+
+	// AdditionalNetworks lists further Calico networks to attach the workload to as part of the same ADD.
+	// Each network gets its own interface in the container (net1, net2, ...), its own IP allocation and its
+	// own WorkloadEndpoint. Requires the additional_networks feature to be enabled.
+	AdditionalNetworks []AdditionalNetwork `json:"additional_networks,omitempty"`
+
+	// MaxConcurrent caps the number of CNI operations on this node that may talk to the datastore at once.
+	// Operations beyond the cap wait for a free slot for up to MaxConcurrentTimeout seconds (default 30).
+	// Slots are lock files in ConcurrencyLockDir (default /var/run/calico/cni). Zero means no cap.
+	MaxConcurrent        int    `json:"max_concurrent,omitempty"`
+	MaxConcurrentTimeout int    `json:"max_concurrent_timeout,omitempty"`
+	ConcurrencyLockDir   string `json:"concurrency_lock_dir,omitempty"`
+
+	// DatastoreOpRate limits the number of ADDs and DELs per second on this node, with a burst of up to one
+	// second's worth. Each takes a single token, however many datastore writes it goes on to make. Operations
+	// beyond the limit wait for up to DatastoreOpTimeout seconds (default 30). The limiter's state is kept in
+	// ConcurrencyLockDir. Zero means no limit.
+	DatastoreOpRate    float64 `json:"datastore_op_rate,omitempty"`
+	DatastoreOpTimeout int     `json:"datastore_op_timeout,omitempty"`
+
+	// DelTombstoneTTL, if set, makes a completed DEL leave a tombstone file in DelTombstoneDir (default
+	// /var/run/calico/cni) for that many seconds. A duplicate DEL for the same container within that time
+	// returns success without touching the datastore.
+	DelTombstoneTTL int    `json:"del_tombstone_ttl,omitempty"`
+	DelTombstoneDir string `json:"del_tombstone_dir,omitempty"`
+
+	// LocalState makes ADD and DEL maintain a file in LocalStateDir (default /var/run/calico/cni) that maps each
+	// container on the node to its WorkloadEndpoint name, IPAM handle, IPs and interface name, for fast local
+	// lookups. It's only a cache; it can be rebuilt from the datastore.
+	LocalState    bool   `json:"local_state,omitempty"`
+	LocalStateDir string `json:"local_state_dir,omitempty"`
+
+	// OtelEndpoint, if set, is the URL of an OpenTelemetry collector (OTLP over HTTP) that each ADD and DEL
+	// exports a trace to when it completes.
+	OtelEndpoint string `json:"otel_endpoint,omitempty"`
+
+	// VethNameStyle controls how the host veths of workloads other than Kubernetes pods are named: "prefix", the
+	// default, uses "cali" and the first 11 characters of the container ID; "hash" uses "cali" and 11 characters
+	// of a hash of the whole container ID, so that container IDs that start the same don't collide.
+	VethNameStyle string `json:"veth_name_style,omitempty"`
+
+	// RawPrevResult is the result of the previous plugin in the chain, when Calico isn't the first plugin.
+	// utils.ParsePrevResult fills in PrevResult from it, in the current result format.
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *current.Result        `json:"-"`
+
+	// NodenameCaseInsensitive lowercases the node name, wherever it came from, so that it matches a Kubernetes
+	// Node whose name was lowercased from a mixed-case hostname.
+	NodenameCaseInsensitive bool `json:"nodename_case_insensitive,omitempty"`
+
+	// ForceInterfaceName, if set, is the name of the container interface, whatever name the runtime asks for.
+	// The WorkloadEndpoint records it, and DEL and CHECK use it too, so that they find the same endpoint.
+	ForceInterfaceName string `json:"force_interface_name,omitempty"`
+
+	// PostAddHook, if set, is the path of a command to run once an ADD has succeeded, for example to register the
+	// workload's IPs with an external system. It's given the network, container ID, pod and IPs as JSON on stdin.
+	// A failure is only logged, unless PostAddHookFatal is set, in which case the ADD is undone and fails.
+	PostAddHook      string `json:"post_add_hook,omitempty"`
+	PostAddHookFatal bool   `json:"post_add_hook_fatal,omitempty"`
+
+	// DebugKeepFailedInterface leaves the container interface and IP allocations of a failed ADD in place, rather
+	// than cleaning them up, so that the half-configured state can be inspected. It's for debugging only: each
+	// failed ADD leaks its IPs until the runtime's DEL releases them, so don't leave it on.
+	DebugKeepFailedInterface bool `json:"debug_keep_failed_interface,omitempty"`
+
+	// AllowMultipleEndpoints lets a workload have an endpoint on each of several container interfaces, each
+	// with its own veth and IPs. Without it, an ADD for a workload that already has an endpoint on a different
+	// interface fails.
+	AllowMultipleEndpoints bool `json:"allow_multiple_endpoints,omitempty"`
+
+	// RequirePoolForStaticIPs rejects a pod whose ipAddrsNoIpam or secondaryIPs annotations give an address
+	// that isn't in any IP pool. Felix only routes addresses within the pools.
+	RequirePoolForStaticIPs bool `json:"require_pool_for_static_ips,omitempty"`
+
+	// IPAMHandlePrefix, if set, is prepended to the IPAM handles of the network's endpoints, as
+	// "<prefix>.<network>.<container ID>", so that networks of the same name in different tenants don't share
+	// handles. Changing it strands the handles of existing endpoints, so it should only be set for a new network.
+	IPAMHandlePrefix string `json:"ipam_handle_prefix,omitempty"`
+
+	// AnnotationLabelPrefix, if set, copies each of a pod's annotations whose key starts with it onto the pod's
+	// WorkloadEndpoint as a label, keyed by the rest of the annotation's key, so that policy selectors can match
+	// on it. Keys and values are sanitized as Mesos labels are. The pod's own labels take precedence.
+	AnnotationLabelPrefix string `json:"annotation_label_prefix,omitempty"`
+
+	// MetricsPushGateway, if set, is the URL of a Prometheus Pushgateway that each ADD and DEL pushes its
+	// duration and outcome to when it completes.
+	MetricsPushGateway string `json:"metrics_push_gateway,omitempty"`
+
+	// ProfileLabelStyle controls the label that the profile created for a non-Kubernetes network applies to its
+	// endpoints. "legacy" (the default) uses the network name as the key, with an empty value. "key-value" uses
+	// the key projectcalico.org/network, with the network name as the value.
+	ProfileLabelStyle string `json:"profile_label_style,omitempty"`
+
+	// DefaultProfileEgress controls the egress rules of the profile created for a non-Kubernetes network.
+	// "allow" (the default) allows all egress traffic. "deny" allows none, leaving it to explicit policy.
+	// "allow-cidrs" allows egress only to the CIDRs in DefaultProfileEgressCIDRs.
+	DefaultProfileEgress      string   `json:"default_profile_egress,omitempty"`
+	DefaultProfileEgressCIDRs []string `json:"default_profile_egress_cidrs,omitempty"`
+
+	// ManageProfile controls whether the plugin attaches profiles to the network's endpoints, and creates the
+	// network's profile if there isn't a policy handler. It defaults to true. With it false, the plugin leaves an
+	// endpoint's profiles as they are, for profiles and policy that are managed out-of-band. A pod can ask for
+	// the same with the cni.projectcalico.org/noProfile annotation.
+	ManageProfile *bool `json:"manage_profile,omitempty"`
+
+	// IPFamilyOrder controls the order of a dual-stack workload's addresses in the CNI result and on its
+	// WorkloadEndpoint. "v4-first" lists IPv4 addresses first; "v6-first" lists IPv6 first. If unset, new
+	// addresses are listed IPv4 first, and an existing endpoint's addresses in the order it records them.
+	IPFamilyOrder string `json:"ip_family_order,omitempty"`
+
+	// AutoCreateNode makes ADD create a minimal Node resource for this node if there isn't one, for
+	// deployments where nothing else creates it. Off by default.
+	AutoCreateNode bool `json:"auto_create_node,omitempty"`
+
+	// AddTimeout, if set, bounds a whole ADD to that many seconds. If it's exceeded, whatever the ADD had
+	// set up so far is removed again and an error is returned, so that the runtime retries from scratch.
+	AddTimeout int `json:"add_timeout,omitempty"`
+
+	// DatastoreTimeoutSeconds bounds each individual datastore operation, such as reading or writing a
+	// WorkloadEndpoint or an IPAM assignment, so that an unresponsive datastore fails the operation with a
+	// clear error rather than hanging. Defaults to 30 seconds.
+	DatastoreTimeoutSeconds int `json:"datastore_timeout_seconds,omitempty"`
+
+	// DNS is reported in the DNS block of the CNI result, for runtimes that configure the container's
+	// resolver from it. With Kubernetes policy, a pod's cni.projectcalico.org/dns annotation replaces it.
+	DNS types.DNS `json:"dns,omitempty"`
+
+	// DryRun makes ADD and DEL work out and print what they would do, without setting up or tearing down any
+	// networking, calling the IPAM plugin or writing to the datastore. ADD reports the WorkloadEndpoint name and
+	// the IP pools that would be used; DEL reports the endpoint and the IPs that would be released. The output
+	// isn't a CNI result, so this is for validating a config by hand rather than for use by a runtime.
+	DryRun bool `json:"dry_run,omitempty"`
+
 	// Windows-specific configuration.
 	// WindowsPodDeletionTimestampTimeout defines number of seconds before a pod deletion timestamp timeout and
 	// should be removed from registry. Default: 600 seconds
@@ -119,11 +315,22 @@ type NetConf struct {
 
 	RuntimeConfig RuntimeConfig
 
+	// AdditionalInterface is set internally on the NetConf for one of the AdditionalNetworks. It isn't
+	// read from the CNI config.
+	AdditionalInterface bool `json:"-"`
+
 	// Options below here are deprecated.
 	EtcdAuthority string `json:"etcd_authority"`
 	Hostname      string `json:"hostname"`
 }
 
+// AdditionalNetwork holds the config for an extra Calico network that a workload is attached to.
+// The IPAM section is kept as a raw map so that it is passed through to the IPAM plugin unchanged.
+type AdditionalNetwork struct {
+	Name string                 `json:"name"`
+	IPAM map[string]interface{} `json:"ipam"`
+}
+
 // Runtime Config is provided by kubernetes
 type RuntimeConfig struct {
 	DNS RuntimeConfigDNS
@@ -142,6 +349,24 @@ type RuntimeConfigDNS struct {
 // to be configured inside the container namespace.
 type ContainerSettings struct {
 	AllowIPForwarding bool `json:"allow_ip_forwarding"`
+
+	// Gateway is the address that the container's routes go via, in place of 169.254.1.1. An IPv6
+	// link-local address sets the IPv6 gateway instead, unless ipv6_gateway is set. An unusable address
+	// is ignored, with a warning.
+	Gateway string `json:"gateway,omitempty"`
+
+	// MTU is the MTU of the container side of the veth, if it's to differ from the host side's, which uses mtu.
+	MTU int `json:"mtu,omitempty"`
+
+	// Routes are added to the container's namespace on top of its usual routes.
+	Routes []ContainerRoute `json:"routes,omitempty"`
+}
+
+// ContainerRoute is an extra route for the container's namespace. Without a gateway, it goes via the same
+// gateway as the container's other routes.
+type ContainerRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
 }
 
 // CNITestArgs is the CNI_ARGS used for test purposes.
@@ -150,6 +375,12 @@ type CNITestArgs struct {
 	CNI_TEST_NAMESPACE types.UnmarshallableString
 }
 
+// KeepIPArgs are the CNI_ARGS that ask a DEL to leave the workload's IPs reserved.
+type KeepIPArgs struct {
+	types.CommonArgs
+	CALICO_KEEP_IP types.UnmarshallableBool
+}
+
 // K8sArgs is the valid CNI_ARGS used for Kubernetes
 type K8sArgs struct {
 	types.CommonArgs
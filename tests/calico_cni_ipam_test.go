@@ -4,18 +4,25 @@ package main_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"os/exec"
+	"strings"
 
 	"github.com/containernetworking/cni/pkg/types"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/projectcalico/cni-plugin/internal/pkg/testutils"
+	"github.com/projectcalico/cni-plugin/internal/pkg/utils"
 	client "github.com/projectcalico/libcalico-go/lib/clientv3"
 	"github.com/projectcalico/libcalico-go/lib/ipam"
 	"github.com/projectcalico/libcalico-go/lib/names"
@@ -66,6 +73,30 @@ var _ = Describe("Calico IPAM Tests", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 
+	Describe("VERSION", func() {
+		It("reports the supported CNI spec versions", func() {
+			cmd := exec.Command(fmt.Sprintf("%s/%s", os.Getenv("BIN"), plugin))
+			cmd.Env = []string{"CNI_COMMAND=VERSION"}
+			out, err := cmd.Output()
+			Expect(err).ShouldNot(HaveOccurred())
+			var info map[string]interface{}
+			Expect(json.Unmarshal(out, &info)).To(Succeed())
+			Expect(info).To(HaveKeyWithValue("cniVersion", "0.4.0"))
+			Expect(info).To(HaveKeyWithValue("supportedVersions", ConsistOf("0.1.0", "0.2.0", "0.3.0", "0.3.1")))
+			Expect(info).To(HaveKey("calicoVersion"))
+			Expect(info).To(HaveKey("gitCommit"))
+			Expect(info).To(HaveKey("cniLibraryVersion"))
+			Expect(info).To(HaveKey("goVersion"))
+		})
+
+		It("prints only the version to stdout for -v", func() {
+			cmd := exec.Command(fmt.Sprintf("%s/%s", os.Getenv("BIN"), plugin), "-v")
+			out, err := cmd.Output()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(strings.Count(strings.TrimSpace(string(out)), "\n")).To(BeZero())
+		})
+	})
+
 	Describe("Run IPAM plugin", func() {
 		DescribeTable("Request different numbers of IP addresses",
 			func(expectedIPv4, expectedIPv6 bool, netconf string) {
@@ -232,6 +263,253 @@ var _ = Describe("Calico IPAM Tests", func() {
 		})
 	})
 
+	Describe("Run IPAM plugin - Verify pool families", func() {
+		DescribeTable("Fails when there's no pool for a requested family",
+			func(checkPoolFamilies bool, deletePool, assignIPv4, assignIPv6, expectedErr string) {
+				testutils.MustDeleteIPPool(calicoClient, deletePool)
+				defer testutils.MustCreateNewIPPool(calicoClient, deletePool, false, false, true)
+
+				netconf := fmt.Sprintf(`
+            {
+              "cniVersion": "%s",
+              "name": "net1",
+              "type": "calico",
+              "etcd_endpoints": "http://%s:2379",
+              "kubernetes": {
+                 "k8s_api_root": "http://127.0.0.1:8080"
+              },
+              "datastore_type": "%s",
+              "check_pool_families": %t,
+              "ipam": {
+                "type": "%s",
+                "assign_ipv4": "%s",
+                "assign_ipv6": "%s"
+              }
+            }`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), checkPoolFamilies, plugin, assignIPv4, assignIPv6)
+				_, cniErr, exitCode := testutils.RunIPAMPlugin(netconf, "ADD", "", cid, cniVersion)
+				Expect(exitCode).NotTo(Equal(0))
+				if checkPoolFamilies {
+					// The check gives a clear error up front.
+					Expect(cniErr.Msg).To(ContainSubstring(expectedErr))
+				} else {
+					// Without the check, the failure comes from IPAM itself.
+					Expect(cniErr.Msg).NotTo(ContainSubstring(expectedErr))
+				}
+
+				// Nothing should have been assigned.
+				handleIPs, err := calicoClient.IPAM().IPsByHandle(context.Background(), "net1."+cid)
+				Expect(err).To(HaveOccurred(), fmt.Sprintf("unexpected IPs assigned: %v", handleIPs))
+			},
+			Entry("IPv4 only, no IPv4 pool", true, defaultIPv4Pool, "true", "false",
+				"assign_ipv4 requested but no IPv4 pool exists"),
+			Entry("IPv6 only, no IPv6 pool", true, "fd80:24e2:f998:72d6::/64", "false", "true",
+				"assign_ipv6 requested but no IPv6 pool exists"),
+			Entry("Dual stack, no IPv4 pool", true, defaultIPv4Pool, "true", "true",
+				"assign_ipv4 requested but no IPv4 pool exists"),
+			Entry("Dual stack, no IPv6 pool", true, "fd80:24e2:f998:72d6::/64", "true", "true",
+				"assign_ipv6 requested but no IPv6 pool exists"),
+			Entry("IPv4 only, no IPv4 pool, check disabled", false, defaultIPv4Pool, "true", "false",
+				"assign_ipv4 requested but no IPv4 pool exists"),
+			Entry("IPv6 only, no IPv6 pool, check disabled", false, "fd80:24e2:f998:72d6::/64", "false", "true",
+				"assign_ipv6 requested but no IPv6 pool exists"),
+		)
+	})
+
+	Describe("Run IPAM plugin - ipam_pool_strategy", func() {
+		fullPool := "10.60.0.0/24"
+		emptyPool := "10.61.0.0/24"
+
+		BeforeEach(func() {
+			testutils.MustCreateNewIPPool(calicoClient, fullPool, false, false, true)
+			testutils.MustCreateNewIPPool(calicoClient, emptyPool, false, false, true)
+
+			// Fill up some of one pool, which also gives this node an affine block in it.
+			hostname, err := names.Hostname()
+			Expect(err).NotTo(HaveOccurred())
+			handle := "filler"
+			_, fullPoolNet, err := cnet.ParseCIDR(fullPool)
+			Expect(err).NotTo(HaveOccurred())
+			v4, _, err := calicoClient.IPAM().AutoAssign(context.Background(), ipam.AutoAssignArgs{
+				Num4:      20,
+				HandleID:  &handle,
+				Hostname:  hostname,
+				IPv4Pools: []cnet.IPNet{*fullPoolNet},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v4).To(HaveLen(20))
+		})
+
+		AfterEach(func() {
+			Expect(calicoClient.IPAM().ReleaseByHandle(context.Background(), "filler")).To(Succeed())
+		})
+
+		DescribeTable("Chooses a pool according to the strategy",
+			func(strategy, expectedPool string) {
+				netconf := fmt.Sprintf(`
+            {
+              "cniVersion": "%s",
+              "name": "net1",
+              "type": "calico",
+              "etcd_endpoints": "http://%s:2379",
+              "kubernetes": {
+                 "k8s_api_root": "http://127.0.0.1:8080"
+              },
+              "datastore_type": "%s",
+              "ipam_pool_strategy": "%s",
+              "ipam": {
+                "type": "%s",
+                "ipv4_pools": ["%s", "%s"]
+              }
+            }`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), strategy, plugin, fullPool, emptyPool)
+				result, _, exitCode := testutils.RunIPAMPlugin(netconf, "ADD", "", cid, cniVersion)
+				Expect(exitCode).To(Equal(0))
+				Expect(result.IPs).To(HaveLen(1))
+
+				_, expected, err := net.ParseCIDR(expectedPool)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(expected.Contains(result.IPs[0].Address.IP)).To(BeTrue(),
+					fmt.Sprintf("%s isn't in %s", result.IPs[0].Address.IP, expectedPool))
+
+				_, _, exitCode = testutils.RunIPAMPlugin(netconf, "DEL", "", cid, cniVersion)
+				Expect(exitCode).To(Equal(0))
+			},
+			// By default, IPAM prefers the node's existing block in the fuller pool.
+			Entry("any", "any", fullPool),
+			Entry("most-free", "most-free", emptyPool),
+		)
+
+		It("rejects an unknown strategy", func() {
+			netconf := fmt.Sprintf(`
+            {
+              "cniVersion": "%s",
+              "name": "net1",
+              "type": "calico",
+              "etcd_endpoints": "http://%s:2379",
+              "datastore_type": "%s",
+              "ipam_pool_strategy": "least-free",
+              "ipam": {
+                "type": "%s"
+              }
+            }`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), plugin)
+			_, cniErr, exitCode := testutils.RunIPAMPlugin(netconf, "ADD", "", cid, cniVersion)
+			Expect(exitCode).NotTo(Equal(0))
+			Expect(cniErr.Msg).To(ContainSubstring("invalid ipam_pool_strategy"))
+		})
+	})
+
+	Describe("Run IPAM plugin - ipam_handle_prefix", func() {
+		It("allocates and releases under the prefixed handle", func() {
+			netconf := fmt.Sprintf(`
+            {
+              "cniVersion": "%s",
+              "name": "net1",
+              "type": "calico",
+              "etcd_endpoints": "http://%s:2379",
+              "datastore_type": "%s",
+              "ipam_handle_prefix": "tenant-a",
+              "ipam": {
+                "type": "%s"
+              }
+            }`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), plugin)
+			result, _, exitCode := testutils.RunIPAMPlugin(netconf, "ADD", "", cid, cniVersion)
+			Expect(exitCode).To(Equal(0))
+			Expect(result.IPs).To(HaveLen(1))
+
+			ips, err := calicoClient.IPAM().IPsByHandle(context.Background(), "tenant-a.net1."+cid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+			Expect(ips[0].IP.Equal(result.IPs[0].Address.IP)).To(BeTrue())
+			_, err = calicoClient.IPAM().IPsByHandle(context.Background(), "net1."+cid)
+			Expect(err).To(HaveOccurred())
+
+			_, _, exitCode = testutils.RunIPAMPlugin(netconf, "DEL", "", cid, cniVersion)
+			Expect(exitCode).To(Equal(0))
+			_, err = calicoClient.IPAM().IPsByHandle(context.Background(), "tenant-a.net1."+cid)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Run IPAM plugin - num_ipv4", func() {
+		netconfWithCount := func(num int) string {
+			return fmt.Sprintf(`
+            {
+              "cniVersion": "%s",
+              "name": "net1",
+              "type": "calico",
+              "etcd_endpoints": "http://%s:2379",
+              "datastore_type": "%s",
+              "ipam": {
+                "type": "%s",
+                "num_ipv4": %d
+              }
+            }`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), plugin, num)
+		}
+
+		It("assigns and releases two IPv4 addresses", func() {
+			netconf := netconfWithCount(2)
+			result, _, exitCode := testutils.RunIPAMPlugin(netconf, "ADD", "", cid, cniVersion)
+			Expect(exitCode).To(Equal(0))
+			Expect(result.IPs).To(HaveLen(2))
+			Expect(result.IPs[0].Address.IP.To4()).NotTo(BeNil())
+			Expect(result.IPs[1].Address.IP.To4()).NotTo(BeNil())
+			Expect(result.IPs[0].Address.IP.Equal(result.IPs[1].Address.IP)).To(BeFalse())
+
+			ips, err := calicoClient.IPAM().IPsByHandle(context.Background(), "net1."+cid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(HaveLen(2))
+
+			_, _, exitCode = testutils.RunIPAMPlugin(netconf, "DEL", "", cid, cniVersion)
+			Expect(exitCode).To(Equal(0))
+			_, err = calicoClient.IPAM().IPsByHandle(context.Background(), "net1."+cid)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects a count over the maximum", func() {
+			_, err, exitCode := testutils.RunIPAMPlugin(netconfWithCount(17), "ADD", "", cid, cniVersion)
+			Expect(exitCode).NotTo(Equal(0))
+			Expect(err.Msg).To(ContainSubstring("invalid num_ipv4 17"))
+		})
+	})
+
+	Describe("Run IPAM plugin - pool exhaustion", func() {
+		It("reports that a full /32 pool is exhausted", func() {
+			pool := testutils.MustCreateNewIPPoolBlockSize(calicoClient, "192.169.2.1/32", false, false, true, 32)
+			netconf := fmt.Sprintf(`
+            {
+              "cniVersion": "%s",
+              "name": "net1",
+              "type": "calico",
+              "etcd_endpoints": "http://%s:2379",
+              "datastore_type": "%s",
+              "ipam": {
+                "type": "%s",
+                "ipv4_pools": [ "192.169.2.1/32" ]
+              }
+            }`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), plugin)
+
+			// Take the only address in the pool.
+			result, _, exitCode := testutils.RunIPAMPlugin(netconf, "ADD", "", cid, cniVersion)
+			Expect(exitCode).To(Equal(0))
+			Expect(result.IPs[0].Address.IP.String()).To(Equal("192.169.2.1"))
+
+			otherCID := uuid.NewV4().String()
+			_, cniErr, exitCode := testutils.RunIPAMPlugin(netconf, "ADD", "", otherCID, cniVersion)
+			Expect(exitCode).NotTo(Equal(0))
+			Expect(cniErr.Code).To(Equal(utils.ErrCodePoolExhausted))
+			Expect(cniErr.Msg).To(ContainSubstring("IP pool exhausted: no free IPv4 addresses in " + pool))
+
+			// The error converts back into a PoolExhaustedError naming the pool.
+			err := utils.FromIPAMError(&cniErr, log.WithField("test", "exhaustion"))
+			Expect(errors.Is(err, utils.ErrPoolExhausted)).To(BeTrue())
+			var exhausted *utils.PoolExhaustedError
+			Expect(errors.As(err, &exhausted)).To(BeTrue())
+			Expect(exhausted.Pools).To(Equal([]string{pool}))
+
+			_, _, exitCode = testutils.RunIPAMPlugin(netconf, "DEL", "", cid, cniVersion)
+			Expect(exitCode).To(Equal(0))
+		})
+	})
+
 	Describe("Run IPAM plugin - Verify IP Pools", func() {
 		Context("Pass valid pools", func() {
 			It("Uses the ipv4 pool", func() {
@@ -281,6 +559,44 @@ var _ = Describe("Calico IPAM Tests", func() {
 			})
 		})
 
+		Context("Pass an exclusion list", func() {
+			It("never assigns an excluded address", func() {
+				testutils.MustCreateNewIPPool(calicoClient, "192.169.2.0/24", false, false, true)
+				netconf := fmt.Sprintf(`
+                {
+                      "cniVersion": "%s",
+                      "name": "net1",
+                      "type": "calico",
+                      "etcd_endpoints": "http://%s:2379",
+                      "kubernetes": {
+                        "k8s_api_root": "http://127.0.0.1:8080"
+                      },
+                      "datastore_type": "%s",
+                      "ipam_exclude": [ "192.169.2.0/30", "192.169.2.4" ],
+                      "ipam": {
+                        "type": "%s",
+                        "assign_ipv4": "true",
+                        "ipv4_pools": [ "192.169.2.0/24" ]
+                      }
+                }`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), plugin)
+				result, _, _ := testutils.RunIPAMPlugin(netconf, "ADD", "", cid, cniVersion)
+				Expect(result.IPs).To(HaveLen(1))
+				ip := result.IPs[0].Address.IP
+				_, excluded, _ := net.ParseCIDR("192.169.2.0/30")
+				Expect(excluded.Contains(ip)).To(BeFalse())
+				Expect(ip.String()).NotTo(Equal("192.169.2.4"))
+
+				// The excluded addresses that were handed back by IPAM have been released again.
+				for _, e := range []string{"192.169.2.0", "192.169.2.1", "192.169.2.4"} {
+					attrs, _, err := calicoClient.IPAM().GetAssignmentAttributes(context.Background(), cnet.IP{IP: net.ParseIP(e)})
+					Expect(err).To(HaveOccurred(), fmt.Sprintf("%s should not be allocated, attrs: %v", e, attrs))
+				}
+
+				_, _, exitCode := testutils.RunIPAMPlugin(netconf, "DEL", "", cid, cniVersion)
+				Expect(exitCode).Should(Equal(0))
+			})
+		})
+
 		Context("Disabled IP pool", func() {
 			It("Never allocates from the disabled pool", func() {
 				netconf := fmt.Sprintf(`
@@ -12,6 +12,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -22,6 +23,7 @@ import (
 	"github.com/containernetworking/plugins/pkg/ns"
 	cnitestutils "github.com/containernetworking/plugins/pkg/testutils"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
@@ -38,6 +40,7 @@ import (
 	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
 	k8sconversion "github.com/projectcalico/libcalico-go/lib/backend/k8s/conversion"
 	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
 	"github.com/projectcalico/libcalico-go/lib/ipam"
 	"github.com/projectcalico/libcalico-go/lib/logutils"
 	"github.com/projectcalico/libcalico-go/lib/names"
@@ -653,6 +656,63 @@ var _ = Describe("Kubernetes CNI tests", func() {
 			})
 		})
 
+		Context("when calico-config contains a container mtu", func() {
+			mtuNetconf := `
+			{
+			  "cniVersion": "%s",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "datastore_type": "%s",
+			  "mtu": 1450,
+			  "container_settings": {"mtu": 9000},
+			  "ipam": {
+			    "type": "host-local",
+			    "subnet": "10.0.0.0/8"
+			  },
+			  "kubernetes": {
+			    "k8s_api_root": "http://127.0.0.1:8080"
+			  },
+			  "policy": {"type": "k8s"},
+			  "nodename_file_optional": true,
+			  "log_level":"info"
+			}`
+
+			It("sets each side of the veth's MTU", func() {
+				config, err := clientcmd.DefaultClientConfig.ClientConfig()
+				Expect(err).NotTo(HaveOccurred())
+
+				clientset, err := kubernetes.NewForConfig(config)
+				Expect(err).NotTo(HaveOccurred())
+
+				name := fmt.Sprintf("mtutest%d", rand.Uint32())
+				netconf := fmt.Sprintf(mtuNetconf, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+				ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: name},
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{{
+							Name:  name,
+							Image: "ignore",
+						}},
+						NodeName: hostname,
+					},
+				})
+				defer ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+
+				_, _, contVeth, _, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(contVeth.Attrs().MTU).Should(Equal(9000))
+
+				hostVeth, err := netlink.LinkByName(k8sconversion.NewConverter().VethNameForWorkload(testutils.K8S_TEST_NS, name))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(hostVeth.Attrs().MTU).Should(Equal(1450))
+
+				_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testutils.K8S_TEST_NS)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+		})
+
 		hostLocalIPAMConfigs := []struct {
 			description, cniVersion, config, unexpectedRoute string
 			expectedV4Routes, expectedV6Routes               []string
@@ -854,6 +914,36 @@ var _ = Describe("Kubernetes CNI tests", func() {
 				numIPv4IPs: 2,
 				numIPv6IPs: 1,
 			},
+			{
+				description: "old-style inline subnet with a custom container gateway",
+				cniVersion:  cniVersion,
+				config: `
+					{
+					  "cniVersion": "%s",
+					  "name": "net6",
+					  "nodename_file_optional": true,
+					  "type": "calico",
+					  "etcd_endpoints": "http://%s:2379",
+					  "datastore_type": "%s",
+					  "container_settings": {"gateway": "169.254.2.2"},
+					  "ipam": {
+					    "type": "host-local",
+					    "subnet": "usePodCidr"
+					  },
+					  "kubernetes": {
+					   "k8s_api_root": "http://127.0.0.1:8080"
+					  },
+					  "policy": {"type": "k8s"},
+					  "log_level":"info"
+					}`,
+				expectedV4Routes: []string{
+					regexp.QuoteMeta("default via 169.254.2.2 dev eth0"),
+					regexp.QuoteMeta("169.254.2.2 dev eth0 scope link"),
+				},
+				unexpectedRoute: regexp.QuoteMeta("169.254.1.1"),
+				numIPv4IPs:      1,
+				numIPv6IPs:      0,
+			},
 		}
 
 		for _, c := range hostLocalIPAMConfigs {
@@ -973,6 +1063,44 @@ var _ = Describe("Kubernetes CNI tests", func() {
 			})
 		}
 
+		It("fails the ADD with a clear error when the node has no PodCIDR", func() {
+			netconfHostLocalIPAM := fmt.Sprintf(hostLocalIPAMConfigs[0].config, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err := kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			ensureNamespace(clientset, testutils.K8S_TEST_NS)
+			ensureNodeDeleted(clientset, hostname)
+
+			// Create a K8s Node object without a PodCIDR.
+			_, err = clientset.CoreV1().Nodes().Create(context.Background(), &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: hostname},
+			}, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			defer ensureNodeDeleted(clientset, hostname)
+
+			name := fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+			defer ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(netconfHostLocalIPAM, name, testutils.K8S_TEST_NS, "")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("node %s has no PodCIDR assigned", hostname)))
+
+			_, err = testutils.DeleteContainer(netconfHostLocalIPAM, contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
 	})
 
 	Context("using calico-ipam with a Namespace annotation only", func() {
@@ -1224,6 +1352,80 @@ var _ = Describe("Kubernetes CNI tests", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 		})
 
+		Context("with a pod ipv4reserved annotation", func() {
+			createPod := func(nsPools, reserved string) {
+				testNS = fmt.Sprintf("run%d", rand.Uint32())
+				_, err := clientset.CoreV1().Namespaces().Create(context.Background(), &v1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        testNS,
+						Annotations: map[string]string{"cni.projectcalico.org/ipv4pools": nsPools},
+					},
+				}, metav1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+
+				name = fmt.Sprintf("run%d", rand.Uint32())
+				ensurePodCreated(clientset, testNS, &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        name,
+						Annotations: map[string]string{"cni.projectcalico.org/ipv4reserved": reserved},
+					},
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{{
+							Name:  name,
+							Image: "ignore",
+						}},
+						NodeName: hostname,
+					},
+				})
+			}
+
+			It("never assigns a reserved address", func() {
+				createPod(`["50.60.0.0/24"]`, `["50.60.0.0/30", "50.60.0.5"]`)
+				_, reservedCIDR, err := net.ParseCIDR("50.60.0.0/30")
+				Expect(err).NotTo(HaveOccurred())
+
+				// The first free addresses in the pool are reserved, so each of these has to be skipped.
+				_, r, _, _, _, contNs, err := testutils.CreateContainer(netconf, name, testNS, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.IPs).To(HaveLen(1))
+				ip := r.IPs[0].Address.IP
+				Expect(pool1CIDR.Contains(ip)).To(BeTrue(), "IP assigned from wrong pool")
+				Expect(reservedCIDR.Contains(ip)).To(BeFalse(), "reserved IP assigned")
+				Expect(ip.String()).NotTo(Equal("50.60.0.5"))
+
+				// The reserved addresses are released again rather than being left allocated.
+				for _, reservedIP := range []string{"50.60.0.0", "50.60.0.1", "50.60.0.2", "50.60.0.3", "50.60.0.5"} {
+					_, _, err := calicoClient.IPAM().GetAssignmentAttributes(context.Background(), cnet.IP{IP: net.ParseIP(reservedIP)})
+					Expect(err).To(HaveOccurred(), "%s is still allocated", reservedIP)
+				}
+
+				_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testNS)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("skips a pool that's entirely reserved", func() {
+				createPod(`["50.60.0.0/24", "50.60.1.0/24"]`, `["50.60.0.0/25", "50.60.0.128/25"]`)
+
+				_, r, _, _, _, contNs, err := testutils.CreateContainer(netconf, name, testNS, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.IPs).To(HaveLen(1))
+				Expect(pool2CIDR.Contains(r.IPs[0].Address.IP)).To(BeTrue(), "IP assigned from a reserved pool")
+
+				_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testNS)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("fails when every pool is entirely reserved", func() {
+				createPod(`["50.60.0.0/24"]`, `["50.60.0.0/23"]`)
+
+				_, _, _, _, _, contNs, err := testutils.CreateContainer(netconf, name, testNS, "")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("ipv4_reserved covers every address in the IPv4 pools"))
+
+				_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testNS)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+		})
 	})
 
 	Context("using calico-ipam with Namespace annotation and pod annotation", func() {
@@ -1439,6 +1641,64 @@ var _ = Describe("Kubernetes CNI tests", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 		})
 
+		It("resolves a user-chosen IP Pool name in the annotation, and rejects an unknown one", func() {
+			namedPool := api.NewIPPool()
+			namedPool.Name = "pool-a"
+			namedPool.Spec.CIDR = "172.18.0.0/16"
+			_, err := calicoClient.IPPools().Create(ctx, namedPool, options.SetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			defer testutils.MustDeleteIPPool(calicoClient, namedPool.Spec.CIDR)
+			_, namedPoolCIDR, err := net.ParseCIDR(namedPool.Spec.CIDR)
+			Expect(err).NotTo(HaveOccurred())
+
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+					Annotations: map[string]string{
+						"cni.projectcalico.org/ipv4pools": `["pool-a"]`,
+					},
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+
+			_, _, _, contAddresses, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(namedPoolCIDR.Contains(contAddresses[0].IP)).To(BeTrue())
+			_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+
+			// A name that doesn't match any pool fails the ADD.
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+					Annotations: map[string]string{
+						"cni.projectcalico.org/ipv4pools": `["pool-b"]`,
+					},
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+
+			containerNs, containerID, err := testutils.CreateContainerNamespace()
+			Expect(err).ToNot(HaveOccurred())
+			_, _, _, _, err = testutils.RunCNIPluginWithId(netconf, name, testutils.K8S_TEST_NS, "", containerID, "", containerNs)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`IP pool "pool-b" does not exist`))
+		})
 	})
 
 	Context("using floatingIPs annotation to assign a DNAT", func() {
@@ -1551,23 +1811,19 @@ var _ = Describe("Kubernetes CNI tests", func() {
 		})
 	})
 
-	Context("using ipAddrsNoIpam annotation to assign IP address to a pod, bypassing IPAM", func() {
+	Context("using the startupBlocked annotation", func() {
+		var netconf types.NetConf
 		var clientset *kubernetes.Clientset
-		var netconf string
-		var nc types.NetConf
 		var name string
+		pool := "172.16.0.0/16"
 
 		BeforeEach(func() {
-			// Set up clients.
-			config, err := clientcmd.DefaultClientConfig.ClientConfig()
-			Expect(err).NotTo(HaveOccurred())
-			clientset, err = kubernetes.NewForConfig(config)
-			Expect(err).NotTo(HaveOccurred())
-
-			// Create a network config.
-			nc = types.NetConf{
+			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
+				Skip("Profiles can't be created with the Kubernetes datastore")
+			}
+			netconf = types.NetConf{
 				CNIVersion:           cniVersion,
-				Name:                 "calico-uts",
+				Name:                 "calico-network-name",
 				Type:                 "calico",
 				EtcdEndpoints:        fmt.Sprintf("http://%s:2379", os.Getenv("ETCD_IP")),
 				DatastoreType:        os.Getenv("DATASTORE_TYPE"),
@@ -1575,29 +1831,25 @@ var _ = Describe("Kubernetes CNI tests", func() {
 				Policy:               types.Policy{PolicyType: "k8s"},
 				NodenameFileOptional: true,
 				LogLevel:             "info",
-				FeatureControl:       types.FeatureControl{IPAddrsNoIpam: true},
+				FeatureControl:       types.FeatureControl{StartupBlocked: true},
 			}
-			nc.IPAM.Type = "calico-ipam"
-			ncb, err := json.Marshal(nc)
-			Expect(err).NotTo(HaveOccurred())
-			netconf = string(ncb)
-		})
-
-		AfterEach(func() {
-			// Delete pod
-			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
-		})
+			netconf.IPAM.Type = "calico-ipam"
+			testutils.MustCreateNewIPPool(calicoClient, pool, false, false, true)
 
-		It("should successfully assigns the annotated IP address", func() {
-			assignIP := net.IPv4(10, 0, 0, 1).To4()
+			// Build kubernetes clients.
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
 
-			// Now create a K8s pod passing in an IP address.
+			// Now create a K8s pod that requests to start blocked.
+			ensureNamespace(clientset, testutils.K8S_TEST_NS)
 			name = fmt.Sprintf("run%d", rand.Uint32())
-			pod := ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: name,
 					Annotations: map[string]string{
-						"cni.projectcalico.org/ipAddrsNoIpam": "[\"10.0.0.1\"]",
+						"cni.projectcalico.org/startupBlocked": "true",
 					},
 				},
 				Spec: v1.PodSpec{
@@ -1608,41 +1860,821 @@ var _ = Describe("Kubernetes CNI tests", func() {
 					NodeName: hostname,
 				},
 			})
+		})
 
-			log.Infof("Created POD object: %v", pod)
+		AfterEach(func() {
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+			testutils.MustDeleteIPPool(calicoClient, pool)
+		})
 
-			containerID, _, contVeth, contAddresses, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
+		It("attaches the block-ingress profile to the endpoint", func() {
+			profile := api.NewProfile()
+			profile.Name = "block-ingress"
+			_, err := calicoClient.Profiles().Create(ctx, profile, options.SetOptions{})
 			Expect(err).NotTo(HaveOccurred())
-			mac := contVeth.Attrs().HardwareAddr
-
-			podIP := contAddresses[0].IP
-			log.Infof("All container IPs: %v", contAddresses)
-			log.Infof("Container got IP address: %s", podIP)
-			Expect(podIP).Should(Equal(assignIP))
-
-			ids := names.WorkloadEndpointIdentifiers{
-				Node:         hostname,
-				Orchestrator: api.OrchestratorKubernetes,
-				Endpoint:     "eth0",
-				Pod:          name,
-				ContainerID:  containerID,
-			}
+			defer func() {
+				_, err := calicoClient.Profiles().Delete(ctx, "block-ingress", options.DeleteOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}()
 
-			wrkload, err := ids.CalculateWorkloadEndpointName(false)
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
 			Expect(err).NotTo(HaveOccurred())
 
-			interfaceName := k8sconversion.NewConverter().VethNameForWorkload(testutils.K8S_TEST_NS, name)
-
-			// The endpoint is created
 			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(endpoints.Items).Should(HaveLen(1))
+			Expect(endpoints.Items[0].Spec.Profiles).Should(Equal([]string{"kns.test", "ksa.test.default", "block-ingress"}))
 
-			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
-				// Unlike etcd datastore, WEP based on a kubernetes pod does not store values for mac/containerID.
-				// Put them back manually for later comparison.
-				endpoints.Items[0].Spec.ContainerID = containerID
-				endpoints.Items[0].Spec.MAC = mac.String()
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("fails when the block-ingress profile doesn't exist", func() {
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).To(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(0))
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("fails when the startup_blocked feature is not enabled", func() {
+			netconf.FeatureControl.StartupBlocked = false
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).To(HaveOccurred())
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("with annotation_label_prefix", func() {
+		var netconf types.NetConf
+		var clientset *kubernetes.Clientset
+		var name string
+		pool := "172.16.0.0/16"
+
+		createPod := func(labels, annotations map[string]string) {
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Labels:      labels,
+					Annotations: annotations,
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+		}
+
+		BeforeEach(func() {
+			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
+				Skip("WorkloadEndpoint labels come from the pod with the Kubernetes datastore")
+			}
+			netconf = types.NetConf{
+				CNIVersion:            cniVersion,
+				Name:                  "calico-network-name",
+				Type:                  "calico",
+				EtcdEndpoints:         fmt.Sprintf("http://%s:2379", os.Getenv("ETCD_IP")),
+				DatastoreType:         os.Getenv("DATASTORE_TYPE"),
+				Kubernetes:            types.Kubernetes{K8sAPIRoot: "http://127.0.0.1:8080"},
+				Policy:                types.Policy{PolicyType: "k8s"},
+				AnnotationLabelPrefix: "label.projectcalico.org/",
+				NodenameFileOptional:  true,
+				LogLevel:              "info",
+			}
+			netconf.IPAM.Type = "calico-ipam"
+			testutils.MustCreateNewIPPool(calicoClient, pool, false, false, true)
+
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+			ensureNamespace(clientset, testutils.K8S_TEST_NS)
+		})
+
+		AfterEach(func() {
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+			testutils.MustDeleteIPPool(calicoClient, pool)
+		})
+
+		It("copies the annotations under the prefix onto the endpoint's labels", func() {
+			createPod(map[string]string{"app": "web"}, map[string]string{
+				"label.projectcalico.org/team": "payments",
+				"label.projectcalico.org/app":  "not-web",
+				"example.com/team":             "other",
+			})
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+			Expect(endpoints.Items[0].Labels).Should(Equal(map[string]string{
+				"app":                              "web",
+				"team":                             "payments",
+				"projectcalico.org/namespace":      "test",
+				"projectcalico.org/orchestrator":   api.OrchestratorKubernetes,
+				"projectcalico.org/serviceaccount": "default",
+			}))
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("rejects an annotation that doesn't make a valid label", func() {
+			createPod(nil, map[string]string{"label.projectcalico.org/team": strings.Repeat("a", 64)})
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("invalid label value"))
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("using the policyTier annotation", func() {
+		var netconf types.NetConf
+		var clientset *kubernetes.Clientset
+		var name string
+		pool := "172.16.0.0/16"
+
+		createPod := func(tier string) {
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+					Annotations: map[string]string{
+						"cni.projectcalico.org/policyTier": tier,
+					},
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+		}
+
+		BeforeEach(func() {
+			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
+				Skip("WorkloadEndpoint annotations aren't stored with the Kubernetes datastore")
+			}
+			netconf = types.NetConf{
+				CNIVersion:    cniVersion,
+				Name:          "calico-network-name",
+				Type:          "calico",
+				EtcdEndpoints: fmt.Sprintf("http://%s:2379", os.Getenv("ETCD_IP")),
+				DatastoreType: os.Getenv("DATASTORE_TYPE"),
+				Kubernetes:    types.Kubernetes{K8sAPIRoot: "http://127.0.0.1:8080"},
+				Policy: types.Policy{
+					PolicyType:   "k8s",
+					AllowedTiers: []string{"security", "platform"},
+				},
+				NodenameFileOptional: true,
+				LogLevel:             "info",
+			}
+			netconf.IPAM.Type = "calico-ipam"
+			testutils.MustCreateNewIPPool(calicoClient, pool, false, false, true)
+
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+			ensureNamespace(clientset, testutils.K8S_TEST_NS)
+		})
+
+		AfterEach(func() {
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+			testutils.MustDeleteIPPool(calicoClient, pool)
+		})
+
+		It("copies an allowed tier onto the endpoint", func() {
+			createPod("platform")
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+			Expect(endpoints.Items[0].Annotations).Should(HaveKeyWithValue("cni.projectcalico.org/policyTier", "platform"))
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("rejects a tier that isn't allowed", func() {
+			createPod("not-a-tier")
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).To(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(0))
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("using the natOutgoing annotation", func() {
+		var netconf types.NetConf
+		var clientset *kubernetes.Clientset
+		var name string
+		pool := "172.16.0.0/16"
+
+		createPod := func(annotations map[string]string) {
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Annotations: annotations,
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+		}
+
+		BeforeEach(func() {
+			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
+				Skip("WorkloadEndpoint annotations aren't stored with the Kubernetes datastore")
+			}
+			netconf = types.NetConf{
+				CNIVersion:           cniVersion,
+				Name:                 "calico-network-name",
+				Type:                 "calico",
+				EtcdEndpoints:        fmt.Sprintf("http://%s:2379", os.Getenv("ETCD_IP")),
+				DatastoreType:        os.Getenv("DATASTORE_TYPE"),
+				Kubernetes:           types.Kubernetes{K8sAPIRoot: "http://127.0.0.1:8080"},
+				Policy:               types.Policy{PolicyType: "k8s"},
+				NodenameFileOptional: true,
+				LogLevel:             "info",
+			}
+			netconf.IPAM.Type = "calico-ipam"
+			testutils.MustCreateNewIPPool(calicoClient, pool, false, true, true)
+
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+			ensureNamespace(clientset, testutils.K8S_TEST_NS)
+		})
+
+		AfterEach(func() {
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+			testutils.MustDeleteIPPool(calicoClient, pool)
+		})
+
+		It("records that source NAT is disabled on the endpoint", func() {
+			createPod(map[string]string{"cni.projectcalico.org/natOutgoing": "false"})
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+			Expect(endpoints.Items[0].Annotations).Should(HaveKeyWithValue("cni.projectcalico.org/natOutgoing", "false"))
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("leaves the endpoint alone when the annotation isn't set", func() {
+			createPod(nil)
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+			Expect(endpoints.Items[0].Annotations).ShouldNot(HaveKey("cni.projectcalico.org/natOutgoing"))
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("rejects a value that isn't a boolean", func() {
+			createPod(map[string]string{"cni.projectcalico.org/natOutgoing": "maybe"})
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).To(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(0))
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("using the hwAddr annotation", func() {
+		var netconf types.NetConf
+		var clientset *kubernetes.Clientset
+		var name string
+		pool := "172.16.0.0/16"
+
+		createPod := func(annotations map[string]string) {
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Annotations: annotations,
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+		}
+
+		BeforeEach(func() {
+			netconf = types.NetConf{
+				CNIVersion:           cniVersion,
+				Name:                 "calico-network-name",
+				Type:                 "calico",
+				EtcdEndpoints:        fmt.Sprintf("http://%s:2379", os.Getenv("ETCD_IP")),
+				DatastoreType:        os.Getenv("DATASTORE_TYPE"),
+				Kubernetes:           types.Kubernetes{K8sAPIRoot: "http://127.0.0.1:8080"},
+				Policy:               types.Policy{PolicyType: "k8s"},
+				NodenameFileOptional: true,
+				LogLevel:             "info",
+			}
+			netconf.IPAM.Type = "calico-ipam"
+			testutils.MustCreateNewIPPool(calicoClient, pool, false, true, true)
+
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+			ensureNamespace(clientset, testutils.K8S_TEST_NS)
+		})
+
+		AfterEach(func() {
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+			testutils.MustDeleteIPPool(calicoClient, pool)
+		})
+
+		It("applies the MAC to the container interface and records it on the endpoint", func() {
+			createPod(map[string]string{"cni.projectcalico.org/hwAddr": "02:42:ac:11:00:02"})
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, contVeth, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contVeth.Attrs().HardwareAddr.String()).To(Equal("02:42:ac:11:00:02"))
+
+			// The Kubernetes datastore doesn't store the MAC.
+			kdd := os.Getenv("DATASTORE_TYPE") == "kubernetes"
+			if !kdd {
+				endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(endpoints.Items).Should(HaveLen(1))
+				Expect(endpoints.Items[0].Spec.MAC).To(Equal("02:42:ac:11:00:02"))
+			}
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			if !kdd {
+				endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(endpoints.Items).Should(HaveLen(0))
+			}
+			err = contNs.Do(func(_ ns.NetNS) error {
+				_, err := netlink.LinkByName("eth0")
+				return err
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		DescribeTable("rejects an invalid MAC",
+			func(hwAddr string) {
+				createPod(map[string]string{"cni.projectcalico.org/hwAddr": hwAddr})
+				confBytes, err := json.Marshal(netconf)
+				Expect(err).NotTo(HaveOccurred())
+				_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+				Expect(err).To(HaveOccurred())
+
+				endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(endpoints.Items).Should(HaveLen(0))
+
+				_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+				Expect(err).ShouldNot(HaveOccurred())
+			},
+			Entry("malformed", "02:42:ac:11:00"),
+			Entry("multicast", "01:00:5e:00:00:01"),
+		)
+	})
+
+	Context("using the bandwidth annotations", func() {
+		var netconf types.NetConf
+		var clientset *kubernetes.Clientset
+		var name string
+		pool := "172.16.0.0/16"
+
+		createPod := func(annotations map[string]string) {
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Annotations: annotations,
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+		}
+
+		// ifbLinks returns the ifb devices that the plugin has created for bandwidth limits.
+		ifbLinks := func() []netlink.Link {
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			var ifbs []netlink.Link
+			for _, l := range links {
+				if l.Type() == "ifb" && strings.HasPrefix(l.Attrs().Name, "cbw") {
+					ifbs = append(ifbs, l)
+				}
+			}
+			return ifbs
+		}
+
+		BeforeEach(func() {
+			netconf = types.NetConf{
+				CNIVersion:           cniVersion,
+				Name:                 "calico-network-name",
+				Type:                 "calico",
+				EtcdEndpoints:        fmt.Sprintf("http://%s:2379", os.Getenv("ETCD_IP")),
+				DatastoreType:        os.Getenv("DATASTORE_TYPE"),
+				Kubernetes:           types.Kubernetes{K8sAPIRoot: "http://127.0.0.1:8080"},
+				Policy:               types.Policy{PolicyType: "k8s"},
+				NodenameFileOptional: true,
+				LogLevel:             "info",
+			}
+			netconf.IPAM.Type = "calico-ipam"
+			testutils.MustCreateNewIPPool(calicoClient, pool, false, true, true)
+
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+			ensureNamespace(clientset, testutils.K8S_TEST_NS)
+		})
+
+		AfterEach(func() {
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+			testutils.MustDeleteIPPool(calicoClient, pool)
+		})
+
+		It("shapes the pod's traffic and removes the shaping on DEL", func() {
+			createPod(map[string]string{
+				"kubernetes.io/ingress-bandwidth": "10M",
+				"kubernetes.io/egress-bandwidth":  "20M",
+			})
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			// Traffic to the pod is shaped on the host veth.
+			hostVeth, err := netlink.LinkByName(k8sconversion.NewConverter().VethNameForWorkload(testutils.K8S_TEST_NS, name))
+			Expect(err).NotTo(HaveOccurred())
+			qdiscs, err := netlink.QdiscList(hostVeth)
+			Expect(err).NotTo(HaveOccurred())
+			var tbfs []*netlink.Tbf
+			var ingress bool
+			for _, q := range qdiscs {
+				switch q := q.(type) {
+				case *netlink.Tbf:
+					tbfs = append(tbfs, q)
+				case *netlink.Ingress:
+					ingress = true
+				}
+			}
+			Expect(tbfs).To(HaveLen(1))
+			Expect(tbfs[0].Rate).To(Equal(uint64(10000000 / 8)))
+			Expect(ingress).To(BeTrue())
+
+			// Traffic from the pod is redirected to an ifb device and shaped there.
+			ifbs := ifbLinks()
+			Expect(ifbs).To(HaveLen(1))
+			qdiscs, err = netlink.QdiscList(ifbs[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(qdiscs).To(ContainElement(BeAssignableToTypeOf(&netlink.Tbf{})))
+			for _, q := range qdiscs {
+				if tbf, ok := q.(*netlink.Tbf); ok {
+					Expect(tbf.Rate).To(Equal(uint64(20000000 / 8)))
+				}
+			}
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ifbLinks()).To(BeEmpty())
+		})
+
+		It("rejects an unparseable rate", func() {
+			createPod(map[string]string{"kubernetes.io/egress-bandwidth": "fast"})
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).To(HaveOccurred())
+			Expect(ifbLinks()).To(BeEmpty())
+
+			_, err = testutils.DeleteContainer(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("recording the CNI network on the endpoint", func() {
+		var netconf types.NetConf
+		var clientset *kubernetes.Clientset
+		var name string
+		pool := "172.16.0.0/16"
+
+		BeforeEach(func() {
+			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
+				Skip("WorkloadEndpoint annotations aren't stored with the Kubernetes datastore")
+			}
+			netconf = types.NetConf{
+				CNIVersion:           cniVersion,
+				Name:                 "calico-network-name",
+				Type:                 "calico",
+				EtcdEndpoints:        fmt.Sprintf("http://%s:2379", os.Getenv("ETCD_IP")),
+				DatastoreType:        os.Getenv("DATASTORE_TYPE"),
+				Kubernetes:           types.Kubernetes{K8sAPIRoot: "http://127.0.0.1:8080"},
+				Policy:               types.Policy{PolicyType: "k8s"},
+				NodenameFileOptional: true,
+				LogLevel:             "info",
+			}
+			netconf.IPAM.Type = "calico-ipam"
+			testutils.MustCreateNewIPPool(calicoClient, pool, false, true, true)
+
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+			ensureNamespace(clientset, testutils.K8S_TEST_NS)
+
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+		})
+
+		AfterEach(func() {
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+			testutils.MustDeleteIPPool(calicoClient, pool)
+		})
+
+		It("annotates the endpoint with the network name and updates it on a repeated ADD", func() {
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			containerID, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+			Expect(endpoints.Items[0].Annotations).Should(HaveKeyWithValue("cni.projectcalico.org/network", "calico-network-name"))
+
+			netconf.Name = "renamed-network"
+			renamedBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, _, _, err = testutils.RunCNIPluginWithId(string(renamedBytes), name, testutils.K8S_TEST_NS, "", containerID, "eth0", contNs)
+			Expect(err).NotTo(HaveOccurred())
+
+			endpoints, err = calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+			Expect(endpoints.Items[0].Annotations).Should(HaveKeyWithValue("cni.projectcalico.org/network", "renamed-network"))
+
+			_, err = testutils.DeleteContainerWithId(string(renamedBytes), contNs.Path(), name, testutils.K8S_TEST_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// The first ADD's allocation is under the original network's handle, so release that too.
+			_, err = testutils.DeleteContainerWithId(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			ips, err := calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("calico-network-name", containerID, ""))
+			Expect(err).To(HaveOccurred(), fmt.Sprintf("unexpected IPs left assigned: %v", ips))
+		})
+	})
+
+	Context("with an add_timeout", func() {
+		var netconf types.NetConf
+		var clientset *kubernetes.Clientset
+		var name, slowIPAM string
+		pool := "10.0.0.0/24"
+
+		BeforeEach(func() {
+			netconf = types.NetConf{
+				CNIVersion:           cniVersion,
+				Name:                 "net1",
+				Type:                 "calico",
+				EtcdEndpoints:        fmt.Sprintf("http://%s:2379", os.Getenv("ETCD_IP")),
+				DatastoreType:        os.Getenv("DATASTORE_TYPE"),
+				Kubernetes:           types.Kubernetes{K8sAPIRoot: "http://127.0.0.1:8080"},
+				Policy:               types.Policy{PolicyType: "k8s"},
+				NodenameFileOptional: true,
+				LogLevel:             "info",
+				AddTimeout:           2,
+			}
+			netconf.IPAM.Type = "slow-ipam"
+			testutils.MustCreateNewIPPool(calicoClient, pool, false, false, true)
+
+			// An IPAM plugin that takes longer than the timeout before handing off to calico-ipam.
+			slowIPAM = filepath.Join(os.Getenv("BIN"), "slow-ipam")
+			script := "#!/bin/sh\nsleep 5\nexec \"$(dirname \"$0\")/calico-ipam\"\n"
+			Expect(ioutil.WriteFile(slowIPAM, []byte(script), 0755)).To(Succeed())
+
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+			ensureNamespace(clientset, testutils.K8S_TEST_NS)
+
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+		})
+
+		AfterEach(func() {
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+			Expect(os.Remove(slowIPAM)).To(Succeed())
+			testutils.MustDeleteIPPool(calicoClient, pool)
+		})
+
+		It("kills the IPAM plugin and leaves nothing behind when the ADD is too slow", func() {
+			confBytes, err := json.Marshal(netconf)
+			Expect(err).NotTo(HaveOccurred())
+
+			start := time.Now()
+			containerID, _, _, _, _, contNs, err := testutils.CreateContainer(string(confBytes), name, testutils.K8S_TEST_NS, "")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("add_timeout"))
+
+			// The IPAM plugin should have been killed at the deadline rather than left to finish.
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+
+			ips, err := calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("net1", containerID, ""))
+			Expect(err).To(HaveOccurred(), fmt.Sprintf("unexpected IPs assigned: %v", ips))
+
+			_, err = testutils.DeleteContainerWithId(string(confBytes), contNs.Path(), name, testutils.K8S_TEST_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("using ipAddrsNoIpam annotation to assign IP address to a pod, bypassing IPAM", func() {
+		var clientset *kubernetes.Clientset
+		var netconf string
+		var nc types.NetConf
+		var name string
+
+		BeforeEach(func() {
+			// Set up clients.
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Create a network config.
+			nc = types.NetConf{
+				CNIVersion:           cniVersion,
+				Name:                 "calico-uts",
+				Type:                 "calico",
+				EtcdEndpoints:        fmt.Sprintf("http://%s:2379", os.Getenv("ETCD_IP")),
+				DatastoreType:        os.Getenv("DATASTORE_TYPE"),
+				Kubernetes:           types.Kubernetes{K8sAPIRoot: "http://127.0.0.1:8080"},
+				Policy:               types.Policy{PolicyType: "k8s"},
+				NodenameFileOptional: true,
+				LogLevel:             "info",
+				FeatureControl:       types.FeatureControl{IPAddrsNoIpam: true},
+			}
+			nc.IPAM.Type = "calico-ipam"
+			ncb, err := json.Marshal(nc)
+			Expect(err).NotTo(HaveOccurred())
+			netconf = string(ncb)
+		})
+
+		AfterEach(func() {
+			// Delete pod
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+		})
+
+		It("should successfully assigns the annotated IP address", func() {
+			assignIP := net.IPv4(10, 0, 0, 1).To4()
+
+			// Now create a K8s pod passing in an IP address.
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			pod := ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+					Annotations: map[string]string{
+						"cni.projectcalico.org/ipAddrsNoIpam": "[\"10.0.0.1\"]",
+					},
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+
+			log.Infof("Created POD object: %v", pod)
+
+			containerID, _, contVeth, contAddresses, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
+			Expect(err).NotTo(HaveOccurred())
+			mac := contVeth.Attrs().HardwareAddr
+
+			podIP := contAddresses[0].IP
+			log.Infof("All container IPs: %v", contAddresses)
+			log.Infof("Container got IP address: %s", podIP)
+			Expect(podIP).Should(Equal(assignIP))
+
+			ids := names.WorkloadEndpointIdentifiers{
+				Node:         hostname,
+				Orchestrator: api.OrchestratorKubernetes,
+				Endpoint:     "eth0",
+				Pod:          name,
+				ContainerID:  containerID,
+			}
+
+			wrkload, err := ids.CalculateWorkloadEndpointName(false)
+			Expect(err).NotTo(HaveOccurred())
+
+			interfaceName := k8sconversion.NewConverter().VethNameForWorkload(testutils.K8S_TEST_NS, name)
+
+			// The endpoint is created
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+
+			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
+				// Unlike etcd datastore, WEP based on a kubernetes pod does not store values for mac/containerID.
+				// Put them back manually for later comparison.
+				endpoints.Items[0].Spec.ContainerID = containerID
+				endpoints.Items[0].Spec.MAC = mac.String()
 			}
 
 			Expect(endpoints.Items[0].Name).Should(Equal(wrkload))
@@ -1746,6 +2778,166 @@ var _ = Describe("Kubernetes CNI tests", func() {
 			_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testutils.K8S_TEST_NS)
 			Expect(err).ShouldNot(HaveOccurred())
 		})
+
+		Context("with no IPAM plugin configured", func() {
+			BeforeEach(func() {
+				nc.IPAM.Type = ""
+				ncb, err := json.Marshal(nc)
+				Expect(err).NotTo(HaveOccurred())
+				netconf = string(ncb)
+			})
+
+			It("should assign the annotated IP address and not call IPAM on DEL", func() {
+				name = fmt.Sprintf("run%d", rand.Uint32())
+				ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: name,
+						Annotations: map[string]string{
+							"cni.projectcalico.org/ipAddrsNoIpam": "[\"10.0.0.1\"]",
+						},
+					},
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{{
+							Name:  name,
+							Image: "ignore",
+						}},
+						NodeName: hostname,
+					},
+				})
+
+				_, _, _, contAddresses, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contAddresses[0].IP).Should(Equal(net.IPv4(10, 0, 0, 1).To4()))
+
+				// There's no IPAM plugin to call, so the DEL must not try to release anything.
+				_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testutils.K8S_TEST_NS)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("should fail if the pod has no ipAddrsNoIpam annotation", func() {
+				name = fmt.Sprintf("run%d", rand.Uint32())
+				ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: name},
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{{
+							Name:  name,
+							Image: "ignore",
+						}},
+						NodeName: hostname,
+					},
+				})
+
+				_, _, _, _, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("no IPAM plugin is configured"))
+
+				if os.Getenv("DATASTORE_TYPE") != "kubernetes" {
+					endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(endpoints.Items).Should(HaveLen(0))
+				}
+
+				_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testutils.K8S_TEST_NS)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+		})
+
+		It("should add the secondaryIPs alongside the ipAddrsNoIpam address", func() {
+			name = fmt.Sprintf("run%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+					Annotations: map[string]string{
+						"cni.projectcalico.org/ipAddrsNoIpam": "[\"10.0.0.1\"]",
+						"cni.projectcalico.org/secondaryIPs":  "[\"10.0.0.2\", \"10.0.0.3\"]",
+					},
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Name:  name,
+						Image: "ignore",
+					}},
+					NodeName: hostname,
+				},
+			})
+
+			_, _, _, contAddresses, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			var addrs []string
+			for _, a := range contAddresses {
+				addrs = append(addrs, a.IPNet.String())
+			}
+			Expect(addrs).To(ConsistOf("10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32"))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+			Expect(endpoints.Items[0].Spec.IPNetworks).To(Equal([]string{"10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32"}))
+
+			_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		Context("with require_pool_for_static_ips", func() {
+			BeforeEach(func() {
+				nc.RequirePoolForStaticIPs = true
+				ncb, err := json.Marshal(nc)
+				Expect(err).NotTo(HaveOccurred())
+				netconf = string(ncb)
+				testutils.MustCreateNewIPPool(calicoClient, "10.0.0.0/24", false, false, true)
+			})
+
+			AfterEach(func() {
+				testutils.MustDeleteIPPool(calicoClient, "10.0.0.0/24")
+			})
+
+			createPod := func(ip string) {
+				name = fmt.Sprintf("run%d", rand.Uint32())
+				ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: name,
+						Annotations: map[string]string{
+							"cni.projectcalico.org/ipAddrsNoIpam": fmt.Sprintf("[%q]", ip),
+						},
+					},
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{{
+							Name:  name,
+							Image: "ignore",
+						}},
+						NodeName: hostname,
+					},
+				})
+			}
+
+			It("should assign an address within a pool", func() {
+				createPod("10.0.0.1")
+
+				_, _, _, contAddresses, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contAddresses).To(HaveLen(1))
+				Expect(contAddresses[0].IPNet.String()).To(Equal("10.0.0.1/32"))
+
+				_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testutils.K8S_TEST_NS)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("should reject an address outside the pools", func() {
+				createPod("10.1.0.1")
+
+				_, _, _, _, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("IP 10.1.0.1 is not in any IP pool"))
+
+				endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(endpoints.Items).Should(HaveLen(0))
+
+				_, err = testutils.DeleteContainer(netconf, contNs.Path(), name, testutils.K8S_TEST_NS)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+		})
 	})
 
 	Context("using ipAddrs annotation to assign IP address to a pod from IPAM", func() {
@@ -2000,18 +3192,197 @@ var _ = Describe("Kubernetes CNI tests", func() {
 						InternalIP: podIPv6.String(),
 						ExternalIP: "2001:647f::21",
 					},
-				},
-				ContainerID:  containerID,
-				Orchestrator: api.OrchestratorKubernetes,
-			}))
+				},
+				ContainerID:  containerID,
+				Orchestrator: api.OrchestratorKubernetes,
+			}))
+
+			// Check the pod's IP annotations.
+			checkPodIPAnnotations(clientset, testutils.K8S_TEST_NS, name, podIPv4.String()+"/32", podIPv4.String()+"/32,"+podIPv6.String()+"/128")
+
+			// Delete the container.
+			_, err = testutils.DeleteContainer(netconfCalicoIPAM, netNS.Path(), name, testutils.K8S_TEST_NS)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		Context("using the ipAddrs annotation", func() {
+			netconfCalicoIPAM := fmt.Sprintf(`
+				{
+				  "cniVersion": "%s",
+				  "name": "net4",
+				  "type": "calico",
+				  "etcd_endpoints": "http://%s:2379",
+				  "datastore_type": "%s",
+				  "nodename_file_optional": true,
+				  "ipam": {"type": "calico-ipam"},
+				  "kubernetes": {"k8s_api_root": "http://127.0.0.1:8080"},
+				  "policy": {"type": "k8s"},
+				  "log_level": "info"
+				}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+			createPod := func(ipAddrs string) string {
+				name := fmt.Sprintf("run%d", rand.Uint32())
+				ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        name,
+						Annotations: map[string]string{"cni.projectcalico.org/ipAddrs": ipAddrs},
+					},
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{{
+							Name:  name,
+							Image: "ignore",
+						}},
+						NodeName: hostname,
+					},
+				})
+				return name
+			}
+
+			It("should assign both an annotated IPv4 and IPv6 address", func() {
+				name := createPod(`["20.0.0.111", "fd80:20::111"]`)
+				defer ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+
+				_, _, _, contAddresses, _, netNS, err := testutils.CreateContainer(netconfCalicoIPAM, name, testutils.K8S_TEST_NS, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contAddresses).To(HaveLen(2))
+				Expect(contAddresses[0].IP.String()).To(Equal("20.0.0.111"))
+				Expect(contAddresses[1].IP.String()).To(Equal("fd80:20::111"))
+
+				endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(endpoints.Items).Should(HaveLen(1))
+				Expect(endpoints.Items[0].Spec.IPNetworks).To(Equal([]string{"20.0.0.111/32", "fd80:20::111/128"}))
+
+				_, err = testutils.DeleteContainer(netconfCalicoIPAM, netNS.Path(), name, testutils.K8S_TEST_NS)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("should release the annotated IPv4 address if the IPv6 one can't be assigned", func() {
+				// The IPv6 address isn't in any pool, so assigning it fails after the IPv4 address is assigned.
+				name := createPod(`["20.0.0.112", "fd00:99::1"]`)
+				defer ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+
+				_, _, _, _, _, _, err := testutils.CreateContainer(netconfCalicoIPAM, name, testutils.K8S_TEST_NS, "")
+				Expect(err).To(HaveOccurred())
+
+				// The IPv4 address should be free to assign again.
+				handle := "ipaddrs-rollback-test"
+				err = calicoClient.IPAM().AssignIP(ctx, ipam.AssignIPArgs{
+					IP:       cnet.MustParseIP("20.0.0.112"),
+					HandleID: &handle,
+					Hostname: hostname,
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(calicoClient.IPAM().ReleaseByHandle(ctx, handle)).To(Succeed())
+			})
+		})
+	})
+
+	Context("with IPv6-only IP allocations", func() {
+		var clientset *kubernetes.Clientset
+		var ipPool6 string = "fd80:30::/96"
+
+		BeforeEach(func() {
+			// Set up clients.
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+			testutils.MustCreateNewIPPool(calicoClient, ipPool6, false, false, true)
+		})
+
+		AfterEach(func() {
+			testutils.MustDeleteIPPool(calicoClient, ipPool6)
+		})
+
+		DescribeTable("should program an IPv6 default route and no IPv4 routes",
+			func(gateway string) {
+				netconfCalicoIPAM := fmt.Sprintf(`
+				{
+				  "cniVersion": "%s",
+				  "name": "net6",
+				  "type": "calico",
+				  "etcd_endpoints": "http://%s:2379",
+				  "datastore_type": "%s",
+				  "nodename_file_optional": true,
+				  "ipv6_gateway": "%s",
+				  "ipam": {
+				    "type": "calico-ipam",
+				    "assign_ipv4": "false",
+				    "assign_ipv6": "true"
+				  },
+				  "kubernetes": {
+				    "k8s_api_root": "http://127.0.0.1:8080"
+				  },
+				  "policy": {"type": "k8s"},
+				  "log_level":"info"
+				}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), gateway)
+
+				name := fmt.Sprintf("run%d", rand.Uint32())
+				ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: name},
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{{
+							Name:  name,
+							Image: "ignore",
+						}},
+						NodeName: hostname,
+					},
+				})
+				defer ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
 
-			// Check the pod's IP annotations.
-			checkPodIPAnnotations(clientset, testutils.K8S_TEST_NS, name, podIPv4.String()+"/32", podIPv4.String()+"/32,"+podIPv6.String()+"/128")
+				_, result, contVeth, contAddresses, contRoutes, netNS, err := testutils.CreateContainer(netconfCalicoIPAM, name, testutils.K8S_TEST_NS, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.IPs).To(HaveLen(1))
+				Expect(result.IPs[0].Version).To(Equal("6"))
+				Expect(contAddresses).To(HaveLen(1))
+				Expect(contAddresses[0].IP.To4()).To(BeNil())
+
+				// There should be no IPv4 routes in the container.
+				Expect(contRoutes).To(BeEmpty())
+
+				// There should be a single IPv6 default route, via the configured gateway if there is one or
+				// otherwise via the link-local address of the host veth.
+				err = netNS.Do(func(_ ns.NetNS) error {
+					v6Routes, err := netlink.RouteList(contVeth, netlink.FAMILY_V6)
+					if err != nil {
+						return err
+					}
+					var defaultRoutes []netlink.Route
+					for _, r := range v6Routes {
+						if r.Dst == nil || r.Dst.String() == "::/0" {
+							defaultRoutes = append(defaultRoutes, r)
+						}
+					}
+					Expect(defaultRoutes).To(HaveLen(1))
+					Expect(defaultRoutes[0].Gw.IsLinkLocalUnicast()).To(BeTrue())
+					if gateway != "" {
+						Expect(defaultRoutes[0].Gw.String()).To(Equal(gateway))
+					}
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
 
-			// Delete the container.
-			_, err = testutils.DeleteContainer(netconfCalicoIPAM, netNS.Path(), name, testutils.K8S_TEST_NS)
-			Expect(err).ShouldNot(HaveOccurred())
-		})
+				if gateway != "" {
+					// The host side of the veth should have the gateway address so that it answers for it.
+					interfaceName := k8sconversion.NewConverter().VethNameForWorkload(testutils.K8S_TEST_NS, name)
+					hostVeth, err := netlink.LinkByName(interfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					hostAddrs, err := netlink.AddrList(hostVeth, netlink.FAMILY_V6)
+					Expect(err).NotTo(HaveOccurred())
+					var hostIPs []string
+					for _, a := range hostAddrs {
+						hostIPs = append(hostIPs, a.IP.String())
+					}
+					Expect(hostIPs).To(ContainElement(gateway))
+				}
+
+				_, err = testutils.DeleteContainer(netconfCalicoIPAM, netNS.Path(), name, testutils.K8S_TEST_NS)
+				Expect(err).ShouldNot(HaveOccurred())
+			},
+			Entry("via the host veth's link-local address by default", ""),
+			Entry("via a configured gateway", "fe80::1"),
+		)
 	})
 
 	// This context contains test cases meant to simulate specific scenarios seen when running the plugin
@@ -2182,6 +3553,50 @@ var _ = Describe("Kubernetes CNI tests", func() {
 			Expect(exitCode).Should(Equal(0))
 		})
 
+		// As above, but checks that the spurious DEL for containerIDX leaves the IPAM allocations alone, as well as
+		// the endpoint, so that it can't release an IP that the running container is using.
+		It("should not release IPs on a spurious DEL for an old container ID", func() {
+			_, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, name, testutils.K8S_TEST_NS, "", cniContainerIDX)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), name, testutils.K8S_TEST_NS, cniContainerIDX)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, result, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, name, testutils.K8S_TEST_NS, "", cniContainerIDY)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+
+			// Give the pod an IP under its legacy workload ID handle too, as after an upgrade from v2.x. That handle
+			// isn't keyed on the container ID, and DEL releases it as well.
+			legacyHandle := fmt.Sprintf("%s.%s", testutils.K8S_TEST_NS, name)
+			err = calicoClient.IPAM().AssignIP(ctx, ipam.AssignIPArgs{
+				IP:       cnet.MustParseIP("10.0.0.250"),
+				HandleID: &legacyHandle,
+				Hostname: hostname,
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// The spurious DEL for container X.
+			exitCode, err := testutils.DeleteContainerWithId(netconf, contNs.Path(), name, testutils.K8S_TEST_NS, cniContainerIDX)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).Should(Equal(0))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+			ips, err := calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("calico-uts", cniContainerIDY, ""))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+			Expect(ips[0].String()).To(Equal(result.IPs[0].Address.IP.String()))
+			ips, err = calicoClient.IPAM().IPsByHandle(ctx, legacyHandle)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), name, testutils.K8S_TEST_NS, cniContainerIDY)
+			Expect(err).ShouldNot(HaveOccurred())
+			ips, err = calicoClient.IPAM().IPsByHandle(ctx, legacyHandle)
+			Expect(err).Should(HaveOccurred(), fmt.Sprintf("unexpected IPs left on the legacy handle: %v", ips))
+		})
+
 		// Specifically, this test simulartes the following:
 		// - CNI ADD using containerIDX
 		// - CNI ADD using containerIDY
@@ -2400,6 +3815,146 @@ var _ = Describe("Kubernetes CNI tests", func() {
 			checkIPAMReservation()
 		})
 
+		It("with pod_reuse_ip, a second ADD for a different container should inherit the IP", func() {
+			nc.PodReuseIP = true
+			ncb, err := json.Marshal(nc)
+			Expect(err).NotTo(HaveOccurred())
+			reuseNetconf := string(ncb)
+
+			resultSecondAdd, _, _, _, err := testutils.RunCNIPluginWithId(reuseNetconf, name, testutils.K8S_TEST_NS, "", "new-container-id", "eth0", contNs)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resultSecondAdd.IPs).To(HaveLen(1))
+			Expect(resultSecondAdd.IPs[0].Address).To(Equal(result.IPs[0].Address))
+
+			// The IP should have moved to the new container's handle.
+			ips, err := calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("calico-uts", "new-container-id", workloadName))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+			Expect(ips[0].String()).To(Equal(result.IPs[0].Address.IP.String()))
+			ips, err = calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("calico-uts", containerID, workloadName))
+			Expect(err).To(BeAssignableToTypeOf(cerrors.ErrorResourceDoesNotExist{}), fmt.Sprintf("unexpected IPs left on the old handle: %v", ips))
+
+			// A late DEL for the old container mustn't take the IP away from the new one.
+			_, err = testutils.DeleteContainerWithId(reuseNetconf, "", name, testutils.K8S_TEST_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			ips, err = calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("calico-uts", "new-container-id", workloadName))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+
+			_, err = testutils.DeleteContainerWithId(reuseNetconf, contNs.Path(), name, testutils.K8S_TEST_NS, "new-container-id")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		Context("with a CNI CHECK", func() {
+			var checkNetconf string
+
+			BeforeEach(func() {
+				// CHECK was added in version 0.4.0 of the spec.
+				checkNC := nc
+				checkNC.CNIVersion = "0.4.0"
+				ncb, err := json.Marshal(checkNC)
+				Expect(err).NotTo(HaveOccurred())
+				checkNetconf = string(ncb)
+			})
+
+			It("should pass while the networking is intact", func() {
+				exitCode, err := testutils.CheckContainerWithId(checkNetconf, contNs.Path(), name, testutils.K8S_TEST_NS, containerID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exitCode).To(Equal(0))
+			})
+
+			It("should fail if a host veth sysctl has drifted", func() {
+				path := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", endpointSpec.InterfaceName)
+				Expect(ioutil.WriteFile(path, []byte("0"), 0644)).To(Succeed())
+
+				exitCode, err := testutils.CheckContainerWithId(checkNetconf, contNs.Path(), name, testutils.K8S_TEST_NS, containerID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exitCode).NotTo(Equal(0))
+			})
+
+			It("should fail if the container interface has lost its IP", func() {
+				err := contNs.Do(func(_ ns.NetNS) error {
+					link, err := netlink.LinkByName("eth0")
+					if err != nil {
+						return err
+					}
+					addr, err := netlink.ParseAddr(endpointSpec.IPNetworks[0])
+					if err != nil {
+						return err
+					}
+					return netlink.AddrDel(link, addr)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				exitCode, err := testutils.CheckContainerWithId(checkNetconf, contNs.Path(), name, testutils.K8S_TEST_NS, containerID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exitCode).NotTo(Equal(0))
+			})
+		})
+
+		It("a DEL without a netns should still release the IP and delete the endpoint", func() {
+			exitCode, err := testutils.DeleteContainerWithId(netconf, "", name, testutils.K8S_TEST_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			if os.Getenv("DATASTORE_TYPE") != "kubernetes" {
+				endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(endpoints.Items).To(HaveLen(0))
+			}
+
+			// Releasing the last IP deletes the handle.
+			ips, err := calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("calico-uts", containerID, workloadName))
+			Expect(err).To(BeAssignableToTypeOf(cerrors.ErrorResourceDoesNotExist{}), fmt.Sprintf("unexpected IPs left assigned: %v", ips))
+		})
+
+		It("a second ADD for the same container should preserve the assignedAt annotation", func() {
+			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
+				Skip("WorkloadEndpoint annotations aren't stored with the Kubernetes datastore")
+			}
+			wep, err := calicoClient.WorkloadEndpoints().Get(ctx, testutils.K8S_TEST_NS, workloadName, options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			assignedAt := wep.Annotations[utils.AssignedAtAnnotation]
+			_, err = time.Parse(time.RFC3339, assignedAt)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// Make sure a reset would produce a different timestamp.
+			time.Sleep(time.Second)
+			_, _, _, _, err = testutils.RunCNIPluginWithId(netconf, name, testutils.K8S_TEST_NS, "", containerID, "eth0", contNs)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			wep, err = calicoClient.WorkloadEndpoints().Get(ctx, testutils.K8S_TEST_NS, workloadName, options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(wep.Annotations).To(HaveKeyWithValue(utils.AssignedAtAnnotation, assignedAt))
+		})
+
+		It("a second ADD should repair an endpoint with the wrong interface name", func() {
+			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
+				Skip("The Kubernetes datastore derives the interface name rather than storing it")
+			}
+			// Rename the veth and record the new name on the endpoint, as if it had been named differently.
+			realVethName := endpointSpec.InterfaceName
+			staleVethName := strings.Replace(realVethName, "cali", "sali", 1)
+			output, err := exec.Command("ip", "link", "set", realVethName, "name", staleVethName).CombinedOutput()
+			Expect(err).NotTo(HaveOccurred(), fmt.Sprintf("Output: %s", output))
+			wep, err := calicoClient.WorkloadEndpoints().Get(ctx, testutils.K8S_TEST_NS, workloadName, options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			wep.Spec.InterfaceName = staleVethName
+			_, err = calicoClient.WorkloadEndpoints().Update(ctx, wep, options.SetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, _, _, _, err = testutils.RunCNIPluginWithId(netconf, name, testutils.K8S_TEST_NS, "", containerID, "eth0", contNs)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			wep, err = calicoClient.WorkloadEndpoints().Get(ctx, testutils.K8S_TEST_NS, workloadName, options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(wep.Spec.InterfaceName).To(Equal(realVethName))
+			_, err = netlink.LinkByName(realVethName)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = netlink.LinkByName(staleVethName)
+			Expect(err).Should(HaveOccurred())
+		})
+
 		Context("with networking rigged to fail", func() {
 			renameVeth := func(from, to string) {
 				output, err := exec.Command("ip", "link", "set", from, "down").CombinedOutput()
@@ -2456,7 +4011,7 @@ var _ = Describe("Kubernetes CNI tests", func() {
 				  "policy": {"type": "k8s"}
 				}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
 
-		It("should successfully execute both ADDs but for second ADD will return the same result as the first time but it won't network the container", func() {
+		It("should fail the second ADD, and keep the first endpoint", func() {
 			// Create a new ipPool.
 			testutils.MustCreateNewIPPool(calicoClient, "10.0.0.0/24", false, false, true)
 
@@ -2489,9 +4044,8 @@ var _ = Describe("Kubernetes CNI tests", func() {
 			containerID, result, _, _, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
 			Expect(err).ShouldNot(HaveOccurred())
 			// Make sure the pod gets cleaned up, whether we fail or not.
-			expectedIfaceName := "eth0"
 			defer func() {
-				_, err := testutils.DeleteContainerWithIdAndIfaceName(netconf, contNs.Path(), name, testutils.K8S_TEST_NS, containerID, expectedIfaceName)
+				_, err := testutils.DeleteContainerWithIdAndIfaceName(netconf, contNs.Path(), name, testutils.K8S_TEST_NS, containerID, "eth0")
 				Expect(err).ShouldNot(HaveOccurred())
 
 				ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
@@ -2527,30 +4081,17 @@ var _ = Describe("Kubernetes CNI tests", func() {
 			}
 
 			// Try to create the same container but with a different endpoint (container interface name 'eth1'),
-			// so CNI receives the ADD for the same containerID but different endpoint.
+			// so CNI receives the ADD for the same containerID but different endpoint. Only one endpoint is
+			// allowed by default, so it should fail rather than quietly reuse the eth0 endpoint.
 			_, _, _, _, err = testutils.RunCNIPluginWithId(netconf, name, testutils.K8S_TEST_NS, "", containerID, "eth1", contNs)
-			Expect(err).ShouldNot(HaveOccurred())
-
-			// If the above command succeeds, the CNI plugin will have renamed the container side of the
-			// veth to "eth1".  We need to clean it up under the correct name, or we'll leak it.
-			expectedIfaceName = "eth1"
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("allow_multiple_endpoints"))
 
-			// The endpoint is created in etcd
+			// The original endpoint is untouched.
 			endpoints, err = calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(endpoints.Items).Should(HaveLen(1))
-
-			// Returned endpoint should still have the same fields even after calling the CNI plugin with a different interface name.
-			// Calico CNI currently only supports one endpoint (interface) per pod.
 			Expect(endpoints.Items[0].Name).Should(Equal(wepName))
-			Expect(endpoints.Items[0].Namespace).Should(Equal(testutils.K8S_TEST_NS))
-			Expect(endpoints.Items[0].Labels).Should(Equal(map[string]string{
-				"projectcalico.org/namespace":      "test",
-				"projectcalico.org/orchestrator":   api.OrchestratorKubernetes,
-				"projectcalico.org/serviceaccount": "default",
-			}))
-
-			// Explicitly assert that endpoint name is still 'eth0' (which was the case from the first ADD)
 			Expect(endpoints.Items[0].Spec.Endpoint).Should(Equal("eth0"))
 			if os.Getenv("DATASTORE_TYPE") != "kubernetes" {
 				Expect(endpoints.Items[0].Spec.ContainerID).Should(Equal(containerID))
@@ -2638,6 +4179,229 @@ var _ = Describe("Kubernetes CNI tests", func() {
 		})
 	})
 
+	Context("with allow_multiple_endpoints", func() {
+		netconf := fmt.Sprintf(`
+				{
+				  "cniVersion": "%s",
+				  "name": "net10",
+				  "type": "calico",
+				  "etcd_endpoints": "http://%s:2379",
+				  "datastore_type": "%s",
+				  "nodename_file_optional": true,
+				  "log_level": "info",
+				  "allow_multiple_endpoints": true,
+				  "ipam": {
+				    "type": "calico-ipam"
+				  },
+				  "kubernetes": {
+				    "k8s_api_root": "http://127.0.0.1:8080"
+				  },
+				  "policy": {"type": "k8s"}
+				}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("gives a second interface its own veth and WorkloadEndpoint", func() {
+			testutils.MustCreateNewIPPool(calicoClient, "10.0.0.0/24", false, false, true)
+
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err := kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			name := "multi-ep"
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{Name: name, Image: "ignore"}},
+					NodeName:   hostname,
+				},
+			})
+			defer ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+
+			containerID, _, _, _, _, contNs, err := testutils.CreateContainer(netconf, name, testutils.K8S_TEST_NS, "")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer func() {
+				_, err := testutils.DeleteContainerWithIdAndIfaceName(netconf, contNs.Path(), name, testutils.K8S_TEST_NS, containerID, "eth0")
+				Expect(err).ShouldNot(HaveOccurred())
+			}()
+
+			_, _, _, _, err = testutils.RunCNIPluginWithId(netconf, name, testutils.K8S_TEST_NS, "", containerID, "eth1", contNs)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(2))
+			weps := map[string]api.WorkloadEndpoint{}
+			for _, ep := range endpoints.Items {
+				weps[ep.Spec.Endpoint] = ep
+			}
+			Expect(weps).To(HaveKey("eth0"))
+			Expect(weps).To(HaveKey("eth1"))
+			Expect(weps["eth1"].Spec.InterfaceName).NotTo(Equal(weps["eth0"].Spec.InterfaceName))
+			Expect(weps["eth1"].Spec.IPNetworks).To(HaveLen(1))
+			Expect(weps["eth1"].Spec.IPNetworks).NotTo(Equal(weps["eth0"].Spec.IPNetworks))
+
+			// Both host veths exist.
+			for _, ep := range weps {
+				_, err = netlink.LinkByName(ep.Spec.InterfaceName)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			// Deleting the second interface leaves the first one alone.
+			_, err = testutils.DeleteContainerWithIdAndIfaceName(netconf, contNs.Path(), name, testutils.K8S_TEST_NS, containerID, "eth1")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			endpoints, err = calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+			Expect(endpoints.Items[0].Spec.Endpoint).To(Equal("eth0"))
+			Expect(endpoints.Items[0].Spec.IPNetworks).To(Equal(weps["eth0"].Spec.IPNetworks))
+			_, err = netlink.LinkByName(weps["eth0"].Spec.InterfaceName)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName(weps["eth1"].Spec.InterfaceName)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with additional networks", func() {
+		var clientset *kubernetes.Clientset
+		var name string
+		netconf := fmt.Sprintf(`
+				{
+				  "cniVersion": "%s",
+				  "name": "net11",
+				  "type": "calico",
+				  "etcd_endpoints": "http://%s:2379",
+				  "datastore_type": "%s",
+				  "nodename_file_optional": true,
+				  "log_level": "info",
+				  "feature_control": {
+				    "additional_networks": true
+				  },
+				  "ipam": {
+				    "type": "calico-ipam"
+				  },
+				  "additional_networks": [
+				    {
+				      "name": "mgmt",
+				      "ipam": {
+				        "type": "host-local",
+				        "subnet": "192.168.100.0/24"
+				      }
+				    }
+				  ],
+				  "kubernetes": {
+				    "k8s_api_root": "http://127.0.0.1:8080"
+				  },
+				  "policy": {"type": "k8s"}
+				}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		BeforeEach(func() {
+			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
+				Skip("additional_networks is not supported with the Kubernetes datastore")
+			}
+			testutils.MustCreateNewIPPool(calicoClient, "10.0.0.0/24", false, false, true)
+
+			config, err := clientcmd.DefaultClientConfig.ClientConfig()
+			Expect(err).NotTo(HaveOccurred())
+			clientset, err = kubernetes.NewForConfig(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			name = fmt.Sprintf("pod-%d", rand.Uint32())
+			ensurePodCreated(clientset, testutils.K8S_TEST_NS, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{Name: name, Image: "ignore"}},
+					NodeName:   hostname,
+				},
+			})
+		})
+
+		AfterEach(func() {
+			if os.Getenv("DATASTORE_TYPE") == "kubernetes" {
+				return
+			}
+			ensurePodDeleted(clientset, testutils.K8S_TEST_NS, name)
+			testutils.MustDeleteIPPool(calicoClient, "10.0.0.0/24")
+		})
+
+		// endpointsByInterface returns the pod's WorkloadEndpoints, keyed by their container interface.
+		endpointsByInterface := func() map[string]api.WorkloadEndpoint {
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			weps := map[string]api.WorkloadEndpoint{}
+			for _, ep := range endpoints.Items {
+				weps[ep.Spec.Endpoint] = ep
+			}
+			return weps
+		}
+
+		It("updates the additional endpoints when the pod's sandbox is recreated", func() {
+			_, _, _, _, _, _, err := testutils.CreateContainerWithId(netconf, name, testutils.K8S_TEST_NS, "", "container-id-00x")
+			Expect(err).ShouldNot(HaveOccurred())
+			before := endpointsByInterface()
+			Expect(before).To(HaveLen(2))
+			Expect(before["net1"].Spec.ContainerID).To(Equal("container-id-00x"))
+
+			// ADD for a new sandbox of the same pod.
+			_, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, name, testutils.K8S_TEST_NS, "", "container-id-00y")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer func() {
+				_, err := testutils.DeleteContainerWithId(netconf, contNs.Path(), name, testutils.K8S_TEST_NS, "container-id-00y")
+				Expect(err).ShouldNot(HaveOccurred())
+			}()
+
+			after := endpointsByInterface()
+			Expect(after).To(HaveLen(2))
+			for _, ep := range after {
+				Expect(ep.Spec.ContainerID).To(Equal("container-id-00y"))
+			}
+			Expect(after["net1"].Name).To(Equal(before["net1"].Name))
+			Expect(after["net1"].Spec.InterfaceName).NotTo(Equal(after["eth0"].Spec.InterfaceName))
+			Expect(after["net1"].Spec.IPNetworks).To(HaveLen(1))
+			Expect(after["net1"].Spec.IPNetworks[0]).To(HavePrefix("192.168.100."))
+
+			_, err = netlink.LinkByName(after["net1"].Spec.InterfaceName)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = contNs.Do(func(_ ns.NetNS) error {
+				_, err := netlink.LinkByName("net1")
+				return err
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("leaves the additional endpoints alone on a DEL for a stale container ID", func() {
+			_, _, _, _, _, contNsX, err := testutils.CreateContainerWithId(netconf, name, testutils.K8S_TEST_NS, "", "container-id-00x")
+			Expect(err).ShouldNot(HaveOccurred())
+			_, _, _, _, _, contNsY, err := testutils.CreateContainerWithId(netconf, name, testutils.K8S_TEST_NS, "", "container-id-00y")
+			Expect(err).ShouldNot(HaveOccurred())
+			weps := endpointsByInterface()
+			Expect(weps).To(HaveLen(2))
+
+			// DEL for the old sandbox.
+			exitCode, err := testutils.DeleteContainerWithId(netconf, contNsX.Path(), name, testutils.K8S_TEST_NS, "container-id-00x")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			// Both endpoints, and the additional network's interfaces, still belong to the new sandbox.
+			Expect(endpointsByInterface()).To(Equal(weps))
+			_, err = netlink.LinkByName(weps["net1"].Spec.InterfaceName)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = contNsY.Do(func(_ ns.NetNS) error {
+				_, err := netlink.LinkByName("net1")
+				return err
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// DEL for the running sandbox removes everything.
+			exitCode, err = testutils.DeleteContainerWithId(netconf, contNsY.Path(), name, testutils.K8S_TEST_NS, "container-id-00y")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+			Expect(endpointsByInterface()).To(BeEmpty())
+			_, err = netlink.LinkByName(weps["net1"].Spec.InterfaceName)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
 	Context("when pod has a service account", func() {
 		var nc types.NetConf
 		var netconf string
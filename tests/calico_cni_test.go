@@ -4,18 +4,24 @@ package main_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/plugins/pkg/ns"
+	cnitestutils "github.com/containernetworking/plugins/pkg/testutils"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
@@ -25,8 +31,10 @@ import (
 	grpc_dataplane "github.com/projectcalico/cni-plugin/pkg/dataplane/grpc"
 	"github.com/projectcalico/cni-plugin/pkg/dataplane/grpc/proto"
 	"github.com/projectcalico/cni-plugin/pkg/dataplane/linux"
+	"github.com/projectcalico/cni-plugin/pkg/types"
 	api "github.com/projectcalico/libcalico-go/lib/apis/v3"
 	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
 	"github.com/projectcalico/libcalico-go/lib/names"
 	"github.com/projectcalico/libcalico-go/lib/options"
 )
@@ -95,7 +103,6 @@ var _ = Describe("CalicoCni", func() {
 			profile, err := calicoClient.Profiles().Get(ctx, "net1", options.GetOptions{})
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(profile.Spec.LabelsToApply).Should(Equal(map[string]string{"net1": ""}))
-			Expect(profile.Spec.Egress).Should(Equal([]api.Rule{{Action: "Allow"}}))
 			Expect(profile.Spec.Ingress).Should(Equal([]api.Rule{{Action: "Allow", Source: api.EntityRule{Selector: "has(net1)"}}}))
 
 			// The endpoint is created in etcd
@@ -224,6 +231,25 @@ var _ = Describe("CalicoCni", func() {
 				_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
 				Expect(err).ShouldNot(HaveOccurred())
 			})
+
+			It("replaces a hostVeth whose peer is gone", func() {
+				containerID := fmt.Sprintf("con%08x", rand.Uint32())
+				err := testutils.CreateOrphanedHostVeth(containerID, "", "", hostname)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				_, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", containerID)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				hostVeth, err := netlink.LinkByName("cali" + containerID)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(hostVeth.Type()).To(Equal("veth"))
+				Expect(hostVeth.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+
+				_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = netlink.LinkByName("cali" + containerID)
+				Expect(err).Should(HaveOccurred())
+			})
 		})
 
 		Context("when ready flag is false", func() {
@@ -318,6 +344,154 @@ var _ = Describe("CalicoCni", func() {
 		})
 	})
 
+	Context("With proxy ARP and host forwarding turned off", func() {
+		netconf := fmt.Sprintf(`
+			{
+			  "cniVersion": "%s",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "log_level": "info",
+			  "nodename_file_optional": true,
+			  "datastore_type": "%s",
+			  "proxy_arp": false,
+			  "host_forwarding": false,
+			  "ipam": {
+			    "type": "host-local",
+			    "subnet": "10.0.0.0/8"
+			  }
+			}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("should leave the host veth's sysctls at their defaults", func() {
+			// A new interface takes its settings from the "default" entries.
+			defaults := map[string]string{}
+			for _, path := range []string{
+				"/proc/sys/net/ipv4/conf/%s/proxy_arp",
+				"/proc/sys/net/ipv4/neigh/%s/proxy_delay",
+				"/proc/sys/net/ipv4/conf/%s/forwarding",
+			} {
+				value, err := ioutil.ReadFile(fmt.Sprintf(path, "default"))
+				Expect(err).ShouldNot(HaveOccurred())
+				defaults[path] = strings.TrimSpace(string(value))
+			}
+
+			containerID := fmt.Sprintf("con%d", rand.Uint32())
+			_, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			hostVethName := "cali" + containerID[:utils.Min(11, len(containerID))]
+			for path, value := range defaults {
+				Expect(testutils.CheckSysctlValue(fmt.Sprintf(path, hostVethName), value)).To(Succeed())
+			}
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("With a default route metric", func() {
+		netconf := fmt.Sprintf(`
+			{
+			  "cniVersion": "%s",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "log_level": "info",
+			  "nodename_file_optional": true,
+			  "datastore_type": "%s",
+			  "default_route_metric": 150,
+			  "ipam": {
+			    "type": "host-local",
+			    "subnet": "10.0.0.0/8"
+			  }
+			}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("installs the default route with the configured metric", func() {
+			containerID := fmt.Sprintf("con%d", rand.Uint32())
+			_, _, contVeth, _, contRoutes, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(contRoutes).Should(ContainElement(netlink.Route{
+				LinkIndex: contVeth.Attrs().Index,
+				Gw:        net.IPv4(169, 254, 1, 1).To4(),
+				Protocol:  syscall.RTPROT_BOOT,
+				Table:     syscall.RT_TABLE_MAIN,
+				Type:      syscall.RTN_UNICAST,
+				Priority:  150,
+			}))
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("rejects a negative metric", func() {
+			invalid := strings.Replace(netconf, `"default_route_metric": 150`, `"default_route_metric": -1`, 1)
+			containerNs, containerID, err := testutils.CreateContainerNamespace()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, _, _, _, err = testutils.RunCNIPluginWithId(invalid, "", testutils.TEST_DEFAULT_NS, "", containerID, "", containerNs)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("With container_settings routes", func() {
+		netconf := fmt.Sprintf(`
+			{
+			  "cniVersion": "%s",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "log_level": "info",
+			  "nodename_file_optional": true,
+			  "datastore_type": "%s",
+			  "container_settings": {
+			    "routes": [
+			      {"dst": "0.0.0.0/0"},
+			      {"dst": "192.168.0.0/16", "gw": "169.254.1.2"}
+			    ]
+			  },
+			  "ipam": {
+			    "type": "host-local",
+			    "subnet": "10.0.0.0/8"
+			  }
+			}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("adds the routes to the container, other than any that duplicate the default route", func() {
+			containerID := fmt.Sprintf("con%d", rand.Uint32())
+			_, _, contVeth, _, contRoutes, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(contRoutes).Should(ContainElement(netlink.Route{
+				LinkIndex: contVeth.Attrs().Index,
+				Dst:       &net.IPNet{IP: net.IPv4(192, 168, 0, 0).To4(), Mask: net.CIDRMask(16, 32)},
+				Gw:        net.IPv4(169, 254, 1, 2).To4(),
+				Flags:     int(netlink.FLAG_ONLINK),
+				Protocol:  syscall.RTPROT_BOOT,
+				Table:     syscall.RT_TABLE_MAIN,
+				Type:      syscall.RTN_UNICAST,
+			}))
+			var defaultRoutes int
+			for _, r := range contRoutes {
+				if r.Dst == nil {
+					defaultRoutes++
+				}
+			}
+			Expect(defaultRoutes).To(Equal(1))
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("rejects a route that isn't a CIDR", func() {
+			invalid := strings.Replace(netconf, `"dst": "192.168.0.0/16"`, `"dst": "192.168.0.1"`, 1)
+			containerNs, containerID, err := testutils.CreateContainerNamespace()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, _, _, _, err = testutils.RunCNIPluginWithId(invalid, "", testutils.TEST_DEFAULT_NS, "", containerID, "", containerNs)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
 	Context("With an invalid dataplane type", func() {
 		netconf := fmt.Sprintf(`
 			{
@@ -621,6 +795,47 @@ var _ = Describe("CalicoCni", func() {
 			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
 			Expect(err).ShouldNot(HaveOccurred())
 		})
+
+		It("fails on a label with nothing valid in it", func() {
+			netconf := fmt.Sprintf(`
+			{
+			  "cniVersion": "%s",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "hostname": "named-hostname.somewhere",
+		          "nodename_file_optional": true,
+			  "ipam": {
+				"type": "host-local",
+				"subnet": "10.0.0.0/8"
+			  },
+			  "args": {
+				"org.apache.mesos": {
+				  "network_info": {
+					"labels": {
+					  "labels": [
+						{
+						  "key": "k",
+						  "value": "///"
+						}
+					  ]
+					}
+				  }
+				}
+			  }
+			}`, cniVersion, os.Getenv("ETCD_IP"))
+			containerID, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "abcd1234")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring(`mesos label "///" has no characters that are valid in a Calico label`))
+
+			// Nothing is left behind.
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(0))
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
 	})
 
 	Context("feature flag processing", func() {
@@ -651,6 +866,139 @@ var _ = Describe("CalicoCni", func() {
 		})
 	})
 
+	Context("with additional networks", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "log_level": "info",
+		  "nodename_file_optional": true,
+		  "datastore_type": "%s",
+		  "feature_control": {
+		    "additional_networks": true
+		  },
+		  "ipam": {
+		    "type": "host-local",
+		    "subnet": "10.0.0.0/8"
+		  },
+		  "additional_networks": [
+		    {
+		      "name": "mgmt",
+		      "ipam": {
+		        "type": "host-local",
+		        "subnet": "192.168.100.0/24"
+		      }
+		    }
+		  ]
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("creates an interface and endpoint per network on ADD and removes them on DEL", func() {
+			containerID, result, contVeth, _, contRoutes, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "abc456")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// The result only describes the primary interface.
+			Expect(result.IPs).Should(HaveLen(1))
+			Expect(result.IPs[0].Address.IP.String()).Should(HavePrefix("10."))
+
+			// The default route stays on the primary interface.
+			Expect(contRoutes).Should(ContainElement(netlink.Route{
+				LinkIndex: contVeth.Attrs().Index,
+				Gw:        net.IPv4(169, 254, 1, 1).To4(),
+				Protocol:  syscall.RTPROT_BOOT,
+				Table:     syscall.RT_TABLE_MAIN,
+				Type:      syscall.RTN_UNICAST,
+			}))
+
+			// There's an endpoint for each network.
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(2))
+
+			ids := names.WorkloadEndpointIdentifiers{
+				Node:         hostname,
+				Orchestrator: "cni",
+				Endpoint:     "net1",
+				ContainerID:  containerID,
+			}
+			wrkload, err := ids.CalculateWorkloadEndpointName(false)
+			Expect(err).NotTo(HaveOccurred())
+
+			wep, err := calicoClient.WorkloadEndpoints().Get(ctx, testutils.TEST_DEFAULT_NS, wrkload, options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(wep.Spec.Endpoint).Should(Equal("net1"))
+			Expect(wep.Spec.Profiles).Should(Equal([]string{"mgmt"}))
+			Expect(wep.Spec.IPNetworks).Should(HaveLen(1))
+			Expect(wep.Spec.IPNetworks[0]).Should(HavePrefix("192.168.100."))
+			Expect(wep.Spec.InterfaceName).ShouldNot(Equal(fmt.Sprintf("cali%s", containerID)))
+
+			// The profile for the additional network is created.
+			profile, err := calicoClient.Profiles().Get(ctx, "mgmt", options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(profile.Spec.LabelsToApply).Should(Equal(map[string]string{"mgmt": ""}))
+
+			// The host and container sides of the additional interface exist.
+			_, err = netlink.LinkByName(wep.Spec.InterfaceName)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = contNs.Do(func(_ ns.NetNS) error {
+				_, err := netlink.LinkByName("net1")
+				return err
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// Both endpoints and both interfaces are gone.
+			endpoints, err = calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(0))
+
+			_, err = netlink.LinkByName(wep.Spec.InterfaceName)
+			Expect(err).Should(HaveOccurred())
+			err = contNs.Do(func(_ ns.NetNS) error {
+				_, err := netlink.LinkByName("net1")
+				return err
+			})
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("errors if the feature is not enabled", func() {
+			disabled := strings.Replace(netconf, `"additional_networks": true`, `"additional_networks": false`, 1)
+
+			containerNs, containerId, err := testutils.CreateContainerNamespace()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, _, _, _, err = testutils.RunCNIPluginWithId(disabled, "", testutils.TEST_DEFAULT_NS, "", containerId, "", containerNs)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("VERSION", func() {
+		It("reports the supported CNI spec versions", func() {
+			cmd := exec.Command(fmt.Sprintf("%s/%s", os.Getenv("BIN"), os.Getenv("PLUGIN")))
+			cmd.Env = []string{"CNI_COMMAND=VERSION"}
+			out, err := cmd.Output()
+			Expect(err).ShouldNot(HaveOccurred())
+			var info map[string]interface{}
+			Expect(json.Unmarshal(out, &info)).To(Succeed())
+			Expect(info).To(HaveKeyWithValue("cniVersion", "0.4.0"))
+			Expect(info).To(HaveKeyWithValue("supportedVersions", ConsistOf("0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0")))
+			Expect(info).To(HaveKey("calicoVersion"))
+			Expect(info).To(HaveKey("gitCommit"))
+			Expect(info).To(HaveKey("cniLibraryVersion"))
+			Expect(info).To(HaveKey("goVersion"))
+		})
+
+		It("prints only the version to stdout for -v", func() {
+			cmd := exec.Command(fmt.Sprintf("%s/%s", os.Getenv("BIN"), os.Getenv("PLUGIN")), "-v")
+			out, err := cmd.Output()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(strings.Count(strings.TrimSpace(string(out)), "\n")).To(BeZero())
+		})
+	})
+
 	Describe("DEL", func() {
 		netconf := fmt.Sprintf(`
 		{
@@ -666,6 +1014,49 @@ var _ = Describe("CalicoCni", func() {
 			}
 		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
 
+		Context("with a dual-stack container", func() {
+			dualStack := fmt.Sprintf(`
+			{
+				"cniVersion": "%s",
+				"name": "net1",
+				"type": "calico",
+				"etcd_endpoints": "http://%s:2379",
+				"nodename_file_optional": true,
+				"datastore_type": "%s",
+				"ipam": {
+					"type": "host-local",
+					"ranges": [
+						[{"subnet": "10.0.0.0/8"}],
+						[{"subnet": "fd80:24e2:f998:72d6::/64"}]
+					]
+				}
+			}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+			It("leaves no address of either family in the namespace", func() {
+				containerID, result, _, _, _, contNs, err := testutils.CreateContainer(dualStack, "", testutils.TEST_DEFAULT_NS, "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(result.IPs).To(HaveLen(2))
+
+				exitCode, err := testutils.DeleteContainerWithId(dualStack, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(exitCode).To(Equal(0))
+
+				err = contNs.Do(func(_ ns.NetNS) error {
+					defer GinkgoRecover()
+					_, err := netlink.LinkByName("eth0")
+					Expect(err).Should(HaveOccurred())
+
+					addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+					Expect(err).ShouldNot(HaveOccurred())
+					for _, addr := range addrs {
+						Expect(addr.IP.IsGlobalUnicast()).To(BeFalse(), fmt.Sprintf("%s was left behind", addr.IPNet))
+					}
+					return nil
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+		})
+
 		Context("when it was never called for SetUP", func() {
 			Context("and a namespace does exist", func() {
 				It("exits with 'success' error code", func() {
@@ -687,20 +1078,786 @@ var _ = Describe("CalicoCni", func() {
 		})
 	})
 
-	Describe("with calico-ipam enabled, after creating a container", func() {
+	Describe("chained after another plugin", func() {
 		netconf := fmt.Sprintf(`
 		{
 		  "cniVersion": "%s",
 		  "name": "net1",
 		  "type": "calico",
 		  "etcd_endpoints": "http://%s:2379",
+		  "nodename_file_optional": true,
 		  "datastore_type": "%s",
-		  "log_level": "info",
-	          "nodename_file_optional": true,
-		  "ipam": { "type": "calico-ipam" }
-		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+		  "ipam": {
+		    "type": "host-local",
+		    "subnet": "10.0.0.0/8"
+		  },
+		  "prevResult": {
+		    "cniVersion": "%s",
+		    "interfaces": [{"name": "tuning0"}],
+		    "ips": [{"version": "4", "address": "172.31.0.2/24", "interface": 0}],
+		    "routes": [{"dst": "172.31.0.0/16"}]
+		  }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), cniVersion)
 
-		var containerID string
+		It("passes on the previous plugin's result along with its own", func() {
+			containerID, result, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "chained1")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(result.Interfaces[0].Name).To(Equal("tuning0"))
+			Expect(result.IPs).To(HaveLen(2))
+			Expect(result.IPs[0].Address.String()).To(Equal("172.31.0.2/24"))
+			Expect(result.IPs[1].Address.IP.To4()).NotTo(BeNil())
+			Expect(result.Routes[0].Dst.String()).To(Equal("172.31.0.0/16"))
+
+			// Only Calico's own IP goes on the endpoint.
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(1))
+			Expect(endpoints.Items[0].Spec.IPNetworks).To(Equal([]string{result.IPs[1].Address.IP.String() + "/32"}))
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("with the hash veth_name_style", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "nodename_file_optional": true,
+		  "datastore_type": "%s",
+		  "veth_name_style": "hash",
+		  "ipam": {
+		    "type": "host-local",
+		    "subnet": "10.0.0.0/8"
+		  }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("networks two containers whose IDs share their first 11 characters", func() {
+			var hostVeths []string
+			for _, containerID := range []string{"sharedprefix-1", "sharedprefix-2"} {
+				_, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", containerID)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer func(containerID string, contNs ns.NetNS) {
+					_, err := testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+					Expect(err).ShouldNot(HaveOccurred())
+				}(containerID, contNs)
+
+				ids := &utils.WEPIdentifiers{}
+				ids.Orchestrator = api.OrchestratorCNI
+				ids.ContainerID = containerID
+				hostVeths = append(hostVeths, utils.HostVethName(types.NetConf{VethNameStyle: utils.VethNameStyleHash}, ids))
+			}
+			Expect(hostVeths[0]).NotTo(Equal(hostVeths[1]))
+
+			// Both containers keep their veths.
+			for _, name := range hostVeths {
+				_, err := netlink.LinkByName(name)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+		})
+	})
+
+	Describe("with host-local routes", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "nodename_file_optional": true,
+		  "datastore_type": "%s",
+		  "ipam": {
+		    "type": "host-local",
+		    "subnet": "10.0.0.0/8",
+		    "routes": [{"dst": "10.1.0.0/16"}]
+		  }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("returns the same result, routes and interfaces included, from a second ADD", func() {
+			containerID, result, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "routes1")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer func() {
+				_, err := testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+				Expect(err).ShouldNot(HaveOccurred())
+			}()
+			Expect(result.Routes).To(HaveLen(1))
+			Expect(result.Routes[0].Dst.String()).To(Equal("10.1.0.0/16"))
+			Expect(result.Interfaces).To(HaveLen(2))
+
+			resultSecondAdd, _, _, _, err := testutils.RunCNIPluginWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", containerID, "eth0", contNs)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(resultSecondAdd).To(Equal(result))
+		})
+	})
+
+	Describe("with force_interface_name", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "nodename_file_optional": true,
+		  "datastore_type": "%s",
+		  "force_interface_name": "net0",
+		  "ipam": {
+		    "type": "host-local",
+		    "subnet": "10.0.0.0/8"
+		  }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("uses the forced name in place of the runtime's on ADD and DEL", func() {
+			contNs, containerID, err := testutils.CreateContainerNamespace()
+			Expect(err).ShouldNot(HaveOccurred())
+			defer contNs.Close()
+
+			// The runtime asks for eth0.
+			_, exitCode, err := testutils.RunContainerCommand("ADD", netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			err = contNs.Do(func(_ ns.NetNS) error {
+				if _, err := netlink.LinkByName("eth0"); err == nil {
+					return fmt.Errorf("eth0 exists")
+				}
+				_, err := netlink.LinkByName("net0")
+				return err
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(1))
+			Expect(endpoints.Items[0].Spec.Endpoint).To(Equal("net0"))
+
+			// DEL, also for eth0, finds the same endpoint.
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			endpoints, err = calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+		})
+
+		It("rejects a name longer than the kernel allows", func() {
+			badConf := strings.Replace(netconf, `"net0"`, `"net0123456789abc"`, 1)
+			_, _, _, _, _, _, err := testutils.CreateContainer(badConf, "", testutils.TEST_DEFAULT_NS, "")
+			Expect(err).To(MatchError(ContainSubstring("invalid force_interface_name")))
+		})
+	})
+
+	Describe("with host_route_table and host_route_protocol", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "nodename_file_optional": true,
+		  "datastore_type": "%s",
+		  "host_route_table": 100,
+		  "host_route_protocol": 80,
+		  "ipam": {
+		    "type": "host-local",
+		    "subnet": "10.0.0.0/8"
+		  }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("adds the host side route to the configured table with the configured protocol", func() {
+			containerID, result, _, _, _, contNs, err := testutils.CreateContainer(netconf, "", testutils.TEST_DEFAULT_NS, "")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			hostVeth, err := netlink.LinkByName("cali" + containerID[:utils.Min(11, len(containerID))])
+			Expect(err).ShouldNot(HaveOccurred())
+			hostRoutes, err := netlink.RouteListFiltered(syscall.AF_INET,
+				&netlink.Route{LinkIndex: hostVeth.Attrs().Index, Table: 100}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(hostRoutes).To(HaveLen(1))
+			Expect(hostRoutes[0].Dst.String()).To(Equal(result.IPs[0].Address.String()))
+			Expect(hostRoutes[0].Protocol).To(Equal(80))
+
+			// Nothing is added to the main table.
+			mainRoutes, err := netlink.RouteList(hostVeth, syscall.AF_INET)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(mainRoutes).To(BeEmpty())
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("rejects a protocol number that doesn't fit in a byte", func() {
+			badConf := strings.Replace(netconf, `"host_route_protocol": 80`, `"host_route_protocol": 256`, 1)
+			_, _, _, _, _, _, err := testutils.CreateContainer(badConf, "", testutils.TEST_DEFAULT_NS, "")
+			Expect(err).To(MatchError(ContainSubstring("invalid host_route_protocol")))
+		})
+	})
+
+	Describe("with send_gratuitous_arp", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "nodename_file_optional": true,
+		  "datastore_type": "%s",
+		  "send_gratuitous_arp": true,
+		  "ipam": {
+		    "type": "host-local",
+		    "subnet": "10.0.0.0/8"
+		  }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("networks the namespace as usual", func() {
+			containerID, result, contVeth, contAddresses, _, contNs, err := testutils.CreateContainer(netconf, "", testutils.TEST_DEFAULT_NS, "")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(contVeth.Attrs().Flags.String()).Should(ContainSubstring("up"))
+			Expect(contAddresses[0].IP.String()).To(Equal(result.IPs[0].Address.IP.String()))
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("with debug_keep_failed_interface", func() {
+		// A fatal post-ADD hook that always fails makes the ADD fail once the networking is in place.
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "nodename_file_optional": true,
+		  "datastore_type": "%s",
+		  "post_add_hook": "/bin/false",
+		  "post_add_hook_fatal": true,
+		  "debug_keep_failed_interface": true,
+		  "ipam": { "type": "calico-ipam" }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		BeforeEach(func() {
+			testutils.MustCreateNewIPPool(calicoClient, "10.0.0.0/24", false, false, true)
+		})
+
+		It("leaves the interface and IP of a failed ADD in place", func() {
+			contNs, containerID, err := testutils.CreateContainerNamespace()
+			Expect(err).ShouldNot(HaveOccurred())
+			defer contNs.Close()
+
+			_, exitCode, err := testutils.RunContainerCommand("ADD", netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).NotTo(Equal(0))
+
+			err = contNs.Do(func(_ ns.NetNS) error {
+				_, err := netlink.LinkByName("eth0")
+				return err
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = netlink.LinkByName("cali" + containerID[:utils.Min(11, len(containerID))])
+			Expect(err).ShouldNot(HaveOccurred())
+
+			ids := names.WorkloadEndpointIdentifiers{
+				Node:         hostname,
+				Orchestrator: "cni",
+				Endpoint:     "eth0",
+				ContainerID:  containerID,
+			}
+			workloadName, err := ids.CalculateWorkloadEndpointName(false)
+			Expect(err).NotTo(HaveOccurred())
+			ips, err := calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("net1", containerID, workloadName))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+
+			// A DEL still cleans up as usual.
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			ips, err = calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("net1", containerID, workloadName))
+			Expect(err).To(BeAssignableToTypeOf(cerrors.ErrorResourceDoesNotExist{}), fmt.Sprintf("unexpected IPs left assigned: %v", ips))
+		})
+	})
+
+	Describe("with a profile_label_style", func() {
+		netconfWithStyle := func(style string) string {
+			return fmt.Sprintf(`
+			{
+			  "cniVersion": "%s",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "nodename_file_optional": true,
+			  "datastore_type": "%s",
+			  "profile_label_style": "%s",
+			  "ipam": {
+			    "type": "host-local",
+			    "subnet": "10.0.0.0/8"
+			  }
+			}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), style)
+		}
+
+		DescribeTable("creates the profile with matching labels and selector",
+			func(style string, labels map[string]string, selector string) {
+				netconf := netconfWithStyle(style)
+				containerID, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "style123")
+				Expect(err).ShouldNot(HaveOccurred())
+
+				profile, err := calicoClient.Profiles().Get(ctx, "net1", options.GetOptions{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(profile.Spec.LabelsToApply).Should(Equal(labels))
+				Expect(profile.Spec.Ingress).Should(Equal([]api.Rule{{Action: "Allow", Source: api.EntityRule{Selector: selector}}}))
+
+				_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+				Expect(err).ShouldNot(HaveOccurred())
+			},
+			Entry("legacy", "legacy", map[string]string{"net1": ""}, "has(net1)"),
+			Entry("key-value", "key-value", map[string]string{"projectcalico.org/network": "net1"}, "projectcalico.org/network == 'net1'"),
+		)
+
+		It("rejects an unknown style", func() {
+			netconf := netconfWithStyle("fancy")
+			_, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "style456")
+			Expect(err).Should(HaveOccurred())
+
+			_, err = calicoClient.Profiles().Get(ctx, "net1", options.GetOptions{})
+			Expect(err).Should(HaveOccurred())
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, "style456")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("with a default_profile_egress", func() {
+		netconfWithEgress := func(mode string, cidrs []string) string {
+			cidrsJSON, err := json.Marshal(cidrs)
+			Expect(err).NotTo(HaveOccurred())
+			return fmt.Sprintf(`
+			{
+			  "cniVersion": "%s",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "nodename_file_optional": true,
+			  "datastore_type": "%s",
+			  "default_profile_egress": "%s",
+			  "default_profile_egress_cidrs": %s,
+			  "ipam": {
+			    "type": "host-local",
+			    "subnet": "10.0.0.0/8"
+			  }
+			}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), mode, cidrsJSON)
+		}
+
+		// A nil egress means that the config should be rejected.
+		DescribeTable("creates the profile with matching egress rules",
+			func(mode string, cidrs []string, egress []api.Rule) {
+				netconf := netconfWithEgress(mode, cidrs)
+				containerID, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "egress123")
+				if egress == nil {
+					Expect(err).Should(HaveOccurred())
+					_, err = calicoClient.Profiles().Get(ctx, "net1", options.GetOptions{})
+					Expect(err).Should(HaveOccurred())
+					containerID = "egress123"
+				} else {
+					Expect(err).ShouldNot(HaveOccurred())
+					profile, err := calicoClient.Profiles().Get(ctx, "net1", options.GetOptions{})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(profile.Spec.Egress).Should(Equal(egress))
+				}
+
+				_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+				Expect(err).ShouldNot(HaveOccurred())
+			},
+			Entry("default", "", nil, []api.Rule{{Action: "Allow"}}),
+			Entry("allow", "allow", nil, []api.Rule{{Action: "Allow"}}),
+			Entry("deny", "deny", nil, []api.Rule{{Action: "Deny"}}),
+			Entry("allow-cidrs", "allow-cidrs", []string{"10.96.0.0/12", "fd00::/64"}, []api.Rule{
+				{Action: "Allow", Destination: api.EntityRule{Nets: []string{"10.96.0.0/12", "fd00::/64"}}},
+				{Action: "Deny"},
+			}),
+			Entry("unknown mode", "sometimes", nil, nil),
+			Entry("allow-cidrs without CIDRs", "allow-cidrs", nil, nil),
+			Entry("allow-cidrs with a bad CIDR", "allow-cidrs", []string{"10.96.0.0/33"}, nil),
+		)
+	})
+
+	Describe("with manage_profile false", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "nodename_file_optional": true,
+		  "datastore_type": "%s",
+		  "manage_profile": false,
+		  "ipam": {
+		    "type": "host-local",
+		    "subnet": "10.0.0.0/8"
+		  }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("neither creates nor attaches the profile, and DEL leaves an out-of-band one alone", func() {
+			containerID, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "noprof123")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = calicoClient.Profiles().Get(ctx, "net1", options.GetOptions{})
+			Expect(err).Should(HaveOccurred())
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).Should(HaveLen(1))
+			Expect(endpoints.Items[0].Spec.Profiles).Should(BeEmpty())
+
+			// A profile of the same name, created by someone else, survives the DEL.
+			profile := api.NewProfile()
+			profile.Name = "net1"
+			_, err = calicoClient.Profiles().Create(ctx, profile, options.SetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = calicoClient.Profiles().Get(ctx, "net1", options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("with dry_run", func() {
+		netconf := func(dryRun bool) string {
+			return fmt.Sprintf(`
+			{
+			  "cniVersion": "%s",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "nodename_file_optional": true,
+			  "datastore_type": "%s",
+			  "dry_run": %t,
+			  "ipam": {
+			    "type": "calico-ipam",
+			    "ipv4_pools": ["10.0.0.0/24"]
+			  }
+			}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"), dryRun)
+		}
+
+		BeforeEach(func() {
+			testutils.MustCreateNewIPPool(calicoClient, "10.0.0.0/24", false, false, true)
+		})
+
+		It("reports an ADD without setting anything up", func() {
+			contNs, containerID, err := testutils.CreateContainerNamespace()
+			Expect(err).ShouldNot(HaveOccurred())
+			defer contNs.Close()
+
+			out, exitCode, err := testutils.RunContainerCommand("ADD", netconf(true), contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			var report utils.DryRunReport
+			Expect(json.Unmarshal(out, &report)).To(Succeed())
+			Expect(report.Command).To(Equal("ADD"))
+			ids := names.WorkloadEndpointIdentifiers{
+				Node:         hostname,
+				Orchestrator: "cni",
+				Endpoint:     "eth0",
+				ContainerID:  containerID,
+			}
+			workloadName, err := ids.CalculateWorkloadEndpointName(false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.WorkloadEndpoint).To(Equal(workloadName))
+			Expect(report.EndpointExists).To(BeFalse())
+			Expect(report.IPv4Pools).To(Equal([]string{"10.0.0.0/24"}))
+			Expect(report.IPv4PoolSource).To(Equal("netconf"))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+			err = contNs.Do(func(_ ns.NetNS) error {
+				_, err := netlink.LinkByName("eth0")
+				return err
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reports a DEL without tearing anything down", func() {
+			containerID, result, _, _, _, contNs, err := testutils.CreateContainer(netconf(false), "", testutils.TEST_DEFAULT_NS, "")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			out, exitCode, err := testutils.RunContainerCommand("DEL", netconf(true), contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			var report utils.DryRunReport
+			Expect(json.Unmarshal(out, &report)).To(Succeed())
+			Expect(report.Command).To(Equal("DEL"))
+			Expect(report.EndpointExists).To(BeTrue())
+			Expect(report.IPs).To(Equal([]string{result.IPs[0].Address.String()}))
+			Expect(report.HandleID).To(Equal(utils.GetHandleID("net1", containerID, report.WorkloadEndpoint)))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(1))
+
+			_, err = testutils.DeleteContainerWithId(netconf(false), contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("DEL after the veth has already gone", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "nodename_file_optional": true,
+		  "datastore_type": "%s",
+		  "ipam": {
+		    "type": "host-local",
+		    "subnet": "10.0.0.0/8"
+		  }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		It("succeeds", func() {
+			containerID, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "gone123")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// Remove the veth behind the plugin's back, as the kernel does when the namespace is destroyed.
+			err = contNs.Do(func(_ ns.NetNS) error {
+				link, err := netlink.LinkByName("eth0")
+				if err != nil {
+					return err
+				}
+				return netlink.LinkDel(link)
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = netlink.LinkByName("cali" + containerID[:11])
+			Expect(err).To(HaveOccurred())
+
+			exitCode, err := testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+		})
+	})
+
+	Describe("DEL with tombstones enabled", func() {
+		tombstoneConf := func(etcdIP string) string {
+			return fmt.Sprintf(`
+			{
+				"cniVersion": "%s",
+				"name": "net1",
+				"type": "calico",
+				"etcd_endpoints": "http://%s:2379",
+				"nodename_file_optional": true,
+				"datastore_type": "%s",
+				"del_tombstone_ttl": 30,
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.0.0.0/8"
+				}
+			}`, cniVersion, etcdIP, os.Getenv("DATASTORE_TYPE"))
+		}
+
+		It("skips the datastore for a duplicate DEL", func() {
+			netconf := tombstoneConf(os.Getenv("ETCD_IP"))
+			containerID, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "tomb123")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			exitCode, err := testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			// The second DEL points at a datastore that doesn't exist, so it can only succeed if it
+			// doesn't try to use it.
+			unreachable := tombstoneConf("127.0.0.254")
+			exitCode, err = testutils.DeleteContainerWithId(unreachable, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+		})
+	})
+
+	Describe("with an add_timeout", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "datastore_type": "%s",
+		  "nodename_file_optional": true,
+		  "add_timeout": 2,
+		  "ipam": { "type": "slow-ipam" }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		var slowIPAM string
+
+		BeforeEach(func() {
+			testutils.MustCreateNewIPPool(calicoClient, "10.0.0.0/24", false, false, true)
+
+			// An IPAM plugin that takes longer than the timeout before handing off to calico-ipam.
+			slowIPAM = filepath.Join(os.Getenv("BIN"), "slow-ipam")
+			script := "#!/bin/sh\nsleep 5\nexec \"$(dirname \"$0\")/calico-ipam\"\n"
+			Expect(ioutil.WriteFile(slowIPAM, []byte(script), 0755)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.Remove(slowIPAM)).To(Succeed())
+			testutils.MustDeleteIPPool(calicoClient, "10.0.0.0/24")
+		})
+
+		It("fails and leaves nothing behind when the ADD is too slow", func() {
+			containerID, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "slow123")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("add_timeout"))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+
+			ips, err := calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("net1", containerID, ""))
+			Expect(err).To(BeAssignableToTypeOf(cerrors.ErrorResourceDoesNotExist{}), fmt.Sprintf("unexpected IPs left assigned: %v", ips))
+
+			_, err = netlink.LinkByName("cali" + containerID[:11])
+			Expect(err).To(HaveOccurred())
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("with a dns section", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "datastore_type": "%s",
+		  "nodename_file_optional": true,
+		  "dns": {"nameservers": ["10.96.0.10"], "search": ["svc.cluster.local"]},
+		  "ipam": { "type": "calico-ipam" }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		BeforeEach(func() {
+			testutils.MustCreateNewIPPool(calicoClient, "10.0.0.0/24", false, false, true)
+		})
+
+		AfterEach(func() {
+			testutils.MustDeleteIPPool(calicoClient, "10.0.0.0/24")
+		})
+
+		It("reports the DNS settings in the result", func() {
+			containerID, result, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "dns123")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(result.DNS.Nameservers).To(Equal([]string{"10.96.0.10"}))
+			Expect(result.DNS.Search).To(Equal([]string{"svc.cluster.local"}))
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("fails the ADD if a nameserver isn't an IP address", func() {
+			badNetconf := strings.Replace(netconf, `"10.96.0.10"`, `"dns.example.com"`, 1)
+			_, _, _, _, _, _, err := testutils.CreateContainerWithId(badNetconf, "", testutils.TEST_DEFAULT_NS, "", "dns456")
+			Expect(err).Should(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+		})
+	})
+
+	Describe("with an unreachable datastore", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://127.0.0.254:2379",
+		  "datastore_type": "etcdv3",
+		  "nodename_file_optional": true,
+		  "ipam": {
+		    "type": "host-local",
+		    "subnet": "10.0.0.0/8"
+		  }
+		}`, cniVersion)
+
+		It("fails the ADD quickly, before setting anything up", func() {
+			start := time.Now()
+			_, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "unreach1")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(MatchRegexp("datastore is unreachable|error getting ClusterInformation"))
+			Expect(time.Since(start)).To(BeNumerically("<", 15*time.Second))
+
+			_, err = netlink.LinkByName("caliunreach1")
+			Expect(err).Should(HaveOccurred())
+			err = contNs.Do(func(_ ns.NetNS) error {
+				_, err := netlink.LinkByName("eth0")
+				return err
+			})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("with etcd_endpoints_backup", func() {
+		// Nothing listens on the primary endpoint, so the plugins should fall back to the backup.
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://127.0.0.1:1",
+		  "etcd_endpoints_backup": "http://%s:2379",
+		  "datastore_type": "%s",
+		  "nodename_file_optional": true,
+		  "ipam": { "type": "calico-ipam" }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		BeforeEach(func() {
+			testutils.MustCreateNewIPPool(calicoClient, "10.0.0.0/24", false, false, true)
+		})
+
+		AfterEach(func() {
+			testutils.MustDeleteIPPool(calicoClient, "10.0.0.0/24")
+		})
+
+		It("sets up and tears down the container using the backup endpoints", func() {
+			containerID, _, _, _, _, contNs, err := testutils.CreateContainerWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", "backup1")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(1))
+
+			_, err = testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			endpoints, err = calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+		})
+	})
+
+	Describe("with calico-ipam enabled, after creating a container", func() {
+		netconf := fmt.Sprintf(`
+		{
+		  "cniVersion": "%s",
+		  "name": "net1",
+		  "type": "calico",
+		  "etcd_endpoints": "http://%s:2379",
+		  "datastore_type": "%s",
+		  "log_level": "info",
+	          "nodename_file_optional": true,
+		  "ipam": { "type": "calico-ipam" }
+		}`, cniVersion, os.Getenv("ETCD_IP"), os.Getenv("DATASTORE_TYPE"))
+
+		var containerID string
 		var workloadName string
 		var endpointSpec api.WorkloadEndpointSpec
 		var contNs ns.NetNS
@@ -776,10 +1933,144 @@ var _ = Describe("CalicoCni", func() {
 			Expect(endpoints.Items).Should(HaveLen(1))
 			Expect(endpoints.Items[0].Spec.Profiles).To(ConsistOf("net1"))
 
+			// Both results report the container interface with the MAC recorded on the endpoint.
+			Expect(resultSecondAdd.Interfaces).To(HaveLen(2))
+			Expect(resultSecondAdd.Interfaces[1].Name).To(Equal("eth0"))
+			Expect(resultSecondAdd.Interfaces[1].Mac).To(Equal(endpoints.Items[0].Spec.MAC))
+			Expect(resultSecondAdd.Interfaces[1].Sandbox).To(Equal(contNs.Path()))
+
 			// IPAM reservation should still be in place.
 			checkIPAMReservation()
 		})
 
+		It("a second ADD for the same container should preserve the assignedAt annotation", func() {
+			wep, err := calicoClient.WorkloadEndpoints().Get(ctx, testutils.TEST_DEFAULT_NS, workloadName, options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			assignedAt := wep.Annotations[utils.AssignedAtAnnotation]
+			_, err = time.Parse(time.RFC3339, assignedAt)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// Make sure a reset would produce a different timestamp.
+			time.Sleep(time.Second)
+			_, _, _, _, err = testutils.RunCNIPluginWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", containerID, "eth0", contNs)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			wep, err = calicoClient.WorkloadEndpoints().Get(ctx, testutils.TEST_DEFAULT_NS, workloadName, options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(wep.Annotations).To(HaveKeyWithValue(utils.AssignedAtAnnotation, assignedAt))
+		})
+
+		It("should record the network and the plugin version as annotations", func() {
+			wep, err := calicoClient.WorkloadEndpoints().Get(ctx, testutils.TEST_DEFAULT_NS, workloadName, options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(wep.Annotations).To(HaveKeyWithValue(utils.NetworkAnnotation, "net1"))
+			Expect(wep.Annotations).To(HaveKey(utils.PluginVersionAnnotation))
+			Expect(wep.Annotations[utils.PluginVersionAnnotation]).NotTo(BeEmpty())
+			Expect(wep.Labels).NotTo(HaveKey(utils.PluginVersionAnnotation))
+		})
+
+		It("a second ADD for the same container should keep annotations set by other components", func() {
+			wep, err := calicoClient.WorkloadEndpoints().Get(ctx, testutils.TEST_DEFAULT_NS, workloadName, options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			wep.Annotations["felix.example.com/state"] = "programmed"
+			_, err = calicoClient.WorkloadEndpoints().Update(ctx, wep, options.SetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, _, _, _, err = testutils.RunCNIPluginWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", containerID, "eth0", contNs)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			wep, err = calicoClient.WorkloadEndpoints().Get(ctx, testutils.TEST_DEFAULT_NS, workloadName, options.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(wep.Annotations).To(HaveKeyWithValue("felix.example.com/state", "programmed"))
+			Expect(wep.Annotations).To(HaveKeyWithValue(utils.NetworkAnnotation, "net1"))
+		})
+
+		It("a DEL with CALICO_KEEP_IP=1 should remove the endpoint but leave the IP reserved", func() {
+			exitCode, err := testutils.DeleteContainerKeepingIPs(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+
+			err = contNs.Do(func(_ ns.NetNS) error {
+				_, err := netlink.LinkByName("eth0")
+				return err
+			})
+			Expect(err).Should(HaveOccurred())
+
+			// The handle survives; the DEL in AfterEach releases it.
+			checkIPAMReservation()
+		})
+
+		It("a DEL after the IP pool has been deleted should still remove the endpoint and release the IP", func() {
+			testutils.MustDeleteIPPool(calicoClient, "10.0.0.0/24")
+
+			exitCode, err := testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+
+			handleID := utils.GetHandleID("net1", containerID, workloadName)
+			ips, err := calicoClient.IPAM().IPsByHandle(ctx, handleID)
+			Expect(err).To(BeAssignableToTypeOf(cerrors.ErrorResourceDoesNotExist{}), fmt.Sprintf("unexpected IPs left assigned: %v", ips))
+		})
+
+		It("a second ADD for the same container should reserve the endpoint's IP again if IPAM lost it", func() {
+			handleID := utils.GetHandleID("net1", containerID, workloadName)
+			Expect(calicoClient.IPAM().ReleaseByHandle(ctx, handleID)).To(Succeed())
+
+			resultSecondAdd, _, _, _, err := testutils.RunCNIPluginWithId(netconf, "", testutils.TEST_DEFAULT_NS, "", containerID, "eth0", contNs)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(resultSecondAdd).Should(Equal(result))
+
+			// The same IP should be reserved under the same handle.
+			checkIPAMReservation()
+		})
+
+		It("a DEL without a netns should still release the IP and delete the endpoint", func() {
+			exitCode, err := testutils.DeleteContainerWithId(netconf, "", "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+
+			// Releasing the last IP deletes the handle.
+			ips, err := calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("net1", containerID, workloadName))
+			Expect(err).To(BeAssignableToTypeOf(cerrors.ErrorResourceDoesNotExist{}), fmt.Sprintf("unexpected IPs left assigned: %v", ips))
+		})
+
+		It("a DEL after the network is renamed should release the IP allocated under the old name", func() {
+			renamedNetconf := strings.Replace(netconf, `"name": "net1"`, `"name": "net2"`, 1)
+			exitCode, err := testutils.DeleteContainerWithId(renamedNetconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			ips, err := calicoClient.IPAM().IPsByHandle(ctx, utils.GetHandleID("net1", containerID, workloadName))
+			Expect(err).To(BeAssignableToTypeOf(cerrors.ErrorResourceDoesNotExist{}), fmt.Sprintf("unexpected IPs left assigned: %v", ips))
+		})
+
+		It("a DEL after the netns has been deleted should succeed", func() {
+			Expect(contNs.Close()).To(Succeed())
+			Expect(cnitestutils.UnmountNS(contNs)).To(Succeed())
+			_, err := os.Stat(contNs.Path())
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			exitCode, err := testutils.DeleteContainerWithId(netconf, contNs.Path(), "", testutils.TEST_DEFAULT_NS, containerID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			endpoints, err := calicoClient.WorkloadEndpoints().List(ctx, options.ListOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpoints.Items).To(HaveLen(0))
+		})
+
 		It("a second ADD with new profile ID should append it", func() {
 			// Try to create the same container (so CNI receives the ADD for the same endpoint again)
 			tweaked := strings.Replace(netconf, "net1", "net2", 1)